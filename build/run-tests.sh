@@ -90,6 +90,7 @@ sdk/go/httpserver
 sdk/go/manifest
 sdk/go/blockdigest
 sdk/go/streamer
+sdk/go/tokencache
 sdk/go/crunchrunner
 sdk/cwl
 tools/crunchstat-summary
@@ -736,6 +737,7 @@ gostuff=(
     sdk/go/httpserver
     sdk/go/manifest
     sdk/go/streamer
+    sdk/go/tokencache
     sdk/go/crunchrunner
     lib/crunchstat
     services/arv-git-httpd
@@ -745,9 +747,6 @@ gostuff=(
     sdk/go/keepclient
     services/keep-balance
     services/keepproxy
-    services/datamanager/summary
-    services/datamanager/collection
-    services/datamanager/keep
     services/datamanager
     services/crunch-dispatch-local
     services/crunch-dispatch-slurm
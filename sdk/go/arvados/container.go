@@ -25,6 +25,7 @@ type Mount struct {
 	DeviceType       string      `json:"device_type"`
 	Path             string      `json:"path"`
 	Content          interface{} `json:"content"`
+	Commit           string      `json:"commit"`
 }
 
 // RuntimeConstraints specify a container's compute resources (RAM,
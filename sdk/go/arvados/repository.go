@@ -0,0 +1,8 @@
+package arvados
+
+// Repository is an arvados#repository record
+type Repository struct {
+	UUID      string   `json:"uuid,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	CloneURLs []string `json:"clone_urls,omitempty"`
+}
@@ -74,6 +74,11 @@ type KeepClient struct {
 	Client             *http.Client
 	Retries            int
 
+	// Keep proxies of other Arvados clusters, keyed by cluster
+	// ID ("zzzzz"), used to retrieve blocks whose locators have
+	// a +K@zzzzz hint.
+	RemoteClusters map[string]RemoteCluster
+
 	// set to 1 if all writable services are of disk type, otherwise 0
 	replicasPerService int
 
@@ -81,6 +86,19 @@ type KeepClient struct {
 	foundNonDiskSvc bool
 }
 
+// RemoteCluster describes how to retrieve blocks from another
+// Arvados cluster's Keep proxy.
+type RemoteCluster struct {
+	// Base URI of the remote cluster's keepproxy, e.g.,
+	// "https://keep.zzzzz.example.com".
+	Proxy string
+
+	// Token to send to the remote keepproxy instead of the
+	// client's own API token. If empty, the client's own token is
+	// sent.
+	Token string
+}
+
 // MakeKeepClient creates a new KeepClient by contacting the API server to discover Keep servers.
 func MakeKeepClient(arv *arvadosclient.ArvadosClient) (*KeepClient, error) {
 	kc := New(arv)
@@ -109,6 +127,26 @@ func New(arv *arvadosclient.ArvadosClient) *KeepClient {
 	return kc
 }
 
+// Clone returns a new KeepClient with the same configuration and
+// service roots as kc. The clone can be modified (e.g., to use a
+// different API token or replication level) without affecting kc.
+func (kc *KeepClient) Clone() *KeepClient {
+	kc.lock.RLock()
+	defer kc.lock.RUnlock()
+	return &KeepClient{
+		Arvados:            kc.Arvados,
+		Want_replicas:      kc.Want_replicas,
+		localRoots:         kc.localRoots,
+		writableLocalRoots: kc.writableLocalRoots,
+		gatewayRoots:       kc.gatewayRoots,
+		Client:             kc.Client,
+		Retries:            kc.Retries,
+		RemoteClusters:     kc.RemoteClusters,
+		replicasPerService: kc.replicasPerService,
+		foundNonDiskSvc:    kc.foundNonDiskSvc,
+	}
+}
+
 // Put a block given the block hash, a reader, and the number of bytes
 // to read from the reader (which must be between 0 and BLOCKSIZE).
 //
@@ -191,7 +229,7 @@ func (kc *KeepClient) getOrHead(method string, locator string) (io.ReadCloser, i
 				errs = append(errs, fmt.Sprintf("%s: %v", url, err))
 				continue
 			}
-			req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", kc.Arvados.ApiToken))
+			req.Header.Add("Authorization", fmt.Sprintf("OAuth2 %s", kc.tokenForRoot(host)))
 			resp, err := kc.Client.Do(req)
 			if err != nil {
 				// Probably a network error, may be transient,
@@ -386,9 +424,15 @@ func (kc *KeepClient) getSortedRoots(locator string) []string {
 			continue
 		}
 		if len(hint) == 7 {
-			// +K@abcde means fetch from proxy at
-			// keep.abcde.arvadosapi.com
-			found = append(found, "https://keep."+hint[2:]+".arvadosapi.com")
+			if rc, ok := kc.RemoteClusters[hint[2:]]; ok {
+				// +K@abcde means fetch from the
+				// configured proxy for cluster abcde
+				found = append(found, rc.Proxy)
+			} else {
+				// ...or, by default, from proxy at
+				// keep.abcde.arvadosapi.com
+				found = append(found, "https://keep."+hint[2:]+".arvadosapi.com")
+			}
 		} else if len(hint) == 29 {
 			// +K@abcde-abcde-abcdeabcdeabcde means fetch
 			// from gateway with given uuid
@@ -403,6 +447,18 @@ func (kc *KeepClient) getSortedRoots(locator string) []string {
 	return found
 }
 
+// tokenForRoot returns the API token to send to the Keep service at
+// the given base URI: the token configured for a remote cluster whose
+// proxy is at that URI, if any, otherwise the client's own token.
+func (kc *KeepClient) tokenForRoot(root string) string {
+	for _, rc := range kc.RemoteClusters {
+		if rc.Proxy == root && rc.Token != "" {
+			return rc.Token
+		}
+	}
+	return kc.Arvados.ApiToken
+}
+
 type Locator struct {
 	Hash  string
 	Size  int      // -1 if data size is not known
@@ -717,6 +717,45 @@ func (s *StandaloneSuite) TestGetWithServiceHintFailoverToLocals(c *C) {
 	c.Check(content, DeepEquals, []byte("foo"))
 }
 
+func (s *StandaloneSuite) TestGetWithRemoteClusterHint(c *C) {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("foo")))
+
+	// This one shouldn't be used:
+	ks0 := RunFakeKeepServer(StubGetHandler{
+		c,
+		"error if used",
+		"abc123",
+		http.StatusOK,
+		[]byte("foo")})
+	defer ks0.listener.Close()
+	// This one should be used, with the remote cluster's token:
+	ks := RunFakeKeepServer(StubGetHandler{
+		c,
+		hash + "+3+K@xyzzy",
+		"remote-token",
+		http.StatusOK,
+		[]byte("foo")})
+	defer ks.listener.Close()
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	kc, _ := MakeKeepClient(&arv)
+	arv.ApiToken = "abc123"
+	kc.SetServiceRoots(map[string]string{"x": ks0.url}, nil, nil)
+	kc.RemoteClusters = map[string]RemoteCluster{
+		"xyzzy": {Proxy: ks.url, Token: "remote-token"},
+	}
+
+	r, n, uri, err := kc.Get(hash + "+3+K@xyzzy")
+	c.Assert(err, Equals, nil)
+	defer r.Close()
+	c.Check(n, Equals, int64(3))
+	c.Check(uri, Equals, fmt.Sprintf("%s/%s", ks.url, hash+"+3+K@xyzzy"))
+
+	content, err := ioutil.ReadAll(r)
+	c.Check(err, Equals, nil)
+	c.Check(content, DeepEquals, []byte("foo"))
+}
+
 type BarHandler struct {
 	handled chan string
 }
@@ -1254,3 +1293,18 @@ func (s *ServerRequiredSuite) TestMakeKeepClientWithNonDiskTypeService(c *C) {
 	c.Assert(kc.foundNonDiskSvc, Equals, true)
 	c.Assert(kc.Client.Timeout, Equals, 300*time.Second)
 }
+
+func (s *StandaloneSuite) TestClone(c *C) {
+	arv, _ := arvadosclient.MakeArvadosClient()
+	kc := New(&arv)
+	kc.Want_replicas = 3
+	kc.SetServiceRoots(map[string]string{"zzzzz-bi6l4-000000000000000": "http://localhost:1"}, nil, nil)
+
+	clone := kc.Clone()
+	c.Check(clone.Want_replicas, Equals, 3)
+	c.Check(clone.LocalRoots(), DeepEquals, kc.LocalRoots())
+	clone.Want_replicas = 1
+	clone.SetServiceRoots(nil, nil, nil)
+	c.Check(kc.Want_replicas, Equals, 3)
+	c.Check(kc.LocalRoots(), HasLen, 1)
+}
@@ -77,6 +77,18 @@ func UnescapeName(s string) string {
 	return escapeSeq.ReplaceAllStringFunc(s, unescapeSeq)
 }
 
+var needEscape = regexp.MustCompile(`[\x00-\x20\\:]`)
+
+// EscapeName returns s with the characters that cannot appear as
+// they are in a stream or file name -- whitespace, control
+// characters, backslash, and colon -- replaced by octal escape
+// sequences. It is the inverse of UnescapeName.
+func EscapeName(s string) string {
+	return needEscape.ReplaceAllStringFunc(s, func(c string) string {
+		return fmt.Sprintf("\\%03o", c[0])
+	})
+}
+
 func ParseBlockLocator(s string) (b BlockLocator, err error) {
 	if !LocatorPattern.MatchString(s) {
 		err = fmt.Errorf("String \"%s\" does not match BlockLocator pattern "+
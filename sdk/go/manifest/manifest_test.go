@@ -176,6 +176,25 @@ func TestUnescape(t *testing.T) {
 	}
 }
 
+func TestEscape(t *testing.T) {
+	for _, testCase := range [][]string{
+		{`foo.txt`, `foo.txt`},
+		{`a b`, `a\040b`},
+		{`\`, `\134`},
+		{"tab\there:", `tab\011here\072`},
+	} {
+		in := testCase[0]
+		expect := testCase[1]
+		got := EscapeName(in)
+		if expect != got {
+			t.Errorf("For '%s' got '%s' instead of '%s'", in, got, expect)
+		}
+		if back := UnescapeName(got); back != in {
+			t.Errorf("For '%s' got '%s' after round trip", in, back)
+		}
+	}
+}
+
 type fsegtest struct {
 	mt   string        // manifest text
 	f    string        // filename
@@ -0,0 +1,47 @@
+package tokencache
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// FlushHandler is an admin endpoint for removing a token from a
+// Cache, e.g., right after the token has been revoked, instead of
+// waiting for the cached entries to expire.
+//
+//   POST {path}?token={token}
+//
+// The request must have an "Authorization: OAuth2 {AdminToken}"
+// header. The response is a JSON object giving the number of entries
+// removed:
+//
+//   {"flushed":2}
+//
+// If AdminToken is empty, all requests are refused.
+type FlushHandler struct {
+	Cache      *Cache
+	AdminToken string
+}
+
+// ServeHTTP implements http.Handler.
+func (h *FlushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Only accept the admin token in the Authorization header:
+	// not in a cookie, which a browser might send with a
+	// cross-site request.
+	if h.AdminToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("OAuth2 "+h.AdminToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing token parameter", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"flushed": h.Cache.Forget(token)})
+}
@@ -0,0 +1,181 @@
+// Package tokencache remembers the results of checking API tokens
+// with the API server, so services like keepproxy, keep-web and
+// arv-git-httpd don't need to ask the API server about the same
+// token on every request.
+//
+// The cache is bounded: when it is full, the least recently used
+// entries are evicted. Entries expire after a configurable TTL, and
+// tokens known to be invalid are remembered too (with a separate,
+// usually shorter TTL). Entries for a specific token can be dropped
+// on demand, e.g., when the token is revoked -- see FlushHandler.
+package tokencache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxEntries  = 1000
+	DefaultTTL         = 5 * time.Minute
+	DefaultNegativeTTL = time.Minute
+)
+
+// invalidScope is the scope of entries recording that a token is
+// invalid.
+const invalidScope = "\x00invalid"
+
+// Cache remembers values associated with (token, scope) pairs. The
+// meaning of "scope" is up to the caller: e.g., keep-web uses the
+// collection being accessed, and keepproxy uses "" because it only
+// needs to know whether the token is valid.
+//
+// The zero value is a usable cache with the default limits. A Cache
+// is safe to use from multiple goroutines.
+type Cache struct {
+	// Maximum number of entries. Zero means DefaultMaxEntries.
+	MaxEntries int
+
+	// How long to remember values. Zero means DefaultTTL.
+	TTL time.Duration
+
+	// How long to remember that a token is invalid. Zero means
+	// DefaultNegativeTTL; negative means invalid tokens are not
+	// remembered.
+	NegativeTTL time.Duration
+
+	entries *list.List
+	index   map[key]*list.Element
+	mtx     sync.Mutex
+}
+
+type key struct {
+	token string
+	scope string
+}
+
+type entry struct {
+	key     key
+	value   interface{}
+	expires time.Time
+}
+
+func (c *Cache) setup() {
+	if c.index == nil {
+		c.entries = list.New()
+		c.index = make(map[key]*list.Element)
+	}
+}
+
+// Get returns the value stored for the given token and scope, if
+// there is one and it has not expired.
+func (c *Cache) Get(token, scope string) (value interface{}, ok bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ent := c.get(key{token, scope})
+	if ent == nil {
+		return nil, false
+	}
+	return ent.value, true
+}
+
+// Invalid returns true if the given token has recently been found to
+// be invalid.
+func (c *Cache) Invalid(token string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.get(key{token, invalidScope}) != nil
+}
+
+// Set stores a value for the given token and scope.
+func (c *Cache) Set(token, scope string, value interface{}) {
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.set(key{token, scope}, value, ttl)
+}
+
+// SetInvalid records that the given token is invalid.
+func (c *Cache) SetInvalid(token string) {
+	ttl := c.NegativeTTL
+	if ttl == 0 {
+		ttl = DefaultNegativeTTL
+	} else if ttl < 0 {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.set(key{token, invalidScope}, nil, ttl)
+}
+
+// Forget removes all entries for the given token, and returns the
+// number of entries removed.
+func (c *Cache) Forget(token string) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.setup()
+	n := 0
+	for k, elt := range c.index {
+		if k.token == token {
+			c.remove(elt)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of entries in the cache, including expired
+// entries that have not been removed yet.
+func (c *Cache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.index)
+}
+
+// get returns the unexpired entry for k, if any, and marks it as
+// most recently used. The caller must hold c.mtx.
+func (c *Cache) get(k key) *entry {
+	c.setup()
+	elt, ok := c.index[k]
+	if !ok {
+		return nil
+	}
+	ent := elt.Value.(*entry)
+	if time.Now().After(ent.expires) {
+		c.remove(elt)
+		return nil
+	}
+	c.entries.MoveToFront(elt)
+	return ent
+}
+
+// set adds or replaces the entry for k, and evicts the least
+// recently used entries if the cache is full. The caller must hold
+// c.mtx.
+func (c *Cache) set(k key, value interface{}, ttl time.Duration) {
+	c.setup()
+	if elt, ok := c.index[k]; ok {
+		c.remove(elt)
+	}
+	c.index[k] = c.entries.PushFront(&entry{
+		key:     k,
+		value:   value,
+		expires: time.Now().Add(ttl),
+	})
+	max := c.MaxEntries
+	if max <= 0 {
+		max = DefaultMaxEntries
+	}
+	for len(c.index) > max {
+		c.remove(c.entries.Back())
+	}
+}
+
+func (c *Cache) remove(elt *list.Element) {
+	c.entries.Remove(elt)
+	delete(c.index, elt.Value.(*entry).key)
+}
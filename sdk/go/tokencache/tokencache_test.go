@@ -0,0 +1,136 @@
+package tokencache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetSet(t *testing.T) {
+	c := &Cache{}
+	if _, ok := c.Get("tok", "scope"); ok {
+		t.Error("empty cache returned a value")
+	}
+	c.Set("tok", "scope", "value")
+	if v, ok := c.Get("tok", "scope"); !ok || v != "value" {
+		t.Errorf("got %v, %v", v, ok)
+	}
+	if _, ok := c.Get("tok", "otherscope"); ok {
+		t.Error("got value for wrong scope")
+	}
+	if c.Invalid("tok") {
+		t.Error("token should not be invalid")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := &Cache{TTL: time.Millisecond, NegativeTTL: time.Millisecond}
+	c.Set("tok", "", true)
+	c.SetInvalid("badtok")
+	if _, ok := c.Get("tok", ""); !ok {
+		t.Error("value expired too soon")
+	}
+	if !c.Invalid("badtok") {
+		t.Error("invalid token expired too soon")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, ok := c.Get("tok", ""); ok {
+		t.Error("value did not expire")
+	}
+	if c.Invalid("badtok") {
+		t.Error("invalid token did not expire")
+	}
+	if c.Len() != 0 {
+		t.Errorf("expired entries not removed: Len() == %d", c.Len())
+	}
+}
+
+func TestNoNegativeCaching(t *testing.T) {
+	c := &Cache{NegativeTTL: -1}
+	c.SetInvalid("badtok")
+	if c.Invalid("badtok") {
+		t.Error("invalid token was remembered")
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := &Cache{MaxEntries: 3}
+	for i := 0; i < 3; i++ {
+		c.Set(fmt.Sprintf("tok%d", i), "", i)
+	}
+	// Use tok0, so tok1 is least recently used.
+	c.Get("tok0", "")
+	c.Set("tok3", "", 3)
+	if _, ok := c.Get("tok1", ""); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	for _, tok := range []string{"tok0", "tok2", "tok3"} {
+		if _, ok := c.Get(tok, ""); !ok {
+			t.Errorf("%s was evicted", tok)
+		}
+	}
+	if c.Len() != 3 {
+		t.Errorf("Len() == %d", c.Len())
+	}
+}
+
+func TestForget(t *testing.T) {
+	c := &Cache{}
+	c.Set("tok", "a", 1)
+	c.Set("tok", "b", 2)
+	c.SetInvalid("tok")
+	c.Set("othertok", "a", 3)
+	if n := c.Forget("tok"); n != 3 {
+		t.Errorf("Forget returned %d", n)
+	}
+	if _, ok := c.Get("tok", "a"); ok {
+		t.Error("entry was not forgotten")
+	}
+	if _, ok := c.Get("othertok", "a"); !ok {
+		t.Error("wrong entry was forgotten")
+	}
+}
+
+func TestFlushHandler(t *testing.T) {
+	c := &Cache{}
+	h := &FlushHandler{Cache: c, AdminToken: "admintoken"}
+	for _, trial := range []struct {
+		method string
+		auth   string
+		status int
+	}{
+		{"GET", "OAuth2 admintoken", http.StatusMethodNotAllowed},
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "OAuth2 tok", http.StatusUnauthorized},
+		{"POST", "OAuth2 admintoken", http.StatusOK},
+	} {
+		c.Set("tok", "", true)
+		req, _ := http.NewRequest(trial.method, "/_admin/flush_token?token=tok", nil)
+		if trial.auth != "" {
+			req.Header.Set("Authorization", trial.auth)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		if resp.Code != trial.status {
+			t.Errorf("%+v: got status %d", trial, resp.Code)
+		}
+		_, cached := c.Get("tok", "")
+		if cached != (trial.status != http.StatusOK) {
+			t.Errorf("%+v: cached == %v", trial, cached)
+		}
+		if trial.status == http.StatusOK && resp.Body.String() != "{\"flushed\":1}\n" {
+			t.Errorf("%+v: got body %q", trial, resp.Body.String())
+		}
+	}
+
+	h = &FlushHandler{Cache: c}
+	req, _ := http.NewRequest("POST", "/_admin/flush_token?token=tok", nil)
+	req.Header.Set("Authorization", "OAuth2 ")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("empty AdminToken: got status %d", resp.Code)
+	}
+}
@@ -13,6 +13,32 @@ class Arvados::V1::CollectionsController < ApplicationController
     super
   end
 
+  def self._update_requires_parameters
+    (super rescue {}).
+      merge({
+              expect_portable_data_hash: {
+                type: 'string',
+                required: false,
+                description: "Update the collection only if its current portable_data_hash matches. Otherwise, respond with status 412.",
+              },
+            })
+  end
+
+  # With expect_portable_data_hash, the update uses row locking so
+  # concurrent clients can't overwrite each other's changes.
+  def update
+    expect = params[:expect_portable_data_hash]
+    return super if expect.nil?
+    @object.with_lock do
+      if @object.portable_data_hash != expect
+        send_error("Collection has been modified (portable_data_hash is #{@object.portable_data_hash}, expected #{expect})",
+                   status: 412)
+      else
+        super
+      end
+    end
+  end
+
   def find_object_by_uuid
     if loc = Keep::Locator.parse(params[:id])
       loc.strip_hints!
@@ -10,6 +10,7 @@ class Container < ArvadosModel
   serialize :mounts, Hash
   serialize :runtime_constraints, Hash
   serialize :command, Array
+  serialize :resource_usage, Hash
 
   before_validation :fill_field_defaults, :if => :new_record?
   before_validation :set_timestamps
@@ -37,6 +38,7 @@ class Container < ArvadosModel
     t.add :output_path
     t.add :priority
     t.add :progress
+    t.add :resource_usage
     t.add :runtime_constraints
     t.add :started_at
     t.add :state
@@ -126,13 +128,13 @@ class Container < ArvadosModel
 
     when Complete
       if self.state_was == Running
-        permitted.push :finished_at, :output, :log, :exit_code
+        permitted.push :finished_at, :output, :log, :exit_code, :resource_usage
       end
 
     when Cancelled
       case self.state_was
       when Running
-        permitted.push :finished_at, :output, :log
+        permitted.push :finished_at, :output, :log, :resource_usage
       when Queued, Locked
         permitted.push :finished_at
       end
@@ -0,0 +1,5 @@
+class AddResourceUsageToContainers < ActiveRecord::Migration
+  def change
+    add_column :containers, :resource_usage, :text
+  end
+end
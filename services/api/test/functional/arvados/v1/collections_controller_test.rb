@@ -887,4 +887,32 @@ EOS
       assert_response 200
     end
   end
+
+  test "update collection with expected portable_data_hash" do
+    authorize_with :active
+    post :update, {
+      id: collections(:collection_owned_by_active).uuid,
+      expect_portable_data_hash: collections(:collection_owned_by_active).portable_data_hash,
+      collection: {
+        manifest_text: ". d41d8cd98f00b204e9800998ecf8427e 0:0:foo.txt\n",
+      }
+    }
+    assert_response 200
+    assert_equal(". d41d8cd98f00b204e9800998ecf8427e 0:0:foo.txt\n",
+                 Collection.find_by_uuid(collections(:collection_owned_by_active).uuid).manifest_text)
+  end
+
+  test "update collection with stale portable_data_hash and expect 412" do
+    authorize_with :active
+    post :update, {
+      id: collections(:collection_owned_by_active).uuid,
+      expect_portable_data_hash: "d41d8cd98f00b204e9800998ecf8427e+0",
+      collection: {
+        manifest_text: ". d41d8cd98f00b204e9800998ecf8427e 0:0:foo.txt\n",
+      }
+    }
+    assert_response 412
+    assert_equal(collections(:collection_owned_by_active).manifest_text,
+                 Collection.find_by_uuid(collections(:collection_owned_by_active).uuid).manifest_text)
+  end
 end
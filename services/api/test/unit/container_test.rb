@@ -194,4 +194,18 @@ class ContainerTest < ActiveSupport::TestCase
 
     assert c.update_attributes(exit_code: 1, state: Container::Complete)
   end
+
+  test "Container records resource usage when finished" do
+    c, _ = minimal_new
+    set_user_from_auth :dispatch1
+    c.update_attributes! state: Container::Locked
+    c.update_attributes! state: Container::Running
+
+    usage = {"peak_rss_bytes" => 123456, "cpu_user_seconds" => 1.5}
+    check_illegal_updates c, [{resource_usage: usage}]
+
+    assert c.update_attributes(resource_usage: usage, exit_code: 0, state: Container::Complete)
+    c.reload
+    assert_equal usage, c.resource_usage
+  end
 end
@@ -68,36 +68,50 @@ func (h *authHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	repoName = pathParts[0]
 	repoName = strings.TrimRight(repoName, "/")
 
+	if theConfig.TokenCache.Invalid(apiToken) {
+		statusCode, statusText = http.StatusInternalServerError, "token was recently rejected by API server"
+		return
+	}
+
 	arv := clientPool.Get()
 	if arv == nil {
 		statusCode, statusText = http.StatusInternalServerError, "connection pool failed: "+clientPool.Err().Error()
 		return
 	}
 	defer clientPool.Put(arv)
-
-	// Ask API server whether the repository is readable using
-	// this token (by trying to read it!)
 	arv.ApiToken = apiToken
-	reposFound := arvadosclient.Dict{}
-	if err := arv.List("repositories", arvadosclient.Dict{
-		"filters": [][]string{{"name", "=", repoName}},
-	}, &reposFound); err != nil {
-		statusCode, statusText = http.StatusInternalServerError, err.Error()
-		return
+
+	var repoUUID string
+	if cached, ok := theConfig.TokenCache.Get(apiToken, repoName); ok {
+		repoUUID = cached.(string)
+	} else {
+		// Ask API server whether the repository is readable
+		// using this token (by trying to read it!)
+		reposFound := arvadosclient.Dict{}
+		if err := arv.List("repositories", arvadosclient.Dict{
+			"filters": [][]string{{"name", "=", repoName}},
+		}, &reposFound); err != nil {
+			if srvErr, ok := err.(arvadosclient.APIServerError); ok && srvErr.HttpStatusCode == http.StatusUnauthorized {
+				theConfig.TokenCache.SetInvalid(apiToken)
+			}
+			statusCode, statusText = http.StatusInternalServerError, err.Error()
+			return
+		}
+		validApiToken = true
+		if avail, ok := reposFound["items_available"].(float64); !ok {
+			statusCode, statusText = http.StatusInternalServerError, "bad list response from API"
+			return
+		} else if avail < 1 {
+			statusCode, statusText = http.StatusNotFound, "not found"
+			return
+		} else if avail > 1 {
+			statusCode, statusText = http.StatusInternalServerError, "name collision"
+			return
+		}
+		repoUUID = reposFound["items"].([]interface{})[0].(map[string]interface{})["uuid"].(string)
+		theConfig.TokenCache.Set(apiToken, repoName, repoUUID)
 	}
 	validApiToken = true
-	if avail, ok := reposFound["items_available"].(float64); !ok {
-		statusCode, statusText = http.StatusInternalServerError, "bad list response from API"
-		return
-	} else if avail < 1 {
-		statusCode, statusText = http.StatusNotFound, "not found"
-		return
-	} else if avail > 1 {
-		statusCode, statusText = http.StatusInternalServerError, "name collision"
-		return
-	}
-
-	repoUUID := reposFound["items"].([]interface{})[0].(map[string]interface{})["uuid"].(string)
 
 	isWrite := strings.HasSuffix(r.URL.Path, "/git-receive-pack")
 	if !isWrite {
@@ -31,5 +31,21 @@ Location of the CGI program to execute for each authorized request
 gitolite, otherwise git). It is invoked with a single argument,
 'http-backend'.  Default is /usr/bin/git.
 
+	-token-cache-size n
+	-token-cache-ttl duration
+	-token-cache-negative-ttl duration
+
+Remember up to n (token, repository) lookups for the given duration,
+so repeated requests from the same client (e.g., during a single
+"git fetch") don't each need to be checked with the API server.
+Tokens rejected by the API server are remembered for the negative
+TTL. Defaults are 1000, 5m, and 1m.
+
+	-admin-token token
+
+Enable the endpoint "POST /_admin/flush_token?token=..." that
+removes a (revoked) token from the cache. Requests must include the
+header "Authorization: OAuth2 token".
+
 */
 package main
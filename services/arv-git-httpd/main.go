@@ -4,12 +4,16 @@ import (
 	"flag"
 	"log"
 	"os"
+
+	"git.curoverse.com/arvados.git/sdk/go/tokencache"
 )
 
 type config struct {
 	Addr       string
 	GitCommand string
 	Root       string
+	TokenCache tokencache.Cache
+	AdminToken string
 }
 
 var theConfig *config
@@ -26,6 +30,14 @@ func init() {
 	}
 	flag.StringVar(&theConfig.Root, "repo-root", cwd,
 		"Path to git repositories.")
+	flag.IntVar(&theConfig.TokenCache.MaxEntries, "token-cache-size", tokencache.DefaultMaxEntries,
+		"Maximum number of (token, repository) lookups to remember.")
+	flag.DurationVar(&theConfig.TokenCache.TTL, "token-cache-ttl", tokencache.DefaultTTL,
+		"How long to remember that a token can read a repository.")
+	flag.DurationVar(&theConfig.TokenCache.NegativeTTL, "token-cache-negative-ttl", tokencache.DefaultNegativeTTL,
+		"How long to remember that a token is invalid. Use a negative value to disable.")
+	flag.StringVar(&theConfig.AdminToken, "admin-token", "",
+		"Token that can be used to remove a revoked token from the token cache with \"POST /_admin/flush_token?token=...\". If empty, this is disabled.")
 
 	// MakeArvadosClient returns an error if token is unset (even
 	// though we don't need to do anything requiring
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"git.curoverse.com/arvados.git/sdk/go/tokencache"
 )
 
 type server struct {
@@ -13,6 +14,7 @@ type server struct {
 func (srv *server) Start() error {
 	mux := http.NewServeMux()
 	mux.Handle("/", &authHandler{newGitHandler()})
+	mux.Handle("/_admin/flush_token", &tokencache.FlushHandler{Cache: &theConfig.TokenCache, AdminToken: theConfig.AdminToken})
 	srv.Handler = mux
 	srv.Addr = theConfig.Addr
 	return srv.Server.Start()
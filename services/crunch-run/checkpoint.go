@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// checkpointFile is a file saved by a previous checkpoint. If its
+// size and modification time haven't changed, the next checkpoint
+// reuses its blocks instead of uploading it again.
+type checkpointFile struct {
+	size    int64
+	modTime time.Time
+	blocks  []string
+}
+
+// StartCheckpoints starts a goroutine that periodically saves the
+// content of the output directory to a collection while the container
+// is running, so the work done so far is not lost if crunch-run or
+// the node fails before the container finishes. The same collection
+// is updated with each checkpoint, and with the final output when the
+// container completes.
+func (runner *ContainerRunner) StartCheckpoints() {
+	if runner.checkpointInterval <= 0 || runner.HostOutputDir == "" {
+		return
+	}
+	runner.checkpointStop = make(chan struct{})
+	runner.checkpointDone = make(chan struct{})
+	go func() {
+		defer close(runner.checkpointDone)
+		ticker := time.NewTicker(runner.checkpointInterval)
+		defer ticker.Stop()
+		var lastSignature string
+		for {
+			select {
+			case <-runner.checkpointStop:
+				return
+			case <-ticker.C:
+			}
+			sig, err := outputSignature(runner.HostOutputDir)
+			if err != nil {
+				runner.CrunchLog.Printf("While checking output directory for checkpoint: %v", err)
+				continue
+			}
+			if sig == lastSignature {
+				continue
+			}
+			err = runner.Checkpoint()
+			if err != nil {
+				runner.CrunchLog.Printf("While saving output checkpoint: %v", err)
+				continue
+			}
+			lastSignature = sig
+		}
+	}()
+}
+
+// StopCheckpoints stops the goroutine started by StartCheckpoints,
+// and waits for any checkpoint in progress to finish.
+func (runner *ContainerRunner) StopCheckpoints() {
+	if runner.checkpointStop == nil {
+		return
+	}
+	close(runner.checkpointStop)
+	<-runner.checkpointDone
+	runner.checkpointStop = nil
+}
+
+// Checkpoint saves the current content of the output directory to
+// the checkpoint collection, creating the collection if needed. Only
+// files added or modified since the last checkpoint are uploaded.
+func (runner *ContainerRunner) Checkpoint() error {
+	// Don't log every file uploaded: the final output capture
+	// does that.
+	manifestText, err := runner.checkpointManifest(log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		return err
+	}
+	var response arvados.Collection
+	if runner.checkpointUUID == "" {
+		err = runner.ArvClient.Create("collections",
+			arvadosclient.Dict{
+				"collection": arvadosclient.Dict{
+					"name":          "output checkpoint for " + runner.Container.UUID,
+					"manifest_text": manifestText}},
+			&response)
+	} else {
+		err = runner.ArvClient.Update("collections", runner.checkpointUUID,
+			arvadosclient.Dict{
+				"collection": arvadosclient.Dict{
+					"manifest_text": manifestText}},
+			&response)
+	}
+	if err != nil {
+		return err
+	}
+	if runner.checkpointUUID == "" {
+		runner.checkpointUUID = response.UUID
+	}
+	runner.CrunchLog.Printf("Saved output checkpoint %s to collection %s", response.PortableDataHash, runner.checkpointUUID)
+	return nil
+}
+
+// checkpointManifest returns a manifest for the current content of
+// the host output directory, uploading the files that changed since
+// the last checkpoint. Progress messages are sent to status.
+func (runner *ContainerRunner) checkpointManifest(status *log.Logger) (string, error) {
+	if _, err := os.Stat(filepath.Join(runner.HostOutputDir, ".arvados#collection")); err == nil {
+		// FUSE mount directory: arv-mount has already
+		// uploaded the content.
+		rec, err := readCollectionMetafile(runner.HostOutputDir)
+		if err != nil {
+			return "", err
+		}
+		return rec.ManifestText, nil
+	}
+
+	files := make(map[string]checkpointFile)
+	streams := make(map[string]*CollectionFileWriter)
+	err := filepath.Walk(runner.HostOutputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(runner.HostOutputDir, path)
+		if err != nil {
+			return err
+		}
+		f, ok := runner.checkpointFiles[rel]
+		if !ok || f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+			status.Printf("Uploading %v (%v bytes)", rel, info.Size())
+			f, err = runner.checkpointUpload(path, info)
+			if err != nil {
+				return err
+			}
+		}
+		files[rel] = f
+
+		dir := filepath.Dir(rel)
+		st := streams[dir]
+		if st == nil {
+			st = &CollectionFileWriter{ManifestStream: &manifest.ManifestStream{StreamName: dir}}
+			streams[dir] = st
+		}
+		st.Blocks = append(st.Blocks, f.blocks...)
+		st.FileStreamSegments = append(st.FileStreamSegments,
+			manifest.FileStreamSegment{st.offset, uint64(f.size), filepath.Base(rel)})
+		st.offset += uint64(f.size)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("While uploading output files: %v", err)
+	}
+	runner.checkpointFiles = files
+
+	var dirs []string
+	for dir := range streams {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	cw := CollectionWriter{IKeepClient: runner.Kc}
+	for _, dir := range dirs {
+		cw.Streams = append(cw.Streams, streams[dir])
+	}
+	return cw.ManifestText()
+}
+
+// checkpointUpload uploads the file at path, and returns its blocks.
+func (runner *ContainerRunner) checkpointUpload(path string, info os.FileInfo) (checkpointFile, error) {
+	f := checkpointFile{size: info.Size(), modTime: info.ModTime()}
+	file, err := os.Open(path)
+	if err != nil {
+		return f, err
+	}
+	defer file.Close()
+
+	// Use a separate stream for each file, so its blocks don't
+	// contain data from other files.
+	cw := CollectionWriter{IKeepClient: runner.Kc}
+	fw := cw.Open(info.Name()).(*CollectionFileWriter)
+	_, err = io.Copy(fw, file)
+	if err != nil {
+		return f, err
+	}
+	fw.Close()
+	err = cw.Finish()
+	if err != nil {
+		return f, err
+	}
+	f.blocks = fw.Blocks
+	return f, nil
+}
+
+// outputSignature returns a string that changes whenever a file is
+// added, removed, or modified in the given directory tree.
+func outputSignature(root string) (string, error) {
+	h := md5.New()
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %d %d %d\n", path, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// UpdateWritableCollections saves the final content of each writable
+// collection mount with a UUID to that collection.
+func (runner *ContainerRunner) UpdateWritableCollections() error {
+	if runner.finalState != "Complete" || len(runner.WritableCollections) == 0 {
+		return nil
+	}
+	arv, _, err := runner.containerClient()
+	if err != nil {
+		return err
+	}
+	for src, uuid := range runner.WritableCollections {
+		rec, err := readCollectionMetafile(src)
+		if err != nil {
+			return fmt.Errorf("While reading content of writable collection %s: %v", uuid, err)
+		}
+		var response arvados.Collection
+		err = arv.Update("collections", uuid,
+			arvadosclient.Dict{
+				"collection": arvadosclient.Dict{
+					"manifest_text": rec.ManifestText}},
+			&response)
+		if err != nil {
+			return fmt.Errorf("While updating writable collection %s: %v", uuid, err)
+		}
+		runner.CrunchLog.Printf("Updated collection %s, new portable data hash %s", uuid, response.PortableDataHash)
+	}
+	return nil
+}
+
+// copyTree copies the directories and regular files in the src tree
+// to dst, which must already exist, and returns the number of bytes
+// copied.
+func copyTree(src, dst string) (int64, error) {
+	var total int64
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case rel == ".":
+			return nil
+		case info.IsDir():
+			return os.Mkdir(target, 0755)
+		case info.Mode().IsRegular():
+			n, err := copyFile(path, target)
+			total += n
+			return err
+		default:
+			return nil
+		}
+	})
+	return total, err
+}
+
+func copyFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return n, err
+	}
+	return n, out.Close()
+}
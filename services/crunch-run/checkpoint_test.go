@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type CheckpointSuite struct {
+	tmpdir string
+}
+
+var _ = Suite(&CheckpointSuite{})
+
+func (s *CheckpointSuite) SetUpTest(c *C) {
+	var err error
+	s.tmpdir, err = ioutil.TempDir("", "crunch-run-checkpoint")
+	c.Assert(err, IsNil)
+}
+
+func (s *CheckpointSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.tmpdir)
+}
+
+func (s *CheckpointSuite) TestCheckpointAndCapture(c *C) {
+	api := &ArvTestClient{}
+	cr := NewContainerRunner(api, &KeepTestClient{}, nil, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	cr.HostOutputDir = s.tmpdir
+
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "file1.txt"), []byte("foo"), 0600)
+	c.Assert(cr.Checkpoint(), IsNil)
+	created := api.CalledWith("collection.name", "output checkpoint for zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(created, NotNil)
+	c.Check(created["collection"].(arvadosclient.Dict)["manifest_text"], Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n")
+	c.Check(cr.checkpointUUID, Not(Equals), "")
+
+	// The final output replaces the checkpoint in the same
+	// collection.
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "file2.txt"), []byte("bar"), 0600)
+	cr.finalState = "Complete"
+	c.Assert(cr.CaptureOutput(), IsNil)
+	final := api.CalledWith("collection.name", "output for zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(final, NotNil)
+	c.Check(final["collection"].(arvadosclient.Dict)["manifest_text"], Equals, ". 3858f62230ac3c915f300c664312c63f+6 0:3:file1.txt 3:3:file2.txt\n")
+	c.Check(cr.OutputPDH, NotNil)
+}
+
+// checkpointKeepClient counts the blocks written to Keep.
+type checkpointKeepClient struct {
+	KeepTestClient
+	puts int
+}
+
+func (kc *checkpointKeepClient) PutHB(hash string, buf []byte) (string, int, error) {
+	kc.puts++
+	return kc.KeepTestClient.PutHB(hash, buf)
+}
+
+func (s *CheckpointSuite) TestCheckpointUploadsChangedFiles(c *C) {
+	api := &ArvTestClient{}
+	kc := &checkpointKeepClient{}
+	cr := NewContainerRunner(api, kc, nil, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	cr.HostOutputDir = s.tmpdir
+
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "file1.txt"), []byte("foo"), 0600)
+	c.Assert(cr.Checkpoint(), IsNil)
+	c.Check(kc.puts, Equals, 1)
+
+	// Only the new file is uploaded.
+	os.Mkdir(filepath.Join(s.tmpdir, "dir"), 0700)
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "dir", "file2.txt"), []byte("bar"), 0600)
+	c.Assert(cr.Checkpoint(), IsNil)
+	c.Check(kc.puts, Equals, 2)
+	c.Check(api.CalledWith("collection.manifest_text", ". acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:file1.txt\n./dir 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file2.txt\n"), NotNil)
+
+	// Nothing changed.
+	c.Assert(cr.Checkpoint(), IsNil)
+	c.Check(kc.puts, Equals, 2)
+
+	// Only the modified file is uploaded, and the removed file
+	// is dropped.
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "file1.txt"), []byte("foobar"), 0600)
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "file3.txt"), []byte("baz"), 0600)
+	os.RemoveAll(filepath.Join(s.tmpdir, "dir"))
+	c.Assert(cr.Checkpoint(), IsNil)
+	c.Check(kc.puts, Equals, 4)
+	c.Check(api.CalledWith("collection.manifest_text", ". 3858f62230ac3c915f300c664312c63f+6 73feffa4b7f6bb68e44cf984c85f6e88+3 0:6:file1.txt 6:3:file3.txt\n"), NotNil)
+}
+
+func (s *CheckpointSuite) TestCaptureReusesCheckpoint(c *C) {
+	api := &ArvTestClient{}
+	kc := &checkpointKeepClient{}
+	cr := NewContainerRunner(api, kc, nil, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	cr.HostOutputDir = s.tmpdir
+	cr.checkpointInterval = time.Hour
+
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "file1.txt"), []byte("foo"), 0600)
+	c.Assert(cr.Checkpoint(), IsNil)
+	c.Check(kc.puts, Equals, 1)
+
+	// Only the file added since the checkpoint is uploaded.
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "file2.txt"), []byte("bar"), 0600)
+	cr.finalState = "Complete"
+	c.Assert(cr.CaptureOutput(), IsNil)
+	c.Check(kc.puts, Equals, 2)
+	final := api.CalledWith("collection.name", "output for zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	c.Assert(final, NotNil)
+	c.Check(final["collection"].(arvadosclient.Dict)["manifest_text"], Equals, ". acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:3:file1.txt 3:3:file2.txt\n")
+}
+
+func (s *CheckpointSuite) TestCheckpointLoop(c *C) {
+	api := &ArvTestClient{}
+	cr := NewContainerRunner(api, &KeepTestClient{}, nil, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	cr.HostOutputDir = s.tmpdir
+	cr.checkpointInterval = 10 * time.Millisecond
+
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "file1.txt"), []byte("foo"), 0600)
+	cr.StartCheckpoints()
+	time.Sleep(100 * time.Millisecond)
+	cr.StopCheckpoints()
+	// Second call has no effect.
+	cr.StopCheckpoints()
+
+	// Several ticks, but the output directory only changed once.
+	api.Lock()
+	defer api.Unlock()
+	saved := 0
+	for _, content := range api.Content {
+		if _, ok := content["collection"]; ok {
+			saved++
+		}
+	}
+	c.Check(saved, Equals, 1)
+	c.Check(cr.checkpointUUID, Not(Equals), "")
+}
+
+func (s *CheckpointSuite) TestOutputSignature(c *C) {
+	sig1, err := outputSignature(s.tmpdir)
+	c.Check(err, IsNil)
+	ioutil.WriteFile(filepath.Join(s.tmpdir, "file1.txt"), []byte("foo"), 0600)
+	sig2, err := outputSignature(s.tmpdir)
+	c.Check(err, IsNil)
+	c.Check(sig2, Not(Equals), sig1)
+	sig3, err := outputSignature(s.tmpdir)
+	c.Check(err, IsNil)
+	c.Check(sig3, Equals, sig2)
+}
+
+func (s *CheckpointSuite) TestUpdateWritableCollections(c *C) {
+	api := &ArvTestClient{}
+	cr := NewContainerRunner(api, &KeepTestClient{}, nil, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	metadata, _ := json.Marshal(map[string]string{
+		"uuid":          "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		"manifest_text": otherManifest,
+	})
+	ioutil.WriteFile(filepath.Join(s.tmpdir, ".arvados#collection"), metadata, 0600)
+	cr.WritableCollections = map[string]string{s.tmpdir: "zzzzz-4zz18-aaaaaaaaaaaaaaa"}
+
+	containerAPI := &ArvTestClient{}
+	var token string
+	cr.NewContainerClient = func(tok string) (IArvadosClient, IKeepClient, error) {
+		token = tok
+		return containerAPI, &KeepTestClient{}, nil
+	}
+
+	// Nothing is saved unless the container completed.
+	cr.finalState = "Cancelled"
+	c.Check(cr.UpdateWritableCollections(), IsNil)
+	c.Check(containerAPI.CalledWith("collection.manifest_text", otherManifest), IsNil)
+
+	// The collection is updated with the container's token.
+	cr.finalState = "Complete"
+	c.Check(cr.UpdateWritableCollections(), IsNil)
+	c.Check(token, Equals, fakeAuthToken)
+	c.Check(containerAPI.CalledWith("collection.manifest_text", otherManifest), NotNil)
+	c.Check(api.CalledWith("collection.manifest_text", otherManifest), IsNil)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -49,6 +50,10 @@ type RunArvMount func(args []string, tok string) (*exec.Cmd, error)
 
 type MkTempDir func(string, string) (string, error)
 
+// NewContainerClient is a factory function to create API and Keep
+// clients that authenticate with the given token.
+type NewContainerClient func(token string) (IArvadosClient, IKeepClient, error)
+
 // ThinDockerClient is the minimal Docker client interface used by crunch-run.
 type ThinDockerClient interface {
 	StopContainer(id string, timeout int) error
@@ -56,9 +61,12 @@ type ThinDockerClient interface {
 	LoadImage(reader io.Reader) error
 	CreateContainer(config *dockerclient.ContainerConfig, name string, authConfig *dockerclient.AuthConfig) (string, error)
 	StartContainer(id string, config *dockerclient.HostConfig) error
+	InspectContainer(id string) (*dockerclient.ContainerInfo, error)
 	AttachContainer(id string, options *dockerclient.AttachOptions) (io.ReadCloser, error)
+	AttachStdin(id string) (io.WriteCloser, error)
 	Wait(id string) <-chan dockerclient.WaitResult
 	RemoveImage(name string, force bool) ([]*dockerclient.ImageDelete, error)
+	RemoveContainer(id string, force, volumes bool) error
 }
 
 // ContainerRunner is the main stateful struct used for a single execution of a
@@ -73,13 +81,19 @@ type ContainerRunner struct {
 	token       string
 	ContainerID string
 	ExitCode    *int
+	OOMKilled   bool
+	startedAt   time.Time
+	finishedAt  time.Time
+	usage       *UsageCollector
 	NewLogWriter
 	loggingDone   chan bool
 	CrunchLog     *ThrottledLogger
 	Stdout        io.WriteCloser
-	Stderr        *ThrottledLogger
+	Stderr        io.WriteCloser
 	LogCollection *CollectionWriter
 	LogsPDH       *string
+	// Live copy of the logs, served by LogStream.Listen.
+	LogStream *LogStream
 	RunArvMount
 	MkTempDir
 	ArvMount       *exec.Cmd
@@ -94,6 +108,30 @@ type ContainerRunner struct {
 	ArvMountExit   chan error
 	finalState     string
 
+	// Returns clients that use the container's API token.
+	NewContainerClient
+
+	// Writable collection mounts with a UUID: maps the host
+	// path of each mount to the collection UUID, so the
+	// collection can be updated when the container finishes.
+	WritableCollections map[string]string
+
+	checkpointInterval time.Duration
+	checkpointUUID     string
+	checkpointStop     chan struct{}
+	checkpointDone     chan struct{}
+	checkpointFiles    map[string]checkpointFile
+
+	// If non-nil, loaded images are tracked here, and unused
+	// images are removed when the container finishes.
+	ImageCache            *ImageCache
+	imageAcquired         bool
+	imageProgressInterval time.Duration
+
+	// If true, allow the container to use swap in addition to
+	// its RAM limit.
+	allowSwap bool
+
 	statLogger   io.WriteCloser
 	statReporter *crunchstat.Reporter
 	statInterval time.Duration
@@ -159,17 +197,40 @@ func (runner *ContainerRunner) LoadImage() (err error) {
 
 	runner.CrunchLog.Printf("Using Docker image id '%s'", imageID)
 
+	if runner.ImageCache != nil {
+		// Take a reference before checking whether the image
+		// is loaded, so another crunch-run process can't
+		// remove it in the meantime.
+		err = runner.ImageCache.Acquire(runner.Container.ContainerImage, imageID)
+		if err != nil {
+			runner.CrunchLog.Printf("While updating image cache: %v", err)
+		} else {
+			runner.imageAcquired = true
+		}
+	}
+
 	_, err = runner.Docker.InspectImage(imageID)
 	if err != nil {
 		runner.CrunchLog.Print("Loading Docker image from keep")
 
-		var readCloser io.ReadCloser
+		var readCloser keepclient.ReadCloserWithLen
 		readCloser, err = runner.Kc.ManifestFileReader(manifest, img)
 		if err != nil {
 			return fmt.Errorf("While creating ManifestFileReader for container image: %v", err)
 		}
-
-		err = runner.Docker.LoadImage(readCloser)
+		defer readCloser.Close()
+
+		err = runner.Docker.LoadImage(&progressReader{
+			Reader:   readCloser,
+			Total:    readCloser.Len(),
+			Interval: runner.imageProgressInterval,
+			Report: func(done, total uint64) {
+				if total == 0 {
+					total = 1
+				}
+				runner.CrunchLog.Printf("Loading Docker image: %d of %d bytes (%d%%)", done, total, done*100/total)
+			},
+		})
 		if err != nil {
 			return fmt.Errorf("While loading container image into Docker: %v", err)
 		}
@@ -182,6 +243,41 @@ func (runner *ContainerRunner) LoadImage() (err error) {
 	return nil
 }
 
+// RemoveContainer removes the Docker container, if one was created.
+// Docker refuses to remove an image while a container created from it
+// exists, even if the container has stopped.
+func (runner *ContainerRunner) RemoveContainer() {
+	runner.CancelLock.Lock()
+	defer runner.CancelLock.Unlock()
+	if runner.ContainerID == "" {
+		return
+	}
+	err := runner.Docker.RemoveContainer(runner.ContainerID, true, true)
+	if err != nil {
+		runner.CrunchLog.Printf("While removing container: %v", err)
+		return
+	}
+	runner.ContainerID = ""
+}
+
+// ReleaseImage tells the image cache the container image is no longer
+// in use by this runner, which can result in removing unused images
+// from Docker.
+func (runner *ContainerRunner) ReleaseImage() {
+	if !runner.imageAcquired {
+		return
+	}
+	runner.imageAcquired = false
+	err := runner.ImageCache.Release(runner.Container.ContainerImage, func(imageID string) error {
+		runner.CrunchLog.Printf("Removing unused Docker image '%s'", imageID)
+		_, err := runner.Docker.RemoveImage(imageID, false)
+		return err
+	})
+	if err != nil {
+		runner.CrunchLog.Printf("While cleaning up image cache: %v", err)
+	}
+}
+
 func (runner *ContainerRunner) ArvMountCmd(arvMountCmd []string, token string) (c *exec.Cmd, err error) {
 	c = exec.Command("arv-mount", arvMountCmd...)
 
@@ -250,12 +346,16 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 	arvMountCmd := []string{"--foreground", "--allow-other", "--read-write"}
 	collectionPaths := []string{}
 	runner.Binds = nil
+	runner.WritableCollections = make(map[string]string)
+	// Maps the host path of each writable collection mount
+	// to the arv-mount path it is copied from.
+	collectionCopies := make(map[string]string)
 
 	for bind, mnt := range runner.Container.Mounts {
-		if bind == "stdout" {
+		if bind == "stdout" || bind == "stderr" {
 			// Is it a "file" mount kind?
 			if mnt.Kind != "file" {
-				return fmt.Errorf("Unsupported mount kind '%s' for stdout. Only 'file' is supported.", mnt.Kind)
+				return fmt.Errorf("Unsupported mount kind '%s' for %s. Only 'file' is supported.", mnt.Kind, bind)
 			}
 
 			// Does path start with OutputPath?
@@ -264,22 +364,55 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 				prefix += "/"
 			}
 			if !strings.HasPrefix(mnt.Path, prefix) {
-				return fmt.Errorf("Stdout path does not start with OutputPath: %s, %s", mnt.Path, prefix)
+				return fmt.Errorf("%s path does not start with OutputPath: %s, %s", strings.Title(bind), mnt.Path, prefix)
+			}
+			continue
+		}
+
+		if bind == "stdin" {
+			// Is it a "collection" or "json" mount kind?
+			switch {
+			case mnt.Kind == "collection" && (mnt.UUID != "" || mnt.PortableDataHash != "") && mnt.Path != "":
+			case mnt.Kind == "json":
+			default:
+				return fmt.Errorf("Unsupported mount kind '%s' for stdin. Only 'collection' with a file 'path', or 'json', is supported.", mnt.Kind)
 			}
+			continue
 		}
 
 		switch {
-		case mnt.Kind == "collection":
+		case mnt.Kind == "collection" || mnt.Kind == "file":
 			var src string
 			if mnt.UUID != "" && mnt.PortableDataHash != "" {
 				return fmt.Errorf("Cannot specify both 'uuid' and 'portable_data_hash' for a collection mount")
 			}
-			if mnt.UUID != "" {
-				if mnt.Writable {
-					return fmt.Errorf("Writing to existing collections currently not permitted.")
+			if mnt.Kind == "file" {
+				if mnt.UUID == "" && mnt.PortableDataHash == "" {
+					return fmt.Errorf("Must specify 'uuid' or 'portable_data_hash' for a file mount")
 				}
+				if mnt.Path == "" || mnt.Writable {
+					return fmt.Errorf("A file mount must specify a 'path' in the collection and cannot be writable")
+				}
+			}
+			if mnt.Path != "" && mnt.Writable {
+				return fmt.Errorf("Cannot mount a 'path' within a collection as writable")
+			}
+			if mnt.UUID != "" {
 				pdhOnly = false
 				src = fmt.Sprintf("%s/by_id/%s", runner.ArvMountPoint, mnt.UUID)
+				if mnt.Writable {
+					// The container writes to a
+					// copy, which is saved to the
+					// collection only if the
+					// container completes.
+					tmpsrc := fmt.Sprintf("%s/tmp%d", runner.ArvMountPoint, tmpcount)
+					arvMountCmd = append(arvMountCmd, "--mount-tmp")
+					arvMountCmd = append(arvMountCmd, fmt.Sprintf("tmp%d", tmpcount))
+					tmpcount += 1
+					collectionCopies[tmpsrc] = src
+					runner.WritableCollections[tmpsrc] = mnt.UUID
+					src = tmpsrc
+				}
 			} else if mnt.PortableDataHash != "" {
 				if mnt.Writable {
 					return fmt.Errorf("Can never write to a collection specified by portable data hash")
@@ -291,6 +424,12 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 				arvMountCmd = append(arvMountCmd, fmt.Sprintf("tmp%d", tmpcount))
 				tmpcount += 1
 			}
+			if mnt.Path != "" {
+				src, err = subPath(src, mnt.Path)
+				if err != nil {
+					return err
+				}
+			}
 			if mnt.Writable {
 				if bind == runner.Container.OutputPath {
 					runner.HostOutputDir = src
@@ -325,22 +464,40 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 			if err != nil {
 				return fmt.Errorf("encoding json data: %v", err)
 			}
-			// Create a tempdir with a single file
-			// (instead of just a tempfile): this way we
-			// can ensure the file is world-readable
-			// inside the container, without having to
-			// make it world-readable on the docker host.
-			tmpdir, err := runner.MkTempDir("", "")
+			tmpfn, err := runner.writeMountData("mountdata.json", jsondata)
 			if err != nil {
-				return fmt.Errorf("creating temp dir: %v", err)
+				return err
+			}
+			runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s:ro", tmpfn, bind))
+
+		case mnt.Kind == "text":
+			text, ok := mnt.Content.(string)
+			if !ok {
+				return fmt.Errorf("content of a text mount must be a string")
 			}
-			runner.CleanupTempDir = append(runner.CleanupTempDir, tmpdir)
-			tmpfn := filepath.Join(tmpdir, "mountdata.json")
-			err = ioutil.WriteFile(tmpfn, jsondata, 0644)
+			tmpfn, err := runner.writeMountData("mountdata.txt", []byte(text))
 			if err != nil {
-				return fmt.Errorf("writing temp file: %v", err)
+				return err
 			}
 			runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s:ro", tmpfn, bind))
+
+		case mnt.Kind == "keep":
+			if mnt.Writable {
+				return fmt.Errorf("A keep mount cannot be writable")
+			}
+			pdhOnly = false
+			src := fmt.Sprintf("%s/by_id", runner.ArvMountPoint)
+			runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s:ro", src, bind))
+
+		case mnt.Kind == "git_tree":
+			if mnt.Writable {
+				return fmt.Errorf("A git_tree mount cannot be writable")
+			}
+			src, err := runner.gitTree(mnt)
+			if err != nil {
+				return fmt.Errorf("While checking out git tree for %s: %v", bind, err)
+			}
+			runner.Binds = append(runner.Binds, fmt.Sprintf("%s:%s:ro", src, bind))
 		}
 	}
 
@@ -372,9 +529,39 @@ func (runner *ContainerRunner) SetupMounts() (err error) {
 		}
 	}
 
+	for dst, src := range collectionCopies {
+		uuid := runner.WritableCollections[dst]
+		runner.CrunchLog.Printf("Copying writable collection %s", uuid)
+		size, err := copyTree(src, dst)
+		if err != nil {
+			return fmt.Errorf("While copying writable collection %s: %v", uuid, err)
+		}
+		runner.CrunchLog.Printf("Copied %d bytes from writable collection %s", size, uuid)
+	}
+
 	return nil
 }
 
+// writeMountData writes data to a new file with the given name, and
+// returns the path to the file.
+func (runner *ContainerRunner) writeMountData(name string, data []byte) (string, error) {
+	// Create a tempdir with a single file (instead of just a
+	// tempfile): this way we can ensure the file is
+	// world-readable inside the container, without having to
+	// make it world-readable on the docker host.
+	tmpdir, err := runner.MkTempDir("", "")
+	if err != nil {
+		return "", fmt.Errorf("creating temp dir: %v", err)
+	}
+	runner.CleanupTempDir = append(runner.CleanupTempDir, tmpdir)
+	tmpfn := filepath.Join(tmpdir, name)
+	err = ioutil.WriteFile(tmpfn, data, 0644)
+	if err != nil {
+		return "", fmt.Errorf("writing temp file: %v", err)
+	}
+	return tmpfn, nil
+}
+
 func (runner *ContainerRunner) ProcessDockerAttach(containerReader io.Reader) {
 	// Handle docker log protocol
 	// https://docs.docker.com/engine/reference/api/docker_remote_api_v1.15/#attach-to-a-container
@@ -428,7 +615,7 @@ func (runner *ContainerRunner) StartCrunchstat() {
 	runner.statLogger = NewThrottledLogger(runner.NewLogWriter("crunchstat"))
 	runner.statReporter = &crunchstat.Reporter{
 		CID:          runner.ContainerID,
-		Logger:       log.New(runner.statLogger, "", 0),
+		Logger:       log.New(io.MultiWriter(runner.statLogger, runner.usage), "", 0),
 		CgroupParent: runner.expectCgroupParent,
 		CgroupRoot:   runner.cgroupRoot,
 		PollPeriod:   runner.statInterval,
@@ -452,42 +639,120 @@ func (runner *ContainerRunner) AttachStreams() (err error) {
 	runner.loggingDone = make(chan bool)
 
 	if stdoutMnt, ok := runner.Container.Mounts["stdout"]; ok {
-		stdoutPath := stdoutMnt.Path[len(runner.Container.OutputPath):]
-		index := strings.LastIndex(stdoutPath, "/")
-		if index > 0 {
-			subdirs := stdoutPath[:index]
-			if subdirs != "" {
-				st, err := os.Stat(runner.HostOutputDir)
-				if err != nil {
-					return fmt.Errorf("While Stat on temp dir: %v", err)
-				}
-				stdoutPath := path.Join(runner.HostOutputDir, subdirs)
-				err = os.MkdirAll(stdoutPath, st.Mode()|os.ModeSetgid|0777)
-				if err != nil {
-					return fmt.Errorf("While MkdirAll %q: %v", stdoutPath, err)
-				}
-			}
-		}
-		stdoutFile, err := os.Create(path.Join(runner.HostOutputDir, stdoutPath))
+		runner.Stdout, err = runner.outputFile(stdoutMnt.Path)
 		if err != nil {
 			return fmt.Errorf("While creating stdout file: %v", err)
 		}
-		runner.Stdout = stdoutFile
 	} else {
 		runner.Stdout = NewThrottledLogger(runner.NewLogWriter("stdout"))
 	}
-	runner.Stderr = NewThrottledLogger(runner.NewLogWriter("stderr"))
+
+	if stderrMnt, ok := runner.Container.Mounts["stderr"]; ok {
+		runner.Stderr, err = runner.outputFile(stderrMnt.Path)
+		if err != nil {
+			return fmt.Errorf("While creating stderr file: %v", err)
+		}
+	} else {
+		runner.Stderr = NewThrottledLogger(runner.NewLogWriter("stderr"))
+	}
+
+	if stdinMnt, ok := runner.Container.Mounts["stdin"]; ok {
+		err = runner.attachStdin(stdinMnt)
+		if err != nil {
+			return err
+		}
+	}
 
 	go runner.ProcessDockerAttach(containerReader)
 
 	return nil
 }
 
+// outputFile creates a file in the host output directory that will
+// appear at containerPath inside the container, creating parent
+// directories as needed.
+func (runner *ContainerRunner) outputFile(containerPath string) (*os.File, error) {
+	relPath := containerPath[len(runner.Container.OutputPath):]
+	index := strings.LastIndex(relPath, "/")
+	if index > 0 {
+		subdirs := relPath[:index]
+		if subdirs != "" {
+			st, err := os.Stat(runner.HostOutputDir)
+			if err != nil {
+				return nil, fmt.Errorf("While Stat on temp dir: %v", err)
+			}
+			dirPath := path.Join(runner.HostOutputDir, subdirs)
+			err = os.MkdirAll(dirPath, st.Mode()|os.ModeSetgid|0777)
+			if err != nil {
+				return nil, fmt.Errorf("While MkdirAll %q: %v", dirPath, err)
+			}
+		}
+	}
+	return os.Create(path.Join(runner.HostOutputDir, relPath))
+}
+
+// attachStdin starts copying the content specified by the stdin mount
+// to the container's standard input.
+func (runner *ContainerRunner) attachStdin(mnt arvados.Mount) error {
+	var stdin io.ReadCloser
+	switch mnt.Kind {
+	case "collection":
+		id := mnt.UUID
+		if id == "" {
+			id = mnt.PortableDataHash
+		}
+		// Read the collection with the container's token,
+		// like arv-mount does for other collection mounts.
+		arv, kc, err := runner.containerClient()
+		if err != nil {
+			return err
+		}
+		var collection arvados.Collection
+		err = arv.Get("collections", id, nil, &collection)
+		if err != nil {
+			return fmt.Errorf("While getting stdin collection: %v", err)
+		}
+		stdin, err = kc.ManifestFileReader(manifest.Manifest{Text: collection.ManifestText}, strings.TrimPrefix(mnt.Path, "/"))
+		if err != nil {
+			return fmt.Errorf("While creating ManifestFileReader for stdin: %v", err)
+		}
+	case "json":
+		jsondata, err := json.Marshal(mnt.Content)
+		if err != nil {
+			return fmt.Errorf("While encoding stdin json data: %v", err)
+		}
+		stdin = ioutil.NopCloser(bytes.NewReader(jsondata))
+	}
+
+	w, err := runner.Docker.AttachStdin(runner.ContainerID)
+	if err != nil {
+		stdin.Close()
+		return fmt.Errorf("While attaching container stdin stream: %v", err)
+	}
+	go func() {
+		defer stdin.Close()
+		_, err := io.Copy(w, stdin)
+		if err != nil {
+			runner.CrunchLog.Printf("While writing container stdin: %v", err)
+		}
+		err = w.Close()
+		if err != nil {
+			runner.CrunchLog.Printf("While closing container stdin: %v", err)
+		}
+	}()
+	return nil
+}
+
 // CreateContainer creates the docker container.
 func (runner *ContainerRunner) CreateContainer() error {
 	runner.CrunchLog.Print("Creating Docker container")
 
 	runner.ContainerConfig.Cmd = runner.Container.Command
+	if _, ok := runner.Container.Mounts["stdin"]; ok {
+		runner.ContainerConfig.OpenStdin = true
+		runner.ContainerConfig.StdinOnce = true
+		runner.ContainerConfig.AttachStdin = true
+	}
 	if runner.Container.Cwd != "." {
 		runner.ContainerConfig.WorkingDir = runner.Container.Cwd
 	}
@@ -510,12 +775,6 @@ func (runner *ContainerRunner) CreateContainer() error {
 		runner.ContainerConfig.NetworkDisabled = true
 	}
 
-	var err error
-	runner.ContainerID, err = runner.Docker.CreateContainer(&runner.ContainerConfig, "", nil)
-	if err != nil {
-		return fmt.Errorf("While creating container: %v", err)
-	}
-
 	runner.HostConfig = dockerclient.HostConfig{
 		Binds:        runner.Binds,
 		CgroupParent: runner.setCgroupParent,
@@ -523,10 +782,45 @@ func (runner *ContainerRunner) CreateContainer() error {
 			Type: "none",
 		},
 	}
+	runner.setResourceLimits()
+	runner.ContainerConfig.HostConfig = runner.HostConfig
+
+	var err error
+	runner.ContainerID, err = runner.Docker.CreateContainer(&runner.ContainerConfig, "", nil)
+	if err != nil {
+		return fmt.Errorf("While creating container: %v", err)
+	}
 
 	return runner.AttachStreams()
 }
 
+// cpuPeriod is the CFS scheduler period used to enforce VCPUs limits,
+// in microseconds.
+const cpuPeriod = 100000
+
+// setResourceLimits sets the memory and CPU limits in HostConfig
+// according to the container's runtime constraints.
+func (runner *ContainerRunner) setResourceLimits() {
+	rc := runner.Container.RuntimeConstraints
+	if rc.RAM > 0 {
+		runner.HostConfig.Memory = int64(rc.RAM)
+		if runner.allowSwap {
+			runner.HostConfig.MemorySwap = -1
+		} else {
+			// Memory+swap limit equal to the memory
+			// limit means no swap.
+			runner.HostConfig.MemorySwap = int64(rc.RAM)
+		}
+		runner.CrunchLog.Printf("Limiting container memory to %d bytes", rc.RAM)
+	}
+	if rc.VCPUs > 0 {
+		runner.HostConfig.CpuShares = int64(rc.VCPUs) * 1024
+		runner.HostConfig.CpuPeriod = cpuPeriod
+		runner.HostConfig.CpuQuota = int64(rc.VCPUs) * cpuPeriod
+		runner.CrunchLog.Printf("Limiting container to %d VCPUs", rc.VCPUs)
+	}
+}
+
 // StartContainer starts the docker container created by CreateContainer.
 func (runner *ContainerRunner) StartContainer() error {
 	runner.CrunchLog.Printf("Starting Docker container id '%s'", runner.ContainerID)
@@ -544,6 +838,7 @@ func (runner *ContainerRunner) WaitFinish() error {
 
 	result := runner.Docker.Wait(runner.ContainerID)
 	wr := <-result
+	runner.finishedAt = time.Now().UTC()
 	if wr.Error != nil {
 		return fmt.Errorf("While waiting for container to finish: %v", wr.Error)
 	}
@@ -552,6 +847,17 @@ func (runner *ContainerRunner) WaitFinish() error {
 	// wait for stdout/stderr to complete
 	<-runner.loggingDone
 
+	runner.StopCheckpoints()
+
+	info, err := runner.Docker.InspectContainer(runner.ContainerID)
+	if err != nil {
+		runner.CrunchLog.Printf("While inspecting container after exit: %v", err)
+	} else if info.State != nil && info.State.OOMKilled {
+		runner.OOMKilled = true
+		runner.CrunchLog.Printf("Container was killed because it ran out of memory (limit %d bytes, exit code %d); consider increasing runtime_constraints.ram",
+			runner.Container.RuntimeConstraints.RAM, wr.ExitCode)
+	}
+
 	return nil
 }
 
@@ -565,52 +871,88 @@ func (runner *ContainerRunner) CaptureOutput() error {
 		return nil
 	}
 
-	_, err := os.Stat(runner.HostOutputDir)
+	var manifestText string
+	var err error
+	if runner.checkpointInterval > 0 {
+		// Only upload the files that changed since the
+		// last checkpoint.
+		manifestText, err = runner.checkpointManifest(runner.CrunchLog.Logger)
+	} else {
+		manifestText, err = runner.outputManifest(runner.CrunchLog.Logger)
+	}
 	if err != nil {
-		return fmt.Errorf("While checking host output path: %v", err)
+		return err
 	}
 
-	var manifestText string
+	var response arvados.Collection
+	if runner.checkpointUUID != "" {
+		// Replace the last checkpoint with the final output.
+		err = runner.ArvClient.Update("collections", runner.checkpointUUID,
+			arvadosclient.Dict{
+				"collection": arvadosclient.Dict{
+					"name":          "output for " + runner.Container.UUID,
+					"manifest_text": manifestText}},
+			&response)
+	} else {
+		err = runner.ArvClient.Create("collections",
+			arvadosclient.Dict{
+				"collection": arvadosclient.Dict{
+					"manifest_text": manifestText}},
+			&response)
+	}
+	if err != nil {
+		return fmt.Errorf("While creating output collection: %v", err)
+	}
+
+	runner.OutputPDH = new(string)
+	*runner.OutputPDH = response.PortableDataHash
+
+	return nil
+}
+
+// outputManifest returns a manifest for the current content of the
+// host output directory, uploading files to Keep if needed. Progress
+// messages are sent to status.
+func (runner *ContainerRunner) outputManifest(status *log.Logger) (string, error) {
+	_, err := os.Stat(runner.HostOutputDir)
+	if err != nil {
+		return "", fmt.Errorf("While checking host output path: %v", err)
+	}
 
 	collectionMetafile := fmt.Sprintf("%s/.arvados#collection", runner.HostOutputDir)
 	_, err = os.Stat(collectionMetafile)
 	if err != nil {
 		// Regular directory
 		cw := CollectionWriter{runner.Kc, nil, sync.Mutex{}}
-		manifestText, err = cw.WriteTree(runner.HostOutputDir, runner.CrunchLog.Logger)
+		manifestText, err := cw.WriteTree(runner.HostOutputDir, status)
 		if err != nil {
-			return fmt.Errorf("While uploading output files: %v", err)
+			return "", fmt.Errorf("While uploading output files: %v", err)
 		}
-	} else {
-		// FUSE mount directory
-		file, openerr := os.Open(collectionMetafile)
-		if openerr != nil {
-			return fmt.Errorf("While opening FUSE metafile: %v", err)
-		}
-		defer file.Close()
-
-		var rec arvados.Collection
-		err = json.NewDecoder(file).Decode(&rec)
-		if err != nil {
-			return fmt.Errorf("While reading FUSE metafile: %v", err)
-		}
-		manifestText = rec.ManifestText
+		return manifestText, nil
 	}
 
-	var response arvados.Collection
-	err = runner.ArvClient.Create("collections",
-		arvadosclient.Dict{
-			"collection": arvadosclient.Dict{
-				"manifest_text": manifestText}},
-		&response)
+	// FUSE mount directory
+	rec, err := readCollectionMetafile(runner.HostOutputDir)
 	if err != nil {
-		return fmt.Errorf("While creating output collection: %v", err)
+		return "", err
 	}
+	return rec.ManifestText, nil
+}
 
-	runner.OutputPDH = new(string)
-	*runner.OutputPDH = response.PortableDataHash
+// readCollectionMetafile returns the collection record that arv-mount
+// provides for the collection mounted at dir.
+func readCollectionMetafile(dir string) (rec arvados.Collection, err error) {
+	file, err := os.Open(fmt.Sprintf("%s/.arvados#collection", dir))
+	if err != nil {
+		return rec, fmt.Errorf("While opening FUSE metafile: %v", err)
+	}
+	defer file.Close()
 
-	return nil
+	err = json.NewDecoder(file).Decode(&rec)
+	if err != nil {
+		return rec, fmt.Errorf("While reading FUSE metafile: %v", err)
+	}
+	return rec, nil
 }
 
 func (runner *ContainerRunner) CleanupDirs() {
@@ -637,15 +979,21 @@ func (runner *ContainerRunner) CleanupDirs() {
 
 // CommitLogs posts the collection containing the final container logs.
 func (runner *ContainerRunner) CommitLogs() error {
-	runner.CrunchLog.Print(runner.finalState)
+	if runner.OOMKilled {
+		runner.CrunchLog.Print(runner.finalState + " (out of memory)")
+	} else {
+		runner.CrunchLog.Print(runner.finalState)
+	}
 	runner.CrunchLog.Close()
 
 	// Closing CrunchLog above allows it to be committed to Keep at this
 	// point, but re-open crunch log with ArvClient in case there are any
 	// other further (such as failing to write the log to Keep!) while
 	// shutting down
-	runner.CrunchLog = NewThrottledLogger(&ArvLogWriter{runner.ArvClient, runner.Container.UUID,
-		"crunch-run", nil})
+	runner.CrunchLog = NewThrottledLogger(&ArvLogWriter{
+		ArvClient:     runner.ArvClient,
+		UUID:          runner.Container.UUID,
+		loggingStream: "crunch-run"})
 
 	if runner.LogsPDH != nil {
 		// If we have already assigned something to LogsPDH,
@@ -656,6 +1004,13 @@ func (runner *ContainerRunner) CommitLogs() error {
 		return nil
 	}
 
+	if !runner.startedAt.IsZero() {
+		err := runner.writeSummary()
+		if err != nil {
+			runner.CrunchLog.Printf("While writing resource usage summary: %v", err)
+		}
+	}
+
 	mt, err := runner.LogCollection.ManifestText()
 	if err != nil {
 		return fmt.Errorf("While creating log manifest: %v", err)
@@ -677,6 +1032,35 @@ func (runner *ContainerRunner) CommitLogs() error {
 	return nil
 }
 
+// resourceUsage returns the container's resource usage, including
+// whether it ran out of memory.
+func (runner *ContainerRunner) resourceUsage() ResourceUsage {
+	usage := runner.usage.Usage()
+	usage.OOMKilled = runner.OOMKilled
+	return usage
+}
+
+// writeSummary saves the container's exit code, start and finish
+// times, and resource usage in a JSON file in the log collection.
+func (runner *ContainerRunner) writeSummary() error {
+	summary := struct {
+		ExitCode      *int          `json:"exit_code"`
+		StartedAt     time.Time     `json:"started_at"`
+		FinishedAt    time.Time     `json:"finished_at"`
+		ResourceUsage ResourceUsage `json:"resource_usage"`
+	}{runner.ExitCode, runner.startedAt, runner.finishedAt, runner.resourceUsage()}
+	buf, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	w := runner.LogCollection.Open("resource-usage.json")
+	_, err = w.Write(append(buf, '\n'))
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
 // UpdateContainerRunning updates the container state to "Running"
 func (runner *ContainerRunner) UpdateContainerRunning() error {
 	runner.CancelLock.Lock()
@@ -684,8 +1068,11 @@ func (runner *ContainerRunner) UpdateContainerRunning() error {
 	if runner.Cancelled {
 		return ErrCancelled
 	}
+	runner.startedAt = time.Now().UTC()
 	return runner.ArvClient.Update("containers", runner.Container.UUID,
-		arvadosclient.Dict{"container": arvadosclient.Dict{"state": "Running"}}, nil)
+		arvadosclient.Dict{"container": arvadosclient.Dict{
+			"state":      "Running",
+			"started_at": runner.startedAt}}, nil)
 }
 
 // ContainerToken returns the api_token the container (and any
@@ -704,6 +1091,35 @@ func (runner *ContainerRunner) ContainerToken() (string, error) {
 	return runner.token, nil
 }
 
+// newContainerClient returns copies of the runner's API and Keep
+// clients that use the given token instead of the dispatcher's.
+func (runner *ContainerRunner) newContainerClient(token string) (IArvadosClient, IKeepClient, error) {
+	arv, ok := runner.ArvClient.(arvadosclient.ArvadosClient)
+	if !ok {
+		return nil, nil, fmt.Errorf("cannot use container token with %T", runner.ArvClient)
+	}
+	arv.ApiToken = token
+	kc, err := keepclient.MakeKeepClient(&arv)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rkc, ok := runner.Kc.(*keepclient.KeepClient); ok {
+		kc.Retries = rkc.Retries
+	}
+	return arv, kc, nil
+}
+
+// containerClient returns API and Keep clients that use the
+// container's API token, so the container can't read or write
+// anything its token doesn't allow.
+func (runner *ContainerRunner) containerClient() (IArvadosClient, IKeepClient, error) {
+	token, err := runner.ContainerToken()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get container token: %v", err)
+	}
+	return runner.NewContainerClient(token)
+}
+
 // UpdateContainerComplete updates the container record state on API
 // server to "Complete" or "Cancelled"
 func (runner *ContainerRunner) UpdateContainerFinal() error {
@@ -720,6 +1136,14 @@ func (runner *ContainerRunner) UpdateContainerFinal() error {
 			update["output"] = *runner.OutputPDH
 		}
 	}
+	if runner.finalState == "Complete" || runner.finalState == "Cancelled" {
+		if !runner.finishedAt.IsZero() {
+			update["finished_at"] = runner.finishedAt
+		}
+		if !runner.startedAt.IsZero() {
+			update["resource_usage"] = runner.resourceUsage()
+		}
+	}
 	return runner.ArvClient.Update("containers", runner.Container.UUID, arvadosclient.Dict{"container": update}, nil)
 }
 
@@ -732,7 +1156,15 @@ func (runner *ContainerRunner) IsCancelled() bool {
 
 // NewArvLogWriter creates an ArvLogWriter
 func (runner *ContainerRunner) NewArvLogWriter(name string) io.WriteCloser {
-	return &ArvLogWriter{runner.ArvClient, runner.Container.UUID, name, runner.LogCollection.Open(name + ".txt")}
+	var w io.WriteCloser = runner.LogCollection.Open(name + ".txt")
+	if runner.LogStream != nil {
+		w = runner.LogStream.Tee(name, w)
+	}
+	return &ArvLogWriter{
+		ArvClient:     runner.ArvClient,
+		UUID:          runner.Container.UUID,
+		loggingStream: name,
+		writeCloser:   w}
 }
 
 // Run the full container lifecycle.
@@ -771,6 +1203,13 @@ func (runner *ContainerRunner) Run() (err error) {
 		// Log the error encountered in Run(), if any
 		checkErr(err)
 
+		runner.RemoveContainer()
+		runner.ReleaseImage()
+
+		if !runner.startedAt.IsZero() && runner.finishedAt.IsZero() {
+			runner.finishedAt = time.Now().UTC()
+		}
+
 		if runner.finalState == "Queued" {
 			runner.UpdateContainerFinal()
 			return
@@ -782,7 +1221,9 @@ func (runner *ContainerRunner) Run() (err error) {
 			// capture partial output and write logs
 		}
 
+		runner.StopCheckpoints()
 		checkErr(runner.CaptureOutput())
+		checkErr(runner.UpdateWritableCollections())
 		checkErr(runner.CommitLogs())
 		checkErr(runner.UpdateContainerFinal())
 
@@ -837,6 +1278,8 @@ func (runner *ContainerRunner) Run() (err error) {
 		return
 	}
 
+	runner.StartCheckpoints()
+
 	err = runner.WaitFinish()
 	if err == nil {
 		runner.finalState = "Complete"
@@ -854,10 +1297,14 @@ func NewContainerRunner(api IArvadosClient,
 	cr.NewLogWriter = cr.NewArvLogWriter
 	cr.RunArvMount = cr.ArvMountCmd
 	cr.MkTempDir = ioutil.TempDir
+	cr.NewContainerClient = cr.newContainerClient
 	cr.LogCollection = &CollectionWriter{kc, nil, sync.Mutex{}}
+	cr.LogStream = NewLogStream()
 	cr.Container.UUID = containerUUID
 	cr.CrunchLog = NewThrottledLogger(cr.NewLogWriter("crunch-run"))
 	cr.CrunchLog.Immediate = log.New(os.Stderr, containerUUID+" ", 0)
+	cr.imageProgressInterval = 10 * time.Second
+	cr.usage = &UsageCollector{}
 	return cr
 }
 
@@ -866,6 +1313,13 @@ func main() {
 	cgroupRoot := flag.String("cgroup-root", "/sys/fs/cgroup", "path to sysfs cgroup tree")
 	cgroupParent := flag.String("cgroup-parent", "docker", "name of container's parent cgroup (ignored if -cgroup-parent-subsystem is used)")
 	cgroupParentSubsystem := flag.String("cgroup-parent-subsystem", "", "use current cgroup for given subsystem as parent cgroup for container")
+	imageCacheState := flag.String("image-cache-state", "", "path to `file` tracking Docker images shared by crunch-run processes on this node (if empty, loaded images are never removed)")
+	imageCacheUnused := flag.Int("image-cache-unused", 4, "number of unused Docker images to keep when -image-cache-state is used")
+	allowSwap := flag.Bool("allow-swap", false, "allow containers to use swap space in addition to their RAM constraint")
+	checkpointInterval := flag.Duration("checkpoint-interval", 0, "save the content of the output directory to Keep at this interval while the container is running (0 to disable)")
+	containerRuntime := flag.String("runtime", "docker", "container runtime to use: \"docker\" or \"singularity\"")
+	singularityImageDir := flag.String("singularity-image-dir", "/var/tmp/crunch-run-singularity", "`directory` where Docker images converted for Singularity are stored")
+	logStream := flag.String("log-stream", "", "serve live container logs on a unix socket `path` (starting with \"/\"; if it ends with \"/\", the socket is created in that directory and named after the container UUID) or loopback TCP host:port")
 	flag.Parse()
 
 	containerId := flag.Arg(0)
@@ -883,23 +1337,57 @@ func main() {
 	}
 	kc.Retries = 4
 
-	var docker *dockerclient.DockerClient
-	docker, err = dockerclient.NewDockerClient("unix:///var/run/docker.sock", nil)
-	if err != nil {
-		log.Fatalf("%s: %v", containerId, err)
+	expectCgroupParent, setCgroupParent := *cgroupParent, ""
+	if *cgroupParentSubsystem != "" {
+		p := findCgroup(*cgroupParentSubsystem)
+		setCgroupParent = p
+		expectCgroupParent = p
+	}
+
+	var docker ThinDockerClient
+	switch *containerRuntime {
+	case "docker":
+		docker, err = NewDockerClient("/var/run/docker.sock")
+		if err != nil {
+			log.Fatalf("%s: %v", containerId, err)
+		}
+	case "singularity":
+		sc := NewSingularityClient(*singularityImageDir)
+		sc.CgroupRoot = *cgroupRoot
+		sc.CgroupParent = expectCgroupParent
+		docker = sc
+	default:
+		log.Fatalf("%s: unknown runtime %q", containerId, *containerRuntime)
 	}
 
 	cr := NewContainerRunner(api, kc, docker, containerId)
 	cr.statInterval = *statInterval
 	cr.cgroupRoot = *cgroupRoot
-	cr.expectCgroupParent = *cgroupParent
-	if *cgroupParentSubsystem != "" {
-		p := findCgroup(*cgroupParentSubsystem)
-		cr.setCgroupParent = p
-		cr.expectCgroupParent = p
+	cr.expectCgroupParent = expectCgroupParent
+	cr.setCgroupParent = setCgroupParent
+	cr.allowSwap = *allowSwap
+	cr.checkpointInterval = *checkpointInterval
+	if *imageCacheState != "" {
+		cr.ImageCache = &ImageCache{
+			StatePath: *imageCacheState,
+			MaxUnused: *imageCacheUnused,
+		}
+	}
+
+	if *logStream != "" {
+		addr := *logStream
+		if strings.HasSuffix(addr, "/") {
+			addr += containerId + ".sock"
+		}
+		err = cr.LogStream.Listen(addr)
+		if err != nil {
+			log.Fatalf("%s: While starting log stream: %v", containerId, err)
+		}
+		cr.CrunchLog.Printf("Serving live logs on %s", cr.LogStream.Addr())
 	}
 
 	err = cr.Run()
+	cr.LogStream.Close()
 	if err != nil {
 		log.Fatalf("%s: %v", containerId, err)
 	}
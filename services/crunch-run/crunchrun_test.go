@@ -42,6 +42,7 @@ type ArvTestClient struct {
 	arvados.Container
 	Logs          map[string]*bytes.Buffer
 	WasSetRunning bool
+	Repository    arvados.Repository
 	sync.Mutex
 }
 
@@ -62,13 +63,20 @@ var fakeAuthToken = "a3ltuwzqcu2u4sc0q7yhpc2w7s00fdcqecg5d6e0u3pfohmbjt"
 
 type TestDockerClient struct {
 	imageLoaded string
-	logReader   io.ReadCloser
-	logWriter   io.WriteCloser
-	fn          func(t *TestDockerClient)
-	finish      chan dockerclient.WaitResult
-	stop        chan bool
-	cwd         string
-	env         []string
+	// Image used by the container, until the container is
+	// removed
+	containerImage string
+	logReader      io.ReadCloser
+	logWriter      io.WriteCloser
+	fn             func(t *TestDockerClient)
+	finish         chan dockerclient.WaitResult
+	stop           chan bool
+	cwd            string
+	env            []string
+	hostConfig     dockerclient.HostConfig
+	oomKilled      bool
+	stdin          bytes.Buffer
+	stdinClosed    chan bool
 }
 
 func NewTestDockerClient() *TestDockerClient {
@@ -108,6 +116,8 @@ func (t *TestDockerClient) CreateContainer(config *dockerclient.ContainerConfig,
 		t.cwd = config.WorkingDir
 	}
 	t.env = config.Env
+	t.hostConfig = config.HostConfig
+	t.containerImage = config.Image
 	return "abcde", nil
 }
 
@@ -120,6 +130,30 @@ func (t *TestDockerClient) StartContainer(id string, config *dockerclient.HostCo
 	}
 }
 
+func (t *TestDockerClient) InspectContainer(id string) (*dockerclient.ContainerInfo, error) {
+	return &dockerclient.ContainerInfo{State: &dockerclient.State{OOMKilled: t.oomKilled}}, nil
+}
+
+// AttachStdin returns a writer that saves the container's stdin in
+// t.stdin, and closes t.stdinClosed when the writer is closed.
+func (t *TestDockerClient) AttachStdin(id string) (io.WriteCloser, error) {
+	t.stdinClosed = make(chan bool)
+	return &testStdinWriter{t}, nil
+}
+
+type testStdinWriter struct {
+	t *TestDockerClient
+}
+
+func (w *testStdinWriter) Write(p []byte) (int, error) {
+	return w.t.stdin.Write(p)
+}
+
+func (w *testStdinWriter) Close() error {
+	close(w.t.stdinClosed)
+	return nil
+}
+
 func (t *TestDockerClient) AttachContainer(id string, options *dockerclient.AttachOptions) (io.ReadCloser, error) {
 	return t.logReader, nil
 }
@@ -128,10 +162,26 @@ func (t *TestDockerClient) Wait(id string) <-chan dockerclient.WaitResult {
 	return t.finish
 }
 
-func (*TestDockerClient) RemoveImage(name string, force bool) ([]*dockerclient.ImageDelete, error) {
+// RemoveImage fails, as Docker does, if a container (even a stopped
+// one) created from the image still exists.
+func (t *TestDockerClient) RemoveImage(name string, force bool) ([]*dockerclient.ImageDelete, error) {
+	if !force && t.containerImage != "" && t.containerImage == name {
+		return nil, fmt.Errorf("conflict: unable to remove image %s: image is being used by a container", name)
+	}
+	if t.imageLoaded == name {
+		t.imageLoaded = ""
+	}
 	return nil, nil
 }
 
+func (t *TestDockerClient) RemoveContainer(id string, force, volumes bool) error {
+	if id != "abcde" {
+		return errors.New("Invalid container id")
+	}
+	t.containerImage = ""
+	return nil
+}
+
 func (client *ArvTestClient) Create(resourceType string,
 	parameters arvadosclient.Dict,
 	output interface{}) error {
@@ -157,6 +207,7 @@ func (client *ArvTestClient) Create(resourceType string,
 		mt := parameters["collection"].(arvadosclient.Dict)["manifest_text"].(string)
 		outmap := output.(*arvados.Collection)
 		outmap.PortableDataHash = fmt.Sprintf("%x+%d", md5.Sum([]byte(mt)), len(mt))
+		outmap.UUID = fmt.Sprintf("zzzzz-4zz18-%015d", client.Calls)
 	}
 
 	return nil
@@ -186,6 +237,9 @@ func (client *ArvTestClient) Get(resourceType string, uuid string, parameters ar
 	if resourceType == "containers" {
 		(*output.(*arvados.Container)) = client.Container
 	}
+	if resourceType == "repositories" {
+		(*output.(*arvados.Repository)) = client.Repository
+	}
 	return nil
 }
 
@@ -194,6 +248,12 @@ func (client *ArvTestClient) Update(resourceType string, uuid string, parameters
 	defer client.Mutex.Unlock()
 	client.Calls++
 	client.Content = append(client.Content, parameters)
+	if resourceType == "collections" && output != nil {
+		mt := parameters["collection"].(arvadosclient.Dict)["manifest_text"].(string)
+		outmap := output.(*arvados.Collection)
+		outmap.PortableDataHash = fmt.Sprintf("%x+%d", md5.Sum([]byte(mt)), len(mt))
+		outmap.UUID = uuid
+	}
 	if resourceType == "containers" {
 		if parameters["container"].(arvadosclient.Dict)["state"] == "Running" {
 			client.WasSetRunning = true
@@ -244,6 +304,11 @@ func (client *KeepTestClient) ManifestFileReader(m manifest.Manifest, filename s
 		client.Called = true
 		return FileWrapper{rdr, 1321984}, nil
 	}
+	if filename == "md5sum.txt" {
+		rdr := ioutil.NopCloser(strings.NewReader("hello stdin\n"))
+		client.Called = true
+		return FileWrapper{rdr, 12}, nil
+	}
 	return nil, nil
 }
 
@@ -519,6 +584,9 @@ func FullRunHelper(c *C, record string, fn func(t *TestDockerClient)) (api *ArvT
 	api = &ArvTestClient{Container: rec}
 	cr = NewContainerRunner(api, &KeepTestClient{}, docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
 	cr.statInterval = 100 * time.Millisecond
+	cr.NewContainerClient = func(string) (IArvadosClient, IKeepClient, error) {
+		return api, cr.Kc, nil
+	}
 	am := &ArvMountCmdLine{}
 	cr.RunArvMount = am.ArvMountTest
 
@@ -560,6 +628,37 @@ func (s *TestSuite) TestFullRunHello(c *C) {
 
 }
 
+func (s *TestSuite) TestFullRunTimesAndResourceUsage(c *C) {
+	api, cr := FullRunHelper(c, `{
+    "command": ["echo", "hello world"],
+    "container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {}
+}`, func(t *TestDockerClient) {
+		t.logWriter.Write(dockerLog(1, "hello world\n"))
+		t.logWriter.Close()
+		t.finish <- dockerclient.WaitResult{}
+	})
+
+	running := api.CalledWith("container.state", "Running")
+	c.Assert(running, NotNil)
+	startedAt := running["container"].(arvadosclient.Dict)["started_at"].(time.Time)
+	final := api.CalledWith("container.state", "Complete")
+	c.Assert(final, NotNil)
+	finishedAt := final["container"].(arvadosclient.Dict)["finished_at"].(time.Time)
+	c.Check(finishedAt.Before(startedAt), Equals, false)
+	c.Check(final["container"].(arvadosclient.Dict)["resource_usage"], FitsTypeOf, ResourceUsage{})
+
+	logs := api.CalledWith("collection.name", "logs for "+cr.Container.UUID)
+	c.Assert(logs, NotNil)
+	c.Check(logs["collection"].(arvadosclient.Dict)["manifest_text"], Matches, `(?ms).* 0:\d+:resource-usage\.json\n.*`)
+	c.Check(cr.finishedAt.IsZero(), Equals, false)
+}
+
 func (s *TestSuite) TestCrunchstat(c *C) {
 	api, _ := FullRunHelper(c, `{
 		"command": ["sleep", "1"],
@@ -593,6 +692,55 @@ func (s *TestSuite) TestCrunchstat(c *C) {
 	c.Check(api.Logs["crunchstat"].String(), Matches, `(?ms).*cgroup stats files never appeared for abcde\n`)
 }
 
+func (s *TestSuite) TestFullRunResourceLimits(c *C) {
+	var hostConfig dockerclient.HostConfig
+	api, _ := FullRunHelper(c, `{
+		"command": ["true"],
+		"container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+		"cwd": ".",
+		"environment": {},
+		"mounts": {"/tmp": {"kind": "tmp"} },
+		"output_path": "/tmp",
+		"priority": 1,
+		"runtime_constraints": {"ram": 1000000000, "vcpus": 2}
+	}`, func(t *TestDockerClient) {
+		hostConfig = t.hostConfig
+		t.logWriter.Close()
+		t.finish <- dockerclient.WaitResult{}
+	})
+
+	c.Check(hostConfig.Memory, Equals, int64(1000000000))
+	c.Check(hostConfig.MemorySwap, Equals, int64(1000000000))
+	c.Check(hostConfig.CpuShares, Equals, int64(2048))
+	c.Check(hostConfig.CpuQuota, Equals, int64(200000))
+	c.Check(hostConfig.CpuPeriod, Equals, int64(100000))
+	c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+}
+
+func (s *TestSuite) TestFullRunOOMKilled(c *C) {
+	api, _ := FullRunHelper(c, `{
+		"command": ["true"],
+		"container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+		"cwd": ".",
+		"environment": {},
+		"mounts": {"/tmp": {"kind": "tmp"} },
+		"output_path": "/tmp",
+		"priority": 1,
+		"runtime_constraints": {"ram": 1000000}
+	}`, func(t *TestDockerClient) {
+		t.oomKilled = true
+		t.logWriter.Close()
+		t.finish <- dockerclient.WaitResult{ExitCode: 137}
+	})
+
+	c.Check(api.CalledWith("container.exit_code", 137), NotNil)
+	c.Check(api.Logs["crunch-run"].String(), Matches, `(?ms).*Container was killed because it ran out of memory \(limit 1000000 bytes, exit code 137\).*`)
+	c.Check(api.Logs["crunch-run"].String(), Matches, `(?ms).*Complete \(out of memory\).*`)
+	final := api.CalledWith("container.state", "Complete")
+	c.Assert(final, NotNil)
+	c.Check(final["container"].(arvadosclient.Dict)["resource_usage"].(ResourceUsage).OOMKilled, Equals, true)
+}
+
 func (s *TestSuite) TestFullRunStderr(c *C) {
 	api, _ := FullRunHelper(c, `{
     "command": ["/bin/sh", "-c", "echo hello ; echo world 1>&2 ; exit 1"],
@@ -830,6 +978,89 @@ func (s *TestSuite) TestSetupMounts(c *C) {
 		checkEmpty()
 	}
 
+	{
+		i = 0
+		cr.Container.Mounts = map[string]arvados.Mount{
+			"/keepinout": {Kind: "collection", UUID: "zzzzz-4zz18-aaaaaaaaaaaaaaa", Writable: true},
+		}
+		cr.OutputPath = "/keepinout"
+
+		os.MkdirAll(realTemp+"/keep1/by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa/dir", os.ModePerm)
+		ioutil.WriteFile(realTemp+"/keep1/by_id/zzzzz-4zz18-aaaaaaaaaaaaaaa/dir/file.txt", []byte("foo"), 0600)
+		os.MkdirAll(realTemp+"/keep1/tmp0", os.ModePerm)
+
+		err := cr.SetupMounts()
+		c.Check(err, IsNil)
+		c.Check(am.Cmd, DeepEquals, []string{"--foreground", "--allow-other", "--read-write", "--mount-tmp", "tmp0", "--mount-by-id", "by_id", realTemp + "/keep1"})
+		c.Check(cr.Binds, DeepEquals, []string{realTemp + "/keep1/tmp0:/keepinout"})
+		c.Check(cr.WritableCollections, DeepEquals, map[string]string{
+			realTemp + "/keep1/tmp0": "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		})
+		// The container writes to a copy of the collection.
+		data, err := ioutil.ReadFile(realTemp + "/keep1/tmp0/dir/file.txt")
+		c.Check(err, IsNil)
+		c.Check(string(data), Equals, "foo")
+		cr.CleanupDirs()
+		checkEmpty()
+	}
+
+	{
+		i = 0
+		cr.Container.Mounts = map[string]arvados.Mount{
+			"/tmp":          {Kind: "tmp"},
+			"/keep":         {Kind: "keep"},
+			"/in/input.txt": {Kind: "file", PortableDataHash: "59389a8f9ee9d399be35462a0f92541c+53", Path: "/foo/input.txt"},
+		}
+		cr.OutputPath = "/tmp"
+
+		os.MkdirAll(realTemp+"/keep1/by_id/59389a8f9ee9d399be35462a0f92541c+53/foo", os.ModePerm)
+		ioutil.WriteFile(realTemp+"/keep1/by_id/59389a8f9ee9d399be35462a0f92541c+53/foo/input.txt", nil, 0644)
+
+		err := cr.SetupMounts()
+		c.Check(err, IsNil)
+		c.Check(am.Cmd, DeepEquals, []string{"--foreground", "--allow-other", "--read-write", "--mount-by-id", "by_id", realTemp + "/keep1"})
+		sort.StringSlice(cr.Binds).Sort()
+		c.Check(cr.Binds, DeepEquals, []string{realTemp + "/2:/tmp",
+			realTemp + "/keep1/by_id/59389a8f9ee9d399be35462a0f92541c+53/foo/input.txt:/in/input.txt:ro",
+			realTemp + "/keep1/by_id:/keep:ro"})
+		cr.CleanupDirs()
+		checkEmpty()
+	}
+
+	for _, mnt := range []arvados.Mount{
+		{Kind: "file", Path: "/foo.txt"},
+		{Kind: "file", PortableDataHash: "59389a8f9ee9d399be35462a0f92541c+53"},
+		{Kind: "collection", PortableDataHash: "59389a8f9ee9d399be35462a0f92541c+53", Path: "../../etc"},
+		{Kind: "keep", Writable: true},
+		{Kind: "text", Content: 123},
+	} {
+		i = 0
+		cr.Container.Mounts = map[string]arvados.Mount{
+			"/tmp": {Kind: "tmp"},
+			"/mnt": mnt,
+		}
+		cr.OutputPath = "/tmp"
+		err := cr.SetupMounts()
+		c.Check(err, NotNil, Commentf("%+v", mnt))
+		cr.CleanupDirs()
+		checkEmpty()
+	}
+
+	{
+		i = 0
+		cr.Container.Mounts = map[string]arvados.Mount{
+			"/mnt/test.txt": {Kind: "text", Content: "foo\nbar\n"},
+		}
+		err := cr.SetupMounts()
+		c.Check(err, IsNil)
+		c.Check(cr.Binds, DeepEquals, []string{realTemp + "/2/mountdata.txt:/mnt/test.txt:ro"})
+		content, err := ioutil.ReadFile(realTemp + "/2/mountdata.txt")
+		c.Check(err, IsNil)
+		c.Check(string(content), Equals, "foo\nbar\n")
+		cr.CleanupDirs()
+		checkEmpty()
+	}
+
 	for _, test := range []struct {
 		in  interface{}
 		out string
@@ -877,6 +1108,103 @@ func (s *TestSuite) TestStdout(c *C) {
 	c.Check(api.CalledWith("collection.manifest_text", "./a/b 307372fa8fd5c146b22ae7a45b49bc31+6 0:6:c.out\n"), NotNil)
 }
 
+func (s *TestSuite) TestStdinCollectionMount(c *C) {
+	api, _ := FullRunHelper(c, `{
+		"command": ["cat"],
+		"container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+		"cwd": ".",
+		"environment": {},
+		"mounts": {"/tmp": {"kind": "tmp"}, "stdin": {"kind": "collection", "portable_data_hash": "`+otherPDH+`", "path": "/md5sum.txt"} },
+		"output_path": "/tmp",
+		"priority": 1,
+		"runtime_constraints": {}
+	}`, func(t *TestDockerClient) {
+		<-t.stdinClosed
+		t.logWriter.Write(dockerLog(1, t.stdin.String()))
+		t.logWriter.Close()
+		t.finish <- dockerclient.WaitResult{ExitCode: 0}
+	})
+
+	c.Check(api.CalledWith("container.exit_code", 0), NotNil)
+	c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+	c.Check(strings.HasSuffix(api.Logs["stdout"].String(), "hello stdin\n"), Equals, true)
+}
+
+func (s *TestSuite) TestStdinContainerToken(c *C) {
+	kc := &KeepTestClient{}
+	docker := NewTestDockerClient()
+	cr := NewContainerRunner(&ArvTestClient{}, kc, docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	containerKc := &KeepTestClient{}
+	var token string
+	cr.NewContainerClient = func(tok string) (IArvadosClient, IKeepClient, error) {
+		token = tok
+		return &ArvTestClient{}, containerKc, nil
+	}
+
+	err := cr.attachStdin(arvados.Mount{Kind: "collection", PortableDataHash: otherPDH, Path: "/md5sum.txt"})
+	c.Assert(err, IsNil)
+	<-docker.stdinClosed
+	c.Check(docker.stdin.String(), Equals, "hello stdin\n")
+
+	// The collection is read with the container's token, not
+	// the dispatcher's.
+	c.Check(token, Equals, fakeAuthToken)
+	c.Check(containerKc.Called, Equals, true)
+	c.Check(kc.Called, Equals, false)
+}
+
+func (s *TestSuite) TestStdinJSONMount(c *C) {
+	api, _ := FullRunHelper(c, `{
+		"command": ["cat"],
+		"container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+		"cwd": ".",
+		"environment": {},
+		"mounts": {"/tmp": {"kind": "tmp"}, "stdin": {"kind": "json", "content": {"foo": "bar"}} },
+		"output_path": "/tmp",
+		"priority": 1,
+		"runtime_constraints": {}
+	}`, func(t *TestDockerClient) {
+		<-t.stdinClosed
+		t.logWriter.Write(dockerLog(1, t.stdin.String()+"\n"))
+		t.logWriter.Close()
+		t.finish <- dockerclient.WaitResult{ExitCode: 0}
+	})
+
+	c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+	c.Check(strings.HasSuffix(api.Logs["stdout"].String(), `{"foo":"bar"}`+"\n"), Equals, true)
+}
+
+func (s *TestSuite) TestStderrMount(c *C) {
+	api, _ := FullRunHelper(c, `{
+		"command": ["/bin/sh", "-c", "echo hello; echo world >&2"],
+		"container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+		"cwd": ".",
+		"environment": {},
+		"mounts": {"/tmp": {"kind": "tmp"},
+			"stdout": {"kind": "file", "path": "/tmp/a/out.txt"},
+			"stderr": {"kind": "file", "path": "/tmp/b/err.txt"}},
+		"output_path": "/tmp",
+		"priority": 1,
+		"runtime_constraints": {}
+	}`, func(t *TestDockerClient) {
+		t.logWriter.Write(dockerLog(1, "hello\n"))
+		t.logWriter.Write(dockerLog(2, "world\n"))
+		t.logWriter.Close()
+		t.finish <- dockerclient.WaitResult{ExitCode: 0}
+	})
+
+	c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+	c.Check(api.Logs["stderr"], IsNil)
+	for _, v := range api.Content {
+		if collection, ok := v["collection"].(arvadosclient.Dict); ok {
+			if mt, ok := collection["manifest_text"].(string); ok && strings.Contains(mt, "out.txt") {
+				c.Check(mt, Matches, `(?ms).*\./a [0-9a-f]+\+6 0:6:out\.txt\n.*`)
+				c.Check(mt, Matches, `(?ms).*\./b [0-9a-f]+\+6 0:6:err\.txt\n.*`)
+			}
+		}
+	}
+}
+
 // Used by the TestStdoutWithWrongPath*()
 func StdoutErrorRunHelper(c *C, record string, fn func(t *TestDockerClient)) (api *ArvTestClient, cr *ContainerRunner, err error) {
 	rec := arvados.Container{}
@@ -916,6 +1244,26 @@ func (s *TestSuite) TestStdoutWithWrongKindTmp(c *C) {
 	c.Check(strings.Contains(err.Error(), "Unsupported mount kind 'tmp' for stdout"), Equals, true)
 }
 
+func (s *TestSuite) TestStderrWithWrongPath(c *C) {
+	_, _, err := StdoutErrorRunHelper(c, `{
+    "mounts": {"/tmp": {"kind": "tmp"}, "stderr": {"kind": "file", "path":"/tmpa.err"} },
+    "output_path": "/tmp"
+}`, func(t *TestDockerClient) {})
+
+	c.Check(err, NotNil)
+	c.Check(strings.Contains(err.Error(), "Stderr path does not start with OutputPath"), Equals, true)
+}
+
+func (s *TestSuite) TestStdinWithWrongKind(c *C) {
+	_, _, err := StdoutErrorRunHelper(c, `{
+    "mounts": {"/tmp": {"kind": "tmp"}, "stdin": {"kind": "tmp"} },
+    "output_path": "/tmp"
+}`, func(t *TestDockerClient) {})
+
+	c.Check(err, NotNil)
+	c.Check(strings.Contains(err.Error(), "Unsupported mount kind 'tmp' for stdin"), Equals, true)
+}
+
 func (s *TestSuite) TestStdoutWithWrongKindCollection(c *C) {
 	_, _, err := StdoutErrorRunHelper(c, `{
     "mounts": {"/tmp": {"kind": "tmp"}, "stdout": {"kind": "collection", "path":"/tmp/a.out"} },
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/curoverse/dockerclient"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// DockerClient is a ThinDockerClient that talks to a Docker daemon. It
+// adds the ability to write to a container's standard input, which
+// dockerclient.DockerClient does not support.
+type DockerClient struct {
+	*dockerclient.DockerClient
+	socketPath string
+}
+
+// NewDockerClient returns a DockerClient that connects to the Docker
+// daemon's unix socket at socketPath.
+func NewDockerClient(socketPath string) (*DockerClient, error) {
+	dc, err := dockerclient.NewDockerClient("unix://"+socketPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &DockerClient{DockerClient: dc, socketPath: socketPath}, nil
+}
+
+// AttachStdin attaches to the standard input of the given container,
+// which must have been created with OpenStdin and StdinOnce. Closing
+// the returned writer closes the container's standard input.
+func (dc *DockerClient) AttachStdin(id string) (io.WriteCloser, error) {
+	conn, err := net.Dial("unix", dc.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", "http://docker/containers/"+url.QueryEscape(id)+"/attach?stream=1&stdin=1", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	req.Header.Set("Content-Type", "text/plain")
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Docker API versions before 1.24 respond "200 OK" instead of
+	// "101 Switching Protocols", but hijack the connection either
+	// way.
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("attach stdin: %s", resp.Status)
+	}
+	return conn, nil
+}
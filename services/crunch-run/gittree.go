@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var commitRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// gitAskPass is a GIT_ASKPASS program that answers git's username and
+// password prompts with the API token from the environment, which is
+// what arv-git-httpd expects.
+const gitAskPass = "#!/bin/sh\necho \"$ARVADOS_API_TOKEN\"\n"
+
+// gitTree checks out the commit specified by a "git_tree" mount into
+// a new temporary directory, and returns the host path to bind into
+// the container. The .git directory is not included.
+func (runner *ContainerRunner) gitTree(mnt arvados.Mount) (string, error) {
+	if !commitRe.MatchString(mnt.Commit) {
+		return "", fmt.Errorf("'commit' must be a 40-character hexadecimal commit hash, not %q", mnt.Commit)
+	}
+	if mnt.UUID == "" {
+		return "", fmt.Errorf("must specify the repository 'uuid'")
+	}
+
+	var repo arvados.Repository
+	err := runner.ArvClient.Get("repositories", mnt.UUID, nil, &repo)
+	if err != nil {
+		return "", fmt.Errorf("While getting repository record: %v", err)
+	}
+	// Use the first URL we can fetch from with an API token,
+	// i.e., not an ssh URL.
+	var url string
+	for _, u := range repo.CloneURLs {
+		if strings.Contains(u, "://") && !strings.HasPrefix(u, "ssh://") {
+			url = u
+			break
+		}
+	}
+	if url == "" {
+		return "", fmt.Errorf("repository %s has no http(s) clone URL", mnt.UUID)
+	}
+
+	token, err := runner.ContainerToken()
+	if err != nil {
+		return "", fmt.Errorf("could not get container token: %s", err)
+	}
+
+	tmpdir, err := runner.MkTempDir("", "git")
+	if err != nil {
+		return "", fmt.Errorf("creating temp dir: %v", err)
+	}
+	runner.CleanupTempDir = append(runner.CleanupTempDir, tmpdir)
+	askpass := filepath.Join(tmpdir, "askpass")
+	err = ioutil.WriteFile(askpass, []byte(gitAskPass), 0700)
+	if err != nil {
+		return "", fmt.Errorf("writing askpass script: %v", err)
+	}
+	checkout := filepath.Join(tmpdir, "tree")
+
+	env := append(os.Environ(), "GIT_ASKPASS="+askpass, "ARVADOS_API_TOKEN="+token, "GIT_TERMINAL_PROMPT=0")
+	for _, args := range [][]string{
+		{"clone", "--quiet", "--no-checkout", url, checkout},
+		{"-C", checkout, "checkout", "--quiet", mnt.Commit},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+	err = os.RemoveAll(filepath.Join(checkout, ".git"))
+	if err != nil {
+		return "", err
+	}
+	// Make the tree readable by any user in the container.
+	err = os.Chmod(tmpdir, 0755)
+	if err != nil {
+		return "", err
+	}
+	runner.CrunchLog.Printf("Checked out commit %s from repository %s", mnt.Commit, mnt.UUID)
+
+	src := checkout
+	if mnt.Path != "" {
+		src, err = subPath(checkout, mnt.Path)
+		if err != nil {
+			return "", err
+		}
+	}
+	// The tree can contain symlinks to anywhere on the host, so
+	// bind the path they resolve to, and only if it is still in
+	// the checkout.
+	src, err = resolveInside(checkout, src)
+	if err != nil {
+		return "", err
+	}
+	return src, nil
+}
+
+// resolveInside returns path with all symlinks resolved, or an error
+// if the result is outside root.
+func resolveInside(root, path string) (string, error) {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+"/") {
+		return "", fmt.Errorf("invalid path %q: resolves to %q, outside %q", path, resolved, root)
+	}
+	return resolved, nil
+}
+
+// subPath returns the given path inside root, or an error if the path
+// refers to something outside root.
+func subPath(root, path string) (string, error) {
+	for _, elt := range strings.Split(path, "/") {
+		if elt == ".." {
+			return "", fmt.Errorf("invalid path %q: must not contain '..'", path)
+		}
+	}
+	return filepath.Join(root, path), nil
+}
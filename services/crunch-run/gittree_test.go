@@ -0,0 +1,115 @@
+package main
+
+import (
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type GitTreeSuite struct {
+	tmpdir string
+	repo   string
+	commit string
+}
+
+var _ = Suite(&GitTreeSuite{})
+
+func (s *GitTreeSuite) SetUpTest(c *C) {
+	var err error
+	s.tmpdir, err = ioutil.TempDir("", "crunch-run-gittree")
+	c.Assert(err, IsNil)
+
+	// Make a repository with two commits.
+	s.repo = filepath.Join(s.tmpdir, "repo")
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", s.repo}, args...)...)
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		c.Assert(err, IsNil, Commentf("%s", out))
+		return strings.TrimSpace(string(out))
+	}
+	c.Assert(os.MkdirAll(filepath.Join(s.repo, "subdir"), 0755), IsNil)
+	git("init", "--quiet")
+	ioutil.WriteFile(filepath.Join(s.repo, "subdir", "script.sh"), []byte("v1"), 0644)
+	os.Symlink("subdir", filepath.Join(s.repo, "link"))
+	os.Symlink("/etc", filepath.Join(s.repo, "escape"))
+	os.Symlink("/etc/passwd", filepath.Join(s.repo, "escape-file"))
+	os.Symlink("../..", filepath.Join(s.repo, "subdir", "up"))
+	git("add", ".")
+	git("commit", "--quiet", "-m", "first")
+	s.commit = git("rev-parse", "HEAD")
+	ioutil.WriteFile(filepath.Join(s.repo, "subdir", "script.sh"), []byte("v2"), 0644)
+	git("commit", "--quiet", "-a", "-m", "second")
+}
+
+func (s *GitTreeSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.tmpdir)
+}
+
+func (s *GitTreeSuite) runner(c *C) *ContainerRunner {
+	api := &ArvTestClient{Repository: arvados.Repository{
+		UUID:      "zzzzz-s0uqq-382brsig8rp3666",
+		CloneURLs: []string{"git@example.com:foo.git", "file://" + s.repo},
+	}}
+	cr := NewContainerRunner(api, &KeepTestClient{}, nil, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	cr.MkTempDir = func(_, prefix string) (string, error) {
+		return ioutil.TempDir(s.tmpdir, prefix)
+	}
+	return cr
+}
+
+func (s *GitTreeSuite) TestCheckout(c *C) {
+	cr := s.runner(c)
+	src, err := cr.gitTree(arvados.Mount{Kind: "git_tree", UUID: "zzzzz-s0uqq-382brsig8rp3666", Commit: s.commit})
+	c.Assert(err, IsNil)
+	buf, err := ioutil.ReadFile(filepath.Join(src, "subdir", "script.sh"))
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "v1")
+	_, err = os.Stat(filepath.Join(src, ".git"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	c.Check(cr.CleanupTempDir, HasLen, 1)
+}
+
+func (s *GitTreeSuite) TestCheckoutPath(c *C) {
+	cr := s.runner(c)
+	src, err := cr.gitTree(arvados.Mount{Kind: "git_tree", UUID: "zzzzz-s0uqq-382brsig8rp3666", Commit: s.commit, Path: "/subdir"})
+	c.Assert(err, IsNil)
+	buf, err := ioutil.ReadFile(filepath.Join(src, "script.sh"))
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "v1")
+}
+
+func (s *GitTreeSuite) TestSymlinks(c *C) {
+	cr := s.runner(c)
+	src, err := cr.gitTree(arvados.Mount{Kind: "git_tree", UUID: "zzzzz-s0uqq-382brsig8rp3666", Commit: s.commit, Path: "/link"})
+	c.Assert(err, IsNil)
+	c.Check(filepath.Base(src), Equals, "subdir")
+	buf, err := ioutil.ReadFile(filepath.Join(src, "script.sh"))
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "v1")
+
+	for _, path := range []string{"/escape", "/escape/passwd", "/escape-file", "/subdir/up", "/subdir/up/askpass"} {
+		_, err := cr.gitTree(arvados.Mount{Kind: "git_tree", UUID: "zzzzz-s0uqq-382brsig8rp3666", Commit: s.commit, Path: path})
+		c.Check(err, ErrorMatches, `invalid path .*outside.*`, Commentf("%s", path))
+	}
+}
+
+func (s *GitTreeSuite) TestBadMounts(c *C) {
+	cr := s.runner(c)
+	for _, mnt := range []arvados.Mount{
+		{Kind: "git_tree", UUID: "zzzzz-s0uqq-382brsig8rp3666", Commit: "master"},
+		{Kind: "git_tree", Commit: s.commit},
+		{Kind: "git_tree", UUID: "zzzzz-s0uqq-382brsig8rp3666", Commit: s.commit, Path: "../.."},
+		{Kind: "git_tree", UUID: "zzzzz-s0uqq-382brsig8rp3666", Commit: s.commit, Path: "/nonexistent"},
+		{Kind: "git_tree", UUID: "zzzzz-s0uqq-382brsig8rp3666", Commit: strings.Repeat("0", 40)},
+	} {
+		_, err := cr.gitTree(mnt)
+		c.Check(err, NotNil, Commentf("%+v", mnt))
+	}
+}
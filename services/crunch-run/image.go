@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ImageCache records which Docker images were loaded from which
+// container image collections, so that concurrent and subsequent
+// crunch-run processes on the same node can share them. Each entry
+// lists the PIDs of the crunch-run processes currently using the
+// image; images that are no longer in use are removed from Docker in
+// least-recently-used order once there are more than MaxUnused of
+// them. PIDs of processes that have exited without releasing the
+// image (e.g., because they were killed) are dropped.
+//
+// The cache state lives in a JSON file, locked with flock(2) while it
+// is being read and updated.
+type ImageCache struct {
+	// Path of the JSON state file.
+	StatePath string
+
+	// Number of unused images to keep in Docker. Zero means
+	// unused images are removed as soon as they are released.
+	MaxUnused int
+
+	// PID recorded by Acquire. Zero means os.Getpid().
+	pid int
+
+	mtx sync.Mutex
+}
+
+// ImageCacheEntry is the state of a single cached image.
+type ImageCacheEntry struct {
+	ImageID  string
+	PIDs     []int
+	LastUsed time.Time
+}
+
+// imageCacheState is the content of the state file, keyed by the
+// portable data hash of the image collection. If a collection is
+// later loaded as a different image, the entry for the previous image
+// is kept under "{pdh}/{imageID}" so its users are still tracked and
+// the image is still removed once it is unused.
+type imageCacheState map[string]*ImageCacheEntry
+
+// Acquire records that the image with the given ID (from the
+// collection with the given PDH) is in use by the caller. Callers
+// should acquire the image before checking whether it is loaded, so
+// it can't be removed by another process in the meantime.
+func (ic *ImageCache) Acquire(pdh, imageID string) error {
+	return ic.update(func(st imageCacheState) error {
+		ent, ok := st[pdh]
+		if ok && ent.ImageID != imageID {
+			st.merge(pdh+"/"+ent.ImageID, ent)
+			ok = false
+		}
+		if !ok {
+			ent, ok = st[pdh+"/"+imageID]
+			if ok {
+				delete(st, pdh+"/"+imageID)
+			} else {
+				ent = &ImageCacheEntry{ImageID: imageID}
+			}
+			st[pdh] = ent
+		}
+		ent.PIDs = append(ent.PIDs, ic.getpid())
+		ent.LastUsed = time.Now().UTC()
+		return nil
+	})
+}
+
+// Release undoes a previous Acquire, then removes unused images in
+// excess of MaxUnused by calling remove with their image IDs. Entries
+// whose removal fails are kept so another attempt can be made later.
+func (ic *ImageCache) Release(pdh string, remove func(imageID string) error) error {
+	return ic.update(func(st imageCacheState) error {
+		released := st.release(pdh, ic.getpid())
+		for k := range st {
+			if released {
+				break
+			}
+			if strings.HasPrefix(k, pdh+"/") {
+				released = st.release(k, ic.getpid())
+			}
+		}
+		var unused byLastUsed
+		for k, ent := range st {
+			if len(ent.PIDs) == 0 {
+				unused.pdhs = append(unused.pdhs, k)
+			}
+		}
+		if len(unused.pdhs) <= ic.MaxUnused {
+			return nil
+		}
+		unused.st = st
+		sort.Sort(unused)
+		var firstErr error
+		for _, k := range unused.pdhs[:len(unused.pdhs)-ic.MaxUnused] {
+			err := remove(st[k].ImageID)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("While removing image %s: %v", st[k].ImageID, err)
+				}
+				continue
+			}
+			delete(st, k)
+		}
+		return firstErr
+	})
+}
+
+// merge adds ent to the entry at key k, combining their PIDs if k is
+// already in use.
+func (st imageCacheState) merge(k string, ent *ImageCacheEntry) {
+	if prev, ok := st[k]; ok {
+		ent.PIDs = append(prev.PIDs, ent.PIDs...)
+		if prev.LastUsed.After(ent.LastUsed) {
+			ent.LastUsed = prev.LastUsed
+		}
+	}
+	st[k] = ent
+}
+
+// release removes one instance of pid from the entry at key k, and
+// returns false if there is none.
+func (st imageCacheState) release(k string, pid int) bool {
+	ent, ok := st[k]
+	if !ok {
+		return false
+	}
+	for i, p := range ent.PIDs {
+		if p == pid {
+			ent.PIDs = append(ent.PIDs[:i], ent.PIDs[i+1:]...)
+			ent.LastUsed = time.Now().UTC()
+			return true
+		}
+	}
+	return false
+}
+
+// byLastUsed sorts a list of cache keys, least recently used first.
+type byLastUsed struct {
+	pdhs []string
+	st   imageCacheState
+}
+
+func (s byLastUsed) Len() int      { return len(s.pdhs) }
+func (s byLastUsed) Swap(i, j int) { s.pdhs[i], s.pdhs[j] = s.pdhs[j], s.pdhs[i] }
+func (s byLastUsed) Less(i, j int) bool {
+	return s.st[s.pdhs[i]].LastUsed.Before(s.st[s.pdhs[j]].LastUsed)
+}
+
+// update loads the state file under an exclusive lock, calls fn, and
+// writes the (possibly modified) state back. The state is written
+// even if fn returns an error.
+func (ic *ImageCache) update(fn func(imageCacheState) error) error {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+
+	f, err := os.OpenFile(ic.StatePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("While opening image cache state: %v", err)
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("While locking image cache state: %v", err)
+	}
+
+	st := imageCacheState{}
+	err = json.NewDecoder(f).Decode(&st)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("While reading image cache state: %v", err)
+	}
+	for _, ent := range st {
+		alive := ent.PIDs[:0]
+		for _, pid := range ent.PIDs {
+			if processExists(pid) {
+				alive = append(alive, pid)
+			}
+		}
+		ent.PIDs = alive
+	}
+
+	fnErr := fn(st)
+
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt(buf, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("While writing image cache state: %v", err)
+	}
+	return fnErr
+}
+
+func (ic *ImageCache) getpid() int {
+	if ic.pid != 0 {
+		return ic.pid
+	}
+	return os.Getpid()
+}
+
+// processExists returns true if a process with the given PID exists.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// progressReader passes reads through to an underlying reader and
+// periodically reports how much of the expected total has been read.
+type progressReader struct {
+	io.Reader
+	Total    uint64
+	Interval time.Duration
+	Report   func(done, total uint64)
+
+	done     uint64
+	lastTime time.Time
+}
+
+func (pr *progressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.Reader.Read(p)
+	pr.done += uint64(n)
+	if now := time.Now(); err == io.EOF || now.Sub(pr.lastTime) >= pr.Interval {
+		pr.lastTime = now
+		pr.Report(pr.done, pr.Total)
+	}
+	return
+}
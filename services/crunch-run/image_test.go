@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+	"github.com/curoverse/dockerclient"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+type ImageCacheSuite struct {
+	tmpdir string
+}
+
+var _ = Suite(&ImageCacheSuite{})
+
+func (s *ImageCacheSuite) SetUpTest(c *C) {
+	var err error
+	s.tmpdir, err = ioutil.TempDir("", "crunch-run-image")
+	c.Assert(err, IsNil)
+}
+
+func (s *ImageCacheSuite) TearDownTest(c *C) {
+	os.RemoveAll(s.tmpdir)
+}
+
+func (s *ImageCacheSuite) TestRefCountAndLRU(c *C) {
+	statePath := filepath.Join(s.tmpdir, "images.json")
+	ic := &ImageCache{StatePath: statePath, MaxUnused: 1}
+	var removed []string
+	remove := func(id string) error {
+		removed = append(removed, id)
+		return nil
+	}
+
+	c.Check(ic.Acquire("pdh-a", "image-a"), IsNil)
+	c.Check(ic.Acquire("pdh-a", "image-a"), IsNil)
+	c.Check(ic.Acquire("pdh-b", "image-b"), IsNil)
+
+	// image-a is still used by one runner
+	c.Check(ic.Release("pdh-a", remove), IsNil)
+	c.Check(removed, HasLen, 0)
+
+	time.Sleep(time.Millisecond)
+	c.Check(ic.Release("pdh-b", remove), IsNil)
+	c.Check(removed, HasLen, 0)
+
+	// Now two images are unused, and the least recently used
+	// one (image-b) gets removed.
+	time.Sleep(time.Millisecond)
+	c.Check(ic.Release("pdh-a", remove), IsNil)
+	c.Check(removed, DeepEquals, []string{"image-b"})
+
+	// A separate ImageCache using the same state file sees
+	// the same entries.
+	ic2 := &ImageCache{StatePath: statePath, MaxUnused: 0}
+	c.Check(ic2.Release("pdh-b", remove), IsNil)
+	c.Check(removed, DeepEquals, []string{"image-b", "image-a"})
+}
+
+func (s *ImageCacheSuite) TestRemoveError(c *C) {
+	ic := &ImageCache{StatePath: filepath.Join(s.tmpdir, "images.json")}
+	c.Check(ic.Acquire("pdh-a", "image-a"), IsNil)
+	err := ic.Release("pdh-a", func(string) error { return errors.New("busy") })
+	c.Check(err, ErrorMatches, `While removing image image-a: busy`)
+
+	// The entry is kept so removal is retried next time.
+	var removed []string
+	err = ic.Release("pdh-x", func(id string) error {
+		removed = append(removed, id)
+		return nil
+	})
+	c.Check(err, IsNil)
+	c.Check(removed, DeepEquals, []string{"image-a"})
+}
+
+func (s *ImageCacheSuite) TestLoadAndReleaseImage(c *C) {
+	docker := NewTestDockerClient()
+	cr := NewContainerRunner(&ArvTestClient{}, &KeepTestClient{}, docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	cr.ImageCache = &ImageCache{StatePath: filepath.Join(s.tmpdir, "images.json")}
+	cr.Container.ContainerImage = hwPDH
+
+	c.Check(cr.LoadImage(), IsNil)
+	c.Check(docker.imageLoaded, Equals, hwImageId)
+
+	cr.ReleaseImage()
+	c.Check(docker.imageLoaded, Equals, "")
+
+	// Releasing twice has no effect.
+	cr.ReleaseImage()
+}
+
+func (s *ImageCacheSuite) TestDeadProcess(c *C) {
+	cmd := exec.Command("true")
+	c.Assert(cmd.Run(), IsNil)
+	deadPID := cmd.Process.Pid
+
+	statePath := filepath.Join(s.tmpdir, "images.json")
+	dead := &ImageCache{StatePath: statePath, pid: deadPID}
+	c.Check(dead.Acquire("pdh-a", "image-a"), IsNil)
+
+	// The image is still in use by this process.
+	ic := &ImageCache{StatePath: statePath}
+	c.Check(ic.Acquire("pdh-b", "image-b"), IsNil)
+
+	// The process that acquired image-a never released it, but
+	// it's gone, so image-a is unused.
+	var removed []string
+	c.Check(ic.Release("pdh-x", func(id string) error {
+		removed = append(removed, id)
+		return nil
+	}), IsNil)
+	c.Check(removed, DeepEquals, []string{"image-a"})
+}
+
+func (s *ImageCacheSuite) TestImageIDChanged(c *C) {
+	cmd := exec.Command("sleep", "60")
+	c.Assert(cmd.Start(), IsNil)
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	statePath := filepath.Join(s.tmpdir, "images.json")
+	other := &ImageCache{StatePath: statePath, pid: cmd.Process.Pid}
+	c.Check(other.Acquire("pdh-a", "image-old"), IsNil)
+
+	// The same collection is now loaded as a different image.
+	ic := &ImageCache{StatePath: statePath}
+	c.Check(ic.Acquire("pdh-a", "image-new"), IsNil)
+
+	// The old image is still in use by the other process.
+	var removed []string
+	remove := func(id string) error {
+		removed = append(removed, id)
+		return nil
+	}
+	c.Check(ic.Release("pdh-a", remove), IsNil)
+	c.Check(removed, DeepEquals, []string{"image-new"})
+
+	// Once the other process releases it, the old image is
+	// removed too.
+	c.Check(other.Release("pdh-a", remove), IsNil)
+	c.Check(removed, DeepEquals, []string{"image-new", "image-old"})
+}
+
+func (s *ImageCacheSuite) TestFullRunRemovesImage(c *C) {
+	rec := arvados.Container{}
+	err := json.Unmarshal([]byte(`{
+    "command": ["echo", "hello world"],
+    "container_image": "d4ab34d3d4f8a72f5c4973051ae69fab+122",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {}
+}`), &rec)
+	c.Assert(err, IsNil)
+
+	docker := NewTestDockerClient()
+	docker.fn = func(t *TestDockerClient) {
+		t.logWriter.Write(dockerLog(1, "hello world\n"))
+		t.logWriter.Close()
+		t.finish <- dockerclient.WaitResult{}
+	}
+	docker.RemoveImage(hwImageId, true)
+
+	api := &ArvTestClient{Container: rec}
+	cr := NewContainerRunner(api, &KeepTestClient{}, docker, "zzzzz-zzzzz-zzzzzzzzzzzzzzz")
+	cr.RunArvMount = (&ArvMountCmdLine{}).ArvMountTest
+	cr.ImageCache = &ImageCache{StatePath: filepath.Join(s.tmpdir, "images.json")}
+
+	c.Check(cr.Run(), IsNil)
+	c.Check(api.CalledWith("container.state", "Complete"), NotNil)
+	c.Check(docker.containerImage, Equals, "")
+	c.Check(docker.imageLoaded, Equals, "")
+	c.Check(api.Logs["crunch-run"].String(), Matches, `(?ms).*Removing unused Docker image.*`)
+	c.Check(api.Logs["crunch-run"].String(), Not(Matches), `(?ms).*While cleaning up image cache.*`)
+}
+
+func (s *ImageCacheSuite) TestProgressReader(c *C) {
+	var reports [][2]uint64
+	pr := &progressReader{
+		Reader:   bytes.NewReader(make([]byte, 3000)),
+		Total:    3000,
+		Interval: time.Hour,
+		Report: func(done, total uint64) {
+			reports = append(reports, [2]uint64{done, total})
+		},
+	}
+	buf := make([]byte, 1000)
+	var err error
+	for err == nil {
+		_, err = pr.Read(buf)
+	}
+	c.Check(err, Equals, io.EOF)
+	// One report on the first read, one at EOF.
+	c.Check(reports, DeepEquals, [][2]uint64{{1000, 3000}, {3000, 3000}})
+}
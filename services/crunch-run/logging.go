@@ -21,6 +21,9 @@ type Timestamper func(t time.Time) string
 // ThrottledLogger.buf -> ThrottledLogger.flusher ->
 // ArvLogWriter.Write -> CollectionFileWriter.Write | Api.Create
 //
+// When the log is also being served live, LogStream.Tee sits between
+// ArvLogWriter and CollectionFileWriter.
+//
 // For stdout/stderr ReadWriteLines additionally runs as a goroutine to pull
 // data from the stdout/stderr Reader and send to the Logger.
 
@@ -32,7 +35,7 @@ type ThrottledLogger struct {
 	buf *bytes.Buffer
 	sync.Mutex
 	writer      io.WriteCloser
-	stop        bool
+	stop        chan struct{}
 	flusherDone chan bool
 	Timestamper
 	Immediate *log.Logger
@@ -75,15 +78,50 @@ func (tl *ThrottledLogger) Write(p []byte) (n int, err error) {
 	return
 }
 
+// Bounds for the ThrottledLogger flush interval. A quiet log is
+// flushed every MinLogFlushInterval, so new lines show up promptly in
+// live log streams. While a log is busy, the interval grows (up to
+// MaxLogFlushInterval) so its output is sent in fewer, larger batches.
+var (
+	MinLogFlushInterval = 500 * time.Millisecond
+	MaxLogFlushInterval = 5 * time.Second
+)
+
+// LogFlushBatchBytes is the flush size at which the flush interval
+// grows.
+const LogFlushBatchBytes = 1 << 16
+
+// nextFlushInterval returns the interval to wait before the next
+// flush, given the current interval and the number of bytes flushed.
+func nextFlushInterval(interval time.Duration, flushed int) time.Duration {
+	if flushed >= LogFlushBatchBytes {
+		interval *= 2
+	} else if flushed < LogFlushBatchBytes/16 {
+		interval /= 2
+	}
+	if interval > MaxLogFlushInterval {
+		interval = MaxLogFlushInterval
+	}
+	if interval < MinLogFlushInterval {
+		interval = MinLogFlushInterval
+	}
+	return interval
+}
+
 // Periodically check the current buffer; if not empty, send it on the
-// channel to the goWriter goroutine.
+// channel to the goWriter goroutine. When tl.stop is closed, flush
+// right away and return.
 func (tl *ThrottledLogger) flusher() {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		// We use a separate "stopping" var here to ensure we flush
-		// tl.buf after tl.stop becomes true.
-		stopping := tl.stop
+	interval := MinLogFlushInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		stopping := false
+		select {
+		case <-timer.C:
+		case <-tl.stop:
+			stopping = true
+		}
 
 		var ready *bytes.Buffer
 
@@ -91,13 +129,16 @@ func (tl *ThrottledLogger) flusher() {
 		ready, tl.buf = tl.buf, nil
 		tl.Mutex.Unlock()
 
+		flushed := 0
 		if ready != nil && ready.Len() > 0 {
+			flushed = ready.Len()
 			tl.writer.Write(ready.Bytes())
 		}
-
 		if stopping {
 			break
 		}
+		interval = nextFlushInterval(interval, flushed)
+		timer.Reset(interval)
 	}
 	close(tl.flusherDone)
 }
@@ -105,7 +146,7 @@ func (tl *ThrottledLogger) flusher() {
 // Close the flusher goroutine and wait for it to complete, then close the
 // underlying Writer.
 func (tl *ThrottledLogger) Close() error {
-	tl.stop = true
+	close(tl.stop)
 	<-tl.flusherDone
 	return tl.writer.Close()
 }
@@ -151,9 +192,10 @@ func ReadWriteLines(in io.Reader, writer io.Writer, done chan<- bool) {
 // NewThrottledLogger creates a new thottled logger that
 // (a) prepends timestamps to each line
 // (b) batches log messages and only calls the underlying Writer at most once
-// per second.
+// per flush interval (see MinLogFlushInterval).
 func NewThrottledLogger(writer io.WriteCloser) *ThrottledLogger {
 	tl := &ThrottledLogger{}
+	tl.stop = make(chan struct{})
 	tl.flusherDone = make(chan bool)
 	tl.writer = writer
 	tl.Logger = log.New(tl, "", 0)
@@ -162,6 +204,23 @@ func NewThrottledLogger(writer io.WriteCloser) *ThrottledLogger {
 	return tl
 }
 
+// Limits on the log data each ArvLogWriter sends to the API server.
+// Once LogAPIBytesPerPeriod bytes have been sent in a LogAPIPeriod,
+// further output is only written to the log collection until the
+// period ends.
+//
+// When the API server fails to create a log entry, or takes longer
+// than LogAPISlowCall to do so, the writer also stops sending to the
+// API server for a while. The pause starts at LogAPIMinBackoff and
+// doubles after each further failed or slow call, up to LogAPIPeriod;
+// a prompt successful call resets it.
+var (
+	LogAPIPeriod         = time.Minute
+	LogAPIBytesPerPeriod = 1 << 20
+	LogAPIMinBackoff     = time.Second
+	LogAPISlowCall       = 5 * time.Second
+)
+
 // ArvLogWriter is an io.WriteCloser that processes each write by
 // writing it through to another io.WriteCloser (typically a
 // CollectionFileWriter) and creating an Arvados log entry.
@@ -170,6 +229,14 @@ type ArvLogWriter struct {
 	UUID          string
 	loggingStream string
 	writeCloser   io.WriteCloser
+
+	periodStart time.Time
+	periodBytes int
+	skipping    bool
+
+	backoff        time.Duration
+	backoffUntil   time.Time
+	backoffSkipped int
 }
 
 func (arvlog *ArvLogWriter) Write(p []byte) (n int, err error) {
@@ -179,12 +246,39 @@ func (arvlog *ArvLogWriter) Write(p []byte) (n int, err error) {
 		_, err1 = arvlog.writeCloser.Write(p)
 	}
 
-	// write to API
-	lr := arvadosclient.Dict{"log": arvadosclient.Dict{
-		"object_uuid": arvlog.UUID,
-		"event_type":  arvlog.loggingStream,
-		"properties":  map[string]string{"text": string(p)}}}
-	err2 := arvlog.ArvClient.Create("logs", lr, nil)
+	// write to API, unless the rate limit has been reached or the
+	// API server is backing off
+	var err2 error
+	now := time.Now()
+	if now.Sub(arvlog.periodStart) >= LogAPIPeriod {
+		arvlog.periodStart = now
+		arvlog.periodBytes = 0
+		arvlog.skipping = false
+	}
+	if now.Before(arvlog.backoffUntil) {
+		arvlog.backoffSkipped += len(p)
+	} else if arvlog.skipping {
+		// Already sent the rate limit notice for this period.
+	} else if arvlog.periodBytes+len(p) <= LogAPIBytesPerPeriod {
+		arvlog.periodBytes += len(p)
+		text := string(p)
+		skipped := arvlog.backoffSkipped
+		if skipped > 0 {
+			text = fmt.Sprintf("%s Skipped %d bytes of log output while the API server was failing or slow; the complete log is saved in the log collection.\n",
+				RFC3339Timestamp(now.UTC()), skipped) + text
+		}
+		err2 = arvlog.createLogBackoff(text)
+		if err2 == nil {
+			arvlog.backoffSkipped = 0
+		} else {
+			arvlog.backoffSkipped = skipped + len(p)
+		}
+	} else {
+		arvlog.skipping = true
+		err2 = arvlog.createLogBackoff(fmt.Sprintf("%s Exceeded rate limit of %d bytes per %v. Logging to the API server will resume at %s; the complete log is saved in the log collection.\n",
+			RFC3339Timestamp(now.UTC()), LogAPIBytesPerPeriod, LogAPIPeriod,
+			RFC3339Timestamp(arvlog.periodStart.Add(LogAPIPeriod).UTC())))
+	}
 
 	if err1 != nil || err2 != nil {
 		return 0, fmt.Errorf("%s ; %s", err1, err2)
@@ -192,6 +286,35 @@ func (arvlog *ArvLogWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+func (arvlog *ArvLogWriter) createLog(text string) error {
+	lr := arvadosclient.Dict{"log": arvadosclient.Dict{
+		"object_uuid": arvlog.UUID,
+		"event_type":  arvlog.loggingStream,
+		"properties":  map[string]string{"text": text}}}
+	return arvlog.ArvClient.Create("logs", lr, nil)
+}
+
+// createLogBackoff calls createLog, and starts or extends a backoff
+// period if the call fails or is slow.
+func (arvlog *ArvLogWriter) createLogBackoff(text string) error {
+	t0 := time.Now()
+	err := arvlog.createLog(text)
+	if err == nil && time.Since(t0) < LogAPISlowCall {
+		arvlog.backoff = 0
+		return nil
+	}
+	if arvlog.backoff == 0 {
+		arvlog.backoff = LogAPIMinBackoff
+	} else {
+		arvlog.backoff *= 2
+	}
+	if arvlog.backoff > LogAPIPeriod {
+		arvlog.backoff = LogAPIPeriod
+	}
+	arvlog.backoffUntil = time.Now().Add(arvlog.backoff)
+	return err
+}
+
 // Close the underlying writer
 func (arvlog *ArvLogWriter) Close() (err error) {
 	if arvlog.writeCloser != nil {
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	. "gopkg.in/check.v1"
+	"strings"
 	"testing"
 	"time"
 )
@@ -59,6 +61,8 @@ func (s *LoggingTestSuite) TestWriteLogsLarge(c *C) {
 	cr := NewContainerRunner(api, kc, nil, "zzzzz-zzzzzzzzzzzzzzz")
 	cr.CrunchLog.Timestamper = (&TestTimestamper{}).Timestamp
 	cr.CrunchLog.Immediate = nil
+	defer func(limit int) { LogAPIBytesPerPeriod = limit }(LogAPIBytesPerPeriod)
+	LogAPIBytesPerPeriod = 1 << 30
 
 	for i := 0; i < 2000000; i++ {
 		cr.CrunchLog.Printf("Hello %d", i)
@@ -109,3 +113,91 @@ func (s *LoggingTestSuite) TestWriteMultipleLogs(c *C) {
 		". 408672f5b5325f7d20edfbf899faee42+83 0:83:crunch-run.txt\n"+
 		". c556a293010069fa79a6790a931531d5+80 0:80:stdout.txt\n")
 }
+
+func (s *LoggingTestSuite) TestAPIRateLimit(c *C) {
+	defer func(limit int) { LogAPIBytesPerPeriod = limit }(LogAPIBytesPerPeriod)
+	LogAPIBytesPerPeriod = 100
+	api := &ArvTestClient{}
+	buf := &bufferCloser{}
+	w := &ArvLogWriter{ArvClient: api, UUID: "zzzzz-zzzzzzzzzzzzzzz", loggingStream: "stdout", writeCloser: buf}
+
+	for _, text := range []string{"0123456789\n", strings.Repeat("x", 99) + "\n", "foo\n", "bar\n"} {
+		_, err := w.Write([]byte(text))
+		c.Check(err, IsNil)
+	}
+	c.Check(w.Close(), IsNil)
+
+	// The first write is sent, the second exceeds the limit and
+	// is replaced by a notice, and the rest are skipped.
+	c.Assert(api.Content, HasLen, 2)
+	c.Check(api.Content[0]["log"].(arvadosclient.Dict)["properties"].(map[string]string)["text"], Equals, "0123456789\n")
+	c.Check(api.Content[1]["log"].(arvadosclient.Dict)["properties"].(map[string]string)["text"], Matches, `\S+ Exceeded rate limit of 100 bytes per 1m0s\. .*\n`)
+
+	// Everything is saved in the log collection.
+	c.Check(buf.String(), Equals, "0123456789\n"+strings.Repeat("x", 99)+"\nfoo\nbar\n")
+}
+
+func (s *LoggingTestSuite) TestNextFlushInterval(c *C) {
+	c.Check(nextFlushInterval(MinLogFlushInterval, 0), Equals, MinLogFlushInterval)
+	c.Check(nextFlushInterval(MinLogFlushInterval, LogFlushBatchBytes), Equals, 2*MinLogFlushInterval)
+	c.Check(nextFlushInterval(MaxLogFlushInterval, LogFlushBatchBytes), Equals, MaxLogFlushInterval)
+	c.Check(nextFlushInterval(4*MinLogFlushInterval, 0), Equals, 2*MinLogFlushInterval)
+	// Moderate output leaves the interval unchanged.
+	c.Check(nextFlushInterval(4*MinLogFlushInterval, LogFlushBatchBytes/2), Equals, 4*MinLogFlushInterval)
+}
+
+func (s *LoggingTestSuite) TestCloseFlushesImmediately(c *C) {
+	defer func(interval time.Duration) { MinLogFlushInterval = interval }(MinLogFlushInterval)
+	MinLogFlushInterval = time.Minute
+	buf := &bufferCloser{}
+	tl := NewThrottledLogger(buf)
+	tl.Timestamper = (&TestTimestamper{}).Timestamp
+
+	tl.Print("Hello world!")
+	t0 := time.Now()
+	c.Check(tl.Close(), IsNil)
+	c.Check(time.Since(t0) < time.Second, Equals, true)
+	c.Check(buf.String(), Equals, "2015-12-29T15:51:45.000000001Z Hello world!\n")
+}
+
+// failingLogClient fails to create logs while fail is true.
+type failingLogClient struct {
+	*ArvTestClient
+	fail bool
+}
+
+func (client *failingLogClient) Create(resourceType string, parameters arvadosclient.Dict, output interface{}) error {
+	if client.fail {
+		return errors.New("API server unavailable")
+	}
+	return client.ArvTestClient.Create(resourceType, parameters, output)
+}
+
+func (s *LoggingTestSuite) TestAPIBackoff(c *C) {
+	defer func(backoff time.Duration) { LogAPIMinBackoff = backoff }(LogAPIMinBackoff)
+	LogAPIMinBackoff = 100 * time.Millisecond
+	api := &failingLogClient{ArvTestClient: &ArvTestClient{}, fail: true}
+	buf := &bufferCloser{}
+	w := &ArvLogWriter{ArvClient: api, UUID: "zzzzz-zzzzzzzzzzzzzzz", loggingStream: "stdout", writeCloser: buf}
+
+	// The failed write starts a backoff period, during which
+	// writes are not sent to the API server.
+	_, err := w.Write([]byte("foo\n"))
+	c.Check(err, NotNil)
+	api.fail = false
+	_, err = w.Write([]byte("bar\n"))
+	c.Check(err, IsNil)
+	c.Check(api.Content, HasLen, 0)
+
+	// After the backoff period, the next write is sent along with
+	// a notice about the skipped output.
+	time.Sleep(LogAPIMinBackoff)
+	_, err = w.Write([]byte("baz\n"))
+	c.Check(err, IsNil)
+	c.Assert(api.Content, HasLen, 1)
+	c.Check(api.Content[0]["log"].(arvadosclient.Dict)["properties"].(map[string]string)["text"], Matches, `\S+ Skipped 8 bytes of log output .*\nbaz\n`)
+	c.Check(w.backoff, Equals, time.Duration(0))
+
+	c.Check(w.Close(), IsNil)
+	c.Check(buf.String(), Equals, "foo\nbar\nbaz\n")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// LogStream keeps the recent output of each of crunch-run's logs in
+// memory, and serves it over HTTP so a client (typically the
+// dispatcher, on behalf of a user) can follow the logs of a running
+// container instead of waiting for them to be saved in Keep.
+//
+// GET / returns a JSON array of log names. GET /{name} (e.g.,
+// /stdout) returns the buffered output of the named log, then sends
+// new output as it is written, until the log is closed.
+type LogStream struct {
+	// Maximum number of bytes to keep for each log. When a log
+	// grows past this size, the oldest lines are discarded.
+	MaxBacklog int
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	logs     map[string]*streamLog
+	closed   bool
+	listener net.Listener
+}
+
+type streamLog struct {
+	buf    []byte
+	start  int64 // offset of buf[0] from the start of the log
+	closed bool
+}
+
+// NewLogStream returns a LogStream with a 1 MiB backlog per log.
+func NewLogStream() *LogStream {
+	ls := &LogStream{MaxBacklog: 1 << 20, logs: make(map[string]*streamLog)}
+	ls.cond = sync.NewCond(&ls.mtx)
+	return ls
+}
+
+// Tee returns an io.WriteCloser that writes to w and also appends to
+// the named log. Closing it closes w and ends the streams of clients
+// following the log.
+func (ls *LogStream) Tee(name string, w io.WriteCloser) io.WriteCloser {
+	ls.mtx.Lock()
+	if ls.logs[name] == nil {
+		ls.logs[name] = &streamLog{}
+	} else {
+		ls.logs[name].closed = false
+	}
+	ls.mtx.Unlock()
+	ls.cond.Broadcast()
+	return &streamWriter{ls, name, w}
+}
+
+type streamWriter struct {
+	ls   *LogStream
+	name string
+	io.WriteCloser
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.ls.append(sw.name, p)
+	return sw.WriteCloser.Write(p)
+}
+
+func (sw *streamWriter) Close() error {
+	sw.ls.mtx.Lock()
+	sw.ls.logs[sw.name].closed = true
+	sw.ls.mtx.Unlock()
+	sw.ls.cond.Broadcast()
+	return sw.WriteCloser.Close()
+}
+
+func (ls *LogStream) append(name string, p []byte) {
+	ls.mtx.Lock()
+	defer ls.cond.Broadcast()
+	defer ls.mtx.Unlock()
+	l := ls.logs[name]
+	l.buf = append(l.buf, p...)
+	excess := len(l.buf) - ls.MaxBacklog
+	if excess <= 0 {
+		return
+	}
+	// Discard whole lines where possible.
+	if i := bytes.IndexByte(l.buf[excess:], '\n'); i >= 0 {
+		excess += i + 1
+	}
+	// Copy instead of reslicing, so slices of the old buffer
+	// being sent to clients are not overwritten by later
+	// appends.
+	l.buf = append([]byte(nil), l.buf[excess:]...)
+	l.start += int64(excess)
+}
+
+// Listen starts serving logs on addr, which is either the path of a
+// unix socket (starting with "/") or a TCP host:port on a loopback
+// interface. Clients are not authenticated: a unix socket is only
+// accessible to the user crunch-run runs as, and a TCP port to users
+// on the same host.
+func (ls *LogStream) Listen(addr string) error {
+	var ln net.Listener
+	var err error
+	if strings.HasPrefix(addr, "/") {
+		ln, err = listenUnix(addr)
+	} else {
+		ln, err = listenLoopback(addr)
+	}
+	if err != nil {
+		return err
+	}
+	ls.listener = ln
+	go http.Serve(ln, ls)
+	return nil
+}
+
+// listenUnix listens on a unix socket at path, replacing a stale
+// socket left there by a previous process.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("While removing stale socket: %v", err)
+		}
+	}
+	// Create the socket with mode 0600, rather than chmod it after
+	// it is already accepting connections. The umask is
+	// process-wide, but Listen is only called during startup, when
+	// nothing else is creating files.
+	oldmask := syscall.Umask(0177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(oldmask)
+	return ln, err
+}
+
+// listenLoopback listens on a TCP host:port, where host is
+// "localhost" or a loopback address.
+func listenLoopback(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%s is not a loopback address: logs are served without authentication", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Addr returns the address the logs are served on, or "" if Listen
+// has not been called.
+func (ls *LogStream) Addr() string {
+	if ls.listener == nil {
+		return ""
+	}
+	return ls.listener.Addr().String()
+}
+
+// Close stops accepting new connections, and ends the streams of
+// connected clients once they have received all buffered output.
+func (ls *LogStream) Close() error {
+	ls.mtx.Lock()
+	ls.closed = true
+	ls.mtx.Unlock()
+	ls.cond.Broadcast()
+	if ls.listener == nil {
+		return nil
+	}
+	return ls.listener.Close()
+}
+
+func (ls *LogStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" {
+		ls.serveIndex(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		// Send the headers now, in case the log stays empty
+		// for a while.
+		f.Flush()
+	}
+
+	// Stop waiting for output when the client disconnects.
+	gone := false
+	if cn, ok := w.(http.CloseNotifier); ok {
+		notify := cn.CloseNotify()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-notify:
+			case <-done:
+				return
+			}
+			ls.mtx.Lock()
+			gone = true
+			ls.mtx.Unlock()
+			ls.cond.Broadcast()
+		}()
+	}
+
+	var pos int64
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	for !gone {
+		// The log might not exist yet (e.g., stdout before
+		// the container starts), in which case we wait for it.
+		l := ls.logs[name]
+		if l != nil && pos < l.start+int64(len(l.buf)) {
+			if pos < l.start {
+				// Client fell behind, and some output
+				// was discarded.
+				pos = l.start
+			}
+			data := l.buf[pos-l.start:]
+			pos += int64(len(data))
+			ls.mtx.Unlock()
+			_, err := w.Write(data)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			ls.mtx.Lock()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if ls.closed || (l != nil && l.closed) {
+			return
+		}
+		ls.cond.Wait()
+	}
+}
+
+func (ls *LogStream) serveIndex(w http.ResponseWriter) {
+	ls.mtx.Lock()
+	names := make([]string, 0, len(ls.logs))
+	for name := range ls.logs {
+		names = append(names, name)
+	}
+	ls.mtx.Unlock()
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
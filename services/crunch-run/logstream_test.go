@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+type LogStreamSuite struct{}
+
+var _ = Suite(&LogStreamSuite{})
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (bc *bufferCloser) Close() error {
+	bc.closed = true
+	return nil
+}
+
+func (s *LogStreamSuite) TestFollow(c *C) {
+	ls := NewLogStream()
+	srv := httptest.NewServer(ls)
+	defer srv.Close()
+
+	// Start following stdout before it exists.
+	resp, err := http.Get(srv.URL + "/stdout")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	rdr := bufio.NewReader(resp.Body)
+
+	buf := &bufferCloser{}
+	w := ls.Tee("stdout", buf)
+	w.Write([]byte("foo\n"))
+	line, err := rdr.ReadString('\n')
+	c.Check(err, IsNil)
+	c.Check(line, Equals, "foo\n")
+
+	w.Write([]byte("bar\n"))
+	line, err = rdr.ReadString('\n')
+	c.Check(err, IsNil)
+	c.Check(line, Equals, "bar\n")
+
+	// The stream ends when the log is closed.
+	c.Check(w.Close(), IsNil)
+	rest, err := ioutil.ReadAll(rdr)
+	c.Check(err, IsNil)
+	c.Check(string(rest), Equals, "")
+	c.Check(buf.String(), Equals, "foo\nbar\n")
+	c.Check(buf.closed, Equals, true)
+
+	// Clients connecting later get the buffered output.
+	resp, err = http.Get(srv.URL + "/stdout")
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(err, IsNil)
+	c.Check(string(body), Equals, "foo\nbar\n")
+
+	resp, err = http.Get(srv.URL + "/")
+	c.Assert(err, IsNil)
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(err, IsNil)
+	c.Check(string(body), Equals, "[\"stdout\"]\n")
+}
+
+func (s *LogStreamSuite) TestBacklog(c *C) {
+	ls := NewLogStream()
+	ls.MaxBacklog = 10
+	srv := httptest.NewServer(ls)
+	defer srv.Close()
+
+	w := ls.Tee("crunchstat", &bufferCloser{})
+	w.Write([]byte("aaaa\nbbbb\n"))
+	w.Write([]byte("cccc\n"))
+	w.Close()
+
+	resp, err := http.Get(srv.URL + "/crunchstat")
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(err, IsNil)
+	c.Check(string(body), Equals, "cccc\n")
+}
+
+func (s *LogStreamSuite) TestCloseEndsStreams(c *C) {
+	tmpdir, err := ioutil.TempDir("", "crunch-run-logstream")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tmpdir)
+
+	ls := NewLogStream()
+	sock := filepath.Join(tmpdir, "logs.sock")
+	c.Assert(ls.Listen(sock), IsNil)
+	c.Check(ls.Addr(), Equals, sock)
+	ls.Tee("stderr", &bufferCloser{}).Write([]byte("oops\n"))
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://crunch-run/stderr")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	rdr := bufio.NewReader(resp.Body)
+	line, err := rdr.ReadString('\n')
+	c.Check(err, IsNil)
+	c.Check(line, Equals, "oops\n")
+
+	c.Check(ls.Close(), IsNil)
+	rest, err := ioutil.ReadAll(rdr)
+	c.Check(err, IsNil)
+	c.Check(string(rest), Equals, "")
+}
+
+func (s *LogStreamSuite) TestListenLoopbackOnly(c *C) {
+	for _, addr := range []string{":0", "0.0.0.0:0", "[::]:0", "example.com:0", "127.0.0.1"} {
+		c.Check(NewLogStream().Listen(addr), NotNil, Commentf("%s", addr))
+	}
+	for _, addr := range []string{"127.0.0.1:0", "localhost:0"} {
+		ls := NewLogStream()
+		c.Check(ls.Listen(addr), IsNil, Commentf("%s", addr))
+		c.Check(ls.Close(), IsNil)
+	}
+}
+
+func (s *LogStreamSuite) TestListenStaleSocket(c *C) {
+	tmpdir, err := ioutil.TempDir("", "crunch-run-logstream")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tmpdir)
+	sock := filepath.Join(tmpdir, "logs.sock")
+
+	// Leave a socket with no listener, as a crashed process
+	// would.
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	c.Assert(err, IsNil)
+	c.Assert(syscall.Bind(fd, &syscall.SockaddrUnix{Name: sock}), IsNil)
+	syscall.Close(fd)
+
+	// The socket is private even with a permissive umask.
+	defer syscall.Umask(syscall.Umask(0))
+	ls := NewLogStream()
+	c.Assert(ls.Listen(sock), IsNil)
+	fi, err := os.Stat(sock)
+	c.Assert(err, IsNil)
+	c.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	// A socket in use is not replaced.
+	c.Check(NewLogStream().Listen(sock), ErrorMatches, `.*in use by another process`)
+	c.Check(ls.Close(), IsNil)
+
+	// Neither is a regular file.
+	c.Assert(ioutil.WriteFile(sock, nil, 0600), IsNil)
+	c.Check(NewLogStream().Listen(sock), ErrorMatches, `.*not a socket`)
+}
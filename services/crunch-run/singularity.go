@@ -0,0 +1,591 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/curoverse/dockerclient"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SingularityClient implements ThinDockerClient by running containers
+// with Singularity instead of a Docker daemon. Docker images loaded
+// from Keep are converted to SIF images and stored in ImageDir.
+//
+// Stdout and stderr are multiplexed using the Docker attach protocol,
+// so ContainerRunner can process them the same way it processes
+// Docker streams. If CgroupRoot is set, the container process is
+// started in a per-container cgroup named CgroupParent/<container id>
+// in each of the cgroup subsystems used by crunchstat, and the memory
+// and CPU limits from HostConfig are applied to those cgroups.
+type SingularityClient struct {
+	// Singularity executable.
+	Command string
+
+	// Directory where converted images are stored.
+	ImageDir string
+
+	// Directory for temporary files, like image tarballs during
+	// conversion and host directories for "tmp" mounts.
+	TempDir string
+
+	CgroupRoot   string
+	CgroupParent string
+
+	containers map[string]*singularityContainer
+	nextID     int
+	mtx        sync.Mutex
+}
+
+type singularityContainer struct {
+	config  dockerclient.ContainerConfig
+	cmd     *exec.Cmd
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
+	stdin   *io.PipeReader
+	started bool
+	exited  chan struct{}
+	result  dockerclient.WaitResult
+	cgroups map[string]string
+
+	// Temporary host directories for bare container paths in
+	// Binds, removed when the container process exits.
+	tmpdirs []string
+
+	// Set when the container process exits, if the kernel
+	// OOM-killed any process in the container's memory cgroup.
+	oomKilled bool
+}
+
+// NewSingularityClient returns a SingularityClient that stores images
+// in imageDir.
+func NewSingularityClient(imageDir string) *SingularityClient {
+	return &SingularityClient{
+		Command:    "singularity",
+		ImageDir:   imageDir,
+		TempDir:    os.TempDir(),
+		containers: make(map[string]*singularityContainer),
+	}
+}
+
+// cgroupSubsystems are the cgroup subsystems crunchstat reads from.
+var cgroupSubsystems = []string{"blkio", "cpu", "cpuacct", "cpuset", "memory"}
+
+func (sc *SingularityClient) imagePath(id string) string {
+	return filepath.Join(sc.ImageDir, id+".sif")
+}
+
+// InspectImage returns an error if the given image has not been
+// converted and stored in ImageDir.
+func (sc *SingularityClient) InspectImage(id string) (*dockerclient.ImageInfo, error) {
+	fi, err := os.Stat(sc.imagePath(id))
+	if err != nil {
+		return nil, err
+	}
+	return &dockerclient.ImageInfo{Id: id, Size: fi.Size()}, nil
+}
+
+// LoadImage reads a tarball produced by "docker save", and converts
+// it to a SIF image in ImageDir. The image ID is taken from the
+// manifest.json file in the tarball.
+func (sc *SingularityClient) LoadImage(reader io.Reader) error {
+	err := os.MkdirAll(sc.ImageDir, 0755)
+	if err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(sc.TempDir, "crunch-run-image-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	imageID, err := dockerImageID(io.TeeReader(reader, tmpfile))
+	if err != nil {
+		return fmt.Errorf("While reading image tarball: %v", err)
+	}
+	err = tmpfile.Close()
+	if err != nil {
+		return err
+	}
+
+	// Build to a unique temporary name, then rename, so a
+	// partially converted image is never mistaken for a usable
+	// one, and other crunch-run processes converting the same
+	// image at the same time don't write to the same file.
+	sif := sc.imagePath(imageID)
+	tmpsif, err := ioutil.TempFile(sc.ImageDir, imageID+".sif.tmp-")
+	if err != nil {
+		return err
+	}
+	tmpsif.Close()
+	defer os.Remove(tmpsif.Name())
+	out, err := exec.Command(sc.Command, "build", "--force", tmpsif.Name(), "docker-archive://"+tmpfile.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("While converting image: %v: %s", err, out)
+	}
+	return os.Rename(tmpsif.Name(), sif)
+}
+
+// dockerImageID reads a "docker save" tarball to the end, and returns
+// the image ID found in its manifest.json.
+func dockerImageID(r io.Reader) (string, error) {
+	var imageID string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if path.Clean(hdr.Name) != "manifest.json" {
+			continue
+		}
+		var manifest []struct {
+			Config string
+		}
+		err = json.NewDecoder(tr).Decode(&manifest)
+		if err != nil {
+			return "", fmt.Errorf("While decoding manifest.json: %v", err)
+		}
+		if len(manifest) != 1 {
+			return "", fmt.Errorf("manifest.json has %d images, expected 1", len(manifest))
+		}
+		// "<id>.json" in Docker format, "blobs/sha256/<id>"
+		// in OCI format.
+		imageID = strings.TrimSuffix(path.Base(manifest[0].Config), ".json")
+	}
+	// Consume any padding after the end-of-archive marker.
+	_, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return "", err
+	}
+	if imageID == "" {
+		return "", errors.New("no manifest.json found in image tarball")
+	}
+	return imageID, nil
+}
+
+// RemoveImage deletes the given image from ImageDir.
+func (sc *SingularityClient) RemoveImage(name string, force bool) ([]*dockerclient.ImageDelete, error) {
+	err := os.Remove(sc.imagePath(name))
+	if err != nil {
+		return nil, err
+	}
+	return []*dockerclient.ImageDelete{{Deleted: name}}, nil
+}
+
+// CreateContainer records the container configuration. The container
+// process is started by StartContainer.
+func (sc *SingularityClient) CreateContainer(config *dockerclient.ContainerConfig, name string, authConfig *dockerclient.AuthConfig) (string, error) {
+	if _, err := sc.InspectImage(config.Image); err != nil {
+		return "", fmt.Errorf("image %q not loaded: %v", config.Image, err)
+	}
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	id := fmt.Sprintf("singularity-%d-%d", os.Getpid(), sc.nextID)
+	sc.nextID++
+	c := &singularityContainer{
+		config: *config,
+		exited: make(chan struct{}),
+	}
+	c.reader, c.writer = io.Pipe()
+	sc.containers[id] = c
+	return id, nil
+}
+
+func (sc *SingularityClient) container(id string) (*singularityContainer, error) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	c, ok := sc.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+	return c, nil
+}
+
+// AttachContainer returns the container's stdout and stderr,
+// multiplexed using the Docker attach protocol.
+func (sc *SingularityClient) AttachContainer(id string, options *dockerclient.AttachOptions) (io.ReadCloser, error) {
+	c, err := sc.container(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.reader, nil
+}
+
+// AttachStdin returns a writer connected to the container's standard
+// input. It must be called before StartContainer.
+func (sc *SingularityClient) AttachStdin(id string) (io.WriteCloser, error) {
+	c, err := sc.container(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.started {
+		return nil, fmt.Errorf("container %s already started", id)
+	}
+	var w *io.PipeWriter
+	c.stdin, w = io.Pipe()
+	return w, nil
+}
+
+// StartContainer starts the container process.
+func (sc *SingularityClient) StartContainer(id string, hostConfig *dockerclient.HostConfig) error {
+	c, err := sc.container(id)
+	if err != nil {
+		return err
+	}
+	if c.started {
+		return fmt.Errorf("container %s already started", id)
+	}
+	args, err := sc.execArgs(c, hostConfig)
+	if err != nil {
+		sc.removeTmpdirs(c)
+		return err
+	}
+	err = sc.createCgroups(id, c, hostConfig)
+	if err != nil {
+		sc.leaveCgroups(c)
+		sc.removeTmpdirs(c)
+		return err
+	}
+	var cmd *exec.Cmd
+	var ready *os.File
+	if len(c.cgroups) == 0 {
+		cmd = exec.Command(sc.Command, args...)
+	} else {
+		// Look up the command now: once the wrapper has
+		// started, a missing command would look like a
+		// container exit status.
+		command, err := exec.LookPath(sc.Command)
+		if err != nil {
+			sc.leaveCgroups(c)
+			sc.removeTmpdirs(c)
+			return fmt.Errorf("While starting %s: %v", sc.Command, err)
+		}
+		wrapperArgs := []string{"-c", cgroupWrapper, "sh"}
+		for _, subsys := range cgroupSubsystems {
+			if dir, ok := c.cgroups[subsys]; ok {
+				wrapperArgs = append(wrapperArgs, filepath.Join(dir, "cgroup.procs"))
+			}
+		}
+		wrapperArgs = append(wrapperArgs, "--", command)
+		cmd = exec.Command("/bin/sh", append(wrapperArgs, args...)...)
+		var w *os.File
+		ready, w, err = os.Pipe()
+		if err != nil {
+			sc.leaveCgroups(c)
+			sc.removeTmpdirs(c)
+			return err
+		}
+		defer ready.Close()
+		defer w.Close()
+		cmd.ExtraFiles = []*os.File{w}
+	}
+	cmd.Env = os.Environ()
+	for _, kv := range c.config.Env {
+		cmd.Env = append(cmd.Env, "SINGULARITYENV_"+kv)
+	}
+	mux := &sync.Mutex{}
+	cmd.Stdout = &attachWriter{stream: 1, w: c.writer, mtx: mux}
+	cmd.Stderr = &attachWriter{stream: 2, w: c.writer, mtx: mux}
+	if c.stdin != nil {
+		cmd.Stdin = c.stdin
+	}
+	err = cmd.Start()
+	if err != nil {
+		sc.leaveCgroups(c)
+		sc.removeTmpdirs(c)
+		return fmt.Errorf("While starting %s: %v", sc.Command, err)
+	}
+	c.cmd = cmd
+	if ready != nil {
+		// Wait for the wrapper to confine itself before
+		// reporting the container as started.
+		cmd.ExtraFiles[0].Close()
+		msg, _ := ioutil.ReadAll(ready)
+		if string(msg) != "ok\n" {
+			cmd.Process.Kill()
+			err = fmt.Errorf("While adding container process to cgroup: %s", bytes.TrimSpace(msg))
+		}
+	}
+	c.started = err == nil
+
+	go func() {
+		waitErr := cmd.Wait()
+		c.result.ExitCode = 0
+		if exiterr, ok := waitErr.(*exec.ExitError); ok {
+			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+				c.result.ExitCode = status.ExitStatus()
+			}
+		} else if waitErr != nil {
+			c.result.Error = waitErr
+		}
+		c.writer.Close()
+		if c.stdin != nil {
+			// Unblock the writer, if the container
+			// exited without reading all of its input.
+			c.stdin.Close()
+		}
+		c.oomKilled = sc.oomKilled(c)
+		sc.leaveCgroups(c)
+		sc.removeTmpdirs(c)
+		close(c.exited)
+	}()
+	return err
+}
+
+// geteuid is os.Geteuid, except in tests.
+var geteuid = os.Geteuid
+
+// execArgs returns the arguments to pass to "singularity exec" to
+// run the given container. Temporary directories created for bare
+// container paths in Binds are added to c.tmpdirs.
+func (sc *SingularityClient) execArgs(c *singularityContainer, hostConfig *dockerclient.HostConfig) ([]string, error) {
+	config := &c.config
+	args := []string{"exec", "--containall"}
+	if config.WorkingDir != "" {
+		args = append(args, "--pwd", config.WorkingDir)
+	}
+	if config.NetworkDisabled {
+		if geteuid() != 0 {
+			// Network namespaces are only available
+			// to root.
+			return nil, errors.New("cannot disable container networking with singularity unless running as root")
+		}
+		args = append(args, "--net", "--network", "none")
+	}
+	for _, bind := range hostConfig.Binds {
+		if !strings.Contains(bind, ":") {
+			// Docker creates a volume for a bare
+			// container path. Use a temp dir instead.
+			tmpdir, err := ioutil.TempDir(sc.TempDir, "crunch-run-tmp-")
+			if err != nil {
+				return nil, err
+			}
+			c.tmpdirs = append(c.tmpdirs, tmpdir)
+			bind = tmpdir + ":" + bind
+		}
+		args = append(args, "--bind", bind)
+	}
+	args = append(args, sc.imagePath(config.Image))
+	return append(args, config.Cmd...), nil
+}
+
+// cgroupWrapper is a shell script that adds its own process to the
+// cgroup.procs files given before "--", then execs the remaining
+// arguments, so singularity and all of its child processes run in
+// the container's cgroups from the start. It writes "ok", or the
+// error from joining a cgroup, to file descriptor 3.
+const cgroupWrapper = `while [ "$1" != -- ]; do { echo $$ >"$1"; } 2>&3 || exit 1; shift; done; shift; echo ok >&3; exec 3>&-; exec "$@"`
+
+// createCgroups creates a new cgroup for the container in each
+// subsystem, so crunchstat can report its resource usage, and sets
+// the resource limits in hostConfig. The container process is added
+// to the cgroups by cgroupWrapper.
+func (sc *SingularityClient) createCgroups(id string, c *singularityContainer, hostConfig *dockerclient.HostConfig) error {
+	if sc.CgroupRoot == "" {
+		return nil
+	}
+	// Limits are written in order: cgroup v1 rejects a
+	// memory.memsw.limit_in_bytes lower than the current
+	// memory.limit_in_bytes.
+	type limit struct {
+		file string
+		val  int64
+	}
+	limits := map[string][]limit{
+		"memory": {
+			{"memory.limit_in_bytes", hostConfig.Memory},
+			{"memory.memsw.limit_in_bytes", hostConfig.MemorySwap},
+		},
+		"cpu": {
+			{"cpu.shares", hostConfig.CpuShares},
+			{"cpu.cfs_period_us", hostConfig.CpuPeriod},
+			{"cpu.cfs_quota_us", hostConfig.CpuQuota},
+		},
+	}
+	c.cgroups = make(map[string]string)
+	for _, subsys := range cgroupSubsystems {
+		dir := filepath.Join(sc.CgroupRoot, subsys, sc.CgroupParent, id)
+		if _, err := os.Stat(filepath.Join(sc.CgroupRoot, subsys)); os.IsNotExist(err) {
+			continue
+		}
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("While creating cgroup: %v", err)
+		}
+		c.cgroups[subsys] = dir
+		for _, l := range limits[subsys] {
+			if l.val == 0 {
+				continue
+			}
+			err = ioutil.WriteFile(filepath.Join(dir, l.file), []byte(fmt.Sprintf("%d\n", l.val)), 0644)
+			if os.IsNotExist(err) && l.file == "memory.memsw.limit_in_bytes" {
+				// Swap accounting is disabled in
+				// this kernel; there is no way to
+				// limit swap.
+				continue
+			} else if err != nil {
+				return fmt.Errorf("While setting %s: %v", l.file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// oomKilled returns true if the memory cgroup created by createCgroups
+// reports that a process was killed by the kernel's OOM killer.
+func (sc *SingularityClient) oomKilled(c *singularityContainer) bool {
+	dir, ok := c.cgroups["memory"]
+	if !ok {
+		return false
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "memory.oom_control"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		var n int
+		if _, err := fmt.Sscanf(line, "oom_kill %d", &n); err == nil && n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// removeTmpdirs removes the temporary directories created by
+// execArgs.
+func (sc *SingularityClient) removeTmpdirs(c *singularityContainer) {
+	for _, dir := range c.tmpdirs {
+		os.RemoveAll(dir)
+	}
+	c.tmpdirs = nil
+}
+
+// leaveCgroups removes the cgroups created by createCgroups. This
+// fails (harmlessly) if any processes are still running in them.
+func (sc *SingularityClient) leaveCgroups(c *singularityContainer) {
+	for _, dir := range c.cgroups {
+		os.Remove(dir)
+	}
+}
+
+// InspectContainer returns the state of the container.
+func (sc *SingularityClient) InspectContainer(id string) (*dockerclient.ContainerInfo, error) {
+	c, err := sc.container(id)
+	if err != nil {
+		return nil, err
+	}
+	info := &dockerclient.ContainerInfo{
+		Id:     id,
+		Config: &c.config,
+		State:  &dockerclient.State{},
+	}
+	select {
+	case <-c.exited:
+		info.State.ExitCode = c.result.ExitCode
+		info.State.OOMKilled = c.oomKilled
+	default:
+		if c.started {
+			info.State.Running = true
+			info.State.Pid = c.cmd.Process.Pid
+		}
+	}
+	return info, nil
+}
+
+// Wait returns a channel that receives the container's exit status
+// when the container process exits.
+func (sc *SingularityClient) Wait(id string) <-chan dockerclient.WaitResult {
+	ch := make(chan dockerclient.WaitResult, 1)
+	c, err := sc.container(id)
+	if err != nil {
+		ch <- dockerclient.WaitResult{Error: err}
+		return ch
+	}
+	go func() {
+		<-c.exited
+		ch <- c.result
+	}()
+	return ch
+}
+
+// StopContainer sends SIGTERM to the container process, and SIGKILL
+// if it is still running after the given number of seconds.
+func (sc *SingularityClient) StopContainer(id string, timeout int) error {
+	c, err := sc.container(id)
+	if err != nil {
+		return err
+	}
+	if !c.started {
+		return nil
+	}
+	c.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-c.exited:
+	case <-time.After(time.Duration(timeout) * time.Second):
+		c.cmd.Process.Kill()
+	}
+	return nil
+}
+
+// RemoveContainer forgets the container. If the container process is
+// still running, it is killed if force is true, otherwise an error is
+// returned.
+func (sc *SingularityClient) RemoveContainer(id string, force, volumes bool) error {
+	c, err := sc.container(id)
+	if err != nil {
+		return err
+	}
+	if c.started {
+		select {
+		case <-c.exited:
+		default:
+			if !force {
+				return fmt.Errorf("container %s is running", id)
+			}
+			c.cmd.Process.Kill()
+			<-c.exited
+		}
+	}
+	sc.mtx.Lock()
+	delete(sc.containers, id)
+	sc.mtx.Unlock()
+	return nil
+}
+
+// attachWriter frames everything written to it as a single stream of
+// the Docker attach protocol: an 8-byte header with the stream number
+// and payload size, followed by the payload.
+type attachWriter struct {
+	stream byte
+	w      io.Writer
+	mtx    *sync.Mutex
+}
+
+func (aw *attachWriter) Write(p []byte) (int, error) {
+	aw.mtx.Lock()
+	defer aw.mtx.Unlock()
+	header := make([]byte, 8)
+	header[0] = aw.stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+	_, err := aw.w.Write(append(header, p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/curoverse/dockerclient"
+	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+type SingularitySuite struct {
+	tmpdir string
+	client *SingularityClient
+}
+
+var _ = Suite(&SingularitySuite{})
+
+// fakeSingularity copies the image tarball instead of converting it,
+// and runs the container command directly on the host.
+const fakeSingularity = `#!/bin/sh
+case "$1" in
+build)
+	cp "${4#docker-archive://}" "$3"
+	;;
+exec)
+	while [ "${1%.sif}" = "$1" ]; do shift; done
+	shift
+	exec "$@"
+	;;
+esac
+`
+
+func (s *SingularitySuite) SetUpTest(c *C) {
+	var err error
+	s.tmpdir, err = ioutil.TempDir("", "crunch-run-singularity")
+	c.Assert(err, IsNil)
+	cmd := filepath.Join(s.tmpdir, "singularity")
+	c.Assert(ioutil.WriteFile(cmd, []byte(fakeSingularity), 0755), IsNil)
+	s.client = NewSingularityClient(filepath.Join(s.tmpdir, "images"))
+	s.client.Command = cmd
+	s.client.TempDir = s.tmpdir
+}
+
+func (s *SingularitySuite) TearDownTest(c *C) {
+	os.RemoveAll(s.tmpdir)
+}
+
+func imageTarball(c *C, manifest string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest))}), IsNil)
+	_, err := tw.Write([]byte(manifest))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+	return buf
+}
+
+func (s *SingularitySuite) TestDockerImageID(c *C) {
+	id, err := dockerImageID(imageTarball(c, `[{"Config":"`+hwImageId+`.json","Layers":[]}]`))
+	c.Check(err, IsNil)
+	c.Check(id, Equals, hwImageId)
+
+	id, err = dockerImageID(imageTarball(c, `[{"Config":"blobs/sha256/`+hwImageId+`"}]`))
+	c.Check(err, IsNil)
+	c.Check(id, Equals, hwImageId)
+
+	_, err = dockerImageID(imageTarball(c, `[]`))
+	c.Check(err, ErrorMatches, `manifest.json has 0 images.*`)
+}
+
+func (s *SingularitySuite) TestExecArgs(c *C) {
+	args, err := s.client.execArgs(&singularityContainer{config: dockerclient.ContainerConfig{
+		Image:      hwImageId,
+		Cmd:        []string{"echo", "foo"},
+		WorkingDir: "/bar",
+	}}, &dockerclient.HostConfig{
+		Binds: []string{"/keep/tmp0:/out", "/keep/by_id/abc:/in:ro"},
+	})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"exec", "--containall", "--pwd", "/bar",
+		"--bind", "/keep/tmp0:/out",
+		"--bind", "/keep/by_id/abc:/in:ro",
+		s.client.imagePath(hwImageId), "echo", "foo"})
+}
+
+func (s *SingularitySuite) TestNetworkDisabled(c *C) {
+	defer func() { geteuid = os.Geteuid }()
+	ctr := &singularityContainer{config: dockerclient.ContainerConfig{
+		Image:           hwImageId,
+		Cmd:             []string{"true"},
+		NetworkDisabled: true,
+	}}
+
+	geteuid = func() int { return 0 }
+	args, err := s.client.execArgs(ctr, &dockerclient.HostConfig{})
+	c.Check(err, IsNil)
+	c.Check(args, DeepEquals, []string{
+		"exec", "--containall", "--net", "--network", "none",
+		s.client.imagePath(hwImageId), "true"})
+
+	geteuid = func() int { return 1000 }
+	_, err = s.client.execArgs(ctr, &dockerclient.HostConfig{})
+	c.Check(err, ErrorMatches, `cannot disable container networking.*`)
+}
+
+func (s *SingularitySuite) TestTmpdirsRemoved(c *C) {
+	c.Assert(s.client.LoadImage(imageTarball(c, `[{"Config":"`+hwImageId+`.json"}]`)), IsNil)
+	id, err := s.client.CreateContainer(&dockerclient.ContainerConfig{
+		Image: hwImageId,
+		Cmd:   []string{"true"},
+	}, "", nil)
+	c.Assert(err, IsNil)
+	rdr, err := s.client.AttachContainer(id, nil)
+	c.Assert(err, IsNil)
+	c.Assert(s.client.StartContainer(id, &dockerclient.HostConfig{Binds: []string{"/scratch"}}), IsNil)
+	io.Copy(ioutil.Discard, rdr)
+	wr := <-s.client.Wait(id)
+	c.Check(wr.Error, IsNil)
+
+	tmpdirs, err := filepath.Glob(filepath.Join(s.tmpdir, "crunch-run-tmp-*"))
+	c.Check(err, IsNil)
+	c.Check(tmpdirs, HasLen, 0)
+}
+
+func (s *SingularitySuite) TestRunContainer(c *C) {
+	_, err := s.client.InspectImage(hwImageId)
+	c.Check(err, NotNil)
+	err = s.client.LoadImage(imageTarball(c, `[{"Config":"`+hwImageId+`.json"}]`))
+	c.Assert(err, IsNil)
+	_, err = s.client.InspectImage(hwImageId)
+	c.Check(err, IsNil)
+
+	id, err := s.client.CreateContainer(&dockerclient.ContainerConfig{
+		Image: hwImageId,
+		Cmd:   []string{"sh", "-c", "echo foo; echo bar >&2; exit 3"},
+	}, "", nil)
+	c.Assert(err, IsNil)
+	rdr, err := s.client.AttachContainer(id, nil)
+	c.Assert(err, IsNil)
+	c.Assert(s.client.StartContainer(id, &dockerclient.HostConfig{}), IsNil)
+
+	streams := map[byte]*bytes.Buffer{1: {}, 2: {}}
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(rdr, header)
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		size := int64(header[4])<<24 | int64(header[5])<<16 | int64(header[6])<<8 | int64(header[7])
+		_, err = io.CopyN(streams[header[0]], rdr, size)
+		c.Assert(err, IsNil)
+	}
+	c.Check(streams[1].String(), Equals, "foo\n")
+	c.Check(streams[2].String(), Equals, "bar\n")
+
+	wr := <-s.client.Wait(id)
+	c.Check(wr.Error, IsNil)
+	c.Check(wr.ExitCode, Equals, 3)
+
+	c.Check(s.client.RemoveContainer(id, false, true), IsNil)
+	_, err = s.client.InspectContainer(id)
+	c.Check(err, NotNil)
+
+	_, err = s.client.RemoveImage(hwImageId, false)
+	c.Check(err, IsNil)
+	_, err = s.client.InspectImage(hwImageId)
+	c.Check(err, NotNil)
+}
+
+func (s *SingularitySuite) TestStdin(c *C) {
+	c.Assert(s.client.LoadImage(imageTarball(c, `[{"Config":"`+hwImageId+`.json"}]`)), IsNil)
+	id, err := s.client.CreateContainer(&dockerclient.ContainerConfig{
+		Image: hwImageId,
+		Cmd:   []string{"cat"},
+	}, "", nil)
+	c.Assert(err, IsNil)
+	rdr, err := s.client.AttachContainer(id, nil)
+	c.Assert(err, IsNil)
+	stdin, err := s.client.AttachStdin(id)
+	c.Assert(err, IsNil)
+	c.Assert(s.client.StartContainer(id, &dockerclient.HostConfig{}), IsNil)
+	go func() {
+		stdin.Write([]byte("hello stdin\n"))
+		stdin.Close()
+	}()
+
+	out, err := ioutil.ReadAll(rdr)
+	c.Check(err, IsNil)
+	c.Check(string(out), Equals, "\x01\x00\x00\x00\x00\x00\x00\x0chello stdin\n")
+	wr := <-s.client.Wait(id)
+	c.Check(wr.ExitCode, Equals, 0)
+}
+
+func (s *SingularitySuite) TestCgroups(c *C) {
+	root := filepath.Join(s.tmpdir, "cgroup")
+	for _, subsys := range []string{"cpu", "memory"} {
+		c.Assert(os.MkdirAll(filepath.Join(root, subsys, "parent"), 0755), IsNil)
+	}
+	s.client.CgroupRoot = root
+	s.client.CgroupParent = "parent"
+
+	c.Assert(s.client.LoadImage(imageTarball(c, `[{"Config":"`+hwImageId+`.json"}]`)), IsNil)
+	id, err := s.client.CreateContainer(&dockerclient.ContainerConfig{
+		Image: hwImageId,
+		Cmd:   []string{"sh", "-c", "echo $$"},
+	}, "", nil)
+	c.Assert(err, IsNil)
+	rdr, err := s.client.AttachContainer(id, nil)
+	c.Assert(err, IsNil)
+	c.Assert(s.client.StartContainer(id, &dockerclient.HostConfig{Memory: 1000000, CpuShares: 512}), IsNil)
+	out, err := ioutil.ReadAll(rdr)
+	c.Check(err, IsNil)
+	wr := <-s.client.Wait(id)
+	c.Check(wr.ExitCode, Equals, 0)
+
+	// The container process was in each cgroup from the start.
+	c.Assert(len(out) > 8, Equals, true)
+	pid := string(out[8:])
+	for _, subsys := range []string{"cpu", "memory"} {
+		buf, err := ioutil.ReadFile(filepath.Join(root, subsys, "parent", id, "cgroup.procs"))
+		c.Check(err, IsNil)
+		c.Check(string(buf), Equals, pid)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(root, "memory", "parent", id, "memory.limit_in_bytes"))
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "1000000\n")
+}
+
+func (s *SingularitySuite) TestCgroupWrapperFails(c *C) {
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer r.Close()
+	cmd := exec.Command("/bin/sh", "-c", cgroupWrapper, "sh", s.tmpdir, "--", "echo", "not confined")
+	cmd.ExtraFiles = []*os.File{w}
+	out, err := cmd.Output()
+	w.Close()
+	c.Check(err, NotNil)
+	c.Check(string(out), Equals, "")
+	msg, err := ioutil.ReadAll(r)
+	c.Check(err, IsNil)
+	c.Check(string(msg), Not(Equals), "")
+	c.Check(string(msg), Not(Matches), "ok\n")
+}
+
+func (s *SingularitySuite) TestLoadImageConcurrent(c *C) {
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		tarball := imageTarball(c, `[{"Config":"`+hwImageId+`.json"}]`)
+		go func() {
+			errs <- s.client.LoadImage(tarball)
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		c.Check(<-errs, IsNil)
+	}
+	_, err := s.client.InspectImage(hwImageId)
+	c.Check(err, IsNil)
+
+	// No temporary files are left behind.
+	files, err := filepath.Glob(filepath.Join(s.client.ImageDir, "*"))
+	c.Check(err, IsNil)
+	c.Check(files, DeepEquals, []string{s.client.imagePath(hwImageId)})
+}
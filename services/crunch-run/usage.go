@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ResourceUsage summarizes the resources used by a container, as
+// reported by crunchstat.
+type ResourceUsage struct {
+	PeakRSSBytes    int64   `json:"peak_rss_bytes"`
+	PeakSwapBytes   int64   `json:"peak_swap_bytes"`
+	CPUUserSeconds  float64 `json:"cpu_user_seconds"`
+	CPUSysSeconds   float64 `json:"cpu_sys_seconds"`
+	BlkioReadBytes  int64   `json:"blkio_read_bytes"`
+	BlkioWriteBytes int64   `json:"blkio_write_bytes"`
+	NetRxBytes      int64   `json:"net_rx_bytes"`
+	NetTxBytes      int64   `json:"net_tx_bytes"`
+
+	// True if the container was killed because it ran out of
+	// memory. Not reported by crunchstat: set by ContainerRunner.
+	OOMKilled bool `json:"oom_killed"`
+}
+
+// UsageCollector is an io.Writer that parses the log lines written by
+// a crunchstat.Reporter and keeps track of the container's peak
+// memory use and total CPU, disk and network usage.
+type UsageCollector struct {
+	mtx   sync.Mutex
+	buf   bytes.Buffer
+	peak  ResourceUsage
+	cpu   [2]float64
+	blkio map[string][2]int64
+	net   map[string][2]int64
+}
+
+// Write parses complete lines of crunchstat output. Incomplete lines
+// are buffered until the rest of the line is written.
+func (uc *UsageCollector) Write(p []byte) (int, error) {
+	uc.mtx.Lock()
+	defer uc.mtx.Unlock()
+	uc.buf.Write(p)
+	for {
+		line, err := uc.buf.ReadString('\n')
+		if err != nil {
+			// Put back the incomplete line.
+			rest := append([]byte(line), uc.buf.Bytes()...)
+			uc.buf.Reset()
+			uc.buf.Write(rest)
+			break
+		}
+		uc.parse(strings.TrimSuffix(line, "\n"))
+	}
+	return len(p), nil
+}
+
+// parse updates the totals from a single line of crunchstat output.
+// Counters reported by crunchstat are cumulative, so the most recent
+// value for each device/interface is the total.
+func (uc *UsageCollector) parse(line string) {
+	if i := strings.Index(line, " -- interval"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	switch {
+	case fields[0] == "mem":
+		// mem 123 cache 0 swap 45 pgmajfault 678 rss
+		for i := 1; i+1 < len(fields); i += 2 {
+			var val int64
+			if _, err := fmt.Sscanf(fields[i], "%d", &val); err != nil {
+				continue
+			}
+			switch fields[i+1] {
+			case "rss":
+				if val > uc.peak.PeakRSSBytes {
+					uc.peak.PeakRSSBytes = val
+				}
+			case "swap":
+				if val > uc.peak.PeakSwapBytes {
+					uc.peak.PeakSwapBytes = val
+				}
+			}
+		}
+	case fields[0] == "cpu":
+		// cpu 1.2345 user 0.1234 sys 4 cpus
+		var user, sys float64
+		if _, err := fmt.Sscanf(line, "cpu %f user %f sys", &user, &sys); err == nil {
+			uc.cpu = [2]float64{user, sys}
+		}
+	case strings.HasPrefix(fields[0], "blkio:"):
+		// blkio:8:0 123 write 456 read
+		var write, read int64
+		if _, err := fmt.Sscanf(strings.Join(fields[1:], " "), "%d write %d read", &write, &read); err == nil {
+			if uc.blkio == nil {
+				uc.blkio = make(map[string][2]int64)
+			}
+			uc.blkio[fields[0]] = [2]int64{read, write}
+		}
+	case strings.HasPrefix(fields[0], "net:"):
+		// net:eth0 123 tx 456 rx
+		var tx, rx int64
+		if _, err := fmt.Sscanf(strings.Join(fields[1:], " "), "%d tx %d rx", &tx, &rx); err == nil {
+			if uc.net == nil {
+				uc.net = make(map[string][2]int64)
+			}
+			uc.net[fields[0]] = [2]int64{rx, tx}
+		}
+	}
+}
+
+// Usage returns the resource usage reported so far.
+func (uc *UsageCollector) Usage() ResourceUsage {
+	uc.mtx.Lock()
+	defer uc.mtx.Unlock()
+	u := uc.peak
+	u.CPUUserSeconds, u.CPUSysSeconds = uc.cpu[0], uc.cpu[1]
+	for _, rw := range uc.blkio {
+		u.BlkioReadBytes += rw[0]
+		u.BlkioWriteBytes += rw[1]
+	}
+	for _, rxtx := range uc.net {
+		u.NetRxBytes += rxtx[0]
+		u.NetTxBytes += rxtx[1]
+	}
+	return u
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+	"io"
+	"log"
+)
+
+type UsageSuite struct{}
+
+var _ = Suite(&UsageSuite{})
+
+func (s *UsageSuite) TestParseCrunchstat(c *C) {
+	uc := &UsageCollector{}
+	logger := log.New(uc, "", 0)
+	for _, line := range []string{
+		"notice: reading stats from /sys/fs/cgroup/memory/docker/abcde/memory.stat",
+		"mem 1000 cache 0 swap 10 pgmajfault 2000 rss",
+		"cpu 1.0000 user 0.5000 sys 4 cpus",
+		"blkio:8:0 100 write 200 read",
+		"net:eth0 300 tx 400 rx",
+		"mem 1000 cache 20 swap 10 pgmajfault 5000 rss",
+		"mem 1000 cache 5 swap 10 pgmajfault 3000 rss",
+		"cpu 3.2500 user 1.2500 sys 4 cpus -- interval 10.0000 seconds 2.2500 user 0.7500 sys",
+		"blkio:8:0 150 write 250 read -- interval 10.0000 seconds 50 write 50 read",
+		"blkio:8:16 1 write 2 read",
+		"net:eth0 350 tx 500 rx -- interval 10.0000 seconds 50 tx 100 rx",
+		"net:eth1 7 tx 8 rx",
+	} {
+		logger.Print(line)
+	}
+	c.Check(uc.Usage(), DeepEquals, ResourceUsage{
+		PeakRSSBytes:    5000,
+		PeakSwapBytes:   20,
+		CPUUserSeconds:  3.25,
+		CPUSysSeconds:   1.25,
+		BlkioReadBytes:  252,
+		BlkioWriteBytes: 151,
+		NetRxBytes:      508,
+		NetTxBytes:      357,
+	})
+}
+
+func (s *UsageSuite) TestPartialWrites(c *C) {
+	uc := &UsageCollector{}
+	io.WriteString(uc, "mem 1000 cache 0 swap 12")
+	c.Check(uc.Usage().PeakRSSBytes, Equals, int64(0))
+	io.WriteString(uc, "34 rss\nmem 5")
+	c.Check(uc.Usage().PeakRSSBytes, Equals, int64(1234))
+}
@@ -1,220 +1,173 @@
-/* Keep Datamanager. Responsible for checking on and reporting on Keep Storage */
+/* Keep Datamanager. Compatibility wrapper that translates the legacy
+Data Manager command line options into a keep-balance configuration,
+and runs keep-balance. */
 
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
-	"fmt"
-	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
-	"git.curoverse.com/arvados.git/sdk/go/keepclient"
-	"git.curoverse.com/arvados.git/sdk/go/logger"
-	"git.curoverse.com/arvados.git/sdk/go/util"
-	"git.curoverse.com/arvados.git/services/datamanager/collection"
-	"git.curoverse.com/arvados.git/services/datamanager/keep"
-	"git.curoverse.com/arvados.git/services/datamanager/loggerutil"
-	"git.curoverse.com/arvados.git/services/datamanager/summary"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/exec"
+	"syscall"
 	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
 )
 
-var (
+// options are the legacy Data Manager command line options.
+type options struct {
 	logEventTypePrefix  string
 	logFrequencySeconds int
 	minutesBetweenRuns  int
 	collectionBatchSize int
 	dryRun              bool
-)
+	serviceType         string
+	writeDataTo         string
+	readDataFrom        string
+	heapProfile         string
+	keepBalance         string
+}
+
+// keepBalanceConfig is the subset of keep-balance's configuration
+// file that corresponds to legacy Data Manager options.
+type keepBalanceConfig struct {
+	Client              arvados.Client
+	KeepServiceTypes    []string
+	RunPeriod           arvados.Duration
+	CollectionBatchSize int
+	LogEventTypePrefix  string
+}
+
+var opts options
 
 func init() {
-	flag.StringVar(&logEventTypePrefix,
+	flag.StringVar(&opts.logEventTypePrefix,
 		"log-event-type-prefix",
 		"experimental-data-manager",
 		"Prefix to use in the event_type of our arvados log entries. Set to empty to turn off logging")
-	flag.IntVar(&logFrequencySeconds,
+	flag.IntVar(&opts.logFrequencySeconds,
 		"log-frequency-seconds",
 		20,
-		"How frequently we'll write log entries in seconds.")
-	flag.IntVar(&minutesBetweenRuns,
+		"Ignored. (keep-balance writes a log entry at the start of each phase.)")
+	flag.IntVar(&opts.minutesBetweenRuns,
 		"minutes-between-runs",
 		0,
 		"How many minutes we wait between data manager runs. 0 means run once and exit.")
-	flag.IntVar(&collectionBatchSize,
+	flag.IntVar(&opts.collectionBatchSize,
 		"collection-batch-size",
 		1000,
 		"How many collections to request in each batch.")
-	flag.BoolVar(&dryRun,
+	flag.BoolVar(&opts.dryRun,
 		"dry-run",
 		false,
 		"Perform a dry run. Log how many blocks would be deleted/moved, but do not issue any changes to keepstore.")
+	flag.StringVar(&opts.serviceType,
+		"service-type",
+		"disk",
+		"Operate only on keep_services with the specified service_type, ignoring all others.")
+	flag.StringVar(&opts.writeDataTo,
+		"write-data-to",
+		"",
+		"Write summary of data received to this file. Used for development only.")
+	flag.StringVar(&opts.readDataFrom,
+		"read-data-from",
+		"",
+		"Avoid network i/o and read summary data from this file instead. Used for development only.")
+	flag.StringVar(&opts.heapProfile,
+		"heap-profile",
+		"",
+		"Ignored.")
+	flag.StringVar(&opts.keepBalance,
+		"keep-balance",
+		"keep-balance",
+		"Path to the keep-balance program.")
 }
 
 func main() {
 	flag.Parse()
 
-	if minutesBetweenRuns == 0 {
-		arv, err := arvadosclient.MakeArvadosClient()
-		if err != nil {
-			loggerutil.FatalWithMessage(arvLogger, fmt.Sprintf("Error making arvados client: %v", err))
-		}
-		err = singlerun(arv)
-		if err != nil {
-			loggerutil.FatalWithMessage(arvLogger, fmt.Sprintf("singlerun: %v", err))
-		}
-	} else {
-		waitTime := time.Minute * time.Duration(minutesBetweenRuns)
-		for {
-			log.Println("Beginning Run")
-			arv, err := arvadosclient.MakeArvadosClient()
-			if err != nil {
-				loggerutil.FatalWithMessage(arvLogger, fmt.Sprintf("Error making arvados client: %v", err))
-			}
-			err = singlerun(arv)
-			if err != nil {
-				log.Printf("singlerun: %v", err)
-			}
-			log.Printf("Sleeping for %d minutes", minutesBetweenRuns)
-			time.Sleep(waitTime)
-		}
+	if opts.heapProfile != "" {
+		log.Print("warning: -heap-profile is no longer supported, ignoring")
 	}
-}
-
-var arvLogger *logger.Logger
 
-func singlerun(arv arvadosclient.ArvadosClient) error {
-	var err error
-	if isAdmin, err := util.UserIsAdmin(arv); err != nil {
-		return errors.New("Error verifying admin token: " + err.Error())
-	} else if !isAdmin {
-		return errors.New("Current user is not an admin. Datamanager requires a privileged token.")
-	}
-
-	if logEventTypePrefix != "" {
-		arvLogger, err = logger.NewLogger(logger.LoggerParams{
-			Client:          arv,
-			EventTypePrefix: logEventTypePrefix,
-			WriteInterval:   time.Second * time.Duration(logFrequencySeconds)})
-	}
-
-	loggerutil.LogRunInfo(arvLogger)
-	if arvLogger != nil {
-		arvLogger.AddWriteHook(loggerutil.LogMemoryAlloc)
-	}
-
-	var (
-		dataFetcher     summary.DataFetcher
-		readCollections collection.ReadCollections
-		keepServerInfo  keep.ReadServers
-	)
-
-	if summary.ShouldReadData() {
-		dataFetcher = summary.ReadData
-	} else {
-		dataFetcher = BuildDataFetcher(arv)
-	}
-
-	err = dataFetcher(arvLogger, &readCollections, &keepServerInfo)
-	if err != nil {
-		return err
+	if opts.readDataFrom != "" && (!opts.dryRun || opts.minutesBetweenRuns != 0) {
+		log.Print("warning: -read-data-from implies -dry-run and -minutes-between-runs=0")
 	}
-
-	err = summary.MaybeWriteData(arvLogger, readCollections, keepServerInfo)
+	config, args, err := opts.keepBalanceArgs(*arvados.NewClientFromEnv())
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-
-	buckets := summary.BucketReplication(readCollections, keepServerInfo)
-	bucketCounts := buckets.Counts()
-
-	replicationSummary := buckets.SummarizeBuckets(readCollections)
-	replicationCounts := replicationSummary.ComputeCounts()
-
-	log.Printf("Blocks In Collections: %d, "+
-		"\nBlocks In Keep: %d.",
-		len(readCollections.BlockToDesiredReplication),
-		len(keepServerInfo.BlockToServers))
-	log.Println(replicationCounts.PrettyPrint())
-
-	log.Printf("Blocks Histogram:")
-	for _, rlbss := range bucketCounts {
-		log.Printf("%+v: %10d",
-			rlbss.Levels,
-			rlbss.Count)
+	if opts.readDataFrom == "" && (config.Client.APIHost == "" || config.Client.AuthToken == "") {
+		log.Fatal("ARVADOS_API_HOST and ARVADOS_API_TOKEN environment variables must be set.")
 	}
 
-	kc, err := keepclient.MakeKeepClient(&arv)
+	f, err := ioutil.TempFile("", "datamanager-keep-balance-")
 	if err != nil {
-		return fmt.Errorf("Error setting up keep client %v", err.Error())
+		log.Fatal(err)
 	}
-
-	// Log that we're finished. We force the recording, since go will
-	// not wait for the write timer before exiting.
-	if arvLogger != nil {
-		defer arvLogger.FinalUpdate(func(p map[string]interface{}, e map[string]interface{}) {
-			summaryInfo := logger.GetOrCreateMap(p, "summary_info")
-			summaryInfo["block_replication_counts"] = bucketCounts
-			summaryInfo["replication_summary"] = replicationCounts
-			p["summary_info"] = summaryInfo
-
-			p["run_info"].(map[string]interface{})["finished_at"] = time.Now()
-		})
+	defer os.Remove(f.Name())
+	err = json.NewEncoder(f).Encode(&config)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-
-	pullServers := summary.ComputePullServers(kc,
-		&keepServerInfo,
-		readCollections.BlockToDesiredReplication,
-		replicationSummary.UnderReplicatedBlocks)
-
-	pullLists := summary.BuildPullLists(pullServers)
-
-	trashLists, trashErr := summary.BuildTrashLists(kc,
-		&keepServerInfo,
-		replicationSummary.KeepBlocksNotInCollections)
-
-	err = summary.WritePullLists(arvLogger, pullLists, dryRun)
 	if err != nil {
-		return err
+		log.Fatalf("writing keep-balance config: %v", err)
 	}
 
-	if trashErr != nil {
-		return err
+	cmd := exec.Command(opts.keepBalance, append([]string{"-config", f.Name()}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	log.Printf("running %q", cmd.Args)
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Remove(f.Name())
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			os.Exit(status.ExitStatus())
+		}
+		os.Exit(1)
+	} else if err != nil {
+		os.Remove(f.Name())
+		log.Fatal(err)
 	}
-	keep.SendTrashLists(arvLogger, kc, trashLists, dryRun)
-
-	return nil
 }
 
-// BuildDataFetcher returns a data fetcher that fetches data from remote servers.
-func BuildDataFetcher(arv arvadosclient.ArvadosClient) summary.DataFetcher {
-	return func(
-		arvLogger *logger.Logger,
-		readCollections *collection.ReadCollections,
-		keepServerInfo *keep.ReadServers,
-	) error {
-		collDone := make(chan struct{})
-		var collErr error
-		go func() {
-			*readCollections, collErr = collection.GetCollectionsAndSummarize(
-				collection.GetCollectionsParams{
-					Client:    arv,
-					Logger:    arvLogger,
-					BatchSize: collectionBatchSize})
-			collDone <- struct{}{}
-		}()
-
-		var keepErr error
-		*keepServerInfo, keepErr = keep.GetKeepServersAndSummarize(
-			keep.GetKeepServersParams{
-				Client: arv,
-				Logger: arvLogger,
-				Limit:  1000})
-
-		<-collDone
-
-		// Return a nil error only if both parts succeeded.
-		if collErr != nil {
-			return collErr
+// keepBalanceArgs returns the keep-balance configuration and command
+// line arguments equivalent to the given Data Manager options.
+//
+// keep-balance only reads a snapshot (-read-data-from) in a single
+// run that does not commit any changes, so -dry-run and
+// -minutes-between-runs are ignored in that case.
+func (opts options) keepBalanceArgs(client arvados.Client) (keepBalanceConfig, []string, error) {
+	if opts.readDataFrom != "" {
+		if opts.writeDataTo != "" {
+			return keepBalanceConfig{}, nil, errors.New("cannot use both -read-data-from and -write-data-to")
 		}
-		return keepErr
+		opts.dryRun = true
+		opts.minutesBetweenRuns = 0
+	}
+	config := keepBalanceConfig{
+		Client:              client,
+		KeepServiceTypes:    []string{opts.serviceType},
+		RunPeriod:           arvados.Duration(time.Duration(opts.minutesBetweenRuns) * time.Minute),
+		CollectionBatchSize: opts.collectionBatchSize,
+		LogEventTypePrefix:  opts.logEventTypePrefix,
+	}
+	var args []string
+	if opts.minutesBetweenRuns == 0 {
+		args = append(args, "-once")
+	}
+	if !opts.dryRun {
+		args = append(args, "-commit-pulls", "-commit-trash")
+	}
+	if opts.writeDataTo != "" {
+		args = append(args, "-write-snapshot", opts.writeDataTo)
+	}
+	if opts.readDataFrom != "" {
+		args = append(args, "-read-snapshot", opts.readDataFrom)
 	}
+	return config, args, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"math"
@@ -24,6 +25,17 @@ func CheckConfig(config Config, runOptions RunOptions) error {
 	if !runOptions.Once && config.RunPeriod == arvados.Duration(0) {
 		return fmt.Errorf("you must either use the -once flag, or specify RunPeriod in config")
 	}
+	if runOptions.ReadSnapshot != "" {
+		if !runOptions.Once {
+			return fmt.Errorf("cannot use -read-snapshot without -once")
+		}
+		if runOptions.CommitPulls || runOptions.CommitTrash {
+			return fmt.Errorf("cannot commit changes computed from a snapshot")
+		}
+		if runOptions.WriteSnapshot != "" {
+			return fmt.Errorf("cannot use both -read-snapshot and -write-snapshot")
+		}
+	}
 	return nil
 }
 
@@ -46,6 +58,11 @@ type Balancer struct {
 
 	collScanned  int
 	serviceRoots map[string]string
+	reporter     *changeReporter
+	status       *Status
+	collCache    *collectionCache
+	snapshot     *snapshot
+	eventLog     *eventLogger
 	errors       []error
 	mutex        sync.Mutex
 }
@@ -70,6 +87,77 @@ func (bal *Balancer) Run(config Config, runOptions RunOptions) (nextRunOptions R
 
 	defer timeMe(bal.Logger, "Run")()
 
+	bal.status = runOptions.Status
+	bal.status.startRun()
+	if runOptions.ReadSnapshot == "" {
+		bal.eventLog = newEventLogger(&config.Client, config.LogEventTypePrefix, bal.logf)
+	}
+	computed := false
+	defer func() {
+		var stats balancerStats
+		if computed && (bal.status != nil || bal.eventLog != nil) {
+			stats = bal.getStatistics()
+		}
+		bal.status.finishRun(stats, err)
+		bal.eventLog.finish(stats, err)
+	}()
+
+	if runOptions.ReadSnapshot != "" {
+		// Everything needed to compute changes comes from
+		// the snapshot. Don't contact the API or keepstore
+		// servers at all.
+		bal.setPhase("reading snapshot")
+		if err = bal.ReadSnapshot(runOptions.ReadSnapshot); err != nil {
+			return
+		}
+	} else if err = bal.fetchState(config, runOptions, &nextRunOptions); err != nil {
+		return
+	}
+	bal.setPhase("computing changes")
+	if runOptions.ChangeReport != "" {
+		if bal.reporter, err = newChangeReporter(runOptions.ChangeReport); err != nil {
+			return
+		}
+	}
+	bal.ComputeChangeSets()
+	computed = true
+	if bal.reporter != nil {
+		var summary string
+		if summary, err = bal.reporter.close(); err != nil {
+			return
+		}
+		bal.logf("%s", summary)
+	}
+	bal.PrintStatistics()
+	if err = bal.CheckSanityLate(); err != nil {
+		return
+	}
+	if runOptions.CommitPulls {
+		if err = bal.status.checkAbort(); err != nil {
+			return
+		}
+		bal.setPhase("committing pulls")
+		err = bal.CommitPulls(&config.Client)
+		if err != nil {
+			// Skip trash if we can't pull. (Too cautious?)
+			return
+		}
+	}
+	if runOptions.CommitTrash {
+		if err = bal.status.checkAbort(); err != nil {
+			return
+		}
+		bal.setPhase("committing trash")
+		err = bal.CommitTrash(&config.Client)
+	}
+	return
+}
+
+// fetchState discovers the keep services to balance, clears their
+// trash lists if needed (updating nextRunOptions accordingly), and
+// retrieves the current state from the API and keepstore servers.
+func (bal *Balancer) fetchState(config Config, runOptions RunOptions, nextRunOptions *RunOptions) (err error) {
+	bal.setPhase("discovering keep services")
 	if len(config.KeepServiceList.Items) > 0 {
 		err = bal.SetKeepServices(config.KeepServiceList)
 	} else {
@@ -88,6 +176,7 @@ func (bal *Balancer) Run(config Config, runOptions RunOptions) (nextRunOptions R
 			bal.logf("notice: KeepServices list has changed since last run")
 		}
 		bal.logf("clearing existing trash lists, in case the new rendezvous order differs from previous run")
+		bal.setPhase("clearing trash lists")
 		if err = bal.ClearTrashLists(&config.Client); err != nil {
 			return
 		}
@@ -97,23 +186,36 @@ func (bal *Balancer) Run(config Config, runOptions RunOptions) (nextRunOptions R
 		// succeed in clearing existing trash lists.
 		nextRunOptions.SafeRendezvousState = rs
 	}
-	if err = bal.GetCurrentState(&config.Client, config.CollectionBatchSize, config.CollectionBuffers); err != nil {
+	if err = bal.status.checkAbort(); err != nil {
 		return
 	}
-	bal.ComputeChangeSets()
-	bal.PrintStatistics()
-	if err = bal.CheckSanityLate(); err != nil {
+	if config.CollectionCache != "" {
+		bal.collCache = loadCollectionCache(config.CollectionCache, time.Duration(config.FullScanPeriod), bal.logf)
+	}
+	if runOptions.WriteSnapshot != "" {
+		if bal.collCache == nil {
+			bal.collCache = newCollectionCache()
+		}
+		bal.snapshot = newSnapshot()
+		for _, srv := range bal.KeepServices {
+			bal.snapshot.KeepServices = append(bal.snapshot.KeepServices, srv.KeepService)
+		}
+	}
+	bal.setPhase("fetching collections and indexes")
+	if err = bal.GetCurrentState(&config.Client, config.CollectionBatchSize, config.CollectionBuffers); err != nil {
 		return
 	}
-	if runOptions.CommitPulls {
-		err = bal.CommitPulls(&config.Client)
-		if err != nil {
-			// Skip trash if we can't pull. (Too cautious?)
+	if config.CollectionCache != "" {
+		if err = bal.collCache.save(config.CollectionCache); err != nil {
 			return
 		}
 	}
-	if runOptions.CommitTrash {
-		err = bal.CommitTrash(&config.Client)
+	if bal.snapshot != nil {
+		bal.snapshot.Collections = bal.collCache.Collections
+		if err = bal.snapshot.save(runOptions.WriteSnapshot); err != nil {
+			return
+		}
+		bal.logf("wrote snapshot to %q", runOptions.WriteSnapshot)
 	}
 	return
 }
@@ -215,7 +317,9 @@ func (bal *Balancer) ClearTrashLists(c *arvados.Client) error {
 // from every known Keep service.
 //
 // It determines the desired replication level by retrieving all
-// collection manifests in the database (API server).
+// collection manifests in the database (API server) -- or, if a
+// collection cache is in use, only the collections modified since
+// the previous run.
 //
 // It encodes the resulting information in BlockStateMap.
 func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) error {
@@ -226,11 +330,18 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 	if err != nil {
 		return err
 	}
+	now := time.Now()
 	bal.DefaultReplication = dd.DefaultCollectionReplication
-	bal.MinMtime = time.Now().UnixNano() - dd.BlobSignatureTTL*1e9
+	bal.MinMtime = now.UnixNano() - dd.BlobSignatureTTL*1e9
+	if bal.snapshot != nil {
+		bal.snapshot.Time = now
+		bal.snapshot.DefaultReplication = dd.DefaultCollectionReplication
+		bal.snapshot.BlobSignatureTTL = dd.BlobSignatureTTL
+	}
 
 	errs := make(chan error, 2+len(bal.KeepServices))
 	wg := sync.WaitGroup{}
+	bal.status.setIndexTotal(len(bal.KeepServices))
 
 	// Start one goroutine for each KeepService: retrieve the
 	// index, and add the returned blocks to BlockStateMap.
@@ -246,6 +357,10 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 			}
 			bal.logf("%s: add %d replicas to map", srv, len(idx))
 			bal.BlockStateMap.AddReplicas(srv, idx)
+			if bal.snapshot != nil {
+				bal.snapshot.addIndex(srv, idx)
+			}
+			bal.status.indexFetched()
 			bal.logf("%s: done", srv)
 		}(srv)
 	}
@@ -278,7 +393,11 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err = EachCollection(c, pageSize,
+		var since time.Time
+		if bal.collCache != nil {
+			since = bal.collCache.since
+		}
+		err = EachCollectionModifiedSince(c, pageSize, since,
 			func(coll arvados.Collection) error {
 				collQ <- coll
 				if len(errs) > 0 {
@@ -288,9 +407,10 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 					// collections.
 					return fmt.Errorf("")
 				}
-				return nil
+				return bal.status.checkAbort()
 			}, func(done, total int) {
 				bal.logf("collections: %d/%d", done, total)
+				bal.status.collectionProgress(done, total)
 			})
 		close(collQ)
 		if err != nil {
@@ -298,14 +418,21 @@ func (bal *Balancer) GetCurrentState(c *arvados.Client, pageSize, bufs int) erro
 		}
 	}()
 
-	go func() {
-		// Send a nil error when all goroutines finish. If
-		// this is the first error sent to errs, then
-		// everything worked.
-		wg.Wait()
-		errs <- nil
-	}()
-	return <-errs
+	// Wait for all goroutines to finish, even if one of them has
+	// already failed, so none of them is still updating
+	// BlockStateMap (or using the API client) after we return.
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	if bal.collCache != nil {
+		bal.collCache.apply(bal.BlockStateMap, bal.DefaultReplication)
+		bal.collScanned = len(bal.collCache.Collections)
+	}
+	return nil
 }
 
 func (bal *Balancer) addCollection(coll arvados.Collection) error {
@@ -316,6 +443,12 @@ func (bal *Balancer) addCollection(coll arvados.Collection) error {
 		bal.mutex.Unlock()
 		return nil
 	}
+	if bal.collCache != nil {
+		// Desired replication is applied after all
+		// modified collections have been retrieved.
+		bal.collCache.update(coll, blkids)
+		return nil
+	}
 	repl := bal.DefaultReplication
 	if coll.ReplicationDesired != nil {
 		repl = *coll.ReplicationDesired
@@ -432,6 +565,21 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) {
 					Mtime:       repl.Mtime,
 				})
 				change = changeTrash
+				if bal.reporter != nil {
+					reason := "overreplicated"
+					if blk.Desired == 0 {
+						reason = "unreferenced"
+					}
+					bal.reporter.add(ChangeReportEntry{
+						Change:  changeName[change],
+						Block:   blkid,
+						Service: srv.UUID,
+						Mtime:   repl.Mtime,
+						Reason:  reason,
+						Have:    len(blk.Replicas),
+						Want:    blk.Desired,
+					})
+				}
 			} else {
 				change = changeStay
 			}
@@ -450,6 +598,21 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) {
 			})
 			pulls++
 			change = changePull
+			if bal.reporter != nil {
+				reason := "misplaced"
+				if len(blk.Replicas) < blk.Desired {
+					reason = "underreplicated"
+				}
+				bal.reporter.add(ChangeReportEntry{
+					Change:  changeName[change],
+					Block:   blkid,
+					Service: srv.UUID,
+					Source:  blk.Replicas[0].URLBase(),
+					Reason:  reason,
+					Have:    len(blk.Replicas),
+					Want:    blk.Desired,
+				})
+			}
 		}
 		if bal.Dumper != nil {
 			changes = append(changes, fmt.Sprintf("%s:%d=%s,%d", srv.ServiceHost, srv.ServicePort, changeName[change], repl.Mtime))
@@ -470,15 +633,83 @@ func (bb blocksNBytes) String() string {
 	return fmt.Sprintf("%d replicas (%d blocks, %d bytes)", bb.replicas, bb.blocks, bb.bytes)
 }
 
+// MarshalJSON implements json.Marshaler.
+func (bb blocksNBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"replicas": bb.replicas,
+		"blocks":   bb.blocks,
+		"bytes":    bb.bytes,
+	})
+}
+
+// replLevels is a combination of desired and actual replication
+// levels, used to group blocks into buckets.
+type replLevels struct {
+	want, have int
+}
+
 type balancerStats struct {
 	lost, overrep, unref, garbage, underrep, justright blocksNBytes
 	desired, current                                   blocksNBytes
 	pulls, trashes                                     int
 	replHistogram                                      []int
+	replBuckets                                        map[replLevels]int
+}
+
+// replLevelsSlice implements sort.Interface, ordering by desired
+// replication, then actual replication.
+type replLevelsSlice []replLevels
+
+func (rls replLevelsSlice) Len() int      { return len(rls) }
+func (rls replLevelsSlice) Swap(i, j int) { rls[i], rls[j] = rls[j], rls[i] }
+func (rls replLevelsSlice) Less(i, j int) bool {
+	if rls[i].want != rls[j].want {
+		return rls[i].want < rls[j].want
+	}
+	return rls[i].have < rls[j].have
+}
+
+// sortedReplBuckets returns the keys of s.replBuckets in order.
+func (s balancerStats) sortedReplBuckets() []replLevels {
+	levels := make(replLevelsSlice, 0, len(s.replBuckets))
+	for lv := range s.replBuckets {
+		levels = append(levels, lv)
+	}
+	sort.Sort(levels)
+	return levels
+}
+
+// MarshalJSON implements json.Marshaler. The category names match
+// the ones logged by PrintStatistics.
+func (s balancerStats) MarshalJSON() ([]byte, error) {
+	type bucket struct {
+		Want   int `json:"want"`
+		Have   int `json:"have"`
+		Blocks int `json:"blocks"`
+	}
+	buckets := []bucket{}
+	for _, lv := range s.sortedReplBuckets() {
+		buckets = append(buckets, bucket{lv.want, lv.have, s.replBuckets[lv]})
+	}
+	return json.Marshal(map[string]interface{}{
+		"lost":                  s.lost,
+		"underreplicated":       s.underrep,
+		"just_right":            s.justright,
+		"overreplicated":        s.overrep,
+		"unreferenced":          s.unref,
+		"garbage":               s.garbage,
+		"total_commitment":      s.desired,
+		"total_usage":           s.current,
+		"pulls":                 s.pulls,
+		"trashes":               s.trashes,
+		"replication_histogram": s.replHistogram,
+		"replication_buckets":   buckets,
+	})
 }
 
 func (bal *Balancer) getStatistics() (s balancerStats) {
 	s.replHistogram = make([]int, 2)
+	s.replBuckets = make(map[replLevels]int)
 	bal.BlockStateMap.Apply(func(blkid arvados.SizedDigest, blk *BlockState) {
 		surplus := len(blk.Replicas) - blk.Desired
 		bytes := blkid.Size()
@@ -527,6 +758,7 @@ func (bal *Balancer) getStatistics() (s balancerStats) {
 			s.replHistogram = append(s.replHistogram, 0)
 		}
 		s.replHistogram[len(blk.Replicas)]++
+		s.replBuckets[replLevels{want: blk.Desired, have: len(blk.Replicas)}]++
 	})
 	for _, srv := range bal.KeepServices {
 		s.pulls += len(srv.ChangeSet.Pulls)
@@ -557,6 +789,11 @@ func (bal *Balancer) PrintStatistics() {
 	bal.logf("===")
 	bal.printHistogram(s, 60)
 	bal.logf("===")
+	bal.logf("Replication level buckets (want/have: blocks):")
+	for _, lv := range s.sortedReplBuckets() {
+		bal.logf("%2d/%2d: %d", lv.want, lv.have, s.replBuckets[lv])
+	}
+	bal.logf("===")
 }
 
 func (bal *Balancer) printHistogram(s balancerStats, hashColumns int) {
@@ -657,6 +894,13 @@ func (bal *Balancer) commitAsync(c *arvados.Client, label string, f func(srv *Ke
 	return lastErr
 }
 
+// setPhase reports the current phase of the balance operation to
+// the status server and the Arvados event log.
+func (bal *Balancer) setPhase(phase string) {
+	bal.status.setPhase(phase)
+	bal.eventLog.setPhase(phase)
+}
+
 func (bal *Balancer) logf(f string, args ...interface{}) {
 	if bal.Logger != nil {
 		bal.Logger.Printf(f, args...)
@@ -1,13 +1,15 @@
 package main
 
 import (
-	_ "encoding/json"
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -344,6 +346,204 @@ func (s *runSuite) TestCommit(c *check.C) {
 	c.Check(stats.pulls, check.Equals, 2)
 }
 
+func (s *runSuite) TestChangeReport(c *check.C) {
+	opts := RunOptions{
+		CommitPulls:  false,
+		CommitTrash:  false,
+		Logger:       s.logger(c),
+		ChangeReport: c.MkDir() + "/changes.json",
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveFourDiskKeepServices()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	for _, status := range []string{"new", "unchanged"} {
+		_, err := (&Balancer{}).Run(s.config, opts)
+		c.Assert(err, check.IsNil)
+
+		f, err := os.Open(opts.ChangeReport)
+		c.Assert(err, check.IsNil)
+		count := map[string]int{}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var ent ChangeReportEntry
+			c.Assert(json.Unmarshal(scanner.Bytes(), &ent), check.IsNil)
+			c.Check(ent.Status, check.Equals, status)
+			c.Check(ent.Want, check.Equals, 2)
+			switch ent.Change {
+			case "pull":
+				c.Check(ent.Block, check.Equals, arvados.SizedDigest("37b51d194a7513e45b56f6524f2d51f2+3"))
+				c.Check(ent.Source, check.Equals, "http://keep0.zzzzz.arvadosapi.com:25107")
+				c.Check(ent.Have, check.Equals, 1)
+			case "trash":
+				c.Check(ent.Block, check.Equals, arvados.SizedDigest("acbd18db4cc2f85cedef654fccc4a4d8+3"))
+				c.Check(ent.Reason, check.Equals, "overreplicated")
+				c.Check(ent.Have, check.Equals, 4)
+			}
+			count[ent.Change]++
+		}
+		f.Close()
+		c.Check(scanner.Err(), check.IsNil)
+		c.Check(count["pull"], check.Equals, 2)
+		c.Check(count["trash"], check.Equals, 2)
+	}
+}
+
+func (s *runSuite) TestStatus(c *check.C) {
+	opts := RunOptions{
+		Logger: s.logger(c),
+		Status: &Status{},
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveFourDiskKeepServices()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	_, err := (&Balancer{}).Run(s.config, opts)
+	c.Check(err, check.IsNil)
+
+	buf, err := json.Marshal(opts.Status)
+	c.Assert(err, check.IsNil)
+	var st struct {
+		Phase   string
+		Indexes struct{ Done, Total int }
+		LastRun struct {
+			Error string
+			Stats struct{ Pulls, Trashes int }
+		} `json:"last_run"`
+	}
+	c.Assert(json.Unmarshal(buf, &st), check.IsNil)
+	c.Check(st.Phase, check.Equals, "idle")
+	c.Check(st.Indexes.Done, check.Equals, 4)
+	c.Check(st.Indexes.Total, check.Equals, 4)
+	c.Check(st.LastRun.Error, check.Equals, "")
+	c.Check(st.LastRun.Stats.Pulls, check.Equals, 2)
+	c.Check(st.LastRun.Stats.Trashes, check.Equals, 2)
+}
+
+func (s *runSuite) TestAbort(c *check.C) {
+	opts := RunOptions{
+		CommitPulls: true,
+		CommitTrash: true,
+		Logger:      s.logger(c),
+		Status:      &Status{},
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFourDiskKeepServices()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	s.stub.mux.HandleFunc("/arvados/v1/collections", func(w http.ResponseWriter, r *http.Request) {
+		opts.Status.Abort()
+		io.WriteString(w, `{"items_available":2,"items":[
+			{"uuid":"zzzzz-4zz18-ehbhgtheo8909or","portable_data_hash":"fa7aeb5140e2848d39b416daeef4ffc5+45","manifest_text":". 37b51d194a7513e45b56f6524f2d51f2+3 0:3:bar\n","modified_at":"2014-02-03T17:22:54Z"}]}`)
+	})
+	trashReqs := s.stub.serveKeepstoreTrash()
+	pullReqs := s.stub.serveKeepstorePull()
+	_, err := (&Balancer{}).Run(s.config, opts)
+	c.Check(err, check.Equals, errAborted)
+	// Only the initial "clear trash lists" requests are sent.
+	c.Check(trashReqs.Count(), check.Equals, 4)
+	c.Check(pullReqs.Count(), check.Equals, 0)
+}
+
+func (s *runSuite) TestCollectionCache(c *check.C) {
+	opts := RunOptions{
+		Logger: s.logger(c),
+	}
+	s.config.CollectionCache = c.MkDir() + "/collections.gob"
+	s.stub.serveCurrentUserAdmin()
+	collReqs := s.stub.serveFooBarFileCollections()
+	s.stub.serveFourDiskKeepServices()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+
+	for _, trial := range []struct {
+		fullScanPeriod time.Duration
+		expectFull     bool
+	}{
+		{time.Hour, true},
+		{time.Hour, false},
+		{time.Nanosecond, true},
+	} {
+		s.config.FullScanPeriod = arvados.Duration(trial.fullScanPeriod)
+		reqsBefore := collReqs.Count()
+		var bal Balancer
+		_, err := bal.Run(s.config, opts)
+		c.Assert(err, check.IsNil)
+		stats := bal.getStatistics()
+		c.Check(stats.pulls, check.Equals, 2)
+		c.Check(stats.trashes, check.Equals, 2)
+
+		collReqs.Lock()
+		firstReq := collReqs.reqs[reqsBefore]
+		collReqs.Unlock()
+		c.Check(strings.Contains(firstReq.Form.Get("filters"), "modified_at"), check.Equals, !trial.expectFull)
+	}
+}
+
+func (s *runSuite) TestSnapshot(c *check.C) {
+	opts := RunOptions{
+		Once:          true,
+		Logger:        s.logger(c),
+		WriteSnapshot: c.MkDir() + "/snapshot.gob",
+	}
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFourDiskKeepServices()
+	collReqs := s.stub.serveFooBarFileCollections()
+	indexReqs := s.stub.serveKeepstoreIndexFoo4Bar1()
+	var bal Balancer
+	_, err := bal.Run(s.config, opts)
+	c.Assert(err, check.IsNil)
+	expect := bal.getStatistics()
+
+	// Replay offline: with an empty config, any attempt to
+	// contact the API server would fail.
+	opts.ReadSnapshot, opts.WriteSnapshot = opts.WriteSnapshot, ""
+	collReqsBefore, indexReqsBefore := collReqs.Count(), indexReqs.Count()
+	bal = Balancer{}
+	_, err = bal.Run(Config{}, opts)
+	c.Assert(err, check.IsNil)
+	c.Check(collReqs.Count(), check.Equals, collReqsBefore)
+	c.Check(indexReqs.Count(), check.Equals, indexReqsBefore)
+	stats := bal.getStatistics()
+	c.Check(stats.pulls, check.Equals, expect.pulls)
+	c.Check(stats.trashes, check.Equals, expect.trashes)
+	c.Check(stats.replBuckets, check.DeepEquals, expect.replBuckets)
+	c.Check(stats.replBuckets[replLevels{want: 2, have: 4}], check.Equals, 1)
+	c.Check(stats.replBuckets[replLevels{want: 2, have: 1}], check.Equals, 1)
+	c.Check(len(bal.KeepServices), check.Equals, 4)
+	c.Check(bal.DefaultReplication, check.Equals, 2)
+
+	opts.CommitTrash = true
+	c.Check(CheckConfig(s.config, opts), check.ErrorMatches, "cannot commit .*")
+}
+
+func (s *runSuite) TestEventLog(c *check.C) {
+	opts := RunOptions{
+		Logger: s.logger(c),
+	}
+	s.config.LogEventTypePrefix = "test-keep-balance"
+	s.stub.serveCurrentUserAdmin()
+	s.stub.serveFooBarFileCollections()
+	s.stub.serveFourDiskKeepServices()
+	s.stub.serveKeepstoreIndexFoo4Bar1()
+	var eventTypes []string
+	var final map[string]interface{}
+	s.stub.mux.HandleFunc("/arvados/v1/logs", func(w http.ResponseWriter, r *http.Request) {
+		var ent map[string]interface{}
+		c.Check(json.Unmarshal([]byte(r.FormValue("log")), &ent), check.IsNil)
+		eventTypes = append(eventTypes, ent["event_type"].(string))
+		final = ent
+		io.WriteString(w, `{}`)
+	})
+	_, err := (&Balancer{}).Run(s.config, opts)
+	c.Check(err, check.IsNil)
+	c.Assert(len(eventTypes) > 2, check.Equals, true)
+	c.Check(eventTypes[0], check.Equals, "test-keep-balance-start")
+	c.Check(eventTypes[1], check.Equals, "test-keep-balance-partial")
+	c.Check(eventTypes[len(eventTypes)-1], check.Equals, "test-keep-balance-final")
+	props := final["properties"].(map[string]interface{})
+	c.Check(props["run_info"].(map[string]interface{})["finished_at"], check.NotNil)
+	c.Check(props["summary_info"].(map[string]interface{})["pulls"], check.Equals, float64(2))
+}
+
 func (s *runSuite) TestRunForever(c *check.C) {
 	opts := RunOptions{
 		CommitPulls: true,
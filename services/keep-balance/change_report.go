@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// ChangeReportEntry describes one planned change (pull or trash) in
+// a machine-readable change report. A change report is a file with
+// one JSON-encoded ChangeReportEntry per line.
+type ChangeReportEntry struct {
+	// "pull" or "trash"
+	Change string `json:"change"`
+
+	Block arvados.SizedDigest `json:"block"`
+
+	// UUID of the keep service that will receive the request,
+	// i.e., the destination of a pull, or the server that will
+	// delete a replica.
+	Service string `json:"service"`
+
+	// Server to copy the block from (pulls only).
+	Source string `json:"source,omitempty"`
+
+	// Mtime of the replica to be deleted (trashes only).
+	Mtime int64 `json:"mtime,omitempty"`
+
+	// Why the change is needed: "underreplicated" or "misplaced"
+	// for pulls; "overreplicated" or "unreferenced" for trashes.
+	Reason string `json:"reason"`
+
+	// Current and desired replication of the block.
+	Have int `json:"have"`
+	Want int `json:"want"`
+
+	// "new" if the change did not appear in the previous report
+	// at the same path, otherwise "unchanged".
+	Status string `json:"status"`
+}
+
+func (ent *ChangeReportEntry) key() string {
+	return fmt.Sprintf("%s %s %s", ent.Change, ent.Block, ent.Service)
+}
+
+// changeReporter writes a change report to a temporary file, and
+// compares it to the previous report found at the same path. It is
+// safe to call add() from multiple goroutines.
+type changeReporter struct {
+	path     string
+	file     *os.File
+	buf      *bufio.Writer
+	enc      *json.Encoder
+	previous map[string]bool
+	seen     int
+	counts   map[string]map[string]int
+	err      error
+	mutex    sync.Mutex
+}
+
+// newChangeReporter reads the previous report at path (if any) and
+// opens a temporary file for the new report. The new report replaces
+// the previous one when close() succeeds.
+func newChangeReporter(path string) (*changeReporter, error) {
+	rep := &changeReporter{
+		path:     path,
+		previous: make(map[string]bool),
+		counts:   make(map[string]map[string]int),
+	}
+	if err := rep.loadPrevious(); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	rep.file = f
+	rep.buf = bufio.NewWriter(f)
+	rep.enc = json.NewEncoder(rep.buf)
+	return rep, nil
+}
+
+func (rep *changeReporter) loadPrevious() error {
+	f, err := os.Open(rep.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var ent ChangeReportEntry
+		err := dec.Decode(&ent)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading previous change report %q: %v", rep.path, err)
+		}
+		rep.previous[ent.key()] = true
+	}
+}
+
+func (rep *changeReporter) add(ent ChangeReportEntry) {
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+	if rep.previous[ent.key()] {
+		ent.Status = "unchanged"
+		rep.seen++
+	} else {
+		ent.Status = "new"
+	}
+	if rep.counts[ent.Change] == nil {
+		rep.counts[ent.Change] = make(map[string]int)
+	}
+	rep.counts[ent.Change][ent.Status]++
+	if rep.err == nil {
+		rep.err = rep.enc.Encode(ent)
+	}
+}
+
+// close finishes writing the new report, moves it into place, and
+// returns a one-line summary of differences from the previous
+// report.
+func (rep *changeReporter) close() (string, error) {
+	err := rep.err
+	if err == nil {
+		err = rep.buf.Flush()
+	}
+	if cerr := rep.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(rep.file.Name(), rep.path)
+	}
+	if err != nil {
+		os.Remove(rep.file.Name())
+		return "", fmt.Errorf("writing change report %q: %v", rep.path, err)
+	}
+	return fmt.Sprintf("change report: %d pulls (%d new), %d trashes (%d new), %d changes from previous report no longer planned",
+		rep.counts["pull"]["new"]+rep.counts["pull"]["unchanged"], rep.counts["pull"]["new"],
+		rep.counts["trash"]["new"]+rep.counts["trash"]["unchanged"], rep.counts["trash"]["new"],
+		len(rep.previous)-rep.seen), nil
+}
@@ -26,11 +26,27 @@ func countCollections(c *arvados.Client, params arvados.ResourceListParams) (int
 // If pageSize > 0 it is used as the maximum page size in each API
 // call; otherwise the maximum allowed page size is requested.
 func EachCollection(c *arvados.Client, pageSize int, f func(arvados.Collection) error, progress func(done, total int)) error {
+	return EachCollectionModifiedSince(c, pageSize, time.Time{}, f, progress)
+}
+
+// EachCollectionModifiedSince is like EachCollection, but only
+// calls f for collections whose modified_at is at or after the given
+// time. If since is zero, every collection is included.
+func EachCollectionModifiedSince(c *arvados.Client, pageSize int, since time.Time, f func(arvados.Collection) error, progress func(done, total int)) error {
 	if progress == nil {
 		progress = func(_, _ int) {}
 	}
 
-	expectCount, err := countCollections(c, arvados.ResourceListParams{})
+	var sinceFilters []arvados.Filter
+	if !since.IsZero() {
+		sinceFilters = []arvados.Filter{{
+			Attr:     "modified_at",
+			Operator: ">=",
+			Operand:  since,
+		}}
+	}
+
+	expectCount, err := countCollections(c, arvados.ResourceListParams{Filters: sinceFilters})
 	if err != nil {
 		return err
 	}
@@ -41,12 +57,13 @@ func EachCollection(c *arvados.Client, pageSize int, f func(arvados.Collection)
 		limit = 1<<31 - 1
 	}
 	params := arvados.ResourceListParams{
-		Limit:  &limit,
-		Order:  "modified_at, uuid",
-		Select: []string{"uuid", "manifest_text", "modified_at", "portable_data_hash", "replication_desired"},
+		Limit:   &limit,
+		Order:   "modified_at, uuid",
+		Select:  []string{"uuid", "manifest_text", "modified_at", "portable_data_hash", "replication_desired"},
+		Filters: sinceFilters,
 	}
 	var last arvados.Collection
-	var filterTime time.Time
+	filterTime := since
 	callCount := 0
 	for {
 		progress(callCount, expectCount)
@@ -89,10 +106,10 @@ func EachCollection(c *arvados.Client, pageSize int, f func(arvados.Collection)
 	}
 	progress(callCount, expectCount)
 
-	if checkCount, err := countCollections(c, arvados.ResourceListParams{Filters: []arvados.Filter{{
+	if checkCount, err := countCollections(c, arvados.ResourceListParams{Filters: append([]arvados.Filter{{
 		Attr:     "modified_at",
 		Operator: "<=",
-		Operand:  filterTime}}}); err != nil {
+		Operand:  filterTime}}, sinceFilters...)}); err != nil {
 		return err
 	} else if callCount < checkCount {
 		return fmt.Errorf("Retrieved %d collections with modtime <= T=%q, but server now reports there are %d collections with modtime <= T", callCount, filterTime, checkCount)
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// incrementalOverlap is subtracted from the high-water mark when
+// retrieving modified collections, so collections whose modified_at
+// timestamps arrive slightly out of order (e.g., because of clock
+// skew between API servers, or transactions that take a while to
+// commit) are not missed.
+const incrementalOverlap = 5 * time.Minute
+
+// defaultFullScanPeriod is used when CollectionCache is configured
+// but FullScanPeriod is not.
+const defaultFullScanPeriod = 24 * time.Hour
+
+// cachedCollection is the part of a collection record keep-balance
+// needs in order to compute desired replication.
+type cachedCollection struct {
+	ReplicationDesired *int
+	Blocks             []arvados.SizedDigest
+}
+
+// collectionCache remembers the blocks referenced by each collection
+// as of the previous run, so a subsequent run only needs to retrieve
+// the collections that have been modified since then.
+//
+// Collections that are deleted are not noticed until the next full
+// scan. In the meantime, their blocks are still considered to be
+// referenced, i.e., they are not garbage collected.
+type collectionCache struct {
+	// Latest modified_at of any collection retrieved so far.
+	HighWater time.Time
+
+	// Start time of the most recent full scan.
+	LastFullScan time.Time
+
+	// Blocks referenced by each collection, keyed by UUID.
+	Collections map[string]cachedCollection
+
+	// Non-zero if only collections modified since this time
+	// need to be retrieved.
+	since time.Time
+	mutex sync.Mutex
+}
+
+// newCollectionCache returns an empty cache, which calls for a full
+// scan.
+func newCollectionCache() *collectionCache {
+	return &collectionCache{
+		LastFullScan: time.Now(),
+		Collections:  make(map[string]cachedCollection),
+	}
+}
+
+// loadCollectionCache reads the cache file at path. If the file does
+// not exist or cannot be decoded, or the last full scan happened more
+// than fullScanPeriod ago, it returns an empty cache that calls for
+// a full scan.
+func loadCollectionCache(path string, fullScanPeriod time.Duration, logf func(string, ...interface{})) *collectionCache {
+	if fullScanPeriod <= 0 {
+		fullScanPeriod = defaultFullScanPeriod
+	}
+	full := newCollectionCache()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		logf("collection cache %q does not exist yet: doing a full scan", path)
+		return full
+	} else if err != nil {
+		logf("collection cache %q: %v: doing a full scan", path, err)
+		return full
+	}
+	defer f.Close()
+	cache := &collectionCache{}
+	if err = gob.NewDecoder(f).Decode(cache); err != nil {
+		logf("collection cache %q: decode: %v: doing a full scan", path, err)
+		return full
+	}
+	if time.Since(cache.LastFullScan) > fullScanPeriod {
+		logf("collection cache %q: last full scan was at %v: doing a full scan", path, cache.LastFullScan)
+		return full
+	}
+	if cache.Collections == nil {
+		cache.Collections = make(map[string]cachedCollection)
+	}
+	cache.since = cache.HighWater.Add(-incrementalOverlap)
+	logf("collection cache %q: %d collections, retrieving collections modified since %v", path, len(cache.Collections), cache.since)
+	return cache
+}
+
+// update replaces the cached information about the given collection.
+func (cache *collectionCache) update(coll arvados.Collection, blkids []arvados.SizedDigest) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.Collections[coll.UUID] = cachedCollection{
+		ReplicationDesired: coll.ReplicationDesired,
+		Blocks:             blkids,
+	}
+	if coll.ModifiedAt != nil && coll.ModifiedAt.After(cache.HighWater) {
+		cache.HighWater = *coll.ModifiedAt
+	}
+}
+
+// apply updates bsm to indicate the desired replication of every
+// block referenced by a cached collection.
+func (cache *collectionCache) apply(bsm *BlockStateMap, defaultReplication int) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, coll := range cache.Collections {
+		repl := defaultReplication
+		if coll.ReplicationDesired != nil {
+			repl = *coll.ReplicationDesired
+		}
+		bsm.IncreaseDesired(repl, coll.Blocks)
+	}
+}
+
+// save writes the cache to path, replacing the previous version
+// only if the new one is written successfully.
+func (cache *collectionCache) save(path string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(cache)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("saving collection cache %q: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// eventLogger records the progress and results of a balance
+// operation as entries in the Arvados logs table. The entries have
+// the same event types as the legacy Data Manager's:
+// "{prefix}-start" when the operation starts, "{prefix}-partial"
+// each time it enters a new phase, and "{prefix}-final" when it
+// finishes.
+//
+// A nil *eventLogger is valid, and does nothing.
+type eventLogger struct {
+	client     *arvados.Client
+	prefix     string
+	logf       func(string, ...interface{})
+	properties map[string]interface{}
+	runInfo    map[string]interface{}
+	mutex      sync.Mutex
+}
+
+// newEventLogger returns an eventLogger that writes log entries using
+// the given client, or nil if prefix is empty.
+func newEventLogger(c *arvados.Client, prefix string, logf func(string, ...interface{})) *eventLogger {
+	if prefix == "" {
+		return nil
+	}
+	runInfo := map[string]interface{}{
+		"started_at": time.Now(),
+		"args":       os.Args,
+		"pid":        os.Getpid(),
+	}
+	if hostname, err := os.Hostname(); err != nil {
+		runInfo["hostname_error"] = err.Error()
+	} else {
+		runInfo["hostname"] = hostname
+	}
+	el := &eventLogger{
+		client:     c,
+		prefix:     prefix,
+		logf:       logf,
+		runInfo:    runInfo,
+		properties: map[string]interface{}{"run_info": runInfo},
+	}
+	el.write("-start")
+	return el
+}
+
+func (el *eventLogger) setPhase(phase string) {
+	if el == nil {
+		return
+	}
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	el.runInfo["phase"] = phase
+	el.write("-partial")
+}
+
+func (el *eventLogger) finish(stats balancerStats, err error) {
+	if el == nil {
+		return
+	}
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+	delete(el.runInfo, "phase")
+	el.runInfo["finished_at"] = time.Now()
+	if err != nil {
+		el.runInfo["error"] = err.Error()
+	}
+	el.properties["summary_info"] = stats
+	el.write("-final")
+}
+
+// write sends the current properties to the API server. Errors are
+// logged, but do not interrupt the balance operation.
+func (el *eventLogger) write(suffix string) {
+	err := el.post(map[string]interface{}{
+		"event_type": el.prefix + suffix,
+		"properties": el.properties,
+	})
+	if err != nil {
+		el.logf("error writing %s%s log entry: %v", el.prefix, suffix, err)
+	}
+}
+
+func (el *eventLogger) post(entry map[string]interface{}) error {
+	j, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	body := url.Values{"log": {string(j)}}.Encode()
+	req, err := http.NewRequest("POST", "https://"+el.client.APIHost+"/arvados/v1/logs", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return el.client.DoAndDecode(nil, req)
+}
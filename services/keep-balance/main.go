@@ -36,6 +36,33 @@ type Config struct {
 	// more memory, but can reduce store-and-forward latency when
 	// fetching pages)
 	CollectionBuffers int
+
+	// Path of a local file where keep-balance saves the blocks
+	// referenced by each collection. If given, each run only
+	// retrieves the collections that have been modified since the
+	// previous run, except for a periodic full scan.
+	CollectionCache string
+
+	// Maximum time between full scans of all collections when
+	// CollectionCache is used. Default 24h.
+	FullScanPeriod arvados.Duration
+
+	// Prefix of the event_type for entries written to the Arvados
+	// logs table to report the progress and results of each
+	// balance operation ("{prefix}-start", "{prefix}-partial",
+	// "{prefix}-final"). If empty, no log entries are written.
+	LogEventTypePrefix string
+
+	// Address ("host:port" or ":port") where the HTTP status
+	// server should listen when running periodically. If empty,
+	// no status server is started.
+	Listen string
+
+	// Token that must be supplied with POST requests to the
+	// status server (/run, /abort). This should not be the same
+	// as Client.AuthToken, which is a superuser token. If empty,
+	// POST requests are rejected.
+	ManagementToken string
 }
 
 // RunOptions controls runtime behavior. The flags/options that belong
@@ -52,6 +79,24 @@ type RunOptions struct {
 	Logger      *log.Logger
 	Dumper      *log.Logger
 
+	// Path of a file to write planned changes to, as JSON
+	// lines. See ChangeReportEntry.
+	ChangeReport string
+
+	// Path of a file to save the keep services, collections,
+	// and keepstore indexes to.
+	WriteSnapshot string
+
+	// Path of a file, written by a previous run, to read keep
+	// services, collections and keepstore indexes from. The API
+	// and keepstore servers are not contacted at all, so Config
+	// is not needed.
+	ReadSnapshot string
+
+	// Status, if not nil, is updated with the progress of each
+	// balance operation, and can be used to abort it.
+	Status *Status
+
 	// SafeRendezvousState from the most recent balance operation,
 	// or "" if unknown. If this changes from one run to the next,
 	// we need to watch out for races. See
@@ -77,14 +122,21 @@ func main() {
 	flag.BoolVar(&runOptions.CommitTrash, "commit-trash", false,
 		"send trash requests (delete unreferenced old blocks, and excess replicas of overreplicated blocks)")
 	dumpFlag := flag.Bool("dump", false, "dump details for each block to stdout")
+	flag.StringVar(&runOptions.ChangeReport, "change-report", "",
+		"write planned pull and trash requests to `path` as JSON lines, and log a summary of differences from the previous report at the same path")
+	flag.StringVar(&runOptions.WriteSnapshot, "write-snapshot", "",
+		"save the keep services, collections and keepstore indexes retrieved from the servers to `path`")
+	flag.StringVar(&runOptions.ReadSnapshot, "read-snapshot", "",
+		"compute changes offline from the keep services, collections and keepstore indexes saved in `path` by -write-snapshot, instead of contacting the servers (requires -once; changes are not committed; -config is optional)")
 	debugFlag := flag.Bool("debug", false, "enable debug messages")
 	flag.Usage = usage
 	flag.Parse()
 
-	if *configPath == "" {
+	if *configPath != "" {
+		mustReadJSON(&config, *configPath)
+	} else if runOptions.ReadSnapshot == "" {
 		log.Fatal("You must specify a config file (see `keep-balance -help`)")
 	}
-	mustReadJSON(&config, *configPath)
 	if *serviceListPath != "" {
 		mustReadJSON(&config.KeepServiceList, *serviceListPath)
 	}
@@ -129,6 +181,19 @@ func RunForever(config Config, runOptions RunOptions, stop <-chan interface{}) e
 	}
 	logger := runOptions.Logger
 
+	if runOptions.Status == nil {
+		runOptions.Status = &Status{}
+	}
+	status := runOptions.Status
+	if config.Listen != "" {
+		srv, err := startStatusServer(config.Listen, status, config.ManagementToken)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+		logger.Printf("status server listening at %s", srv.Addr)
+	}
+
 	ticker := time.NewTicker(time.Duration(config.RunPeriod))
 
 	// The unbuffered channel here means we only hear SIGUSR1 if
@@ -146,6 +211,7 @@ func RunForever(config Config, runOptions RunOptions, stop <-chan interface{}) e
 
 		bal := &Balancer{}
 		var err error
+		t0 := time.Now()
 		runOptions, err = bal.Run(config, runOptions)
 		if err != nil {
 			logger.Print("run failed: ", err)
@@ -153,6 +219,15 @@ func RunForever(config Config, runOptions RunOptions, stop <-chan interface{}) e
 			logger.Print("run succeeded")
 		}
 
+		// The ticker fires RunPeriod after the previous run
+		// started, or (if that time has already passed) as
+		// soon as we start waiting.
+		if next := t0.Add(time.Duration(config.RunPeriod)); next.After(time.Now()) {
+			status.setNextRun(next)
+		} else {
+			status.setNextRun(time.Now())
+		}
+
 		select {
 		case <-stop:
 			signal.Stop(sigUSR1)
@@ -166,7 +241,12 @@ func RunForever(config Config, runOptions RunOptions, stop <-chan interface{}) e
 			// by SIGUSR1.
 			ticker.Stop()
 			ticker = time.NewTicker(time.Duration(config.RunPeriod))
+		case <-status.Triggered():
+			logger.Print("run requested via status server, resetting timer")
+			ticker.Stop()
+			ticker = time.NewTicker(time.Duration(config.RunPeriod))
 		}
+		status.setNextRun(time.Time{})
 		logger.Print("starting next run")
 	}
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"git.curoverse.com/arvados.git/sdk/go/auth"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+)
+
+// statusHandler serves the current Status as JSON, and accepts
+// requests to start or abort a run.
+//
+//   GET  /status.json   current phase, progress, last run statistics
+//   POST /run           start a new run now (or when the current run finishes)
+//   POST /abort         abort the current run
+//
+// POST requests must supply the token given in Config.ManagementToken.
+// If no token is configured, POST requests are rejected.
+type statusHandler struct {
+	status *Status
+	token  string
+	mux    *http.ServeMux
+}
+
+func newStatusHandler(status *Status, token string) http.Handler {
+	h := &statusHandler{
+		status: status,
+		token:  token,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/status.json", h.serveStatus)
+	h.mux.HandleFunc("/run", h.requirePost(h.serveRun))
+	h.mux.HandleFunc("/abort", h.requirePost(h.serveAbort))
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *statusHandler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.status)
+}
+
+func (h *statusHandler) serveRun(w http.ResponseWriter, r *http.Request) {
+	h.status.Trigger()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(h.status)
+}
+
+func (h *statusHandler) serveAbort(w http.ResponseWriter, r *http.Request) {
+	if !h.status.Abort() {
+		http.Error(w, "no run in progress", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(h.status)
+}
+
+// requirePost wraps f, responding 405 to anything but a POST request
+// and 401 to a request without a valid token.
+func (h *statusHandler) requirePost(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if h.token == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		for _, tok := range auth.NewCredentialsFromHTTPRequest(r).Tokens {
+			if subtle.ConstantTimeCompare([]byte(tok), []byte(h.token)) == 1 {
+				f(w, r)
+				return
+			}
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// startStatusServer starts an HTTP server for the given Status on
+// the given address.
+func startStatusServer(addr string, status *Status, token string) (*httpserver.Server, error) {
+	srv := &httpserver.Server{
+		Server: http.Server{
+			Handler: newStatusHandler(status, token),
+		},
+		Addr: addr,
+	}
+	return srv, srv.Start()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&serverSuite{})
+
+type serverSuite struct{}
+
+func (s *serverSuite) request(h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://keep-balance.example"+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "OAuth2 "+token)
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *serverSuite) TestStatusIdle(c *check.C) {
+	h := newStatusHandler(&Status{}, "xyzzy")
+	resp := s.request(h, "GET", "/status.json", "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	var st map[string]interface{}
+	c.Check(json.Unmarshal(resp.Body.Bytes(), &st), check.IsNil)
+	c.Check(st["phase"], check.Equals, "idle")
+	c.Check(st["last_run"], check.IsNil)
+}
+
+func (s *serverSuite) TestRequireToken(c *check.C) {
+	st := &Status{}
+	h := newStatusHandler(st, "xyzzy")
+	for _, path := range []string{"/run", "/abort"} {
+		c.Check(s.request(h, "POST", path, "").Code, check.Equals, http.StatusUnauthorized)
+		c.Check(s.request(h, "POST", path, "wrong").Code, check.Equals, http.StatusUnauthorized)
+		c.Check(s.request(h, "GET", path, "xyzzy").Code, check.Equals, http.StatusMethodNotAllowed)
+	}
+	select {
+	case <-st.Triggered():
+		c.Error("unauthorized request triggered a run")
+	default:
+	}
+}
+
+func (s *serverSuite) TestTrigger(c *check.C) {
+	st := &Status{}
+	h := newStatusHandler(st, "xyzzy")
+	c.Check(s.request(h, "POST", "/run", "xyzzy").Code, check.Equals, http.StatusAccepted)
+	c.Check(s.request(h, "POST", "/run", "xyzzy").Code, check.Equals, http.StatusAccepted)
+	<-st.Triggered()
+	select {
+	case <-st.Triggered():
+		c.Error("two triggers should be merged into one")
+	default:
+	}
+}
+
+func (s *serverSuite) TestAbort(c *check.C) {
+	st := &Status{}
+	h := newStatusHandler(st, "xyzzy")
+	c.Check(s.request(h, "POST", "/abort", "xyzzy").Code, check.Equals, http.StatusConflict)
+	st.startRun()
+	c.Check(st.checkAbort(), check.IsNil)
+	c.Check(s.request(h, "POST", "/abort", "xyzzy").Code, check.Equals, http.StatusAccepted)
+	c.Check(st.checkAbort(), check.Equals, errAborted)
+	st.finishRun(balancerStats{}, errAborted)
+	c.Check(st.checkAbort(), check.IsNil)
+
+	var stj map[string]interface{}
+	c.Check(json.Unmarshal(s.request(h, "GET", "/status.json", "").Body.Bytes(), &stj), check.IsNil)
+	c.Check(stj["last_run"].(map[string]interface{})["error"], check.Equals, "run aborted")
+}
+
+func (s *serverSuite) TestNoTokenConfigured(c *check.C) {
+	h := newStatusHandler(&Status{}, "")
+	c.Check(s.request(h, "POST", "/run", "").Code, check.Equals, http.StatusUnauthorized)
+	c.Check(s.request(h, "POST", "/run", "xyzzy").Code, check.Equals, http.StatusUnauthorized)
+}
+
+func (s *serverSuite) TestNilStatus(c *check.C) {
+	var st *Status
+	st.Trigger()
+	c.Check(st.Triggered(), check.IsNil)
+	c.Check(st.Abort(), check.Equals, false)
+	buf, err := json.Marshal(st)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf), check.Equals, "null")
+}
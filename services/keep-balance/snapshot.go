@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvados"
+)
+
+// snapshot is the state retrieved by GetCurrentState: the keep
+// services being balanced, the relevant site configuration, the
+// blocks referenced by each collection, and the index of each keep
+// service. It can be saved to a file (see RunOptions.WriteSnapshot)
+// and used later to compute changes offline, without contacting the
+// API and keepstore servers at all (see RunOptions.ReadSnapshot).
+type snapshot struct {
+	// Time the state was retrieved. Block mtimes are compared to
+	// this, rather than the current time, when deciding whether
+	// unreferenced blocks are old enough to trash.
+	Time time.Time
+
+	// Site configuration from the API server's discovery
+	// document.
+	DefaultReplication int
+	BlobSignatureTTL   int64
+
+	KeepServices []arvados.KeepService
+
+	Collections map[string]cachedCollection
+
+	// Index of each keep service, keyed by UUID.
+	Indexes map[string][]arvados.KeepServiceIndexEntry
+
+	mutex sync.Mutex
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{
+		Indexes: make(map[string][]arvados.KeepServiceIndexEntry),
+	}
+}
+
+func (snap *snapshot) addIndex(srv *KeepService, idx []arvados.KeepServiceIndexEntry) {
+	snap.mutex.Lock()
+	defer snap.mutex.Unlock()
+	snap.Indexes[srv.UUID] = idx
+}
+
+// save writes the snapshot to path, replacing any existing file only
+// if the new one is written successfully.
+func (snap *snapshot) save(path string) error {
+	snap.mutex.Lock()
+	defer snap.mutex.Unlock()
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(snap)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("writing snapshot %q: %v", path, err)
+	}
+	return nil
+}
+
+func loadSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap := newSnapshot()
+	if err = gob.NewDecoder(f).Decode(snap); err != nil {
+		return nil, fmt.Errorf("reading snapshot %q: %v", path, err)
+	}
+	return snap, nil
+}
+
+// ReadSnapshot is like SetKeepServices followed by GetCurrentState,
+// except that everything is read from a snapshot file written by a
+// previous run. It does not contact the API or keepstore servers.
+func (bal *Balancer) ReadSnapshot(path string) error {
+	defer timeMe(bal.Logger, "ReadSnapshot")()
+	snap, err := loadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	if len(snap.KeepServices) == 0 {
+		return fmt.Errorf("snapshot %q has no keep services (written by an older version of keep-balance?)", path)
+	}
+	err = bal.SetKeepServices(arvados.KeepServiceList{Items: snap.KeepServices})
+	if err != nil {
+		return err
+	}
+	bal.BlockStateMap = NewBlockStateMap()
+	bal.DefaultReplication = snap.DefaultReplication
+	bal.MinMtime = snap.Time.UnixNano() - snap.BlobSignatureTTL*1e9
+
+	for _, srv := range bal.KeepServices {
+		idx, ok := snap.Indexes[srv.UUID]
+		if !ok {
+			return fmt.Errorf("snapshot %q has no index for %s", path, srv)
+		}
+		bal.logf("%s: add %d replicas to map", srv, len(idx))
+		bal.BlockStateMap.AddReplicas(srv, idx)
+	}
+
+	bal.collCache = &collectionCache{Collections: snap.Collections}
+	if bal.collCache.Collections == nil {
+		bal.collCache.Collections = make(map[string]cachedCollection)
+	}
+	bal.collCache.apply(bal.BlockStateMap, bal.DefaultReplication)
+	bal.collScanned = len(bal.collCache.Collections)
+	bal.logf("read %d collections and %d indexes from snapshot %q taken at %v", bal.collScanned, len(snap.Indexes), path, snap.Time)
+	return nil
+}
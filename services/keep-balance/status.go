@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errAborted = errors.New("run aborted")
+
+// Status tracks the progress of balance operations, so it can be
+// reported by the HTTP status server (see server.go). It also
+// carries requests to trigger or abort a run.
+//
+// A nil *Status is valid: updates are ignored, and runs are never
+// aborted.
+//
+// Status is safe to use from multiple goroutines.
+type Status struct {
+	phase      string
+	runStarted time.Time
+	collDone   int
+	collTotal  int
+	idxDone    int
+	idxTotal   int
+	nextRun    time.Time
+	lastRun    *runSummary
+	abort      chan struct{}
+	trigger    chan struct{}
+	mutex      sync.Mutex
+	setupOnce  sync.Once
+}
+
+type runSummary struct {
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Error    string        `json:"error,omitempty"`
+	Stats    balancerStats `json:"stats"`
+}
+
+func (st *Status) setup() {
+	st.setupOnce.Do(func() {
+		st.trigger = make(chan struct{}, 1)
+	})
+}
+
+// Trigger requests a new run as soon as the current one (if any) is
+// finished.
+func (st *Status) Trigger() {
+	if st == nil {
+		return
+	}
+	st.setup()
+	select {
+	case st.trigger <- struct{}{}:
+	default:
+		// already triggered
+	}
+}
+
+// Triggered returns a channel that is ready to receive when a run
+// has been requested via Trigger. For a nil *Status, it returns a nil
+// channel, which is never ready.
+func (st *Status) Triggered() <-chan struct{} {
+	if st == nil {
+		return nil
+	}
+	st.setup()
+	return st.trigger
+}
+
+// Abort requests that the current run stop as soon as possible. It
+// returns false if no run is in progress.
+func (st *Status) Abort() bool {
+	if st == nil {
+		return false
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.abort == nil {
+		return false
+	}
+	select {
+	case <-st.abort:
+		// already aborted
+	default:
+		close(st.abort)
+	}
+	return true
+}
+
+// checkAbort returns errAborted if Abort has been called since the
+// current run started.
+func (st *Status) checkAbort() error {
+	if st == nil {
+		return nil
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.abort == nil {
+		return nil
+	}
+	select {
+	case <-st.abort:
+		return errAborted
+	default:
+		return nil
+	}
+}
+
+func (st *Status) startRun() {
+	if st == nil {
+		return
+	}
+	st.setup()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.runStarted = time.Now()
+	st.collDone, st.collTotal = 0, 0
+	st.idxDone, st.idxTotal = 0, 0
+	st.abort = make(chan struct{})
+}
+
+func (st *Status) finishRun(stats balancerStats, err error) {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.lastRun = &runSummary{
+		Started:  st.runStarted,
+		Finished: time.Now(),
+		Stats:    stats,
+	}
+	if err != nil {
+		st.lastRun.Error = err.Error()
+	}
+	st.phase = ""
+	st.abort = nil
+}
+
+func (st *Status) setPhase(phase string) {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	st.phase = phase
+	st.mutex.Unlock()
+}
+
+func (st *Status) setIndexTotal(total int) {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	st.idxTotal = total
+	st.mutex.Unlock()
+}
+
+func (st *Status) indexFetched() {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	st.idxDone++
+	st.mutex.Unlock()
+}
+
+func (st *Status) collectionProgress(done, total int) {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	st.collDone, st.collTotal = done, total
+	st.mutex.Unlock()
+}
+
+func (st *Status) setNextRun(t time.Time) {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	st.nextRun = t
+	st.mutex.Unlock()
+}
+
+// MarshalJSON implements json.Marshaler.
+func (st *Status) MarshalJSON() ([]byte, error) {
+	if st == nil {
+		return []byte("null"), nil
+	}
+	st.setup()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	type progress struct {
+		Done  int `json:"done"`
+		Total int `json:"total"`
+	}
+	phase := st.phase
+	if phase == "" {
+		phase = "idle"
+	}
+	var runStarted, nextRun *time.Time
+	if st.abort != nil {
+		runStarted = &st.runStarted
+	}
+	if !st.nextRun.IsZero() {
+		nextRun = &st.nextRun
+	}
+	return json.Marshal(struct {
+		Phase       string      `json:"phase"`
+		RunStarted  *time.Time  `json:"run_started,omitempty"`
+		Collections progress    `json:"collections"`
+		Indexes     progress    `json:"indexes"`
+		NextRun     *time.Time  `json:"next_run,omitempty"`
+		LastRun     *runSummary `json:"last_run"`
+	}{
+		Phase:       phase,
+		RunStarted:  runStarted,
+		Collections: progress{st.collDone, st.collTotal},
+		Indexes:     progress{st.idxDone, st.idxTotal},
+		NextRun:     nextRun,
+		LastRun:     st.lastRun,
+	})
+}
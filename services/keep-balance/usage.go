@@ -59,6 +59,21 @@ Periodic scanning:
     If SIGUSR1 is received during an idle period between operations,
     the next operation will start immediately.
 
+Status server:
+
+    If Listen is given (e.g., ":9005"), keep-balance serves its
+    current status at http://{Listen}/status.json while operating
+    periodically: the current phase, progress fetching collections
+    and indexes, the scheduled time of the next operation, and
+    statistics from the most recent operation.
+
+    A POST request to /run starts the next operation immediately (or
+    as soon as the current one finishes). A POST request to /abort
+    stops the current operation. POST requests must be authorized
+    with ManagementToken, e.g., "Authorization: OAuth2 xyzzy". If
+    ManagementToken is not given, POST requests are rejected. Use a
+    random string, not Client.AuthToken.
+
 One-time scanning:
 
     Use the -once flag to do a single operation and then exit. The
@@ -73,6 +88,49 @@ Committing:
     Use the -commit-pull and -commit-trash flags to implement the
     computed changes.
 
+Reviewing changes:
+
+    Use the -change-report flag to write every computed pull and
+    trash request to a file, one JSON object per line, with the
+    block, the keep service that will act on it, the pull source,
+    the reason for the change, and the block's current and desired
+    replication.
+
+    If a report from a previous run already exists at the same path,
+    each entry is marked "new" or "unchanged", and a summary of the
+    differences is logged. The previous report is replaced only after
+    the new one has been written successfully.
+
+Snapshots:
+
+    Use the -write-snapshot flag to save the keep services,
+    collections, keepstore indexes, and relevant site configuration
+    (default replication and blob signature TTL) retrieved during a
+    run. A subsequent "-once -read-snapshot" run computes changes
+    entirely offline from the saved data, without contacting the API
+    or keepstore servers, so a config file is not needed. Unreferenced
+    blocks are considered old enough to trash relative to the time
+    the snapshot was taken, so replaying a snapshot gives the same
+    results no matter when it is done. This is useful for testing
+    changes to balancing policy against a production snapshot, and
+    for troubleshooting. Changes computed from a snapshot cannot be
+    committed.
+
+    Example:
+
+        keep-balance -config config.json -once -write-snapshot /tmp/snap
+        keep-balance -once -read-snapshot /tmp/snap -dump -change-report /tmp/changes
+
+Event logging:
+
+    If LogEventTypePrefix is given (e.g., "keep-balance"), each
+    operation is recorded in the Arvados logs table, with event types
+    "{prefix}-start", "{prefix}-partial" (at the start of each phase),
+    and "{prefix}-final". The final entry includes the statistics
+    reported at the end of the operation, including the number of
+    blocks at each combination of desired and actual replication
+    level.
+
 Tuning resource usage:
 
     CollectionBatchSize limits the number of collections retrieved per
@@ -86,6 +144,20 @@ Tuning resource usage:
     while the current page is still being processed. If this is zero
     or omitted, pages are processed serially.
 
+Incremental scanning:
+
+    If CollectionCache is given (e.g., "/var/lib/keep-balance/collections.gob"),
+    keep-balance saves the list of blocks referenced by each
+    collection in that file. Subsequent runs retrieve only the
+    collections that have been modified since the previous run, and
+    use the saved lists for the rest. Keepstore indexes are always
+    retrieved in full.
+
+    Deleted collections are not noticed until the next full scan, so
+    their blocks are not garbage-collected until then. A full scan is
+    done whenever the last one was more than FullScanPeriod ago
+    (default "24h"), or the cache file is missing or unreadable.
+
 Limitations:
 
     keep-balance does not attempt to discover whether committed pull
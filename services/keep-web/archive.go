@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+)
+
+// archiveEntry is a file or directory to be included in an archive.
+type archiveEntry struct {
+	name string
+	dir  *treeDir
+	file *treeFile
+}
+
+// archiveEntries returns entries for dir and everything in it, with
+// names starting with prefix. Each directory comes before its
+// contents.
+func archiveEntries(dir *treeDir, prefix string) []archiveEntry {
+	entries := []archiveEntry{{name: prefix + "/", dir: dir}}
+	for _, name := range dir.dirNames() {
+		entries = append(entries, archiveEntries(dir.dirs[name], prefix+"/"+name)...)
+	}
+	for _, name := range dir.fileNames() {
+		entries = append(entries, archiveEntry{name: prefix + "/" + name, file: dir.files[name]})
+	}
+	return entries
+}
+
+// serveArchive responds to a request for a zip or tar archive of a
+// directory in a collection. The archive is generated on the fly, so
+// no more than one block is held in memory at a time.
+//
+// The layout of a tar archive is known before any data is read, so
+// Range requests are supported for tar archives. Zip archives are
+// streamed, and Range headers are ignored.
+func serveArchive(w http.ResponseWriter, r *http.Request, kc *keepclient.KeepClient, collection map[string]interface{}, target string, format string) (int, string) {
+	tree, err := newCollectionTree(manifestText(collection))
+	if err != nil {
+		return http.StatusBadGateway, err.Error()
+	}
+	target = cleanTarget(target)
+	dir, _ := tree.lookup(target)
+	if dir == nil {
+		return http.StatusNotFound, ""
+	}
+
+	// Put everything in a top level directory named after the
+	// requested directory, or the collection itself.
+	_, prefix := splitPath(target)
+	if prefix == "" {
+		prefix, _ = collection["name"].(string)
+	}
+	if prefix == "" {
+		prefix, _ = collection["portable_data_hash"].(string)
+	}
+	prefix = strings.Replace(prefix, "/", "_", -1)
+	if prefix == "" || prefix == "." || prefix == ".." {
+		prefix = "collection"
+	}
+
+	modTime := collectionModTime(collection).Truncate(time.Second)
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.QuoteToASCII(prefix+"."+format))
+	entries := archiveEntries(dir, prefix)
+	if format == "tar" {
+		parts, err := tarParts(entries, modTime)
+		if err != nil {
+			return http.StatusInternalServerError, err.Error()
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		http.ServeContent(w, r, "", modTime, newPartsReader(kc, parts))
+		return 0, ""
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.WriteHeader(http.StatusOK)
+	zw := zip.NewWriter(w)
+	for _, ent := range entries {
+		hdr := &zip.FileHeader{Name: ent.name, Method: zip.Store}
+		hdr.SetModTime(modTime)
+		if ent.dir != nil {
+			hdr.SetMode(os.ModeDir | 0755)
+		} else {
+			hdr.SetMode(0644)
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return http.StatusOK, err.Error()
+		}
+		if ent.file != nil {
+			if _, err = io.Copy(fw, newFileReader(kc, ent.file)); err != nil {
+				// The client will see a truncated
+				// archive.
+				return http.StatusOK, err.Error()
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return http.StatusOK, err.Error()
+	}
+	return http.StatusOK, ""
+}
+
+// tarParts returns the parts of a tar archive containing the given
+// entries: headers, file content, and padding.
+func tarParts(entries []archiveEntry, modTime time.Time) ([]readerPart, error) {
+	var parts []readerPart
+	for _, ent := range entries {
+		hdr := &tar.Header{
+			Name:    ent.name,
+			ModTime: modTime,
+		}
+		if ent.dir != nil {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		} else {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Mode = 0644
+			hdr.Size = ent.file.size
+		}
+		// Render the header (including any extended headers
+		// needed for long names) with a throwaway Writer.
+		var buf bytes.Buffer
+		if err := tar.NewWriter(&buf).WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		parts = append(parts, readerPart{data: buf.Bytes()})
+		if ent.file != nil {
+			parts = append(parts, readerPart{file: ent.file})
+			if pad := (512 - ent.file.size%512) % 512; pad > 0 {
+				parts = append(parts, readerPart{data: make([]byte, pad)})
+			}
+		}
+	}
+	// End of archive marker: two zero blocks.
+	parts = append(parts, readerPart{data: make([]byte, 1024)})
+	return parts, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestTarParts(c *check.C) {
+	tree, err := newCollectionTree(". " + foobarLocator + " 0:3:foo\n./dir " + foobarLocator + " 3:3:bar 0:0:empty\n")
+	c.Assert(err, check.IsNil)
+	modTime := time.Date(2016, 8, 1, 12, 34, 56, 0, time.UTC)
+	parts, err := tarParts(archiveEntries(tree.root, "coll"), modTime)
+	c.Assert(err, check.IsNil)
+
+	rdr := newPartsReader(nil, parts)
+	// All of the file content is in one block, so prime the
+	// reader's block cache instead of fetching from Keep.
+	rdr.blockLocator, rdr.block = foobarLocator, []byte("foobar")
+	c.Check(rdr.Len()%512, check.Equals, uint64(0))
+
+	tr := tar.NewReader(rdr)
+	for _, expect := range []struct {
+		name string
+		data string
+	}{
+		{"coll/", ""},
+		{"coll/dir/", ""},
+		{"coll/dir/bar", "bar"},
+		{"coll/dir/empty", ""},
+		{"coll/foo", "foo"},
+	} {
+		hdr, err := tr.Next()
+		c.Assert(err, check.IsNil)
+		c.Check(hdr.Name, check.Equals, expect.name)
+		c.Check(hdr.ModTime.Equal(modTime), check.Equals, true)
+		data, err := ioutil.ReadAll(tr)
+		c.Check(err, check.IsNil)
+		c.Check(string(data), check.Equals, expect.data)
+	}
+	_, err = tr.Next()
+	c.Check(err, check.Equals, io.EOF)
+
+	// Seek back and re-read part of the archive.
+	_, err = rdr.Seek(-1024-512+1, os.SEEK_END)
+	c.Assert(err, check.IsNil)
+	buf := make([]byte, 3)
+	n, err := io.ReadFull(rdr, buf)
+	c.Check(err, check.IsNil)
+	c.Check(string(buf[:n]), check.Equals, "oo\x00")
+}
+
+func (s *IntegrationSuite) TestArchive(c *check.C) {
+	host := arvadostest.FooBarDirCollection + ".collections.example.com"
+	for _, format := range []string{"zip", "tar"} {
+		u := mustParseURL("http://" + host + "/dir1/?format=" + format)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"OAuth2 " + arvadostest.ActiveToken},
+			},
+		}
+		resp := httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		c.Check(resp.Header().Get("Content-Disposition"), check.Equals, `attachment; filename="dir1.`+format+`"`)
+		files := map[string]string{}
+		if format == "zip" {
+			zr, err := zip.NewReader(bytes.NewReader(resp.Body.Bytes()), int64(resp.Body.Len()))
+			c.Assert(err, check.IsNil)
+			for _, f := range zr.File {
+				rc, err := f.Open()
+				c.Assert(err, check.IsNil)
+				data, err := ioutil.ReadAll(rc)
+				c.Check(err, check.IsNil)
+				files[f.Name] = string(data)
+			}
+		} else {
+			tr := tar.NewReader(resp.Body)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				c.Assert(err, check.IsNil)
+				data, err := ioutil.ReadAll(tr)
+				c.Check(err, check.IsNil)
+				files[hdr.Name] = string(data)
+			}
+		}
+		c.Check(files, check.DeepEquals, map[string]string{
+			"dir1/":    "",
+			"dir1/bar": "bar",
+			"dir1/foo": "foo",
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// dirEntry is a file or subdirectory in a directory listing.
+type dirEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	Href string `json:"href"`
+}
+
+// dirListing is the data given in a directory listing.
+type dirListing struct {
+	Path    string     `json:"path"`
+	Parent  bool       `json:"-"`
+	Entries []dirEntry `json:"entries"`
+}
+
+var dirListingTemplate = template.Must(template.New("dirListing").Parse(`<!DOCTYPE HTML>
+<HTML><HEAD>
+<META charset="utf-8">
+<TITLE>Index of {{.Path}}</TITLE>
+<STYLE type="text/css">
+body { font-family: sans-serif; }
+td { padding: 0 1em; }
+td.size { text-align: right; }
+</STYLE>
+</HEAD>
+<BODY>
+<H1>Index of {{.Path}}</H1>
+<TABLE>
+{{if .Parent}}<TR><TD><A href="../">../</A></TD><TD></TD></TR>
+{{end}}{{range .Entries}}<TR><TD><A href="{{.Href}}">{{.Name}}{{if eq .Type "directory"}}/{{end}}</A></TD><TD class="size">{{.Size}}</TD></TR>
+{{end}}</TABLE>
+</BODY>
+</HTML>
+`))
+
+// serveDirectory responds to a GET request for a directory in a
+// collection, given as a path relative to the collection root.
+//
+// If the directory has an index.html file that should be served
+// instead of a listing, serveDirectory returns the path of that file
+// without writing a response. Otherwise, it writes a response -- an
+// HTML or JSON listing, a redirect to the same path with a trailing
+// slash, or 404 -- and returns "" and the response status.
+func serveDirectory(w http.ResponseWriter, r *http.Request, collection map[string]interface{}, target string) (string, int, string) {
+	tree, err := newCollectionTree(manifestText(collection))
+	if err != nil {
+		return "", http.StatusBadGateway, err.Error()
+	}
+	target = cleanTarget(target)
+	dir, _ := tree.lookup(target)
+	if dir == nil {
+		return "", http.StatusNotFound, ""
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		// Relative links in the listing (or index.html) only
+		// work if the URL ends with "/".
+		redir := (&url.URL{Path: r.URL.Path + "/", RawQuery: r.URL.RawQuery}).String()
+		w.Header().Set("Location", redir)
+		w.WriteHeader(http.StatusFound)
+		return "", http.StatusFound, redir
+	}
+
+	wantJSON := r.FormValue("format") == "json" ||
+		strings.HasPrefix(r.Header.Get("Accept"), "application/json")
+	if !wantJSON && serveIndexHTML && dir.files["index.html"] != nil {
+		if target == "" {
+			return "index.html", 0, ""
+		}
+		return target + "/index.html", 0, ""
+	}
+
+	listing := dirListing{
+		Path:   "/" + target,
+		Parent: target != "",
+	}
+	if target != "" {
+		listing.Path += "/"
+	}
+	for _, name := range dir.dirNames() {
+		listing.Entries = append(listing.Entries, dirEntry{
+			Name: name,
+			Type: "directory",
+			Size: dir.dirs[name].size(),
+			Href: relativeHref(name) + "/",
+		})
+	}
+	for _, name := range dir.fileNames() {
+		listing.Entries = append(listing.Entries, dirEntry{
+			Name: name,
+			Type: "file",
+			Size: dir.files[name].size,
+			Href: relativeHref(name),
+		})
+	}
+
+	if wantJSON {
+		if listing.Entries == nil {
+			listing.Entries = []dirEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(listing)
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		err = dirListingTemplate.Execute(w, listing)
+	}
+	if err != nil {
+		return "", http.StatusOK, err.Error()
+	}
+	return "", http.StatusOK, ""
+}
+
+// relativeHref returns a relative URL for the given file name. The
+// "./" prefix prevents a name like "foo:bar" from being mistaken for
+// an absolute URL.
+func relativeHref(name string) string {
+	return "./" + (&url.URL{Path: name}).EscapedPath()
+}
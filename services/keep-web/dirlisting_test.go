@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+var dirListingCollection = map[string]interface{}{
+	"manifest_text": ". " + fooLocator + " 0:3:foo\n" +
+		"./dir\\040one " + barLocator + " 0:3:bar&baz\n" +
+		"./site " + foobarLocator + " 0:6:index.html\n",
+}
+
+func (s *UnitSuite) TestDirListingHTML(c *check.C) {
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/c=x/", nil)
+	index, status, _ := serveDirectory(resp, req, dirListingCollection, "")
+	c.Check(index, check.Equals, "")
+	c.Check(status, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "text/html; charset=utf-8")
+	body := resp.Body.String()
+	c.Check(body, check.Matches, `(?s).*<A href="\./dir%20one/">dir one/</A></TD><TD class="size">3</TD>.*`)
+	c.Check(body, check.Matches, `(?s).*<A href="\./foo">foo</A></TD><TD class="size">3</TD>.*`)
+	c.Check(body, check.Not(check.Matches), `(?s).*\.\./.*`)
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/c=x/dir%20one/", nil)
+	_, status, _ = serveDirectory(resp, req, dirListingCollection, "dir one/")
+	c.Check(status, check.Equals, http.StatusOK)
+	body = resp.Body.String()
+	c.Check(body, check.Matches, `(?s).*<TITLE>Index of /dir one/</TITLE>.*`)
+	c.Check(body, check.Matches, `(?s).*<A href="\.\./">\.\./</A>.*`)
+	c.Check(body, check.Matches, `(?s).*<A href="\./bar&amp;baz">bar&amp;baz</A>.*`)
+}
+
+func (s *UnitSuite) TestDirListingJSON(c *check.C) {
+	for _, req := range []*http.Request{
+		mustNewRequest("GET", "/c=x/?format=json"),
+		mustNewRequest("GET", "/c=x/"),
+	} {
+		if req.URL.RawQuery == "" {
+			req.Header.Set("Accept", "application/json")
+		}
+		resp := httptest.NewRecorder()
+		_, status, _ := serveDirectory(resp, req, dirListingCollection, "")
+		c.Check(status, check.Equals, http.StatusOK)
+		var listing dirListing
+		c.Assert(json.Unmarshal(resp.Body.Bytes(), &listing), check.IsNil)
+		c.Check(listing.Path, check.Equals, "/")
+		c.Check(listing.Entries, check.DeepEquals, []dirEntry{
+			{Name: "dir one", Type: "directory", Size: 3, Href: "./dir%20one/"},
+			{Name: "site", Type: "directory", Size: 6, Href: "./site/"},
+			{Name: "foo", Type: "file", Size: 3, Href: "./foo"},
+		})
+	}
+}
+
+func (s *UnitSuite) TestDirListingRedirect(c *check.C) {
+	resp := httptest.NewRecorder()
+	_, status, _ := serveDirectory(resp, mustNewRequest("GET", "/c=x/dir%20one?disposition=attachment"), dirListingCollection, "dir one")
+	c.Check(status, check.Equals, http.StatusFound)
+	c.Check(resp.Code, check.Equals, http.StatusFound)
+	c.Check(resp.Header().Get("Location"), check.Equals, "/c=x/dir%20one/?disposition=attachment")
+}
+
+func (s *UnitSuite) TestDirListingIndexHTML(c *check.C) {
+	defer func(orig bool) { serveIndexHTML = orig }(serveIndexHTML)
+	serveIndexHTML = true
+	resp := httptest.NewRecorder()
+	index, _, _ := serveDirectory(resp, mustNewRequest("GET", "/c=x/site/"), dirListingCollection, "site/")
+	c.Check(index, check.Equals, "site/index.html")
+	c.Check(resp.Body.String(), check.Equals, "")
+
+	serveIndexHTML = false
+	resp = httptest.NewRecorder()
+	index, status, _ := serveDirectory(resp, mustNewRequest("GET", "/c=x/site/"), dirListingCollection, "site/")
+	c.Check(index, check.Equals, "")
+	c.Check(status, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*<A href="\./index\.html">index\.html</A>.*`)
+}
+
+func (s *UnitSuite) TestDirListingNotFound(c *check.C) {
+	for _, target := range []string{"nonexistent/", "foo/"} {
+		resp := httptest.NewRecorder()
+		_, status, _ := serveDirectory(resp, mustNewRequest("GET", "/c=x/"+target), dirListingCollection, target)
+		c.Check(status, check.Equals, http.StatusNotFound)
+	}
+}
+
+func mustNewRequest(method, url string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+func (s *IntegrationSuite) TestDirectoryListing(c *check.C) {
+	host := arvadostest.FooBarDirCollection + ".collections.example.com"
+	for _, trial := range []struct {
+		path   string
+		status int
+		expect string
+	}{
+		{"/", http.StatusOK, `(?s).*<A href="\./dir1/">dir1/</A>.*`},
+		{"/dir1", http.StatusFound, ``},
+		{"/dir1/", http.StatusOK, `(?s).*<A href="\./bar">bar</A>.*<A href="\./foo">foo</A>.*`},
+		{"/dir1/?format=json", http.StatusOK, `(?s).*"name":"foo".*`},
+		{"/nonexistent/", http.StatusNotFound, ``},
+	} {
+		u := mustParseURL("http://" + host + trial.path)
+		req := &http.Request{
+			Method:     "GET",
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header: http.Header{
+				"Authorization": {"OAuth2 " + arvadostest.ActiveToken},
+			},
+		}
+		resp := httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, trial.status, check.Commentf("%s", trial.path))
+		c.Check(resp.Body.String(), check.Matches, trial.expect, check.Commentf("%s", trial.path))
+	}
+}
@@ -1,4 +1,4 @@
-// Keep-web provides read-only HTTP access to files stored in Keep. It
+// Keep-web provides HTTP and WebDAV access to files stored in Keep. It
 // serves public data to anonymous and unauthenticated clients, and
 // serves private data to clients that supply Arvados API tokens. It
 // can be installed anywhere with access to Keep services, typically
@@ -156,13 +156,180 @@
 // the token stripped from the query string and added to a cookie
 // instead.
 //
+// Caching
+//
+// Each file is served with an ETag (derived from the collection's
+// portable data hash and the file's path) and a Last-Modified time
+// (the collection's modification time), and conditional requests
+// using If-None-Match or If-Modified-Since get a 304 Not Modified
+// response when the content hasn't changed.
+//
+// Content requested by portable data hash never changes, so browsers
+// and proxies are told they can cache it for a year. Content
+// requested by UUID must be revalidated each time. Unless the content
+// was retrieved using an anonymous token, shared caches are told not
+// to store it.
+//
+// The Content-Type of a file is determined by its extension. If the
+// extension is missing or unrecognized, it is determined by sniffing
+// the first 512 bytes of the file.
+//
+// Previews and media
+//
+// Any single byte range of a file can be requested, so browsers can
+// play audio and video files (and skip ahead) without downloading
+// them first.
+//
+// A thumbnail of a PNG, JPEG, or GIF image, no more than N pixels
+// wide or high, is returned if the request has a "thumbnail=N" query
+// parameter, where N is 32, 64, 128, 256, 512, or 1024. Recently
+// generated thumbnails are kept in memory: see the
+// -thumbnail-cache-size option. To limit memory use, only a few
+// images are decoded at a time: see the -thumbnail-max-concurrent
+// option.
+//
+//   https://uuid_or_pdh.collections.example.com/photos/cat.jpg?thumbnail=256
+//
+// An HTML page showing the first N lines of a text file (such as a
+// FASTQ, VCF, or CSV file) is returned if the request has a
+// "preview=N" query parameter. Files whose names end in ".gz" are
+// decompressed first.
+//
+//   https://uuid_or_pdh.collections.example.com/reads.fastq.gz?preview=100
+//
 // Indexes
 //
-// Currently, keep-web does not generate HTML index listings, nor does
-// it serve a default file like "index.html" when a directory is
-// requested. These features are likely to be added in future
-// versions. Until then, keep-web responds with 404 if a directory
-// name (or any path ending with "/") is requested.
+// When a directory (or the root of a collection) is requested,
+// keep-web responds with an HTML page listing the files and
+// subdirectories it contains, with their sizes. If the requested path
+// does not end with "/", the response is a redirect to the same path
+// with "/" appended, so relative links work.
+//
+// If the directory contains a file called "index.html", that file is
+// served instead of a listing, so a static web site can be served
+// from a collection. Use -index-html=false to disable this.
+//
+// A listing in JSON format is returned instead if the request has a
+// "format=json" query parameter or an "Accept: application/json"
+// header:
+//
+//   {"path":"/dir1/","entries":[
+//    {"name":"subdir","type":"directory","size":1234,"href":"./subdir/"},
+//    {"name":"foo.txt","type":"file","size":3,"href":"./foo.txt"}]}
+//
+// The size of a directory is the total size of the files it contains,
+// including files in its subdirectories.
+//
+// Archives
+//
+// A whole collection, or a directory in a collection, can be
+// downloaded as a single zip or tar file by adding "format=zip" or
+// "format=tar" to the URL of the directory:
+//
+//   https://uuid_or_pdh.collections.example.com/?format=zip
+//   https://uuid_or_pdh.collections.example.com/dir1/?format=tar
+//
+// The archive is generated as it is sent, without compression. Files
+// are placed in a top level directory named after the requested
+// directory (or, for the collection root, the collection's name).
+// Tar archives support Range requests, so an interrupted download can
+// be resumed; zip archives do not.
+//
+// WebDAV
+//
+// Keep-web also accepts WebDAV requests (OPTIONS, PROPFIND, PUT,
+// MKCOL, DELETE, and MOVE) at the same URLs, so a collection can be
+// mounted by a desktop file manager or a WebDAV client like cadaver:
+//
+//   cadaver https://uuid_or_pdh.collections.example.com/
+//
+// Most WebDAV clients send the token as the password in HTTP Basic
+// authentication (the username is ignored), so credentials must be
+// accepted at the URL being used -- see "Same-origin URLs" below.
+//
+// A collection requested by portable data hash is read-only. When a
+// collection requested by UUID is modified, keep-web writes any new
+// data to Keep, then updates the collection record with a new
+// manifest. If another client has changed the collection in the
+// meantime, keep-web applies the modification to the new version
+// instead of overwriting the other client's changes. If the
+// collection keeps changing, the request fails with status 409.
+//
+// PROPFIND requests with "Depth: infinity" are treated like "Depth:
+// 1". Locking is not supported.
+//
+// S3 API
+//
+// Keep-web also accepts a subset of the Amazon S3 API: ListObjects
+// (versions 1 and 2), GetObject (including Range requests),
+// HeadObject, HeadBucket, and PutObject. The bucket name is a
+// collection UUID or portable data hash, given either as the first
+// part of the path or in the host name (as in the download URLs
+// above), and object keys are file paths in the collection. Empty
+// directories are listed as keys ending in "/".
+//
+//   aws s3 --endpoint-url https://collections.example.com ls s3://uuid_or_pdh/
+//
+// The S3 API is only enabled if keep-web is started with the
+// -s3-secret option. S3 clients use an access key and secret key
+// issued by keep-web for an Arvados token:
+//
+//   curl -X POST -H "Authorization: OAuth2 $ARVADOS_API_TOKEN" https://collections.example.com/_s3credentials
+//
+// The response gives the access key and secret key:
+//
+//   {"access_key_id":"...","secret_access_key":"..."}
+//
+// The _s3credentials endpoint is not available on a collection's own
+// virtual host (like uuid_or_pdh.collections.example.com), where the
+// path refers to a file in the collection instead.
+//
+// Keep-web checks the signature of every S3 request (AWS signature
+// version 2 or 4), and then acts with the token given by the access
+// key. The access key doesn't reveal the token. Requests signed in
+// the Authorization header must be received within 15 minutes of
+// being signed, and presigned URLs expire after at most 7 days.
+// Credentials stay valid as long as the token does, and stop working
+// if -s3-secret is changed. PutObject only works with a
+// collection requested by UUID, and does not support chunked
+// ("aws-chunked") uploads, so clients must be configured to sign the
+// whole payload.
+//
+// Share links
+//
+// If keep-web is started with -share-link-secret and
+// -share-link-token options, a user can create a link that lets
+// anyone download a file or directory from a collection, without
+// sharing the user's own API token:
+//
+//   curl -X POST -H "Authorization: OAuth2 $ARVADOS_API_TOKEN" \
+//     "https://collections.example.com/_share?collection=uuid_or_pdh&path=dir/file.txt&expires_in=86400&max_downloads=3"
+//
+// The response gives the URL of the new link, and its expiry time:
+//
+//   {"expires_at":"2016-10-20T12:34:56Z","max_downloads":3,"url":"https://collections.example.com/_share/eyJ...../file.txt"}
+//
+// As with _s3credentials, links are not created or served on a
+// collection's own virtual host.
+//
+// The link is signed with the -share-link-secret key, and keep-web
+// checks the signature and expiry time before serving any content.
+// The user's token is only used to check that the user can read the
+// collection. Content is read using the -share-link-token, which must
+// be able to read every collection users might share.
+//
+// A link gives access to the content the collection had when the
+// link was created, even if the collection is modified later.
+// Expiry times are limited by -share-link-max-ttl. The
+// max_downloads parameter is optional. Each request for a file, or
+// for a zip or tar archive of a directory, counts as a download,
+// including Range requests to resume an interrupted download.
+// Directory listings don't count. Responses to share links are
+// marked "Cache-Control: no-store", so browsers and proxies don't
+// keep shared content after the link expires. Download counts are kept in
+// memory by each keep-web process, so they are approximate if
+// multiple keep-web servers are used, and they are reset when
+// keep-web restarts.
 //
 // Compatibility
 //
@@ -237,4 +404,21 @@
 // avoids redirecting requests to keep-web if they depend on
 // -trust-all-content being set.
 //
+// Token cache
+//
+// Keep-web remembers which tokens can read which collections, so it
+// doesn't have to ask the API server again each time the same client
+// requests another file from the same collection. Only collections
+// requested by portable data hash are remembered, because their
+// content cannot change. Tokens rejected by the API server are also
+// remembered for a short time. See the -token-cache-* options.
+//
+// When a token is revoked, keep-web may continue to accept it until
+// the cache entry expires. To remove it from the cache right away,
+// start keep-web with an -admin-token option, and use that token to
+// call the flush endpoint:
+//
+//   curl -X POST -H "Authorization: OAuth2 $ADMIN_TOKEN" \
+//     "https://collections.example.com/_admin/flush_token?token=$REVOKED_TOKEN"
+//
 package main
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha1"
 	"flag"
 	"fmt"
 	"html"
@@ -12,11 +13,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/auth"
 	"git.curoverse.com/arvados.git/sdk/go/httpserver"
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/tokencache"
 )
 
 type handler struct{}
@@ -25,6 +28,8 @@ var (
 	clientPool         = arvadosclient.MakeClientPool()
 	trustAllContent    = false
 	attachmentOnlyHost = ""
+	tokenCache         tokencache.Cache
+	serveIndexHTML     = true
 )
 
 func init() {
@@ -32,6 +37,14 @@ func init() {
 		"Accept credentials, and add \"Content-Disposition: attachment\" response headers, for requests at this hostname:port. Prohibiting inline display makes it possible to serve untrusted and non-public content from a single origin, i.e., without wildcard DNS or SSL.")
 	flag.BoolVar(&trustAllContent, "trust-all-content", false,
 		"Serve non-public content from a single origin. Dangerous: read docs before using!")
+	flag.IntVar(&tokenCache.MaxEntries, "token-cache-size", tokencache.DefaultMaxEntries,
+		"Maximum number of (token, collection) permission checks to remember.")
+	flag.DurationVar(&tokenCache.TTL, "token-cache-ttl", tokencache.DefaultTTL,
+		"How long to remember that a token can read a collection. (Only content-addressed collections are remembered.)")
+	flag.DurationVar(&tokenCache.NegativeTTL, "token-cache-negative-ttl", tokencache.DefaultNegativeTTL,
+		"How long to remember that a token is invalid. Use a negative value to disable.")
+	flag.BoolVar(&serveIndexHTML, "index-html", true,
+		"When a directory is requested, serve the index.html file in that directory (if there is one) instead of a generated listing.")
 }
 
 // return a UUID or PDH if s begins with a UUID or URL-encoded PDH;
@@ -95,11 +108,26 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 		httpserver.Log(remoteAddr, statusCode, statusText, w.WroteBodyBytes(), r.Method, r.Host, r.URL.Path, r.URL.RawQuery)
 	}()
 
-	if r.Method != "GET" && r.Method != "POST" {
+	if s3AccessKey(r) != "" {
+		statusCode, statusText = serveS3(w, r)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "POST" && !davMethods[r.Method] {
 		statusCode, statusText = http.StatusMethodNotAllowed, r.Method
 		return
 	}
 
+	if r.Method == "OPTIONS" {
+		serveDAVOptions(w)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "POST" {
+		// Don't let FormValue() consume a PUT request body.
+		r.PostForm = url.Values{}
+	}
+
 	if r.Header.Get("Origin") != "" {
 		// Allow simple cross-origin requests without user
 		// credentials ("user credentials" as defined by CORS,
@@ -260,29 +288,21 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 
 	tokenResult := make(map[string]int)
-	collection := make(map[string]interface{})
-	found := false
+	var collection map[string]interface{}
 	for _, arv.ApiToken = range tokens {
-		err := arv.Get("collections", targetID, nil, &collection)
-		if err == nil {
-			// Success
-			found = true
+		var code int
+		var err error
+		collection, code, err = getCollection(arv, targetID)
+		if err != nil {
+			// Something more serious is wrong
+			statusCode, statusText = http.StatusInternalServerError, err.Error()
+			return
+		} else if collection != nil {
 			break
 		}
-		if srvErr, ok := err.(arvadosclient.APIServerError); ok {
-			switch srvErr.HttpStatusCode {
-			case 404, 401:
-				// Token broken or insufficient to
-				// retrieve collection
-				tokenResult[arv.ApiToken] = srvErr.HttpStatusCode
-				continue
-			}
-		}
-		// Something more serious is wrong
-		statusCode, statusText = http.StatusInternalServerError, err.Error()
-		return
+		tokenResult[arv.ApiToken] = code
 	}
-	if !found {
+	if collection == nil {
 		if pathToken || !credentialsOK {
 			// Either the URL is a "secret sharing link"
 			// that didn't work out (and asking the client
@@ -326,15 +346,85 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			defer t.CloseIdleConnections()
 		}
 	}
-	rdr, err := kc.CollectionFileReader(collection, filename)
-	if os.IsNotExist(err) {
-		statusCode = http.StatusNotFound
-		return
-	} else if err != nil {
-		statusCode, statusText = http.StatusBadGateway, err.Error()
+
+	if r.Method != "GET" && r.Method != "POST" {
+		basePath := "/"
+		if prefix := pathParts[:len(pathParts)-len(targetPath)]; len(prefix) > 0 {
+			basePath += strings.Join(prefix, "/") + "/"
+		}
+		dr := &davRequest{
+			w:          w,
+			r:          r,
+			arv:        arv,
+			kc:         kc,
+			collection: collection,
+			targetID:   targetID,
+			basePath:   basePath,
+			target:     cleanTarget(filename),
+		}
+		statusCode, statusText = dr.serveDAV()
 		return
 	}
-	defer rdr.Close()
+
+	statusCode, statusText = serveContent(w, r, kc, collection, targetID, arv.ApiToken, filename, attachment)
+}
+
+// serveContent responds to a GET or POST request for a file or
+// directory in a collection, which was retrieved (using the given
+// token) by the given UUID or PDH. It returns the response status
+// and a status message to log, if any.
+func serveContent(w http.ResponseWriter, r *http.Request, kc *keepclient.KeepClient, collection map[string]interface{}, targetID, token, filename string, attachment bool) (int, string) {
+	tree, err := newCollectionTree(manifestText(collection))
+	if err != nil {
+		return http.StatusBadGateway, err.Error()
+	}
+	var file *treeFile
+	if !strings.HasSuffix(filename, "/") {
+		_, file = tree.lookup(cleanTarget(filename))
+	}
+	if file == nil {
+		// Not a file, but it might be a directory.
+		if format := r.FormValue("format"); format == "zip" || format == "tar" {
+			return serveArchive(w, r, kc, collection, filename, format)
+		}
+		index, status, text := serveDirectory(w, r, collection, filename)
+		if index == "" {
+			return status, text
+		}
+		filename = index
+		if _, file = tree.lookup(filename); file == nil {
+			return http.StatusNotFound, ""
+		}
+	}
+	// A partsReader can seek, so any single byte range can be
+	// served (e.g., when a browser skips ahead in a video).
+	var rdr keepclient.ReadCloserWithLen = newFileReader(kc, file)
+
+	// Thumbnails and previews are derived from the file, so they
+	// get their own ETags.
+	var variant string
+	for _, param := range []string{"thumbnail", "preview"} {
+		if v := r.FormValue(param); v != "" {
+			variant = "?" + param + "=" + v
+			break
+		}
+	}
+
+	pdh, _ := collection["portable_data_hash"].(string)
+	etag, modTime := fileETag(pdh, filename+variant), collectionModTime(collection)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if w.Header().Get("Cache-Control") == "" {
+		applyCacheControlHdr(w, targetID, token)
+	}
+	if notModified(r, etag, modTime) {
+		return http.StatusNotModified, ""
+	}
+	if v := r.FormValue("thumbnail"); v != "" {
+		return serveThumbnail(w, r, rdr, pdh+"/"+filename, v)
+	} else if v := r.FormValue("preview"); v != "" {
+		return servePreview(w, r, rdr, filename, v)
+	}
 
 	basenamePos := strings.LastIndex(filename, "/")
 	if basenamePos < 0 {
@@ -347,40 +437,225 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", t)
 		}
 	}
+	if w.Header().Get("Content-Type") == "" {
+		// Sniff the content type here, rather than letting
+		// the http server do it: the server would only see
+		// the requested range, not the start of the file.
+		var t string
+		rdr, t, err = sniffContentType(rdr)
+		if err != nil {
+			return http.StatusBadGateway, err.Error()
+		}
+		w.Header().Set("Content-Type", t)
+	}
 	if rdr, ok := rdr.(keepclient.ReadCloserWithLen); ok {
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", rdr.Len()))
 	}
 
 	applyContentDispositionHdr(w, r, filename[basenamePos:], attachment)
-	rangeRdr, statusCode := applyRangeHdr(w, r, rdr)
+	rangeRdr, status := applyRangeHdr(w, r, rdr)
 
-	w.WriteHeader(statusCode)
+	w.WriteHeader(status)
 	_, err = io.Copy(w, rangeRdr)
 	if err != nil {
-		statusCode, statusText = http.StatusBadGateway, err.Error()
+		return http.StatusBadGateway, err.Error()
 	}
+	return status, ""
 }
 
-var rangeRe = regexp.MustCompile(`^bytes=0-([0-9]*)$`)
+// getCollection retrieves the collection with the given UUID or PDH,
+// using arv.ApiToken. If the token is broken or insufficient to
+// retrieve the collection, it returns a nil collection and the API
+// server's response status (401 or 404).
+func getCollection(arv *arvadosclient.ArvadosClient, targetID string) (map[string]interface{}, int, error) {
+	if tokenCache.Invalid(arv.ApiToken) {
+		return nil, http.StatusUnauthorized, nil
+	}
+	if cached, ok := tokenCache.Get(arv.ApiToken, targetID); ok {
+		return cached.(map[string]interface{}), 0, nil
+	}
+	collection := make(map[string]interface{})
+	err := arv.Get("collections", targetID, nil, &collection)
+	if err == nil {
+		if arvadosclient.PDHMatch(targetID) {
+			// The content of a collection identified by
+			// PDH never changes, so it's safe to reuse.
+			tokenCache.Set(arv.ApiToken, targetID, collection)
+		}
+		return collection, 0, nil
+	}
+	if srvErr, ok := err.(arvadosclient.APIServerError); ok {
+		switch srvErr.HttpStatusCode {
+		case 404, 401:
+			if srvErr.HttpStatusCode == 401 {
+				tokenCache.SetInvalid(arv.ApiToken)
+			}
+			return nil, srvErr.HttpStatusCode, nil
+		}
+	}
+	return nil, 0, err
+}
+
+var rangeRe = regexp.MustCompile(`^bytes=([0-9]*)-([0-9]*)$`)
 
+// applyRangeHdr returns a reader for the part of rdr requested by
+// the Range header (if any) and the response status to send. Only
+// single ranges are supported. Unless rdr is also an io.Seeker, only
+// ranges starting at byte 0 are supported. Unsupported ranges are
+// ignored, and the entire content is sent.
 func applyRangeHdr(w http.ResponseWriter, r *http.Request, rdr keepclient.ReadCloserWithLen) (io.Reader, int) {
 	w.Header().Set("Accept-Ranges", "bytes")
 	hdr := r.Header.Get("Range")
 	fields := rangeRe.FindStringSubmatch(hdr)
-	if fields == nil {
+	if fields == nil || fields[1] == "" && fields[2] == "" {
 		return rdr, http.StatusOK
 	}
-	rangeEnd, err := strconv.ParseInt(fields[1], 10, 64)
+	size := int64(rdr.Len())
+	var rangeStart, rangeEnd int64
+	var err error
+	if fields[1] == "" {
+		// "bytes=-N" means the last N bytes
+		rangeEnd = size - 1
+		rangeStart, err = strconv.ParseInt(fields[2], 10, 64)
+		rangeStart = size - rangeStart
+		if rangeStart < 0 {
+			rangeStart = 0
+		}
+	} else {
+		rangeStart, err = strconv.ParseInt(fields[1], 10, 64)
+		rangeEnd = size - 1
+		if err == nil && fields[2] != "" {
+			rangeEnd, err = strconv.ParseInt(fields[2], 10, 64)
+		}
+	}
 	if err != nil {
-		// Empty or too big for int64 == send entire content
+		// Too big for int64 == send entire content
 		return rdr, http.StatusOK
 	}
-	if uint64(rangeEnd) >= rdr.Len() {
+	if rangeEnd >= size {
+		rangeEnd = size - 1
+	}
+	if rangeStart > 0 || fields[1] == "" {
+		seeker, ok := rdr.(io.Seeker)
+		if !ok {
+			return rdr, http.StatusOK
+		}
+		if rangeStart >= size || rangeStart > rangeEnd {
+			w.Header().Set("Content-Length", "0")
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return strings.NewReader(""), http.StatusRequestedRangeNotSatisfiable
+		}
+		if _, err := seeker.Seek(rangeStart, os.SEEK_SET); err != nil {
+			return rdr, http.StatusOK
+		}
+	}
+	if rangeStart == 0 && rangeEnd >= size-1 {
 		return rdr, http.StatusOK
 	}
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", rangeEnd+1))
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", 0, rangeEnd, rdr.Len()))
-	return &io.LimitedReader{R: rdr, N: rangeEnd + 1}, http.StatusPartialContent
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", rangeEnd-rangeStart+1))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rangeStart, rangeEnd, size))
+	return &io.LimitedReader{R: rdr, N: rangeEnd - rangeStart + 1}, http.StatusPartialContent
+}
+
+// pdhMaxAge is the Cache-Control max-age for files in collections
+// requested by PDH, whose content never changes.
+const pdhMaxAge = 365 * 24 * time.Hour
+
+// applyCacheControlHdr sets a Cache-Control header suitable for a
+// file in the collection with the given UUID or PDH, retrieved using
+// the given token. Content addressed by PDH can be cached for a long
+// time; content addressed by UUID must be revalidated each time. If
+// the token isn't one of the anonymous tokens, shared caches must not
+// store the response at all.
+func applyCacheControlHdr(w http.ResponseWriter, targetID, token string) {
+	visibility := "private"
+	for _, t := range anonymousTokens {
+		if t == token {
+			visibility = "public"
+		}
+	}
+	if arvadosclient.PDHMatch(targetID) {
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, int(pdhMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", visibility+", no-cache")
+	}
+}
+
+// notModified returns true if the request's If-None-Match or
+// If-Modified-Since header indicates the client already has the
+// current version of the content. As in RFC 7232, If-Modified-Since
+// is ignored if If-None-Match is given.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !modTime.Truncate(time.Second).After(ims)
+	}
+	return false
+}
+
+// sniffedReader is a ReadCloserWithLen whose first few bytes have
+// already been read from the underlying reader, into buf.
+type sniffedReader struct {
+	keepclient.ReadCloserWithLen
+	buf []byte
+}
+
+func (r *sniffedReader) Read(p []byte) (int, error) {
+	if len(r.buf) > 0 {
+		n := copy(p, r.buf)
+		r.buf = r.buf[n:]
+		return n, nil
+	}
+	return r.ReadCloserWithLen.Read(p)
+}
+
+// sniffContentType detects the content type of the data in rdr, as
+// in http.DetectContentType, and returns a reader that reads the
+// same data from the beginning.
+func sniffContentType(rdr keepclient.ReadCloserWithLen) (keepclient.ReadCloserWithLen, string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(rdr, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return rdr, "", err
+	}
+	buf = buf[:n]
+	if seeker, ok := rdr.(io.Seeker); ok {
+		// Rewind instead of wrapping, so the caller can still
+		// seek.
+		if _, err := seeker.Seek(0, os.SEEK_SET); err != nil {
+			return rdr, "", err
+		}
+		return rdr, http.DetectContentType(buf), nil
+	}
+	return &sniffedReader{ReadCloserWithLen: rdr, buf: buf}, http.DetectContentType(buf), nil
+}
+
+// collectionModTime returns the collection's modified_at time, or
+// the current time if modified_at is missing or unparseable.
+func collectionModTime(collection map[string]interface{}) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, fmt.Sprint(collection["modified_at"])); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// fileETag returns a quoted entity tag for the file at the given
+// path in the collection with the given PDH. It changes whenever
+// the collection content changes. It is longer than an MD5 digest,
+// so S3 clients won't mistake it for a checksum of the file content.
+func fileETag(pdh, name string) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum([]byte(pdh+"/"+name)))
 }
 
 func applyContentDispositionHdr(w http.ResponseWriter, r *http.Request, filename string, isAttachment bool) {
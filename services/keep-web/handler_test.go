@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"html"
 	"io/ioutil"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
 	"git.curoverse.com/arvados.git/sdk/go/auth"
@@ -380,11 +382,31 @@ func (s *IntegrationSuite) TestRange(c *check.C) {
 	c.Check(resp.Body.String(), check.Equals, "Hello world\n")
 	c.Check(resp.Header().Get("Content-Length"), check.Equals, "12")
 
+	// Ranges that don't start at byte 0 are supported too, so
+	// browsers can skip ahead in audio and video files
+	for hdr, expect := range map[string]string{
+		"bytes=5-5": " ",
+		"bytes=-5":  "orld\n",
+		"bytes=6-":  "world\n",
+	} {
+		req.Header.Set("Range", hdr)
+		resp = httptest.NewRecorder()
+		(&handler{}).ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+		c.Check(resp.Body.String(), check.Equals, expect)
+		c.Check(resp.Header().Get("Content-Length"), check.Equals, fmt.Sprintf("%d", len(expect)))
+	}
+
+	req.Header.Set("Range", "bytes=12-")
+	resp = httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusRequestedRangeNotSatisfiable)
+	c.Check(resp.Header().Get("Content-Range"), check.Equals, "bytes */12")
+
 	// Unsupported ranges are ignored
 	for _, hdr := range []string{
-		"bytes=5-5",  // non-zero start byte
-		"bytes=-5",   // last 5 bytes
-		"cubits=0-5", // unsupported unit
+		"bytes=0-1,3-4", // multiple ranges
+		"cubits=0-5",    // unsupported unit
 		"bytes=0-340282366920938463463374607431768211456", // 2^128
 	} {
 		req.Header.Set("Range", hdr)
@@ -426,6 +448,47 @@ func (s *IntegrationSuite) TestXHRNoRedirect(c *check.C) {
 	c.Check(resp.Header().Get("Access-Control-Allow-Origin"), check.Equals, "*")
 }
 
+func (s *IntegrationSuite) TestConditionalGet(c *check.C) {
+	u := mustParseURL("http://" + arvadostest.FooCollection + ".collections.example.com/foo")
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header: http.Header{
+			"Authorization": {"OAuth2 " + arvadostest.ActiveToken},
+		},
+	}
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Cache-Control"), check.Equals, "private, no-cache")
+	// Content type is sniffed, because "foo" has no extension
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "text/plain; charset=utf-8")
+	etag := resp.Header().Get("ETag")
+	c.Check(etag, check.Matches, `"[0-9a-f]{40}"`)
+	lastModified := resp.Header().Get("Last-Modified")
+	c.Check(lastModified, check.Not(check.Equals), "")
+
+	req.Header.Set("If-None-Match", etag)
+	resp = httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusNotModified)
+	c.Check(resp.Body.String(), check.Equals, "")
+
+	req.Header.Del("If-None-Match")
+	req.Header.Set("If-Modified-Since", lastModified)
+	resp = httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusNotModified)
+
+	req.Header.Set("If-None-Match", `"0123"`)
+	resp = httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+}
+
 func (s *IntegrationSuite) testVhostRedirectTokenToCookie(c *check.C, method, hostPath, queryString, contentType, reqBody string, expectStatus int, expectRespBody string) *httptest.ResponseRecorder {
 	u, _ := url.Parse(`http://` + hostPath + queryString)
 	req := &http.Request{
@@ -467,3 +530,67 @@ func (s *IntegrationSuite) testVhostRedirectTokenToCookie(c *check.C, method, ho
 	c.Check(resp.Header().Get("Location"), check.Equals, "")
 	return resp
 }
+
+func (s *UnitSuite) TestNotModified(c *check.C) {
+	modTime := time.Date(2016, 8, 1, 12, 34, 56, 789000000, time.UTC)
+	for _, trial := range []struct {
+		hdr    map[string]string
+		expect bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"If-None-Match": `"abc"`}, true},
+		{map[string]string{"If-None-Match": `"xyz", W/"abc"`}, true},
+		{map[string]string{"If-None-Match": `*`}, true},
+		{map[string]string{"If-None-Match": `"xyz"`}, false},
+		{map[string]string{"If-Modified-Since": "Mon, 01 Aug 2016 12:34:56 GMT"}, true},
+		{map[string]string{"If-Modified-Since": "Mon, 01 Aug 2016 12:34:55 GMT"}, false},
+		{map[string]string{"If-Modified-Since": "garbage"}, false},
+		{map[string]string{"If-None-Match": `"xyz"`, "If-Modified-Since": "Mon, 01 Aug 2016 12:34:56 GMT"}, false},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		for k, v := range trial.hdr {
+			req.Header.Set(k, v)
+		}
+		c.Check(notModified(req, `"abc"`, modTime), check.Equals, trial.expect, check.Commentf("%v", trial.hdr))
+	}
+}
+
+func (s *UnitSuite) TestCacheControl(c *check.C) {
+	defer func(orig tokenSet) { anonymousTokens = orig }(anonymousTokens)
+	anonymousTokens = []string{arvadostest.AnonymousToken}
+	for _, trial := range []struct {
+		targetID string
+		token    string
+		expect   string
+	}{
+		{arvadostest.FooPdh, arvadostest.AnonymousToken, "public, max-age=31536000"},
+		{arvadostest.FooPdh, arvadostest.ActiveToken, "private, max-age=31536000"},
+		{arvadostest.FooCollection, arvadostest.AnonymousToken, "public, no-cache"},
+		{arvadostest.FooCollection, arvadostest.ActiveToken, "private, no-cache"},
+	} {
+		resp := httptest.NewRecorder()
+		applyCacheControlHdr(resp, trial.targetID, trial.token)
+		c.Check(resp.Header().Get("Cache-Control"), check.Equals, trial.expect)
+	}
+}
+
+func (s *UnitSuite) TestSniffContentType(c *check.C) {
+	for _, trial := range []struct {
+		data   string
+		expect string
+	}{
+		{"<!DOCTYPE html><html></html>", "text/html; charset=utf-8"},
+		{"\x89PNG\x0d\x0a\x1a\x0a" + strings.Repeat("\x00", 600), "image/png"},
+		{"ACGT\n", "text/plain; charset=utf-8"},
+		{"", "text/plain; charset=utf-8"},
+	} {
+		rdr := newPartsReader(nil, []readerPart{{data: []byte(trial.data)}})
+		sniffed, t, err := sniffContentType(rdr)
+		c.Check(err, check.IsNil)
+		c.Check(t, check.Equals, trial.expect)
+		c.Check(sniffed.Len(), check.Equals, uint64(len(trial.data)))
+		buf, err := ioutil.ReadAll(sniffed)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf), check.Equals, trial.data)
+	}
+}
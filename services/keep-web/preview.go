@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Most lines a client can request in a text preview
+	previewMaxLines = 10000
+
+	// Most bytes of (uncompressed) text shown in a preview,
+	// regardless of the number of lines
+	previewMaxBytes = 1 << 20
+)
+
+// mediaTypes are content types for audio and video formats that
+// browsers can play, in case the system's MIME type database doesn't
+// know about them. Without the right type, browsers download media
+// files instead of playing them.
+var mediaTypes = map[string]string{
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".m4v":  "video/mp4",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".ogv":  "video/ogg",
+	".wav":  "audio/wav",
+	".webm": "video/webm",
+}
+
+func init() {
+	for ext, t := range mediaTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, t)
+		}
+	}
+}
+
+type textPreview struct {
+	Name      string
+	Href      string
+	Lines     int
+	Text      string
+	Truncated bool
+}
+
+var textPreviewTemplate = template.Must(template.New("textPreview").Parse(`<!DOCTYPE HTML>
+<HTML><HEAD>
+<META charset="utf-8">
+<TITLE>{{.Name}}</TITLE>
+<STYLE type="text/css">
+body { font-family: sans-serif; }
+pre { font-family: monospace; }
+</STYLE>
+</HEAD>
+<BODY>
+<H1>{{.Name}}</H1>
+<P>{{if .Truncated}}First {{.Lines}} lines of <A href="{{.Href}}">{{.Name}}</A>{{else}}<A href="{{.Href}}">{{.Name}}</A>{{end}}</P>
+<PRE>{{.Text}}</PRE>
+</BODY>
+</HTML>
+`))
+
+// servePreview responds with an HTML page showing the first
+// linesParam lines of the text file in rdr. If the file name ends in
+// ".gz", the file is decompressed first.
+func servePreview(w http.ResponseWriter, r *http.Request, rdr io.Reader, filename string, linesParam string) (int, string) {
+	lines, err := strconv.Atoi(linesParam)
+	if err != nil || lines < 1 || lines > previewMaxLines {
+		return http.StatusBadRequest, fmt.Sprintf("preview lines must be between 1 and %d", previewMaxLines)
+	}
+	name := path.Base(filename)
+	if strings.HasSuffix(name, ".gz") {
+		if rdr, err = gzip.NewReader(rdr); err != nil {
+			return http.StatusUnsupportedMediaType, err.Error()
+		}
+	}
+	text, truncated, err := readLines(rdr, lines, previewMaxBytes)
+	if err != nil {
+		return http.StatusBadGateway, err.Error()
+	}
+	if bytes.IndexByte(text, 0) >= 0 {
+		return http.StatusUnsupportedMediaType, "binary file"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	err = textPreviewTemplate.Execute(w, textPreview{
+		Name:      name,
+		Href:      relativeHref(name),
+		Lines:     lines,
+		Text:      string(text),
+		Truncated: truncated,
+	})
+	if err != nil {
+		return http.StatusOK, err.Error()
+	}
+	return http.StatusOK, ""
+}
+
+// readLines returns the first n lines from rdr, or the first
+// maxBytes bytes if that comes first. It also returns true if there
+// is more data after that.
+func readLines(rdr io.Reader, n int, maxBytes int64) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	br := bufio.NewReader(io.LimitReader(rdr, maxBytes+1))
+	for i := 0; i < n; i++ {
+		line, err := br.ReadBytes('\n')
+		buf.Write(line)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+	if int64(buf.Len()) > maxBytes {
+		return buf.Bytes()[:maxBytes], true, nil
+	}
+	_, err := br.Peek(1)
+	return buf.Bytes(), err == nil, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestPreview(c *check.C) {
+	fastq := "@read1\nACGT\n+\nIIII\n@read2\nTTTT\n+\nIIII\n"
+	var gzData bytes.Buffer
+	zw := gzip.NewWriter(&gzData)
+	zw.Write([]byte(fastq))
+	zw.Close()
+
+	for _, trial := range []struct {
+		filename string
+		data     string
+		lines    string
+		status   int
+		expect   []string
+		reject   []string
+	}{
+		{"dir/reads.fastq", fastq, "4", http.StatusOK,
+			[]string{`<PRE>@read1
+ACGT
+&#43;
+IIII
+</PRE>`, `First 4 lines of <A href="./reads.fastq">reads.fastq</A>`},
+			[]string{`read2`}},
+		{"reads.fastq.gz", gzData.String(), "100", http.StatusOK,
+			[]string{`@read2`, `<A href="./reads.fastq.gz">reads.fastq.gz</A></P>`},
+			[]string{`First`}},
+		{"x.csv", "a,b\n<script>\n", "10", http.StatusOK,
+			[]string{`&lt;script&gt;`},
+			[]string{`<script>`}},
+		{"x.bin", "\x00\x01\x02", "10", http.StatusUnsupportedMediaType, nil, nil},
+		{"x.gz", "not gzip", "10", http.StatusUnsupportedMediaType, nil, nil},
+		{"x.csv", "a,b\n", "0", http.StatusBadRequest, nil, nil},
+		{"x.csv", "a,b\n", "lots", http.StatusBadRequest, nil, nil},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp := httptest.NewRecorder()
+		status, _ := servePreview(resp, req, strings.NewReader(trial.data), trial.filename, trial.lines)
+		c.Check(status, check.Equals, trial.status, check.Commentf("%s", trial.filename))
+		for _, s := range trial.expect {
+			c.Check(strings.Contains(resp.Body.String(), s), check.Equals, true, check.Commentf("%q not in %q", s, resp.Body.String()))
+		}
+		for _, s := range trial.reject {
+			c.Check(strings.Contains(resp.Body.String(), s), check.Equals, false, check.Commentf("%q in %q", s, resp.Body.String()))
+		}
+	}
+}
+
+func (s *UnitSuite) TestReadLines(c *check.C) {
+	for _, trial := range []struct {
+		data      string
+		n         int
+		maxBytes  int64
+		expect    string
+		truncated bool
+	}{
+		{"a\nb\nc\n", 2, 100, "a\nb\n", true},
+		{"a\nb\nc\n", 3, 100, "a\nb\nc\n", false},
+		{"a\nb\nc", 5, 100, "a\nb\nc", false},
+		{"aaaaaaaaaa\n", 1, 4, "aaaa", true},
+		{"", 1, 4, "", false},
+	} {
+		text, truncated, err := readLines(strings.NewReader(trial.data), trial.n, trial.maxBytes)
+		c.Check(err, check.IsNil)
+		c.Check(string(text), check.Equals, trial.expect)
+		c.Check(truncated, check.Equals, trial.truncated, check.Commentf("%+v", trial))
+	}
+}
+
+func (s *IntegrationSuite) TestPreview(c *check.C) {
+	u := mustParseURL("http://example.com/c=" + arvadostest.HelloWorldCollection + "/Hello%20world.txt?preview=10")
+	req := &http.Request{
+		Method:     "GET",
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+	}
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Type"), check.Equals, "text/html; charset=utf-8")
+	c.Check(resp.Body.String(), check.Matches, `(?s).*<PRE>Hello world\n</PRE>.*`)
+	previewETag := resp.Header().Get("ETag")
+
+	u.RawQuery = ""
+	req.URL, req.RequestURI = u, u.RequestURI()
+	resp = httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("ETag"), check.Not(check.Equals), previewETag)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+)
+
+var errSeekNegative = errors.New("seek to negative offset")
+
+// readerPart is part of the content read by a partsReader: either a
+// literal byte slice, or the content of a file in a collection.
+type readerPart struct {
+	data []byte
+	file *treeFile
+}
+
+func (p readerPart) size() int64 {
+	if p.file != nil {
+		return p.file.size
+	}
+	return int64(len(p.data))
+}
+
+// partsReader is an io.ReadSeeker that reads a sequence of parts,
+// fetching file content from Keep as needed. Seeking is cheap: no
+// data is fetched until Read is called.
+type partsReader struct {
+	kc        *keepclient.KeepClient
+	parts     []readerPart
+	partStart []int64
+	size      int64
+	offset    int64
+
+	// Most recently fetched block
+	blockLocator string
+	block        []byte
+}
+
+func newPartsReader(kc *keepclient.KeepClient, parts []readerPart) *partsReader {
+	r := &partsReader{
+		kc:        kc,
+		parts:     parts,
+		partStart: make([]int64, len(parts)),
+	}
+	for i, p := range parts {
+		r.partStart[i] = r.size
+		r.size += p.size()
+	}
+	return r
+}
+
+// newFileReader returns a partsReader for the content of a single
+// file.
+func newFileReader(kc *keepclient.KeepClient, f *treeFile) *partsReader {
+	return newPartsReader(kc, []readerPart{{file: f}})
+}
+
+// Len returns the total number of bytes in all parts.
+func (r *partsReader) Len() uint64 {
+	return uint64(r.size)
+}
+
+// Close implements io.Closer, so a partsReader can be used as a
+// keepclient.ReadCloserWithLen. It does nothing.
+func (r *partsReader) Close() error {
+	return nil
+}
+
+func (r *partsReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += r.offset
+	case os.SEEK_END:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, errSeekNegative
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *partsReader) Read(buf []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	// Find the last part that starts at or before r.offset. It
+	// can't be empty, because r.offset < r.size.
+	i := sort.Search(len(r.parts), func(i int) bool {
+		return r.partStart[i] > r.offset
+	}) - 1
+	part, partOffset := r.parts[i], r.offset-r.partStart[i]
+	var n int
+	if part.file == nil {
+		n = copy(buf, part.data[partOffset:])
+	} else {
+		data, err := r.fileData(part.file, partOffset)
+		if err != nil {
+			return 0, err
+		}
+		n = copy(buf, data)
+	}
+	r.offset += int64(n)
+	return n, nil
+}
+
+// fileData returns the data in f starting at the given offset, up to
+// the end of the segment containing that offset.
+func (r *partsReader) fileData(f *treeFile, offset int64) ([]byte, error) {
+	for _, seg := range f.segments {
+		if offset >= int64(seg.Len) {
+			offset -= int64(seg.Len)
+			continue
+		}
+		if seg.Locator != r.blockLocator {
+			block, err := r.fetch(seg.Locator)
+			if err != nil {
+				return nil, err
+			}
+			r.blockLocator, r.block = seg.Locator, block
+		}
+		if seg.Offset+seg.Len > len(r.block) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return r.block[seg.Offset+int(offset) : seg.Offset+seg.Len], nil
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+func (r *partsReader) fetch(locator string) ([]byte, error) {
+	rdr, size, _, err := r.kc.Get(locator)
+	if err != nil {
+		return nil, err
+	}
+	defer rdr.Close()
+	// Reading to EOF makes the HashCheckingReader verify the
+	// data.
+	block, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	} else if int64(len(block)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return block, nil
+}
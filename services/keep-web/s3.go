@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+)
+
+const s3XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3MaxKeys is the default (and maximum) number of keys returned by
+// a single ListObjects request.
+const s3MaxKeys = 1000
+
+// s3Error is the body of an S3 error response.
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+// serveS3Error writes an S3 error response, and returns the status
+// and message to log.
+func serveS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) (int, string) {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		io.WriteString(w, xml.Header)
+		xml.NewEncoder(w).Encode(s3Error{Code: code, Message: message, Resource: r.URL.Path})
+	}
+	return status, message
+}
+
+// serveS3 handles a request made by an S3 client, using the token
+// given by the request's access key. The bucket name is a collection
+// UUID or PDH, given either in the host name (as in
+// handler.ServeHTTP) or as the first component of the path. The
+// object key is a file path in the collection.
+func serveS3(w http.ResponseWriter, r *http.Request) (int, string) {
+	if s3Secret == "" {
+		return serveS3Error(w, r, http.StatusForbidden, "AccessDenied", "S3 API is disabled")
+	}
+	token, authErr := s3Authenticate(r, s3Secret, time.Now())
+	if authErr != nil {
+		return serveS3Error(w, r, http.StatusForbidden, authErr.Code, authErr.Message)
+	}
+	var bucket, key string
+	if targetID := parseCollectionIDFromDNSName(r.Host); targetID != "" {
+		// http://ID.collections.example/KEY
+		bucket, key = targetID, strings.TrimPrefix(r.URL.Path, "/")
+	} else {
+		// http://collections.example/ID/KEY
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		bucket = parseCollectionIDFromURL(parts[0])
+		if len(parts) > 1 {
+			key = parts[1]
+		}
+	}
+	if bucket == "" {
+		return serveS3Error(w, r, http.StatusNotFound, "NoSuchBucket", "")
+	}
+
+	arv := clientPool.Get()
+	if arv == nil {
+		return serveS3Error(w, r, http.StatusInternalServerError, "InternalError", "Pool failed: "+clientPool.Err().Error())
+	}
+	defer clientPool.Put(arv)
+	arv.ApiToken = token
+
+	collection, code, err := getCollection(arv, bucket)
+	if err != nil {
+		return serveS3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+	} else if code == http.StatusUnauthorized {
+		return serveS3Error(w, r, http.StatusForbidden, "InvalidAccessKeyId", "")
+	} else if collection == nil {
+		return serveS3Error(w, r, http.StatusNotFound, "NoSuchBucket", "")
+	}
+	tree, err := newCollectionTree(manifestText(collection))
+	if err != nil {
+		return serveS3Error(w, r, http.StatusBadGateway, "InternalError", err.Error())
+	}
+
+	kc, err := keepclient.MakeKeepClient(arv)
+	if err != nil {
+		return serveS3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+	if kc.Client != nil && kc.Client.Transport != nil {
+		// Workaround for https://dev.arvados.org/issues/9005
+		if t, ok := kc.Client.Transport.(*http.Transport); ok {
+			defer t.CloseIdleConnections()
+		}
+	}
+
+	switch {
+	case key == "" && r.Method == "HEAD":
+		// HeadBucket
+		w.WriteHeader(http.StatusOK)
+		return http.StatusOK, ""
+	case key == "" && r.Method == "GET":
+		if _, ok := r.URL.Query()["location"]; ok {
+			w.Header().Set("Content-Type", "application/xml")
+			io.WriteString(w, xml.Header+`<LocationConstraint xmlns="`+s3XMLNS+`"></LocationConstraint>`)
+			return http.StatusOK, ""
+		}
+		return serveS3List(w, r, bucket, collection, tree)
+	case key != "" && (r.Method == "GET" || r.Method == "HEAD"):
+		return serveS3Object(w, r, kc, collection, tree, key)
+	case key != "" && r.Method == "PUT":
+		if !arvadosclient.UUIDMatch(bucket) {
+			// A collection identified by its content hash
+			// can't change.
+			return serveS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "collection is read-only")
+		}
+		return serveS3Put(w, r, arv, kc, bucket, collection, key)
+	default:
+		return serveS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+	}
+}
+
+// s3Object is an object in a ListObjects response.
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+// s3ListResult is the body of a ListObjects response. Version 1 and
+// version 2 responses use different subsets of the fields.
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	XMLNS                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	IsTruncated           bool
+	Marker                string     `xml:",omitempty"`
+	NextMarker            string     `xml:",omitempty"`
+	StartAfter            string     `xml:",omitempty"`
+	ContinuationToken     string     `xml:",omitempty"`
+	NextContinuationToken string     `xml:",omitempty"`
+	KeyCount              *int       `xml:",omitempty"`
+	Contents              []s3Object `xml:",omitempty"`
+	CommonPrefixes        []s3Prefix `xml:",omitempty"`
+}
+
+// s3Key is a file, or an empty directory, in a collection.
+type s3Key struct {
+	key  string
+	file *treeFile
+}
+
+type s3KeyList []s3Key
+
+func (l s3KeyList) Len() int           { return len(l) }
+func (l s3KeyList) Less(i, j int) bool { return l[i].key < l[j].key }
+func (l s3KeyList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// s3Keys returns the keys for all files in dir and its
+// subdirectories, with names starting with prefix. Empty directories
+// are listed with a trailing slash, so they don't disappear from the
+// client's view of the collection.
+func s3Keys(dir *treeDir, prefix string) []s3Key {
+	var keys []s3Key
+	for _, name := range dir.dirNames() {
+		sub := dir.dirs[name]
+		if len(sub.dirs) == 0 && len(sub.files) == 0 {
+			keys = append(keys, s3Key{key: prefix + name + "/"})
+		} else {
+			keys = append(keys, s3Keys(sub, prefix+name+"/")...)
+		}
+	}
+	for _, name := range dir.fileNames() {
+		keys = append(keys, s3Key{key: prefix + name, file: dir.files[name]})
+	}
+	return keys
+}
+
+// s3List returns the ListObjects result for the given collection
+// tree and query parameters.
+func s3List(tree *collectionTree, params map[string][]string, pdh string, modTime time.Time) s3ListResult {
+	get := func(k string) string {
+		if v := params[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	v2 := get("list-type") == "2"
+	result := s3ListResult{
+		XMLNS:     s3XMLNS,
+		Prefix:    get("prefix"),
+		Delimiter: get("delimiter"),
+		MaxKeys:   s3MaxKeys,
+	}
+	if n, err := strconv.Atoi(get("max-keys")); err == nil && n >= 0 && n < s3MaxKeys {
+		result.MaxKeys = n
+	}
+	var marker string
+	if v2 {
+		result.StartAfter = get("start-after")
+		result.ContinuationToken = get("continuation-token")
+		marker = result.StartAfter
+		if result.ContinuationToken != "" {
+			marker = result.ContinuationToken
+		}
+	} else {
+		result.Marker = get("marker")
+		marker = result.Marker
+	}
+
+	keys := s3Keys(tree.root, "")
+	sort.Sort(s3KeyList(keys))
+	lastModified := modTime.UTC().Format("2006-01-02T15:04:05.000Z")
+	var next string
+	count := 0
+	for _, k := range keys {
+		if !strings.HasPrefix(k.key, result.Prefix) {
+			continue
+		}
+		entry, isPrefix := k.key, false
+		if result.Delimiter != "" {
+			if i := strings.Index(k.key[len(result.Prefix):], result.Delimiter); i >= 0 {
+				entry = k.key[:len(result.Prefix)+i+len(result.Delimiter)]
+				isPrefix = true
+			}
+		}
+		if entry <= marker || entry == next {
+			// Already listed in a previous page, or (if
+			// entry is a common prefix) in this page.
+			continue
+		}
+		if count >= result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		count++
+		next = entry
+		if isPrefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{entry})
+			continue
+		}
+		obj := s3Object{
+			Key:          k.key,
+			LastModified: lastModified,
+			ETag:         fileETag(pdh, k.key),
+			StorageClass: "STANDARD",
+		}
+		if k.file != nil {
+			obj.Size = k.file.size
+		}
+		result.Contents = append(result.Contents, obj)
+	}
+	if v2 {
+		result.KeyCount = &count
+		if result.IsTruncated {
+			result.NextContinuationToken = next
+		}
+	} else if result.IsTruncated {
+		result.NextMarker = next
+	}
+	return result
+}
+
+func serveS3List(w http.ResponseWriter, r *http.Request, bucket string, collection map[string]interface{}, tree *collectionTree) (int, string) {
+	pdh, _ := collection["portable_data_hash"].(string)
+	result := s3List(tree, r.URL.Query(), pdh, collectionModTime(collection))
+	result.Name = bucket
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		return http.StatusOK, err.Error()
+	}
+	return http.StatusOK, ""
+}
+
+// serveS3Object responds to a GetObject or HeadObject request.
+func serveS3Object(w http.ResponseWriter, r *http.Request, kc *keepclient.KeepClient, collection map[string]interface{}, tree *collectionTree, key string) (int, string) {
+	dir, file := tree.lookup(cleanTarget(key))
+	var rdr *partsReader
+	if file != nil && !strings.HasSuffix(key, "/") {
+		rdr = newFileReader(kc, file)
+	} else if dir != nil && strings.HasSuffix(key, "/") {
+		// Directory placeholder, as listed by s3Keys
+		rdr = newPartsReader(kc, nil)
+	} else {
+		return serveS3Error(w, r, http.StatusNotFound, "NoSuchKey", "")
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	pdh, _ := collection["portable_data_hash"].(string)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", rdr.Len()))
+	w.Header().Set("Last-Modified", collectionModTime(collection).UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", fileETag(pdh, key))
+	// S3 clients don't care about Content-Disposition. Browsers
+	// following a presigned link do, and must not run scripts
+	// from the collection in an origin where the token is
+	// visible in the URL.
+	applyContentDispositionHdr(w, r, path.Base(key), true)
+
+	rangeRdr, status := applyRangeHdr(w, r, rdr)
+	if status == http.StatusRequestedRangeNotSatisfiable {
+		w.Header().Del("Content-Length")
+		return serveS3Error(w, r, status, "InvalidRange", "")
+	}
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return status, ""
+	}
+	if _, err := io.Copy(w, rangeRdr); err != nil {
+		return http.StatusBadGateway, err.Error()
+	}
+	return status, ""
+}
+
+// serveS3Put responds to a PutObject request. A key ending in "/"
+// creates an empty directory. Missing parent directories are
+// created as needed.
+func serveS3Put(w http.ResponseWriter, r *http.Request, arv *arvadosclient.ArvadosClient, kc *keepclient.KeepClient, uuid string, collection map[string]interface{}, key string) (int, string) {
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		// The body is in aws-chunked encoding, with a
+		// signature in each chunk.
+		return serveS3Error(w, r, http.StatusNotImplemented, "NotImplemented", "chunked uploads are not supported")
+	}
+	target := cleanTarget(key)
+	if target == "" {
+		return serveS3Error(w, r, http.StatusBadRequest, "InvalidRequest", "invalid key")
+	}
+	var f *treeFile
+	if !strings.HasSuffix(key, "/") {
+		// Store the body in Keep first, so the same file can
+		// be added again if the update is retried.
+		// If the signature covers the payload hash, check
+		// that the body matches it.
+		hash := sha256.New()
+		var err error
+		f, err = storeFile(kc, io.TeeReader(r.Body, hash))
+		if err != nil {
+			return serveS3Error(w, r, http.StatusBadGateway, "InternalError", err.Error())
+		}
+		if want := r.Header.Get("X-Amz-Content-Sha256"); len(want) == 64 && want != fmt.Sprintf("%x", hash.Sum(nil)) {
+			return serveS3Error(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "")
+		}
+	}
+	status, err := modifyCollection(arv, uuid, &collection, func(tree *collectionTree) (int, error) {
+		if f == nil {
+			if _, err := tree.mkdirAll(target); err != nil {
+				return http.StatusConflict, err
+			}
+			return http.StatusOK, nil
+		}
+		dirPath, _ := splitPath(target)
+		if _, err := tree.mkdirAll(dirPath); err != nil {
+			return http.StatusConflict, err
+		}
+		if _, err := tree.putFile(target, f); err != nil {
+			return http.StatusConflict, err
+		}
+		return http.StatusOK, nil
+	})
+	switch {
+	case err == nil:
+	case err == errCollectionModified:
+		return serveS3Error(w, r, status, "OperationAborted", err.Error())
+	case status == http.StatusForbidden:
+		return serveS3Error(w, r, status, "AccessDenied", err.Error())
+	case status == http.StatusConflict:
+		return serveS3Error(w, r, status, "InvalidRequest", err.Error())
+	default:
+		return serveS3Error(w, r, status, "InternalError", err.Error())
+	}
+	pdh, _ := collection["portable_data_hash"].(string)
+	w.Header().Set("ETag", fileETag(pdh, key))
+	w.WriteHeader(http.StatusOK)
+	return http.StatusOK, ""
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestS3List(c *check.C) {
+	tree, err := newCollectionTree(". " + fooLocator + " 0:3:foo\n" +
+		"./dir " + barLocator + " 0:3:bar 0:3:baz\n" +
+		"./dir/sub " + fooLocator + " 0:3:foo\n" +
+		"./empty d41d8cd98f00b204e9800998ecf8427e+0 0:0:\\056\n")
+	c.Assert(err, check.IsNil)
+	modTime := time.Date(2016, 8, 1, 12, 34, 56, 0, time.UTC)
+
+	keys := func(result s3ListResult) (keys []string) {
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		for _, p := range result.CommonPrefixes {
+			keys = append(keys, p.Prefix)
+		}
+		return
+	}
+
+	result := s3List(tree, url.Values{}, arvadostest.FooPdh, modTime)
+	c.Check(keys(result), check.DeepEquals, []string{"dir/bar", "dir/baz", "dir/sub/foo", "empty/", "foo"})
+	c.Check(result.IsTruncated, check.Equals, false)
+	c.Check(result.Contents[0].Size, check.Equals, int64(3))
+	c.Check(result.Contents[0].LastModified, check.Equals, "2016-08-01T12:34:56.000Z")
+	c.Check(result.Contents[0].ETag, check.Matches, `"[0-9a-f]{40}"`)
+	c.Check(result.KeyCount, check.IsNil)
+
+	result = s3List(tree, url.Values{"delimiter": {"/"}}, arvadostest.FooPdh, modTime)
+	c.Check(keys(result), check.DeepEquals, []string{"foo", "dir/", "empty/"})
+
+	result = s3List(tree, url.Values{"delimiter": {"/"}, "prefix": {"dir/"}}, arvadostest.FooPdh, modTime)
+	c.Check(keys(result), check.DeepEquals, []string{"dir/bar", "dir/baz", "dir/sub/"})
+
+	// Page through the listing, two entries at a time.
+	var all []string
+	params := url.Values{"delimiter": {"/"}, "max-keys": {"2"}}
+	for i := 0; i < 3; i++ {
+		result = s3List(tree, params, arvadostest.FooPdh, modTime)
+		all = append(all, keys(result)...)
+		if !result.IsTruncated {
+			break
+		}
+		params.Set("marker", result.NextMarker)
+	}
+	c.Check(result.IsTruncated, check.Equals, false)
+	c.Check(all, check.DeepEquals, []string{"dir/", "empty/", "foo"})
+
+	// Version 2
+	params = url.Values{"list-type": {"2"}, "max-keys": {"3"}}
+	result = s3List(tree, params, arvadostest.FooPdh, modTime)
+	c.Check(keys(result), check.DeepEquals, []string{"dir/bar", "dir/baz", "dir/sub/foo"})
+	c.Check(result.IsTruncated, check.Equals, true)
+	c.Check(*result.KeyCount, check.Equals, 3)
+	params.Set("continuation-token", result.NextContinuationToken)
+	result = s3List(tree, params, arvadostest.FooPdh, modTime)
+	c.Check(keys(result), check.DeepEquals, []string{"empty/", "foo"})
+	c.Check(result.IsTruncated, check.Equals, false)
+	c.Check(result.NextContinuationToken, check.Equals, "")
+
+	buf, err := xml.Marshal(result)
+	c.Assert(err, check.IsNil)
+	c.Check(string(buf), check.Matches, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">.*<KeyCount>2</KeyCount><Contents><Key>empty/</Key>.*`)
+}
+
+func (s *UnitSuite) TestApplyRangeHdr(c *check.C) {
+	for _, trial := range []struct {
+		hdr    string
+		status int
+		body   string
+		crange string
+	}{
+		{"", http.StatusOK, "hello world", ""},
+		{"bytes=0-4", http.StatusPartialContent, "hello", "bytes 0-4/11"},
+		{"bytes=6-", http.StatusPartialContent, "world", "bytes 6-10/11"},
+		{"bytes=6-100", http.StatusPartialContent, "world", "bytes 6-10/11"},
+		{"bytes=-3", http.StatusPartialContent, "rld", "bytes 8-10/11"},
+		{"bytes=-30", http.StatusOK, "hello world", ""},
+		{"bytes=0-", http.StatusOK, "hello world", ""},
+		{"bytes=11-", http.StatusRequestedRangeNotSatisfiable, "", "bytes */11"},
+		{"bytes=5-4", http.StatusRequestedRangeNotSatisfiable, "", "bytes */11"},
+		{"bytes=0-1,3-4", http.StatusOK, "hello world", ""},
+	} {
+		req, err := http.NewRequest("GET", "/", nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set("Range", trial.hdr)
+		resp := httptest.NewRecorder()
+		rdr, status := applyRangeHdr(resp, req, newPartsReader(nil, []readerPart{{data: []byte("hello world")}}))
+		c.Check(status, check.Equals, trial.status, check.Commentf("%q", trial.hdr))
+		buf, err := ioutil.ReadAll(rdr)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf), check.Equals, trial.body, check.Commentf("%q", trial.hdr))
+		c.Check(resp.Header().Get("Content-Range"), check.Equals, trial.crange, check.Commentf("%q", trial.hdr))
+	}
+}
+
+func (s *IntegrationSuite) doS3Request(c *check.C, method, path, token string, hdr map[string]string, body string) *httptest.ResponseRecorder {
+	u := mustParseURL("http://collections.example.com" + path)
+	req := &http.Request{
+		Method:     method,
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header: http.Header{
+			"Date": {time.Now().UTC().Format(http.TimeFormat)},
+		},
+		Body: ioutil.NopCloser(strings.NewReader(body)),
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	accessKey, secretKey, err := s3Credentials(s3Secret, token)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "AWS "+accessKey+":"+s3SignatureV2(req, secretKey, req.Header.Get("Date")))
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *IntegrationSuite) TestS3ReadOnly(c *check.C) {
+	defer func(secret string) { s3Secret = secret }(s3Secret)
+	s3Secret = "secret"
+
+	bucket := "/" + arvadostest.FooPdh
+
+	resp := s.doS3Request(c, "GET", bucket+"/?list-type=2", arvadostest.ActiveToken, nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*<Contents><Key>foo</Key>.*<Size>3</Size>.*`)
+
+	resp = s.doS3Request(c, "HEAD", bucket+"/foo", arvadostest.ActiveToken, nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("Content-Length"), check.Equals, "3")
+	c.Check(resp.Header().Get("ETag"), check.Matches, `"[0-9a-f]{40}"`)
+
+	resp = s.doS3Request(c, "GET", bucket+"/foo", arvadostest.ActiveToken, map[string]string{"Range": "bytes=1-"}, "")
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(resp.Body.String(), check.Equals, "oo")
+
+	resp = s.doS3Request(c, "GET", bucket+"/missing", arvadostest.ActiveToken, nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*<Code>NoSuchKey</Code>.*`)
+
+	resp = s.doS3Request(c, "PUT", bucket+"/bar", arvadostest.ActiveToken, nil, "bar")
+	c.Check(resp.Code, check.Equals, http.StatusMethodNotAllowed)
+
+	resp = s.doS3Request(c, "GET", bucket+"/foo", "bogustoken", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusForbidden)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*<Code>InvalidAccessKeyId</Code>.*`)
+
+	// The signature covers the X-Amz-* headers.
+	resp = s.doS3Request(c, "GET", bucket+"/foo", arvadostest.ActiveToken, map[string]string{"X-Amz-Meta-Foo": "bar"}, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	u := mustParseURL("http://collections.example.com" + bucket + "/foo")
+	req := &http.Request{Method: "GET", Host: u.Host, URL: u, RequestURI: u.RequestURI(), Header: http.Header{
+		"Date": {time.Now().UTC().Format(http.TimeFormat)},
+	}}
+	accessKey, secretKey, err := s3Credentials(s3Secret, arvadostest.ActiveToken)
+	c.Assert(err, check.IsNil)
+	req.Header.Set("Authorization", "AWS "+accessKey+":"+s3SignatureV2(req, secretKey, req.Header.Get("Date")))
+	req.Header.Set("X-Amz-Meta-Foo", "bar")
+	rr := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(rr, req)
+	c.Check(rr.Code, check.Equals, http.StatusForbidden)
+	c.Check(rr.Body.String(), check.Matches, `(?s).*<Code>SignatureDoesNotMatch</Code>.*`)
+
+	s3Secret = ""
+	resp = s.doS3Request(c, "GET", bucket+"/foo", arvadostest.ActiveToken, nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusForbidden)
+}
+
+func (s *IntegrationSuite) TestS3ReadWrite(c *check.C) {
+	defer func(secret string) { s3Secret = secret }(s3Secret)
+	s3Secret = "secret"
+
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, check.IsNil)
+	arv.ApiToken = arvadostest.ActiveToken
+	var coll map[string]interface{}
+	err = arv.Create("collections", arvadosclient.Dict{"collection": arvadosclient.Dict{"manifest_text": ""}}, &coll)
+	c.Assert(err, check.IsNil)
+	uuid := coll["uuid"].(string)
+	defer arv.Delete("collections", uuid, nil, nil)
+
+	resp := s.doS3Request(c, "PUT", "/"+uuid+"/dir/foo", arvadostest.ActiveToken, nil, "foo")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = s.doS3Request(c, "PUT", "/"+uuid+"/empty/", arvadostest.ActiveToken, nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = s.doS3Request(c, "PUT", "/"+uuid+"/dir/foo/bar", arvadostest.ActiveToken, nil, "bar")
+	c.Check(resp.Code, check.Equals, http.StatusConflict)
+
+	resp = s.doS3Request(c, "GET", "/"+uuid+"/dir/foo", arvadostest.ActiveToken, nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+
+	resp = s.doS3Request(c, "GET", "/"+uuid+"/?delimiter=/", arvadostest.ActiveToken, nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*<CommonPrefixes><Prefix>dir/</Prefix></CommonPrefixes><CommonPrefixes><Prefix>empty/</Prefix></CommonPrefixes>.*`)
+
+	err = arv.Get("collections", uuid, nil, &coll)
+	c.Assert(err, check.IsNil)
+	c.Check(coll["manifest_text"], check.Matches, `\./dir acbd18db4cc2f85cedef654fccc4a4d8\+3\S* 0:3:foo\n\./empty d41d8cd98f00b204e9800998ecf8427e\+0 0:0:\\056\n`)
+}
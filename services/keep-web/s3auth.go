@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+)
+
+var s3Secret string
+
+func init() {
+	flag.StringVar(&s3Secret, "s3-secret", "",
+		"Secret key used to issue S3 credentials (\"POST /_s3credentials\") and to check the signatures of S3 requests. If empty, the S3 API is disabled.")
+}
+
+const (
+	// s3MaxClockSkew is the maximum difference between the time
+	// a request was signed and the time it is received, for
+	// requests signed in the Authorization header.
+	s3MaxClockSkew = 15 * time.Minute
+
+	// s3MaxPresignTTL is the maximum lifetime of a presigned
+	// URL, as in the AWS implementation.
+	s3MaxPresignTTL = 7 * 24 * time.Hour
+)
+
+// An s3AuthError explains why an S3 request was not authenticated.
+// Code is the S3 error code to send to the client.
+type s3AuthError struct {
+	Code    string
+	Message string
+}
+
+func (e *s3AuthError) Error() string {
+	return e.Message
+}
+
+var (
+	errS3InvalidAccessKey = &s3AuthError{"InvalidAccessKeyId", "The access key is not valid."}
+	errS3BadSignature     = &s3AuthError{"SignatureDoesNotMatch", "The request signature does not match."}
+	errS3Expired          = &s3AuthError{"AccessDenied", "Request has expired."}
+	errS3ClockSkew        = &s3AuthError{"RequestTimeTooSkewed", "The difference between the request time and the current time is too large."}
+	errS3Malformed        = &s3AuthError{"AccessDenied", "The request is not signed correctly."}
+)
+
+// S3 credentials are derived from an Arvados token and s3Secret. The
+// access key is the token encrypted with a key derived from
+// s3Secret, so keep-web can recover the token from a request without
+// the token appearing in it (e.g., in a presigned URL). The secret
+// key is a MAC of the token, and is used to check the request
+// signature.
+
+func s3DerivedKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func s3AEAD(secret string) cipher.AEAD {
+	block, err := aes.NewCipher(s3DerivedKey(secret, "s3 access key"))
+	if err != nil {
+		// Can't happen: the key is always 32 bytes.
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// s3Credentials returns a new access key and the secret key for the
+// given token.
+func s3Credentials(secret, token string) (accessKey, secretKey string, err error) {
+	aead := s3AEAD(secret)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	accessKey = base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(token), nil))
+	secretKey = s3SecretKey(secret, token)
+	return
+}
+
+func s3SecretKey(secret, token string) string {
+	return base64.RawURLEncoding.EncodeToString(s3DerivedKey(secret, "s3 secret key\x00"+token))
+}
+
+// s3AccessKeyToken returns the token encrypted in an access key
+// issued by s3Credentials.
+func s3AccessKeyToken(secret, accessKey string) (string, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(accessKey)
+	aead := s3AEAD(secret)
+	if err != nil || len(buf) < aead.NonceSize() {
+		return "", errS3InvalidAccessKey
+	}
+	token, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errS3InvalidAccessKey
+	}
+	return string(token), nil
+}
+
+// s3AccessKey returns the access key given in an S3 request's
+// Authorization header or query string, or "" if r isn't an S3
+// request.
+func s3AccessKey(r *http.Request) string {
+	authHdr := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(authHdr, "AWS4-HMAC-SHA256 "):
+		// AWS4-HMAC-SHA256 Credential=KEY/DATE/REGION/s3/aws4_request, SignedHeaders=..., Signature=...
+		return strings.Split(s3AuthFields(authHdr[17:])["Credential"], "/")[0]
+	case strings.HasPrefix(authHdr, "AWS "):
+		// AWS KEY:SIGNATURE
+		if i := strings.LastIndex(authHdr, ":"); i > 4 {
+			return authHdr[4:i]
+		}
+		return ""
+	}
+	// Presigned URLs
+	q := r.URL.Query()
+	if cred := q.Get("X-Amz-Credential"); cred != "" {
+		return strings.Split(cred, "/")[0]
+	}
+	return q.Get("AWSAccessKeyId")
+}
+
+func s3AuthFields(s string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	return fields
+}
+
+// s3Authenticate checks the signature and expiry time of an S3
+// request, and returns the token given by its access key.
+func s3Authenticate(r *http.Request, secret string, now time.Time) (string, *s3AuthError) {
+	token, err := s3AccessKeyToken(secret, s3AccessKey(r))
+	if err != nil {
+		return "", errS3InvalidAccessKey
+	}
+	if err := s3CheckSignature(r, s3SecretKey(secret, token), now); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// s3CheckSignature checks the AWS signature (version 2 or 4, in the
+// Authorization header or a presigned URL) of an S3 request, using
+// the given secret key.
+func s3CheckSignature(r *http.Request, secretKey string, now time.Time) *s3AuthError {
+	authHdr := r.Header.Get("Authorization")
+	q := r.URL.Query()
+	switch {
+	case strings.HasPrefix(authHdr, "AWS4-HMAC-SHA256 "):
+		fields := s3AuthFields(authHdr[17:])
+		t, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			if t, err = http.ParseTime(r.Header.Get("Date")); err != nil {
+				return errS3Malformed
+			}
+		}
+		if now.Sub(t) > s3MaxClockSkew || t.Sub(now) > s3MaxClockSkew {
+			return errS3ClockSkew
+		}
+		payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = "UNSIGNED-PAYLOAD"
+		}
+		return s3CheckV4(r, secretKey, t, fields["Credential"], fields["SignedHeaders"], fields["Signature"], payloadHash)
+	case strings.HasPrefix(authHdr, "AWS "):
+		i := strings.LastIndex(authHdr, ":")
+		date := r.Header.Get("X-Amz-Date")
+		if date == "" {
+			date = r.Header.Get("Date")
+		}
+		t, err := http.ParseTime(date)
+		if err != nil {
+			// Some clients send a numeric time zone
+			// instead of "GMT".
+			if t, err = time.Parse(time.RFC1123Z, date); err != nil {
+				return errS3Malformed
+			}
+		}
+		if now.Sub(t) > s3MaxClockSkew || t.Sub(now) > s3MaxClockSkew {
+			return errS3ClockSkew
+		}
+		return s3CheckV2(r, secretKey, r.Header.Get("Date"), authHdr[i+1:])
+	case q.Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256":
+		t, err := time.Parse("20060102T150405Z", q.Get("X-Amz-Date"))
+		if err != nil {
+			return errS3Malformed
+		}
+		secs, err := strconv.ParseInt(q.Get("X-Amz-Expires"), 10, 64)
+		if err != nil || secs <= 0 || time.Duration(secs)*time.Second > s3MaxPresignTTL {
+			return errS3Malformed
+		}
+		if !now.Before(t.Add(time.Duration(secs) * time.Second)) {
+			return errS3Expired
+		}
+		return s3CheckV4(r, secretKey, t, q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Signature"), "UNSIGNED-PAYLOAD")
+	case q.Get("AWSAccessKeyId") != "":
+		expires, err := strconv.ParseInt(q.Get("Expires"), 10, 64)
+		if err != nil {
+			return errS3Malformed
+		}
+		if now.Unix() >= expires {
+			return errS3Expired
+		}
+		if time.Unix(expires, 0).Sub(now) > s3MaxPresignTTL {
+			return errS3Malformed
+		}
+		return s3CheckV2(r, secretKey, q.Get("Expires"), q.Get("Signature"))
+	}
+	return errS3Malformed
+}
+
+// s3CheckV2 checks a signature version 2. date is the Date header,
+// or the expiry time of a presigned URL.
+func s3CheckV2(r *http.Request, secretKey, date, signature string) *s3AuthError {
+	if !hmac.Equal([]byte(signature), []byte(s3SignatureV2(r, secretKey, date))) {
+		return errS3BadSignature
+	}
+	return nil
+}
+
+// s3SignatureV2 returns the version 2 signature of r.
+func s3SignatureV2(r *http.Request, secretKey, date string) string {
+	if r.Header.Get("X-Amz-Date") != "" {
+		// The Date header isn't signed when X-Amz-Date is
+		// given.
+		date = ""
+	}
+	var amzHeaders []string
+	for k, v := range r.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			amzHeaders = append(amzHeaders, k+":"+strings.Join(s3TrimValues(v), ",")+"\n")
+		}
+	}
+	sort.Strings(amzHeaders)
+
+	resource := r.URL.EscapedPath()
+	if parseCollectionIDFromDNSName(r.Host) != "" {
+		// Virtual-hosted-style request: the bucket name is
+		// the first label of the host name.
+		bucket := strings.SplitN(r.Host, ".", 2)[0]
+		if i := strings.Index(bucket, "--"); i >= 0 {
+			bucket = bucket[:i]
+		}
+		resource = "/" + bucket + resource
+	}
+	var subresources []string
+	q := r.URL.Query()
+	for k, vs := range q {
+		if !s3V2Subresources[k] {
+			continue
+		}
+		for _, v := range vs {
+			if v == "" {
+				subresources = append(subresources, k)
+			} else {
+				subresources = append(subresources, k+"="+v)
+			}
+		}
+	}
+	if len(subresources) > 0 {
+		sort.Strings(subresources)
+		resource += "?" + strings.Join(subresources, "&")
+	}
+
+	stringToSign := r.Method + "\n" +
+		r.Header.Get("Content-MD5") + "\n" +
+		r.Header.Get("Content-Type") + "\n" +
+		date + "\n" +
+		strings.Join(amzHeaders, "") +
+		resource
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// s3V2Subresources are the query parameters included in the
+// resource signed by a version 2 signature.
+var s3V2Subresources = map[string]bool{
+	"acl": true, "delete": true, "lifecycle": true, "location": true,
+	"logging": true, "notification": true, "partNumber": true,
+	"policy": true, "requestPayment": true, "torrent": true,
+	"uploadId": true, "uploads": true, "versionId": true,
+	"versioning": true, "versions": true, "website": true,
+	"response-cache-control": true, "response-content-disposition": true,
+	"response-content-encoding": true, "response-content-language": true,
+	"response-content-type": true, "response-expires": true,
+}
+
+// s3CheckV4 checks a signature version 4 made at time t.
+func s3CheckV4(r *http.Request, secretKey string, t time.Time, credential, signedHeaders, signature, payloadHash string) *s3AuthError {
+	// KEY/DATE/REGION/SERVICE/aws4_request
+	scope := strings.SplitN(credential, "/", 2)
+	if len(scope) != 2 {
+		return errS3Malformed
+	}
+	scopeParts := strings.Split(scope[1], "/")
+	if len(scopeParts) != 4 || scopeParts[0] != t.Format("20060102") || scopeParts[3] != "aws4_request" {
+		return errS3Malformed
+	}
+	if !hmac.Equal([]byte(signature), []byte(s3SignatureV4(r, secretKey, t, scope[1], signedHeaders, payloadHash))) {
+		return errS3BadSignature
+	}
+	return nil
+}
+
+// s3SignatureV4 returns the version 4 signature of r, made at time t
+// with the given credential scope (DATE/REGION/SERVICE/aws4_request).
+func s3SignatureV4(r *http.Request, secretKey string, t time.Time, scope, signedHeaders, payloadHash string) string {
+
+	var hdrs []string
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var vals []string
+		if name == "host" {
+			vals = []string{r.Host}
+		} else {
+			vals = r.Header[http.CanonicalHeaderKey(name)]
+		}
+		hdrs = append(hdrs, name+":"+strings.Join(s3TrimValues(vals), ",")+"\n")
+	}
+
+	var query []string
+	for k, vs := range r.URL.Query() {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			query = append(query, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(query)
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		s3Escape(r.URL.Path, true),
+		strings.Join(query, "&"),
+		strings.Join(hdrs, ""),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" +
+		t.Format("20060102T150405Z") + "\n" +
+		scope + "\n" +
+		hex.EncodeToString(crHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = s3HMAC(key, part)
+	}
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3TrimValues returns header values with leading and trailing
+// spaces removed, and internal runs of spaces collapsed.
+func s3TrimValues(vals []string) []string {
+	trimmed := make([]string, len(vals))
+	for i, v := range vals {
+		trimmed[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return trimmed
+}
+
+// s3Escape URI-encodes s as specified for AWS signature version 4:
+// every byte except A-Z, a-z, 0-9, "-", ".", "_", "~" (and "/" if
+// keepSlash is true) is percent-encoded.
+func s3Escape(s string, keepSlash bool) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && keepSlash:
+			buf = append(buf, c)
+		default:
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
+
+// s3CredentialsHandler issues S3 credentials for the token in the
+// request's Authorization header.
+//
+//   POST /_s3credentials
+type s3CredentialsHandler struct{}
+
+func (h *s3CredentialsHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
+	var statusCode = 0
+	var statusText string
+
+	w := httpserver.WrapResponseWriter(wOrig)
+	defer func() {
+		if statusCode == 0 {
+			statusCode = w.WroteStatus()
+		} else if w.WroteStatus() == 0 {
+			w.WriteHeader(statusCode)
+		}
+		if statusText == "" {
+			statusText = http.StatusText(statusCode)
+		}
+		httpserver.Log(r.RemoteAddr, statusCode, statusText, w.WroteBodyBytes(), r.Method, r.Host, r.URL.Path)
+	}()
+
+	if s3Secret == "" {
+		statusCode, statusText = http.StatusNotFound, "S3 API is disabled"
+		return
+	}
+	if r.Method != "POST" {
+		statusCode = http.StatusMethodNotAllowed
+		return
+	}
+	// As in shareHandler.create, only accept the token in the
+	// Authorization header.
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "OAuth2 ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		statusCode = http.StatusUnauthorized
+		return
+	}
+
+	arv := clientPool.Get()
+	if arv == nil {
+		statusCode, statusText = http.StatusInternalServerError, "Pool failed: "+clientPool.Err().Error()
+		return
+	}
+	defer clientPool.Put(arv)
+	arv.ApiToken = token
+	if err := arv.Call("GET", "users", "", "current", nil, nil); err != nil {
+		if srvErr, ok := err.(arvadosclient.APIServerError); ok && srvErr.HttpStatusCode == 401 {
+			statusCode = http.StatusUnauthorized
+		} else {
+			statusCode, statusText = http.StatusBadGateway, err.Error()
+		}
+		return
+	}
+
+	accessKey, secretKey, err := s3Credentials(s3Secret, token)
+	if err != nil {
+		statusCode, statusText = http.StatusInternalServerError, err.Error()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_key_id":     accessKey,
+		"secret_access_key": secretKey,
+	})
+	statusCode = http.StatusOK
+}
@@ -5,13 +5,19 @@ import (
 	"net/http"
 
 	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"git.curoverse.com/arvados.git/sdk/go/tokencache"
 )
 
-var address string
+var (
+	address    string
+	adminToken string
+)
 
 func init() {
 	flag.StringVar(&address, "listen", ":80",
 		"Address to listen on: \"host:port\", or \":port\" to listen on all interfaces.")
+	flag.StringVar(&adminToken, "admin-token", "",
+		"Token that can be used to remove a revoked token from the token cache with \"POST /_admin/flush_token?token=...\". If empty, this is disabled.")
 }
 
 type server struct {
@@ -19,9 +25,35 @@ type server struct {
 }
 
 func (srv *server) Start() error {
-	mux := http.NewServeMux()
-	mux.Handle("/", &handler{})
-	srv.Handler = mux
+	srv.Handler = newMux(&handler{})
 	srv.Addr = address
 	return srv.Server.Start()
 }
+
+// newMux returns the keep-web request router, which passes requests
+// to h unless they are for one of keep-web's own endpoints.
+func newMux(h http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	mux.Handle("/_share", siteOnly{Handler: &shareHandler{}, Fallback: h})
+	mux.Handle("/_share/", siteOnly{Handler: &shareHandler{}, Fallback: h})
+	mux.Handle("/_s3credentials", siteOnly{Handler: &s3CredentialsHandler{}, Fallback: h})
+	mux.Handle("/_admin/flush_token", &tokencache.FlushHandler{Cache: &tokenCache, AdminToken: adminToken})
+	return mux
+}
+
+// siteOnly serves Handler, except on a collection's own virtual host
+// (like {uuid}.collections.example.com), where the request is passed
+// to Fallback to serve the collection's content at that path.
+type siteOnly struct {
+	http.Handler
+	Fallback http.Handler
+}
+
+func (so siteOnly) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if parseCollectionIDFromDNSName(r.Host) != "" {
+		so.Fallback.ServeHTTP(w, r)
+		return
+	}
+	so.Handler.ServeHTTP(w, r)
+}
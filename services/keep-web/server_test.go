@@ -56,9 +56,9 @@ func (s *IntegrationSuite) Test404(c *check.C) {
 		"/download",
 		"/collections",
 		"/collections/",
-		// Implicit/generated index is not implemented yet;
-		// until then, return 404.
 		"/collections/" + arvadostest.FooCollection,
+		// Collection not readable by anonymous token, which
+		// is the only token accepted at /collections/ID/...
 		"/collections/" + arvadostest.FooCollection + "/",
 		"/collections/" + arvadostest.FooBarDirCollection + "/dir1",
 		"/collections/" + arvadostest.FooBarDirCollection + "/dir1/",
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/httpserver"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+)
+
+var (
+	shareLinkSecret string
+	shareLinkToken  string
+	shareLinkMaxTTL = 30 * 24 * time.Hour
+)
+
+// shareLinkDefaultTTL is the lifetime of a share link when the
+// client doesn't specify one.
+const shareLinkDefaultTTL = 24 * time.Hour
+
+func init() {
+	flag.StringVar(&shareLinkSecret, "share-link-secret", "",
+		"Secret key used to sign share links created with \"POST /_share\". If empty, share links are disabled.")
+	flag.StringVar(&shareLinkToken, "share-link-token", "",
+		"Token used to read collections via share links. It must be able to read every collection users might share (e.g., an admin token).")
+	flag.DurationVar(&shareLinkMaxTTL, "share-link-max-ttl", shareLinkMaxTTL,
+		"Maximum lifetime of a share link.")
+}
+
+var (
+	errShareLinkInvalid = errors.New("invalid share link")
+	errShareLinkExpired = errors.New("share link expired")
+)
+
+// A shareLink grants read access to a file or directory in a
+// collection, until it expires. The collection is identified by the
+// PDH it had when the link was created, so the link doesn't expose
+// content added to the collection later.
+type shareLink struct {
+	ID           string `json:"id"`
+	PDH          string `json:"pdh"`
+	Path         string `json:"path"`
+	Expires      int64  `json:"exp"`
+	MaxDownloads int    `json:"max,omitempty"`
+}
+
+var shareLinkEncoding = base64.URLEncoding
+
+// encode returns the link's payload and signature, in a form
+// suitable for use as a URL path component.
+func (sl *shareLink) encode(secret string) string {
+	buf, _ := json.Marshal(sl)
+	payload := strings.TrimRight(shareLinkEncoding.EncodeToString(buf), "=")
+	return payload + "." + shareLinkSignature(secret, payload)
+}
+
+func shareLinkSignature(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return strings.TrimRight(shareLinkEncoding.EncodeToString(mac.Sum(nil)), "=")
+}
+
+// decodeShareLink checks the signature and expiry time of an encoded
+// share link, and returns the decoded link.
+func decodeShareLink(secret, s string, now time.Time) (*shareLink, error) {
+	i := strings.LastIndex(s, ".")
+	if i < 0 {
+		return nil, errShareLinkInvalid
+	}
+	payload, sig := s[:i], s[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(shareLinkSignature(secret, payload))) {
+		return nil, errShareLinkInvalid
+	}
+	if pad := len(payload) % 4; pad > 0 {
+		payload += strings.Repeat("=", 4-pad)
+	}
+	buf, err := shareLinkEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errShareLinkInvalid
+	}
+	var sl shareLink
+	if err := json.Unmarshal(buf, &sl); err != nil {
+		return nil, errShareLinkInvalid
+	}
+	if now.Unix() >= sl.Expires {
+		return nil, errShareLinkExpired
+	}
+	return &sl, nil
+}
+
+// downloadCounter counts downloads via share links with a limited
+// number of downloads. Counts are kept in memory, so they are not
+// shared between keep-web processes, and are reset when keep-web
+// restarts.
+type downloadCounter struct {
+	counts  map[string]int
+	expires map[string]int64
+	mtx     sync.Mutex
+}
+
+var shareDownloads = &downloadCounter{}
+
+// take records a download via the given link, and returns false if
+// the link's download limit has already been reached.
+func (dc *downloadCounter) take(sl *shareLink, now time.Time) bool {
+	if sl.MaxDownloads <= 0 {
+		return true
+	}
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	if dc.counts == nil {
+		dc.counts = make(map[string]int)
+		dc.expires = make(map[string]int64)
+	}
+	if dc.counts[sl.ID] >= sl.MaxDownloads {
+		return false
+	}
+	if _, ok := dc.counts[sl.ID]; !ok {
+		// Forget about expired links before adding a new one.
+		for id, exp := range dc.expires {
+			if now.Unix() >= exp {
+				delete(dc.counts, id)
+				delete(dc.expires, id)
+			}
+		}
+		dc.expires[sl.ID] = sl.Expires
+	}
+	dc.counts[sl.ID]++
+	return true
+}
+
+// shareHandler creates share links ("POST /_share") and serves
+// content via share links ("GET /_share/{link}/...").
+type shareHandler struct{}
+
+func (h *shareHandler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
+	var statusCode = 0
+	var statusText string
+
+	w := httpserver.WrapResponseWriter(wOrig)
+	defer func() {
+		if statusCode == 0 {
+			statusCode = w.WroteStatus()
+		} else if w.WroteStatus() == 0 {
+			w.WriteHeader(statusCode)
+		}
+		if statusText == "" {
+			statusText = http.StatusText(statusCode)
+		}
+		httpserver.Log(r.RemoteAddr, statusCode, statusText, w.WroteBodyBytes(), r.Method, r.Host, r.URL.Path)
+	}()
+
+	if shareLinkSecret == "" {
+		statusCode, statusText = http.StatusNotFound, "share links are disabled"
+		return
+	}
+	if r.URL.Path == "/_share" {
+		if r.Method != "POST" {
+			statusCode = http.StatusMethodNotAllowed
+			return
+		}
+		statusCode, statusText = h.create(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		statusCode = http.StatusMethodNotAllowed
+		return
+	}
+	statusCode, statusText = h.serve(w, r)
+}
+
+// create responds to a request to create a share link. The client
+// must be able to read the collection using the token in its
+// Authorization header.
+//
+//   POST /_share?collection={uuid_or_pdh}&path={path}&expires_in={seconds}&max_downloads={n}
+func (h *shareHandler) create(w http.ResponseWriter, r *http.Request) (int, string) {
+	// Only accept the token in the Authorization header: not in
+	// a cookie, which a browser might send with a cross-site
+	// request.
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "OAuth2 ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return http.StatusUnauthorized, ""
+	}
+	targetID := parseCollectionIDFromURL(r.FormValue("collection"))
+	if targetID == "" {
+		return http.StatusBadRequest, "missing or invalid collection parameter"
+	}
+	ttl := shareLinkDefaultTTL
+	if s := r.FormValue("expires_in"); s != "" {
+		secs, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || secs <= 0 {
+			return http.StatusBadRequest, "invalid expires_in parameter"
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+	if ttl > shareLinkMaxTTL {
+		ttl = shareLinkMaxTTL
+	}
+	var maxDownloads int
+	if s := r.FormValue("max_downloads"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return http.StatusBadRequest, "invalid max_downloads parameter"
+		}
+		maxDownloads = n
+	}
+
+	arv := clientPool.Get()
+	if arv == nil {
+		return http.StatusInternalServerError, "Pool failed: " + clientPool.Err().Error()
+	}
+	defer clientPool.Put(arv)
+	arv.ApiToken = token
+	collection, code, err := getCollection(arv, targetID)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	} else if collection == nil {
+		return code, ""
+	}
+	tree, err := newCollectionTree(manifestText(collection))
+	if err != nil {
+		return http.StatusBadGateway, err.Error()
+	}
+	target := cleanTarget(r.FormValue("path"))
+	dir, file := tree.lookup(target)
+	if dir == nil && file == nil {
+		return http.StatusNotFound, ""
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	pdh, _ := collection["portable_data_hash"].(string)
+	expires := time.Now().Add(ttl)
+	sl := &shareLink{
+		ID:           fmt.Sprintf("%x", id),
+		PDH:          pdh,
+		Path:         target,
+		Expires:      expires.Unix(),
+		MaxDownloads: maxDownloads,
+	}
+	linkPath := "/_share/" + sl.encode(shareLinkSecret) + "/"
+	if file != nil {
+		_, name := splitPath(target)
+		linkPath += (&url.URL{Path: name}).EscapedPath()
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"url":           scheme + "://" + r.Host + linkPath,
+		"expires_at":    expires.UTC().Format(time.RFC3339),
+		"max_downloads": maxDownloads,
+	})
+	return http.StatusOK, ""
+}
+
+// serve responds to a request for content via a share link. If the
+// link is for a directory, the rest of the path is a file or
+// directory in that directory. If the link is for a file, the rest of
+// the path (normally the file name) is ignored.
+func (h *shareHandler) serve(w http.ResponseWriter, r *http.Request) (int, string) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/_share/"), "/", 2)
+	sl, err := decodeShareLink(shareLinkSecret, parts[0], time.Now())
+	if err == errShareLinkExpired {
+		return http.StatusGone, err.Error()
+	} else if err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	if len(parts) < 2 {
+		// Relative links in a directory listing only work
+		// if the URL ends with "/".
+		redir := (&url.URL{Path: r.URL.Path + "/", RawQuery: r.URL.RawQuery}).String()
+		w.Header().Set("Location", redir)
+		return http.StatusFound, redir
+	}
+
+	arv := clientPool.Get()
+	if arv == nil {
+		return http.StatusInternalServerError, "Pool failed: " + clientPool.Err().Error()
+	}
+	defer clientPool.Put(arv)
+	arv.ApiToken = shareLinkToken
+	collection, code, err := getCollection(arv, sl.PDH)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	} else if collection == nil {
+		return http.StatusBadGateway, fmt.Sprintf("share link token got %d", code)
+	}
+	tree, err := newCollectionTree(manifestText(collection))
+	if err != nil {
+		return http.StatusBadGateway, err.Error()
+	}
+
+	filename := sl.Path
+	if _, file := tree.lookup(sl.Path); file == nil {
+		filename = strings.TrimPrefix(sl.Path+"/"+cleanTarget(parts[1]), "/")
+		if strings.HasSuffix(parts[1], "/") || parts[1] == "" {
+			filename += "/"
+		}
+	}
+	// Every request for a file or an archive counts as a
+	// download, whatever its Range header: any byte range can be
+	// used to get most or all of the content.
+	dir, file := tree.lookup(cleanTarget(filename))
+	format := r.FormValue("format")
+	if file != nil && !strings.HasSuffix(filename, "/") || dir != nil && (format == "zip" || format == "tar") {
+		if !shareDownloads.take(sl, time.Now()) {
+			return http.StatusGone, "download limit reached"
+		}
+	}
+
+	kc, err := keepclient.MakeKeepClient(arv)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	if kc.Client != nil && kc.Client.Transport != nil {
+		// Workaround for https://dev.arvados.org/issues/9005
+		if t, ok := kc.Client.Transport.(*http.Transport); ok {
+			defer t.CloseIdleConnections()
+		}
+	}
+
+	// Content is served inline only where keep-web never accepts
+	// credentials, so scripts in shared content can't use a
+	// visitor's credentials to read other collections.
+	attachment := r.FormValue("disposition") == "attachment" ||
+		trustAllContent ||
+		r.Host == attachmentOnlyHost
+	// Don't let browsers or proxies keep shared content after the
+	// link expires, or serve it again without counting a
+	// download.
+	w.Header().Set("Cache-Control", "no-store")
+	return serveContent(w, r, kc, collection, sl.PDH, shareLinkToken, filename, attachment)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestShareLinkEncode(c *check.C) {
+	now := time.Now()
+	sl := &shareLink{
+		ID:      "0123456789abcdef",
+		PDH:     arvadostest.FooPdh,
+		Path:    "dir/foo",
+		Expires: now.Add(time.Hour).Unix(),
+	}
+	encoded := sl.encode("secret")
+	c.Check(encoded, check.Matches, `[-_A-Za-z0-9]+\.[-_A-Za-z0-9]+`)
+
+	decoded, err := decodeShareLink("secret", encoded, now)
+	c.Check(err, check.IsNil)
+	c.Check(decoded, check.DeepEquals, sl)
+
+	_, err = decodeShareLink("othersecret", encoded, now)
+	c.Check(err, check.Equals, errShareLinkInvalid)
+
+	_, err = decodeShareLink("secret", encoded, now.Add(2*time.Hour))
+	c.Check(err, check.Equals, errShareLinkExpired)
+
+	// Change the payload, keeping the signature
+	sl.Path = "dir"
+	tampered := strings.Split(sl.encode("secret"), ".")[0] + "." + strings.Split(encoded, ".")[1]
+	_, err = decodeShareLink("secret", tampered, now)
+	c.Check(err, check.Equals, errShareLinkInvalid)
+
+	for _, bogus := range []string{"", ".", "foo", "foo.bar"} {
+		_, err = decodeShareLink("secret", bogus, now)
+		c.Check(err, check.Equals, errShareLinkInvalid)
+	}
+}
+
+func (s *UnitSuite) TestShareLinkDownloadLimit(c *check.C) {
+	now := time.Now()
+	dc := &downloadCounter{}
+	unlimited := &shareLink{ID: "a", Expires: now.Add(time.Hour).Unix()}
+	limited := &shareLink{ID: "b", Expires: now.Add(time.Hour).Unix(), MaxDownloads: 2}
+	expired := &shareLink{ID: "c", Expires: now.Add(-time.Hour).Unix(), MaxDownloads: 1}
+	for i := 0; i < 3; i++ {
+		c.Check(dc.take(unlimited, now), check.Equals, true)
+	}
+	c.Check(dc.take(expired, now.Add(-2*time.Hour)), check.Equals, true)
+	c.Check(dc.take(limited, now), check.Equals, true)
+	c.Check(dc.take(limited, now), check.Equals, true)
+	c.Check(dc.take(limited, now), check.Equals, false)
+	c.Check(dc.counts, check.DeepEquals, map[string]int{"b": 2})
+}
+
+func (s *UnitSuite) TestShareLinkRoute(c *check.C) {
+	mux := newMux(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("collection content"))
+	}))
+	for _, trial := range []struct {
+		host     string
+		path     string
+		fallback bool
+	}{
+		{"collections.example.com", "/_share", false},
+		{"collections.example.com", "/_share/foo", false},
+		{arvadostest.FooCollection + ".collections.example.com", "/_share", true},
+		{arvadostest.FooCollection + "--collections.example.com", "/_share/foo", true},
+	} {
+		req, err := http.NewRequest("GET", "http://"+trial.host+trial.path, nil)
+		c.Assert(err, check.IsNil)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		if trial.fallback {
+			c.Check(resp.Body.String(), check.Equals, "collection content", check.Commentf("%+v", trial))
+		} else {
+			c.Check(resp.Body.String(), check.Not(check.Equals), "collection content", check.Commentf("%+v", trial))
+		}
+	}
+}
+
+func (s *IntegrationSuite) TestShareLink(c *check.C) {
+	defer func(secret, token string) {
+		shareLinkSecret, shareLinkToken = secret, token
+	}(shareLinkSecret, shareLinkToken)
+	shareLinkSecret, shareLinkToken = "secret", arvadostest.AdminToken
+
+	doRequest := func(method, path, token string, hdr map[string]string) *httptest.ResponseRecorder {
+		u := mustParseURL("http://collections.example.com" + path)
+		req := &http.Request{
+			Method:     method,
+			Host:       u.Host,
+			URL:        u,
+			RequestURI: u.RequestURI(),
+			Header:     http.Header{},
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "OAuth2 "+token)
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		(&shareHandler{}).ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := doRequest("POST", "/_share?collection="+arvadostest.FooCollection+"&path=foo&max_downloads=1", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusUnauthorized)
+	resp = doRequest("POST", "/_share?collection="+arvadostest.FooCollection+"&path=foo&max_downloads=1", arvadostest.SpectatorToken, nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+	resp = doRequest("POST", "/_share?collection="+arvadostest.FooCollection+"&path=missing", arvadostest.ActiveToken, nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	resp = doRequest("POST", "/_share?collection="+arvadostest.FooCollection+"&path=foo&max_downloads=1", arvadostest.ActiveToken, nil)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	var link struct {
+		URL          string `json:"url"`
+		ExpiresAt    string `json:"expires_at"`
+		MaxDownloads int    `json:"max_downloads"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&link)
+	c.Assert(err, check.IsNil)
+	c.Check(link.URL, check.Matches, `http://collections\.example\.com/_share/[-_A-Za-z0-9]+\.[-_A-Za-z0-9]+/foo`)
+	c.Check(link.MaxDownloads, check.Equals, 1)
+	path := mustParseURL(link.URL).Path
+
+	resp = doRequest("GET", path, "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+	c.Check(resp.Header().Get("Cache-Control"), check.Equals, "no-store")
+	resp = doRequest("GET", path, "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusGone)
+
+	resp = doRequest("GET", strings.Replace(path, ".", "x.", 1), "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	resp = doRequest("POST", "/_share?collection="+arvadostest.FooCollection, arvadostest.ActiveToken, nil)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	err = json.NewDecoder(resp.Body).Decode(&link)
+	c.Assert(err, check.IsNil)
+	path = mustParseURL(link.URL).Path
+	resp = doRequest("GET", path+"foo", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+	resp = doRequest("GET", path+"?format=json", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*"name":"foo".*`)
+
+	// Range requests count as downloads, even if they don't
+	// start at 0.
+	resp = doRequest("POST", "/_share?collection="+arvadostest.FooCollection+"&path=foo&max_downloads=2", arvadostest.ActiveToken, nil)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	err = json.NewDecoder(resp.Body).Decode(&link)
+	c.Assert(err, check.IsNil)
+	path = mustParseURL(link.URL).Path
+	resp = doRequest("GET", path, "", map[string]string{"Range": "bytes=-1000000"})
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foo")
+	resp = doRequest("GET", path, "", map[string]string{"Range": "bytes=1-"})
+	c.Check(resp.Code, check.Equals, http.StatusPartialContent)
+	c.Check(resp.Body.String(), check.Equals, "oo")
+	resp = doRequest("GET", path, "", map[string]string{"Range": "bytes=2-"})
+	c.Check(resp.Code, check.Equals, http.StatusGone)
+
+	// Archives of a directory link count as downloads, but
+	// listings don't.
+	resp = doRequest("POST", "/_share?collection="+arvadostest.FooCollection+"&max_downloads=1", arvadostest.ActiveToken, nil)
+	c.Assert(resp.Code, check.Equals, http.StatusOK)
+	err = json.NewDecoder(resp.Body).Decode(&link)
+	c.Assert(err, check.IsNil)
+	path = mustParseURL(link.URL).Path
+	resp = doRequest("GET", path+"?format=json", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = doRequest("GET", path+"?format=zip", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	resp = doRequest("GET", path+"?format=tar", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusGone)
+	resp = doRequest("GET", path+"foo", "", nil)
+	c.Check(resp.Code, check.Equals, http.StatusGone)
+}
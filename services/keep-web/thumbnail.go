@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+)
+
+// thumbnailSizes are the thumbnail widths/heights a client can
+// request. Limiting them keeps clients from filling the cache with
+// many slightly different thumbnails of the same image.
+var thumbnailSizes = []int{32, 64, 128, 256, 512, 1024}
+
+const (
+	// Images bigger than this (in bytes or pixels) are not
+	// decoded at all
+	thumbnailMaxSourceBytes  = 64 << 20
+	thumbnailMaxSourcePixels = 40000000
+)
+
+var thumbnails = &thumbnailCache{MaxBytes: 64 << 20, MaxDecoders: 4}
+
+func init() {
+	flag.Int64Var(&thumbnails.MaxBytes, "thumbnail-cache-size", thumbnails.MaxBytes,
+		"Maximum total size (in bytes) of generated thumbnails to keep in memory.")
+	flag.IntVar(&thumbnails.MaxDecoders, "thumbnail-max-concurrent", thumbnails.MaxDecoders,
+		"Maximum number of images to decode at a time when generating thumbnails. Each one can use several hundred megabytes of memory.")
+}
+
+// thumbnailCache keeps recently generated thumbnails in memory. When
+// the total size exceeds MaxBytes, the least recently used thumbnails
+// are evicted.
+//
+// The cache is keyed by PDH and file path, so it does not know which
+// clients are allowed to read which collections. Callers must check
+// permission before using a cached thumbnail.
+type thumbnailCache struct {
+	MaxBytes int64
+
+	// Maximum number of thumbnails being generated at a time.
+	// Other requests wait for a turn.
+	MaxDecoders int
+
+	size     int64
+	entries  *list.List
+	index    map[string]*list.Element
+	decoders chan struct{}
+	mtx      sync.Mutex
+}
+
+type thumbnail struct {
+	key         string
+	contentType string
+	data        []byte
+}
+
+// get returns the cached thumbnail with the given key, or nil.
+func (tc *thumbnailCache) get(key string) *thumbnail {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	elt, ok := tc.index[key]
+	if !ok {
+		return nil
+	}
+	tc.entries.MoveToFront(elt)
+	return elt.Value.(*thumbnail)
+}
+
+// decoderSlots returns a channel with room for MaxDecoders values.
+// Callers send a value before decoding an image, and receive one when
+// they are done.
+func (tc *thumbnailCache) decoderSlots() chan struct{} {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	if tc.decoders == nil {
+		n := tc.MaxDecoders
+		if n < 1 {
+			n = 1
+		}
+		tc.decoders = make(chan struct{}, n)
+	}
+	return tc.decoders
+}
+
+func (tc *thumbnailCache) add(th *thumbnail) {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	if tc.index == nil {
+		tc.entries = list.New()
+		tc.index = make(map[string]*list.Element)
+	}
+	if _, ok := tc.index[th.key]; ok {
+		return
+	}
+	tc.index[th.key] = tc.entries.PushFront(th)
+	tc.size += int64(len(th.data))
+	for tc.size > tc.MaxBytes && tc.entries.Len() > 0 {
+		elt := tc.entries.Back()
+		old := elt.Value.(*thumbnail)
+		tc.entries.Remove(elt)
+		delete(tc.index, old.key)
+		tc.size -= int64(len(old.data))
+	}
+}
+
+// serveThumbnail responds with a thumbnail of the image in rdr, no
+// more than sizeParam pixels wide or high. Thumbnails of JPEG images
+// are JPEG images; others are PNG images. The given key identifies
+// the source image in the thumbnail cache.
+func serveThumbnail(w http.ResponseWriter, r *http.Request, rdr keepclient.ReadCloserWithLen, key string, sizeParam string) (int, string) {
+	size, err := strconv.Atoi(sizeParam)
+	if err != nil || !validThumbnailSize(size) {
+		return http.StatusBadRequest, fmt.Sprintf("thumbnail size must be one of %v", thumbnailSizes)
+	}
+	key = fmt.Sprintf("%s?%d", key, size)
+	th := thumbnails.get(key)
+	if th == nil {
+		slots := thumbnails.decoderSlots()
+		slots <- struct{}{}
+		// Another request for the same thumbnail might have
+		// finished while we were waiting.
+		if th = thumbnails.get(key); th == nil {
+			th, err = makeThumbnail(rdr, size)
+			if err == nil {
+				th.key = key
+				thumbnails.add(th)
+			}
+		}
+		<-slots
+		if err != nil {
+			return http.StatusUnsupportedMediaType, err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", th.contentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(th.data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(th.data)
+	return http.StatusOK, ""
+}
+
+func validThumbnailSize(size int) bool {
+	for _, s := range thumbnailSizes {
+		if size == s {
+			return true
+		}
+	}
+	return false
+}
+
+// makeThumbnail decodes the image in rdr and returns a scaled-down
+// copy, encoded in the same format (if JPEG) or PNG (otherwise).
+func makeThumbnail(rdr keepclient.ReadCloserWithLen, size int) (*thumbnail, error) {
+	if rdr.Len() > thumbnailMaxSourceBytes {
+		return nil, fmt.Errorf("image file is too big (%d bytes)", rdr.Len())
+	}
+	// Check the dimensions before decoding the whole image, in
+	// case a small file expands to a huge image.
+	cfg, _, err := image.DecodeConfig(rdr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxSourcePixels {
+		return nil, fmt.Errorf("image is too big (%dx%d)", cfg.Width, cfg.Height)
+	}
+	if seeker, ok := rdr.(io.Seeker); !ok {
+		return nil, fmt.Errorf("cannot rewind %T", rdr)
+	} else if _, err := seeker.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	img, format, err := image.Decode(rdr)
+	if err != nil {
+		return nil, err
+	}
+	img = scaleImage(img, size)
+
+	var buf bytes.Buffer
+	th := &thumbnail{}
+	if format == "jpeg" {
+		th.contentType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		th.contentType = "image/png"
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	th.data = buf.Bytes()
+	return th, nil
+}
+
+// scaleImage returns a copy of src scaled down (preserving the aspect
+// ratio) to fit in a size x size square. Each pixel of the result is
+// the average of the source pixels it covers. Images that already fit
+// are returned unchanged.
+func scaleImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+	dw, dh := size, size
+	if sw > sh {
+		dh = sh * size / sw
+	} else {
+		dw = sw * size / sh
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := bounds.Min.Y+y*sh/dh, bounds.Min.Y+(y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := bounds.Min.X+x*sw/dw, bounds.Min.X+(x+1)*sw/dw
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
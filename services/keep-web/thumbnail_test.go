@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	check "gopkg.in/check.v1"
+)
+
+func (s *UnitSuite) TestScaleImage(c *check.C) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 100; y++ {
+			if x%2 == 0 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+	dst := scaleImage(src, 100)
+	c.Check(dst.Bounds(), check.Equals, image.Rect(0, 0, 100, 25))
+	// Alternating black and white columns average out to grey
+	r, g, b, a := dst.At(50, 10).RGBA()
+	c.Check(r, check.Equals, uint32(0x7fff))
+	c.Check(g, check.Equals, r)
+	c.Check(b, check.Equals, r)
+	c.Check(a, check.Equals, uint32(0xffff))
+
+	// Small images are not enlarged
+	c.Check(scaleImage(src, 500), check.Equals, src)
+}
+
+func (s *UnitSuite) TestThumbnail(c *check.C) {
+	defer func(orig *thumbnailCache) { thumbnails = orig }(thumbnails)
+	thumbnails = &thumbnailCache{MaxBytes: 1 << 20}
+
+	src := image.NewRGBA(image.Rect(0, 0, 60, 120))
+	var pngData, jpegData bytes.Buffer
+	c.Assert(png.Encode(&pngData, src), check.IsNil)
+	c.Assert(jpeg.Encode(&jpegData, src, nil), check.IsNil)
+
+	for _, trial := range []struct {
+		data        []byte
+		size        string
+		status      int
+		contentType string
+		bounds      image.Rectangle
+	}{
+		{pngData.Bytes(), "32", http.StatusOK, "image/png", image.Rect(0, 0, 16, 32)},
+		{jpegData.Bytes(), "32", http.StatusOK, "image/jpeg", image.Rect(0, 0, 16, 32)},
+		{pngData.Bytes(), "0", http.StatusBadRequest, "", image.Rectangle{}},
+		{pngData.Bytes(), "30", http.StatusBadRequest, "", image.Rectangle{}},
+		{pngData.Bytes(), "99999", http.StatusBadRequest, "", image.Rectangle{}},
+		{[]byte("not an image"), "32", http.StatusUnsupportedMediaType, "", image.Rectangle{}},
+	} {
+		for i := 0; i < 2; i++ {
+			// Second time, the thumbnail (if any) comes
+			// from the cache.
+			req, _ := http.NewRequest("GET", "/", nil)
+			resp := httptest.NewRecorder()
+			rdr := newPartsReader(nil, []readerPart{{data: trial.data}})
+			status, _ := serveThumbnail(resp, req, rdr, trial.contentType+"/x", trial.size)
+			c.Check(status, check.Equals, trial.status)
+			if status != http.StatusOK {
+				continue
+			}
+			c.Check(resp.Header().Get("Content-Type"), check.Equals, trial.contentType)
+			img, _, err := image.Decode(resp.Body)
+			c.Assert(err, check.IsNil)
+			c.Check(img.Bounds(), check.Equals, trial.bounds)
+		}
+	}
+	c.Check(thumbnails.entries.Len(), check.Equals, 2)
+}
+
+func (s *UnitSuite) TestThumbnailConcurrent(c *check.C) {
+	defer func(orig *thumbnailCache) { thumbnails = orig }(thumbnails)
+	thumbnails = &thumbnailCache{MaxBytes: 1 << 20, MaxDecoders: 1}
+
+	var pngData bytes.Buffer
+	c.Assert(png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 200, 200))), check.IsNil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/", nil)
+			resp := httptest.NewRecorder()
+			rdr := newPartsReader(nil, []readerPart{{data: pngData.Bytes()}})
+			status, _ := serveThumbnail(resp, req, rdr, "x", "64")
+			c.Check(status, check.Equals, http.StatusOK)
+		}()
+	}
+	wg.Wait()
+	c.Check(cap(thumbnails.decoders), check.Equals, 1)
+	c.Check(len(thumbnails.decoders), check.Equals, 0)
+	c.Check(thumbnails.entries.Len(), check.Equals, 1)
+}
+
+func (s *UnitSuite) TestThumbnailCacheEviction(c *check.C) {
+	tc := &thumbnailCache{MaxBytes: 10}
+	tc.add(&thumbnail{key: "a", data: make([]byte, 4)})
+	tc.add(&thumbnail{key: "b", data: make([]byte, 4)})
+	c.Check(tc.get("a"), check.NotNil)
+	tc.add(&thumbnail{key: "c", data: make([]byte, 4)})
+	c.Check(tc.get("a"), check.NotNil)
+	c.Check(tc.get("b"), check.IsNil)
+	c.Check(tc.get("c"), check.NotNil)
+	c.Check(tc.size, check.Equals, int64(8))
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+)
+
+const emptyBlockLocator = "d41d8cd98f00b204e9800998ecf8427e+0"
+
+var (
+	errIsDirectory  = errors.New("is a directory")
+	errNotDirectory = errors.New("not a directory")
+	errRootReadOnly = errors.New("cannot modify the root directory")
+)
+
+// collectionTree is the directory tree described by a collection's
+// manifest. It can be modified, and written back out as a manifest
+// with manifestText().
+type collectionTree struct {
+	root *treeDir
+}
+
+type treeDir struct {
+	dirs  map[string]*treeDir
+	files map[string]*treeFile
+}
+
+// treeFile is a file in a collectionTree: a sequence of segments of
+// Keep blocks.
+type treeFile struct {
+	size     int64
+	segments []manifest.FileSegment
+}
+
+func newTreeDir() *treeDir {
+	return &treeDir{
+		dirs:  make(map[string]*treeDir),
+		files: make(map[string]*treeFile),
+	}
+}
+
+// newCollectionTree parses the given manifest text.
+func newCollectionTree(mText string) (*collectionTree, error) {
+	t := &collectionTree{root: newTreeDir()}
+	m := manifest.Manifest{Text: mText}
+	for stream := range m.StreamIter() {
+		if stream.Err != nil {
+			return nil, stream.Err
+		}
+		if err := t.addStream(stream); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *collectionTree) addStream(stream manifest.ManifestStream) error {
+	blockLens := make([]int, len(stream.Blocks))
+	for i, loc := range stream.Blocks {
+		b, err := manifest.ParseBlockLocator(loc)
+		if err != nil {
+			return err
+		}
+		blockLens[i] = b.Size
+	}
+	dirName := strings.TrimPrefix(stream.StreamName, ".")
+	for _, fTok := range stream.FileStreamSegments {
+		name := path.Clean(dirName + "/" + fTok.Name)
+		if fTok.Name == "." {
+			// Placeholder for an empty directory.
+			if _, err := t.mkdirAll(strings.TrimPrefix(name, "/")); err != nil {
+				return err
+			}
+			continue
+		}
+		dir, err := t.mkdirAll(strings.TrimPrefix(path.Dir(name), "/"))
+		if err != nil {
+			return err
+		}
+		base := path.Base(name)
+		if _, ok := dir.dirs[base]; ok {
+			return fmt.Errorf("%q is both a file and a directory", name)
+		}
+		f, ok := dir.files[base]
+		if !ok {
+			f = &treeFile{}
+			dir.files[base] = f
+		}
+		// Find the parts of the stream's blocks that hold the
+		// data for this file token.
+		wantPos, wantEnd := fTok.SegPos, fTok.SegPos+fTok.SegLen
+		var blockPos uint64
+		for i, loc := range stream.Blocks {
+			blockEnd := blockPos + uint64(blockLens[i])
+			if blockEnd > wantPos && blockPos < wantEnd {
+				seg := manifest.FileSegment{Locator: loc, Len: blockLens[i]}
+				if blockPos < wantPos {
+					seg.Offset = int(wantPos - blockPos)
+					seg.Len -= seg.Offset
+				}
+				if blockEnd > wantEnd {
+					seg.Len -= int(blockEnd - wantEnd)
+				}
+				f.segments = append(f.segments, seg)
+				f.size += int64(seg.Len)
+			}
+			blockPos = blockEnd
+		}
+		if blockPos < wantEnd {
+			return fmt.Errorf("file segment %d:%d:%s extends past end of stream", fTok.SegPos, fTok.SegLen, fTok.Name)
+		}
+	}
+	return nil
+}
+
+// splitPath returns the parent directory and base name of a path
+// within the tree. The root directory is "".
+func splitPath(p string) (string, string) {
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return "", p
+}
+
+// mkdirAll returns the directory at the given path, creating it and
+// its parents if needed.
+func (t *collectionTree) mkdirAll(p string) (*treeDir, error) {
+	dir := t.root
+	if p == "" {
+		return dir, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		if _, ok := dir.files[name]; ok {
+			return nil, errNotDirectory
+		}
+		sub, ok := dir.dirs[name]
+		if !ok {
+			sub = newTreeDir()
+			dir.dirs[name] = sub
+		}
+		dir = sub
+	}
+	return dir, nil
+}
+
+// lookup returns the directory or file at the given path. If nothing
+// exists there, both return values are nil.
+func (t *collectionTree) lookup(p string) (*treeDir, *treeFile) {
+	dir := t.root
+	if p == "" {
+		return dir, nil
+	}
+	parts := strings.Split(p, "/")
+	for _, name := range parts[:len(parts)-1] {
+		if dir = dir.dirs[name]; dir == nil {
+			return nil, nil
+		}
+	}
+	name := parts[len(parts)-1]
+	if sub, ok := dir.dirs[name]; ok {
+		return sub, nil
+	}
+	return nil, dir.files[name]
+}
+
+// parent returns the directory that holds (or would hold) the entry
+// at the given path.
+func (t *collectionTree) parent(p string) (*treeDir, string, error) {
+	if p == "" {
+		return nil, "", errRootReadOnly
+	}
+	dirPath, name := splitPath(p)
+	dir, f := t.lookup(dirPath)
+	if f != nil {
+		return nil, "", errNotDirectory
+	} else if dir == nil {
+		return nil, "", os.ErrNotExist
+	}
+	return dir, name, nil
+}
+
+// mkdir creates a directory. Its parent must already exist.
+func (t *collectionTree) mkdir(p string) error {
+	dir, name, err := t.parent(p)
+	if err != nil {
+		return err
+	}
+	if dir.dirs[name] != nil || dir.files[name] != nil {
+		return os.ErrExist
+	}
+	dir.dirs[name] = newTreeDir()
+	return nil
+}
+
+// putFile stores f at the given path, replacing any existing file
+// there. It returns true if a new file was created.
+func (t *collectionTree) putFile(p string, f *treeFile) (bool, error) {
+	dir, name, err := t.parent(p)
+	if err != nil {
+		return false, err
+	}
+	if dir.dirs[name] != nil {
+		return false, errIsDirectory
+	}
+	_, replaced := dir.files[name]
+	dir.files[name] = f
+	return !replaced, nil
+}
+
+// remove removes the file or directory (including its contents) at
+// the given path.
+func (t *collectionTree) remove(p string) error {
+	dir, name, err := t.parent(p)
+	if err != nil {
+		return err
+	}
+	if dir.dirs[name] != nil {
+		delete(dir.dirs, name)
+	} else if dir.files[name] != nil {
+		delete(dir.files, name)
+	} else {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// rename moves the file or directory at oldPath to newPath. The
+// parent of newPath must exist, and nothing may exist at newPath.
+func (t *collectionTree) rename(oldPath, newPath string) error {
+	if newPath == oldPath {
+		return nil
+	}
+	if strings.HasPrefix(newPath+"/", oldPath+"/") {
+		return fmt.Errorf("cannot move %q into itself", oldPath)
+	}
+	oldDir, oldName, err := t.parent(oldPath)
+	if err != nil {
+		return err
+	}
+	newDir, newName, err := t.parent(newPath)
+	if err != nil {
+		return err
+	}
+	if newDir.dirs[newName] != nil || newDir.files[newName] != nil {
+		return os.ErrExist
+	}
+	if d := oldDir.dirs[oldName]; d != nil {
+		delete(oldDir.dirs, oldName)
+		newDir.dirs[newName] = d
+	} else if f := oldDir.files[oldName]; f != nil {
+		delete(oldDir.files, oldName)
+		newDir.files[newName] = f
+	} else {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// manifestText returns a manifest describing the tree: one stream for
+// each directory that contains files, plus a placeholder stream for
+// each empty directory.
+func (t *collectionTree) manifestText() string {
+	var buf bytes.Buffer
+	t.root.writeStreams(&buf, ".")
+	return buf.String()
+}
+
+func (dir *treeDir) writeStreams(buf *bytes.Buffer, streamName string) {
+	if len(dir.files) > 0 {
+		var blocks, tokens []string
+		var streamLen, blockStart int64
+		for _, name := range dir.fileNames() {
+			f := dir.files[name]
+			ename := manifest.EscapeName(name)
+			var tokPos, tokLen int64
+			for _, seg := range f.segments {
+				if seg.Len == 0 {
+					continue
+				}
+				// Reuse the previous block if this segment
+				// comes from the same one, as it often
+				// does when small files are packed into
+				// one block.
+				if len(blocks) == 0 || blocks[len(blocks)-1] != seg.Locator {
+					blockStart = streamLen
+					blocks = append(blocks, seg.Locator)
+					streamLen += blockLen(seg.Locator)
+				}
+				pos := blockStart + int64(seg.Offset)
+				if tokLen > 0 && tokPos+tokLen == pos {
+					tokLen += int64(seg.Len)
+					continue
+				}
+				if tokLen > 0 {
+					tokens = append(tokens, fmt.Sprintf("%d:%d:%s", tokPos, tokLen, ename))
+				}
+				tokPos, tokLen = pos, int64(seg.Len)
+			}
+			if tokLen > 0 || f.size == 0 {
+				tokens = append(tokens, fmt.Sprintf("%d:%d:%s", tokPos, tokLen, ename))
+			}
+		}
+		if len(blocks) == 0 {
+			blocks = []string{emptyBlockLocator}
+		}
+		fmt.Fprintf(buf, "%s %s %s\n", manifest.EscapeName(streamName), strings.Join(blocks, " "), strings.Join(tokens, " "))
+	} else if len(dir.dirs) == 0 && streamName != "." {
+		fmt.Fprintf(buf, "%s %s 0:0:\\056\n", manifest.EscapeName(streamName), emptyBlockLocator)
+	}
+	for _, name := range dir.dirNames() {
+		dir.dirs[name].writeStreams(buf, streamName+"/"+name)
+	}
+}
+
+// size returns the total size of the files in dir and its
+// subdirectories.
+func (dir *treeDir) size() int64 {
+	var size int64
+	for _, f := range dir.files {
+		size += f.size
+	}
+	for _, sub := range dir.dirs {
+		size += sub.size()
+	}
+	return size
+}
+
+// dirNames returns the names of dir's subdirectories, sorted.
+func (dir *treeDir) dirNames() []string {
+	names := make([]string, 0, len(dir.dirs))
+	for name := range dir.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fileNames returns the names of the files in dir, sorted.
+func (dir *treeDir) fileNames() []string {
+	names := make([]string, 0, len(dir.files))
+	for name := range dir.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func blockLen(locator string) int64 {
+	b, err := manifest.ParseBlockLocator(locator)
+	if err != nil {
+		return 0
+	}
+	return int64(b.Size)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+
+	check "gopkg.in/check.v1"
+)
+
+const (
+	fooLocator    = "acbd18db4cc2f85cedef654fccc4a4d8+3"
+	barLocator    = "37b51d194a7513e45b56f6524f2d51f2+3"
+	foobarLocator = "3858f62230ac3c915f300c664312c63f+6"
+)
+
+func (s *UnitSuite) TestTreeParse(c *check.C) {
+	tree, err := newCollectionTree(". " + foobarLocator + " 0:3:foo 3:3:bar\n" +
+		"./dir\\040one " + fooLocator + " " + barLocator + " 0:6:foobar 2:2:ob\n" +
+		"./empty " + emptyBlockLocator + " 0:0:\\056\n")
+	c.Assert(err, check.IsNil)
+
+	_, f := tree.lookup("bar")
+	c.Assert(f, check.NotNil)
+	c.Check(f.size, check.Equals, int64(3))
+	c.Check(f.segments[0].Locator, check.Equals, foobarLocator)
+	c.Check(f.segments[0].Offset, check.Equals, 3)
+
+	_, f = tree.lookup("dir one/foobar")
+	c.Assert(f, check.NotNil)
+	c.Check(f.size, check.Equals, int64(6))
+	c.Check(f.segments, check.HasLen, 2)
+
+	_, f = tree.lookup("dir one/ob")
+	c.Assert(f, check.NotNil)
+	c.Check(f.segments, check.HasLen, 2)
+	c.Check(f.segments[0].Offset, check.Equals, 2)
+	c.Check(f.segments[0].Len, check.Equals, 1)
+	c.Check(f.segments[1].Offset, check.Equals, 0)
+	c.Check(f.segments[1].Len, check.Equals, 1)
+
+	d, f := tree.lookup("empty")
+	c.Check(f, check.IsNil)
+	c.Assert(d, check.NotNil)
+	c.Check(d.dirs, check.HasLen, 0)
+	c.Check(d.files, check.HasLen, 0)
+
+	d, f = tree.lookup("nonexistent/foo")
+	c.Check(d, check.IsNil)
+	c.Check(f, check.IsNil)
+}
+
+func (s *UnitSuite) TestTreeBadManifest(c *check.C) {
+	for _, mText := range []string{
+		". " + fooLocator + " 0:4:foo\n",
+		". " + fooLocator + " 0:3:foo\n./foo " + fooLocator + " 0:3:bar\n",
+		"foo " + fooLocator + " 0:3:foo\n",
+	} {
+		_, err := newCollectionTree(mText)
+		c.Check(err, check.NotNil, check.Commentf("%q", mText))
+	}
+}
+
+func (s *UnitSuite) TestTreeManifestText(c *check.C) {
+	for _, mText := range []string{
+		"",
+		". " + foobarLocator + " 0:3:a 3:3:b\n",
+		". " + fooLocator + " 0:3:foo\n./dir\\040one " + fooLocator + " " + barLocator + " 0:6:foobar\n",
+		". " + emptyBlockLocator + " 0:0:empty.txt\n./empty " + emptyBlockLocator + " 0:0:\\056\n",
+	} {
+		tree, err := newCollectionTree(mText)
+		c.Assert(err, check.IsNil)
+		c.Check(tree.manifestText(), check.Equals, mText)
+	}
+}
+
+func (s *UnitSuite) TestTreeModify(c *check.C) {
+	tree, err := newCollectionTree(". " + foobarLocator + " 0:3:foo 3:3:bar\n")
+	c.Assert(err, check.IsNil)
+
+	c.Check(tree.mkdir("dir"), check.IsNil)
+	c.Check(os.IsExist(tree.mkdir("dir")), check.Equals, true)
+	c.Check(os.IsNotExist(tree.mkdir("a/b")), check.Equals, true)
+	c.Check(tree.mkdir("foo/b"), check.Equals, errNotDirectory)
+
+	c.Check(tree.rename("foo", "dir/foo"), check.IsNil)
+	c.Check(os.IsExist(tree.rename("bar", "dir")), check.Equals, true)
+	c.Check(tree.rename("dir", "dir/sub"), check.NotNil)
+	c.Check(tree.manifestText(), check.Equals,
+		". "+foobarLocator+" 3:3:bar\n./dir "+foobarLocator+" 0:3:foo\n")
+
+	created, err := tree.putFile("dir/baz", &treeFile{})
+	c.Check(err, check.IsNil)
+	c.Check(created, check.Equals, true)
+	_, err = tree.putFile("dir", &treeFile{})
+	c.Check(err, check.Equals, errIsDirectory)
+
+	c.Check(tree.remove("dir/foo"), check.IsNil)
+	c.Check(os.IsNotExist(tree.remove("dir/foo")), check.Equals, true)
+	c.Check(tree.remove(""), check.Equals, errRootReadOnly)
+	c.Check(tree.manifestText(), check.Equals,
+		". "+foobarLocator+" 3:3:bar\n./dir "+emptyBlockLocator+" 0:0:baz\n")
+
+	c.Check(tree.remove("dir"), check.IsNil)
+	c.Check(tree.manifestText(), check.Equals, ". "+foobarLocator+" 3:3:bar\n")
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/manifest"
+)
+
+// davMethods are the WebDAV methods handled by serveDAV, in addition
+// to the GET and POST requests handled by handler.ServeHTTP.
+var davMethods = map[string]bool{
+	"OPTIONS":  true,
+	"PROPFIND": true,
+	"PUT":      true,
+	"MKCOL":    true,
+	"DELETE":   true,
+	"MOVE":     true,
+}
+
+const davAllow = "OPTIONS, GET, POST, PROPFIND, PUT, MKCOL, DELETE, MOVE"
+
+// davRequest is a WebDAV request for a path in a collection.
+type davRequest struct {
+	w          http.ResponseWriter
+	r          *http.Request
+	arv        *arvadosclient.ArvadosClient
+	kc         *keepclient.KeepClient
+	collection map[string]interface{}
+	targetID   string
+
+	// URL path of the collection root, with a trailing slash
+	basePath string
+
+	// Path of the requested file or directory relative to the
+	// collection root, without leading or trailing slashes ("" for
+	// the root itself)
+	target string
+}
+
+// serveDAV handles a WebDAV request, and returns the response status
+// (and a status message to log, if any).
+func (dr *davRequest) serveDAV() (int, string) {
+	if dr.r.Method == "PROPFIND" {
+		tree, err := newCollectionTree(manifestText(dr.collection))
+		if err != nil {
+			return http.StatusBadGateway, err.Error()
+		}
+		return dr.propfind(tree)
+	}
+
+	// All other methods modify the collection.
+	if !arvadosclient.UUIDMatch(dr.targetID) {
+		// A collection identified by its content hash can't
+		// change.
+		dr.w.Header().Set("Allow", "OPTIONS, GET, POST, PROPFIND")
+		return http.StatusMethodNotAllowed, "collection is read-only"
+	}
+	var modify func(*collectionTree) (int, error)
+	switch dr.r.Method {
+	case "PUT":
+		// Store the request body in Keep first, so the same
+		// file can be added again if the update is retried.
+		f, err := storeFile(dr.kc, dr.r.Body)
+		if err != nil {
+			return http.StatusBadGateway, err.Error()
+		}
+		modify = func(tree *collectionTree) (int, error) {
+			return dr.put(tree, f)
+		}
+	case "MKCOL":
+		modify = dr.mkcol
+	case "DELETE":
+		modify = dr.delete
+	case "MOVE":
+		modify = dr.move
+	}
+	status, err := modifyCollection(dr.arv, dr.targetID, &dr.collection, modify)
+	if err != nil {
+		if status == 0 {
+			status = davErrorStatus(err)
+		}
+		return status, err.Error()
+	}
+	dr.w.WriteHeader(status)
+	return status, ""
+}
+
+// davErrorStatus returns the response status for an error returned
+// by a collectionTree method that modifies the tree.
+func davErrorStatus(err error) int {
+	switch {
+	case os.IsNotExist(err), err == errNotDirectory:
+		// The parent of the target doesn't exist, or isn't a
+		// directory.
+		return http.StatusConflict
+	case os.IsExist(err), err == errIsDirectory:
+		return http.StatusMethodNotAllowed
+	default:
+		return http.StatusForbidden
+	}
+}
+
+func (dr *davRequest) put(tree *collectionTree, f *treeFile) (int, error) {
+	if created, err := tree.putFile(dr.target, f); err != nil {
+		return 0, err
+	} else if created {
+		return http.StatusCreated, nil
+	}
+	return http.StatusNoContent, nil
+}
+
+func (dr *davRequest) delete(tree *collectionTree) (int, error) {
+	if d, f := tree.lookup(dr.target); d == nil && f == nil {
+		return http.StatusNotFound, os.ErrNotExist
+	}
+	if err := tree.remove(dr.target); err != nil {
+		return 0, err
+	}
+	return http.StatusNoContent, nil
+}
+
+// storeFile writes data from r to Keep, and returns a treeFile with
+// the resulting blocks.
+func storeFile(kc *keepclient.KeepClient, r io.Reader) (*treeFile, error) {
+	f := &treeFile{}
+	buf := make([]byte, keepclient.BLOCKSIZE)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			locator, _, err := kc.PutB(buf[:n])
+			if err != nil {
+				return nil, err
+			}
+			f.segments = append(f.segments, manifest.FileSegment{Locator: locator, Len: n})
+			f.size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return f, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (dr *davRequest) mkcol(tree *collectionTree) (int, error) {
+	if dr.r.ContentLength > 0 {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("MKCOL request body is not supported")
+	}
+	if err := tree.mkdir(dr.target); err != nil {
+		return 0, err
+	}
+	return http.StatusCreated, nil
+}
+
+func (dr *davRequest) move(tree *collectionTree) (int, error) {
+	dest, err := url.Parse(dr.r.Header.Get("Destination"))
+	if err != nil || dr.r.Header.Get("Destination") == "" {
+		return http.StatusBadRequest, fmt.Errorf("missing or invalid Destination header")
+	}
+	if dest.Host != "" && dest.Host != dr.r.Host {
+		return http.StatusBadGateway, fmt.Errorf("cannot move to a different server")
+	}
+	if !strings.HasPrefix(dest.Path, dr.basePath) {
+		return http.StatusForbidden, fmt.Errorf("cannot move to a different collection")
+	}
+	destTarget := cleanTarget(dest.Path[len(dr.basePath):])
+	if d, f := tree.lookup(dr.target); d == nil && f == nil {
+		return http.StatusNotFound, os.ErrNotExist
+	}
+	status := http.StatusCreated
+	if d, f := tree.lookup(destTarget); d != nil || f != nil {
+		if dr.r.Header.Get("Overwrite") == "F" {
+			return http.StatusPreconditionFailed, fmt.Errorf("destination exists")
+		}
+		if destTarget != dr.target {
+			if err := tree.remove(destTarget); err != nil {
+				return 0, err
+			}
+		}
+		status = http.StatusNoContent
+	}
+	if err := tree.rename(dr.target, destTarget); err != nil {
+		return 0, err
+	}
+	return status, nil
+}
+
+// errCollectionModified is returned by updateCollection when another
+// client has changed the collection since it was loaded.
+var errCollectionModified = errors.New("collection was modified by another client")
+
+// maxUpdateAttempts is the number of times modifyCollection applies a
+// change to the latest version of a collection before giving up.
+const maxUpdateAttempts = 3
+
+// modifyCollection calls modify on a tree built from *collection, and
+// saves the modified tree. If another client changes the collection
+// in the meantime, it loads the new version and tries again. It
+// returns the status returned by modify, or the status and error
+// from the first step that failed.
+func modifyCollection(arv *arvadosclient.ArvadosClient, uuid string, collection *map[string]interface{}, modify func(*collectionTree) (int, error)) (int, error) {
+	for attempt := 1; ; attempt++ {
+		tree, err := newCollectionTree(manifestText(*collection))
+		if err != nil {
+			return http.StatusBadGateway, err
+		}
+		status, err := modify(tree)
+		if err != nil {
+			return status, err
+		}
+		updStatus, err := updateCollection(arv, uuid, tree, collection)
+		if err == nil {
+			return status, nil
+		} else if err != errCollectionModified {
+			return updStatus, err
+		} else if attempt >= maxUpdateAttempts {
+			return http.StatusConflict, err
+		}
+		reloaded := make(map[string]interface{})
+		if err := arv.Get("collections", uuid, nil, &reloaded); err != nil {
+			return http.StatusBadGateway, err
+		}
+		*collection = reloaded
+	}
+}
+
+// updateCollection replaces the manifest of the collection with the
+// given UUID with tree's manifest, and loads the updated collection
+// record into *collection. The update is only done if the collection
+// still has the portable data hash given in *collection: otherwise,
+// it returns errCollectionModified.
+func updateCollection(arv *arvadosclient.ArvadosClient, uuid string, tree *collectionTree, collection *map[string]interface{}) (int, error) {
+	params := arvadosclient.Dict{
+		"collection": arvadosclient.Dict{
+			"manifest_text": tree.manifestText(),
+		},
+	}
+	if pdh, ok := (*collection)["portable_data_hash"].(string); ok {
+		params["expect_portable_data_hash"] = pdh
+	}
+	err := arv.Update("collections", uuid, params, collection)
+	if err == nil {
+		return 0, nil
+	}
+	if srvErr, ok := err.(arvadosclient.APIServerError); ok {
+		switch srvErr.HttpStatusCode {
+		case 401, 403, 404, 422:
+			return http.StatusForbidden, err
+		case 412:
+			return http.StatusPreconditionFailed, errCollectionModified
+		}
+	}
+	return http.StatusBadGateway, err
+}
+
+type davEntry struct {
+	name string
+	dir  *treeDir
+	file *treeFile
+}
+
+func (dr *davRequest) propfind(tree *collectionTree) (int, string) {
+	dir, file := tree.lookup(dr.target)
+	if dir == nil && file == nil {
+		return http.StatusNotFound, ""
+	}
+	entries := []davEntry{{dr.target, dir, file}}
+	if dir != nil && dr.r.Header.Get("Depth") != "0" {
+		// "Depth: 1" and "Depth: infinity" both get one level:
+		// listing a whole collection could be expensive.
+		prefix := dr.target
+		if prefix != "" {
+			prefix += "/"
+		}
+		for _, name := range dir.dirNames() {
+			entries = append(entries, davEntry{prefix + name, dir.dirs[name], nil})
+		}
+		for _, name := range dir.fileNames() {
+			entries = append(entries, davEntry{prefix + name, nil, dir.files[name]})
+		}
+	}
+
+	var lastModified string
+	if t, err := time.Parse(time.RFC3339Nano, fmt.Sprint(dr.collection["modified_at"])); err == nil {
+		lastModified = t.UTC().Format(http.TimeFormat)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	buf.WriteString(`<D:multistatus xmlns:D="DAV:">` + "\n")
+	for _, ent := range entries {
+		href := dr.basePath + ent.name
+		if ent.dir != nil && ent.name != "" {
+			href += "/"
+		}
+		buf.WriteString("<D:response><D:href>")
+		xml.EscapeText(&buf, []byte((&url.URL{Path: href}).EscapedPath()))
+		buf.WriteString("</D:href><D:propstat><D:prop>")
+		buf.WriteString("<D:displayname>")
+		xml.EscapeText(&buf, []byte(path.Base("/"+ent.name)))
+		buf.WriteString("</D:displayname>")
+		if ent.dir != nil {
+			buf.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+		} else {
+			buf.WriteString("<D:resourcetype/>")
+			fmt.Fprintf(&buf, "<D:getcontentlength>%d</D:getcontentlength>", ent.file.size)
+			if t := mime.TypeByExtension(path.Ext(ent.name)); t != "" {
+				buf.WriteString("<D:getcontenttype>")
+				xml.EscapeText(&buf, []byte(t))
+				buf.WriteString("</D:getcontenttype>")
+			}
+		}
+		if lastModified != "" {
+			fmt.Fprintf(&buf, "<D:getlastmodified>%s</D:getlastmodified>", lastModified)
+		}
+		buf.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>\n")
+	}
+	buf.WriteString("</D:multistatus>\n")
+
+	dr.w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	dr.w.WriteHeader(http.StatusMultiStatus)
+	dr.w.Write(buf.Bytes())
+	return http.StatusMultiStatus, ""
+}
+
+// serveDAVOptions responds to an OPTIONS request. Clients use this to
+// find out whether WebDAV is supported, so it doesn't need
+// credentials.
+func serveDAVOptions(w http.ResponseWriter) {
+	w.Header().Set("DAV", "1")
+	w.Header().Set("Allow", davAllow)
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.WriteHeader(http.StatusOK)
+}
+
+// cleanTarget returns the given path relative to the collection root,
+// without leading or trailing slashes.
+func cleanTarget(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func manifestText(collection map[string]interface{}) string {
+	mText, _ := collection["manifest_text"].(string)
+	return mText
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+
+	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
+	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
+	check "gopkg.in/check.v1"
+)
+
+func (s *IntegrationSuite) doDAVRequest(c *check.C, method, host, path string, hdr map[string]string, body string) *httptest.ResponseRecorder {
+	u := mustParseURL("http://" + host + path)
+	req := &http.Request{
+		Method:     method,
+		Host:       u.Host,
+		URL:        u,
+		RequestURI: u.RequestURI(),
+		Header: http.Header{
+			"Authorization": {"OAuth2 " + arvadostest.ActiveToken},
+		},
+		Body: ioutil.NopCloser(strings.NewReader(body)),
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	resp := httptest.NewRecorder()
+	(&handler{}).ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *IntegrationSuite) TestDAVReadOnlyPDH(c *check.C) {
+	host := strings.Replace(arvadostest.FooPdh, "+", "-", 1) + ".collections.example.com"
+	resp := s.doDAVRequest(c, "PROPFIND", host, "/", map[string]string{"Depth": "1"}, "")
+	c.Check(resp.Code, check.Equals, http.StatusMultiStatus)
+	c.Check(resp.Body.String(), check.Matches, `(?s).*<D:href>/foo</D:href>.*<D:getcontentlength>3</D:getcontentlength>.*`)
+
+	resp = s.doDAVRequest(c, "PUT", host, "/bar", nil, "bar")
+	c.Check(resp.Code, check.Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *IntegrationSuite) TestDAVReadWrite(c *check.C) {
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, check.IsNil)
+	arv.ApiToken = arvadostest.ActiveToken
+	var coll map[string]interface{}
+	err = arv.Create("collections", arvadosclient.Dict{"collection": arvadosclient.Dict{"manifest_text": ""}}, &coll)
+	c.Assert(err, check.IsNil)
+	uuid := coll["uuid"].(string)
+	defer arv.Delete("collections", uuid, nil, nil)
+	host := uuid + ".collections.example.com"
+
+	resp := s.doDAVRequest(c, "OPTIONS", host, "/", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Header().Get("DAV"), check.Equals, "1")
+
+	resp = s.doDAVRequest(c, "MKCOL", host, "/dir", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusCreated)
+	resp = s.doDAVRequest(c, "MKCOL", host, "/dir", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusMethodNotAllowed)
+	resp = s.doDAVRequest(c, "MKCOL", host, "/missing/dir", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusConflict)
+
+	resp = s.doDAVRequest(c, "PUT", host, "/dir/foo", nil, "foo")
+	c.Check(resp.Code, check.Equals, http.StatusCreated)
+	resp = s.doDAVRequest(c, "PUT", host, "/dir/foo", nil, "foobar")
+	c.Check(resp.Code, check.Equals, http.StatusNoContent)
+	resp = s.doDAVRequest(c, "GET", host, "/dir/foo", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusOK)
+	c.Check(resp.Body.String(), check.Equals, "foobar")
+
+	resp = s.doDAVRequest(c, "MOVE", host, "/dir/foo", map[string]string{"Destination": "http://" + host + "/bar"}, "")
+	c.Check(resp.Code, check.Equals, http.StatusCreated)
+	resp = s.doDAVRequest(c, "PUT", host, "/baz", nil, "baz")
+	c.Check(resp.Code, check.Equals, http.StatusCreated)
+	resp = s.doDAVRequest(c, "MOVE", host, "/baz", map[string]string{"Destination": "/bar", "Overwrite": "F"}, "")
+	c.Check(resp.Code, check.Equals, http.StatusPreconditionFailed)
+
+	resp = s.doDAVRequest(c, "PROPFIND", host, "/", map[string]string{"Depth": "1"}, "")
+	c.Check(resp.Code, check.Equals, http.StatusMultiStatus)
+	body := resp.Body.String()
+	c.Check(body, check.Matches, `(?s).*<D:href>/dir/</D:href>.*`)
+	c.Check(body, check.Matches, `(?s).*<D:href>/bar</D:href>.*<D:getcontentlength>6</D:getcontentlength>.*`)
+	c.Check(body, check.Not(check.Matches), `(?s).*<D:href>/dir/foo</D:href>.*`)
+
+	resp = s.doDAVRequest(c, "DELETE", host, "/dir", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusNoContent)
+	resp = s.doDAVRequest(c, "DELETE", host, "/dir", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusNotFound)
+
+	err = arv.Get("collections", uuid, nil, &coll)
+	c.Assert(err, check.IsNil)
+	c.Check(coll["manifest_text"], check.Matches, `\. 3858f62230ac3c915f300c664312c63f\+6\S* 73feffa4b7f6bb68e44cf984c85f6e88\+3\S* 0:6:bar 6:3:baz\n`)
+}
+
+func (s *IntegrationSuite) TestModifyStaleCollection(c *check.C) {
+	arv, err := arvadosclient.MakeArvadosClient()
+	c.Assert(err, check.IsNil)
+	arv.ApiToken = arvadostest.ActiveToken
+	var coll map[string]interface{}
+	err = arv.Create("collections", arvadosclient.Dict{"collection": arvadosclient.Dict{"manifest_text": ""}}, &coll)
+	c.Assert(err, check.IsNil)
+	uuid := coll["uuid"].(string)
+	defer arv.Delete("collections", uuid, nil, nil)
+
+	// Another client adds a directory after coll was loaded.
+	host := uuid + ".collections.example.com"
+	resp := s.doDAVRequest(c, "MKCOL", host, "/other", nil, "")
+	c.Check(resp.Code, check.Equals, http.StatusCreated)
+
+	calls := 0
+	status, err := modifyCollection(&arv, uuid, &coll, func(tree *collectionTree) (int, error) {
+		calls++
+		return http.StatusCreated, tree.mkdir("mine")
+	})
+	c.Check(err, check.IsNil)
+	c.Check(status, check.Equals, http.StatusCreated)
+	c.Check(calls, check.Equals, 2)
+
+	tree, err := newCollectionTree(manifestText(coll))
+	c.Assert(err, check.IsNil)
+	for _, name := range []string{"other", "mine"} {
+		d, _ := tree.lookup(name)
+		c.Check(d, check.NotNil, check.Commentf("%s", name))
+	}
+}
+
+func (s *UnitSuite) TestPropfind(c *check.C) {
+	for _, trial := range []struct {
+		target string
+		depth  string
+		expect []string
+	}{
+		{"", "0", []string{`/c=x/`}},
+		{"", "1", []string{`/c=x/`, `/c=x/dir%20one/`, `/c=x/foo`}},
+		{"dir one", "1", []string{`/c=x/dir%20one/`, `/c=x/dir%20one/bar&amp;baz`}},
+		{"foo", "1", []string{`/c=x/foo`}},
+	} {
+		req, err := http.NewRequest("PROPFIND", "/c=x/"+trial.target, nil)
+		c.Assert(err, check.IsNil)
+		req.Header.Set("Depth", trial.depth)
+		resp := httptest.NewRecorder()
+		dr := &davRequest{
+			w: resp,
+			r: req,
+			collection: map[string]interface{}{
+				"manifest_text": ". " + fooLocator + " 0:3:foo\n./dir\\040one " + barLocator + " 0:3:bar&baz\n",
+				"modified_at":   "2016-08-01T12:34:56.789Z",
+			},
+			targetID: arvadostest.FooPdh,
+			basePath: "/c=x/",
+			target:   trial.target,
+		}
+		status, _ := dr.serveDAV()
+		c.Check(status, check.Equals, http.StatusMultiStatus)
+		c.Check(resp.Code, check.Equals, http.StatusMultiStatus)
+		body := resp.Body.String()
+		c.Check(strings.Count(body, "<D:response>"), check.Equals, len(trial.expect))
+		for _, href := range trial.expect {
+			c.Check(body, check.Matches, `(?s).*<D:href>`+regexp.QuoteMeta(href)+`</D:href>.*`)
+		}
+		c.Check(body, check.Matches, `(?s).*<D:getlastmodified>Mon, 01 Aug 2016 12:34:56 GMT</D:getlastmodified>.*`)
+	}
+}
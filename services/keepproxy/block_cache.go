@@ -0,0 +1,269 @@
+package main
+
+import (
+	"container/list"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BlockCache keeps copies of recently used data blocks in memory
+// and (optionally) on disk, so blocks that are read repeatedly do not
+// have to be retrieved from the backend Keep services each time.
+//
+// Each tier is bounded by the total size of the blocks it holds. When
+// a tier is full, the least recently used blocks are evicted.
+//
+// The cache is keyed by block hash, so it does not know which
+// clients are allowed to read which blocks. Callers must check
+// permission before using a cached block.
+type BlockCache struct {
+	// Maximum total size of blocks held in memory.
+	MaxMemoryBytes int64
+
+	// Directory to hold cached blocks on disk. If empty, the disk
+	// cache is disabled.
+	Dir string
+
+	// Maximum total size of blocks held in Dir.
+	MaxDiskBytes int64
+
+	// If PermissionSecret is not nil, signatures on locators are
+	// verified locally before returning cached blocks. Otherwise,
+	// each cache hit is confirmed by a HEAD request to a backend
+	// Keep service, which verifies the signature itself.
+	PermissionSecret []byte
+	BlobSignatureTTL time.Duration
+
+	mem  lruIndex
+	disk lruIndex
+
+	// Blocks whose disk cache files are being written or deleted
+	// by another goroutine.
+	busy map[string]bool
+
+	// mtx protects mem, disk and busy. It is not held during
+	// disk I/O.
+	mtx       sync.Mutex
+	setupOnce sync.Once
+}
+
+type lruIndex struct {
+	size    int64
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+type lruEntry struct {
+	hash string
+	size int64
+	data []byte
+}
+
+func (idx *lruIndex) init() {
+	idx.entries = list.New()
+	idx.index = make(map[string]*list.Element)
+}
+
+// get returns the entry for the given hash, and marks it as most
+// recently used.
+func (idx *lruIndex) get(hash string) *lruEntry {
+	elt, ok := idx.index[hash]
+	if !ok {
+		return nil
+	}
+	idx.entries.MoveToFront(elt)
+	return elt.Value.(*lruEntry)
+}
+
+func (idx *lruIndex) add(ent *lruEntry) {
+	if elt, ok := idx.index[ent.hash]; ok {
+		idx.entries.MoveToFront(elt)
+		return
+	}
+	idx.index[ent.hash] = idx.entries.PushFront(ent)
+	idx.size += ent.size
+}
+
+func (idx *lruIndex) remove(hash string) {
+	if elt, ok := idx.index[hash]; ok {
+		idx.size -= elt.Value.(*lruEntry).size
+		idx.entries.Remove(elt)
+		delete(idx.index, hash)
+	}
+}
+
+// evict removes least recently used entries until the total size is
+// no more than max, and returns the removed entries.
+func (idx *lruIndex) evict(max int64) (evicted []*lruEntry) {
+	for idx.size > max {
+		ent := idx.entries.Back().Value.(*lruEntry)
+		idx.remove(ent.hash)
+		evicted = append(evicted, ent)
+	}
+	return
+}
+
+var blockHashRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func (cache *BlockCache) setup() {
+	cache.setupOnce.Do(func() {
+		cache.mem.init()
+		cache.disk.init()
+		cache.busy = make(map[string]bool)
+		if cache.Dir != "" {
+			cache.loadDir()
+		}
+	})
+}
+
+// Get returns the cached data for the block with the given hash, or
+// nil if the block is not in the cache.
+func (cache *BlockCache) Get(hash string) []byte {
+	cache.setup()
+	cache.mtx.Lock()
+	if ent := cache.mem.get(hash); ent != nil {
+		cache.mtx.Unlock()
+		return ent.data
+	}
+	onDisk := cache.disk.get(hash) != nil
+	cache.mtx.Unlock()
+	if !onDisk {
+		return nil
+	}
+
+	// Read and verify the file without holding the lock, so other
+	// cache operations don't wait for disk I/O.
+	data, err := ioutil.ReadFile(cache.path(hash))
+	if err == nil && fmt.Sprintf("%x", md5.Sum(data)) != hash {
+		err = fmt.Errorf("hash mismatch")
+	}
+	if err != nil {
+		log.Printf("block cache: %s: %s", cache.path(hash), err)
+		cache.mtx.Lock()
+		cache.disk.remove(hash)
+		cache.mtx.Unlock()
+		cache.removeFiles([]*lruEntry{{hash: hash}})
+		return nil
+	}
+	cache.mtx.Lock()
+	cache.addMemory(hash, data)
+	cache.mtx.Unlock()
+	return data
+}
+
+// Put adds a block to the cache. The caller must ensure data matches
+// hash.
+func (cache *BlockCache) Put(hash string, data []byte) {
+	cache.setup()
+	cache.mtx.Lock()
+	cache.addMemory(hash, data)
+	if cache.Dir == "" || int64(len(data)) > cache.MaxDiskBytes ||
+		cache.disk.get(hash) != nil || cache.busy[hash] {
+		cache.mtx.Unlock()
+		return
+	}
+	cache.busy[hash] = true
+	cache.mtx.Unlock()
+
+	err := cache.writeFile(hash, data)
+
+	cache.mtx.Lock()
+	delete(cache.busy, hash)
+	if err != nil {
+		cache.mtx.Unlock()
+		log.Printf("block cache: %s", err)
+		return
+	}
+	cache.disk.add(&lruEntry{hash: hash, size: int64(len(data))})
+	evicted := cache.disk.evict(cache.MaxDiskBytes)
+	cache.mtx.Unlock()
+	cache.removeFiles(evicted)
+}
+
+// removeFiles deletes the disk cache files for the given entries,
+// which have already been removed from the disk index. While a file
+// is being deleted, Put does not write a new file for the same block.
+func (cache *BlockCache) removeFiles(ents []*lruEntry) {
+	if len(ents) == 0 {
+		return
+	}
+	cache.mtx.Lock()
+	for _, ent := range ents {
+		cache.busy[ent.hash] = true
+	}
+	cache.mtx.Unlock()
+	for _, ent := range ents {
+		os.Remove(cache.path(ent.hash))
+	}
+	cache.mtx.Lock()
+	for _, ent := range ents {
+		delete(cache.busy, ent.hash)
+	}
+	cache.mtx.Unlock()
+}
+
+// addMemory adds a block to the memory cache. The caller must hold
+// cache.mtx.
+func (cache *BlockCache) addMemory(hash string, data []byte) {
+	if int64(len(data)) > cache.MaxMemoryBytes {
+		return
+	}
+	cache.mem.add(&lruEntry{hash: hash, size: int64(len(data)), data: data})
+	cache.mem.evict(cache.MaxMemoryBytes)
+}
+
+func (cache *BlockCache) path(hash string) string {
+	return filepath.Join(cache.Dir, hash[:3], hash)
+}
+
+// writeFile writes data to the cache directory, replacing any
+// existing file only if the new one is written successfully.
+func (cache *BlockCache) writeFile(hash string, data []byte) error {
+	path := cache.path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	err := ioutil.WriteFile(path+".tmp", data, 0600)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return err
+}
+
+// loadDir adds the blocks already stored in Dir (e.g., by a previous
+// keepproxy process) to the disk index, oldest first, so they are
+// evicted in order of last modification.
+func (cache *BlockCache) loadDir() {
+	var files []os.FileInfo
+	filepath.Walk(cache.Dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && blockHashRe.MatchString(fi.Name()) {
+			files = append(files, fi)
+		}
+		return nil
+	})
+	sort.Sort(byModTime(files))
+	for _, fi := range files {
+		cache.disk.add(&lruEntry{hash: fi.Name(), size: fi.Size()})
+	}
+	for _, ent := range cache.disk.evict(cache.MaxDiskBytes) {
+		os.Remove(cache.path(ent.hash))
+	}
+	log.Printf("block cache: found %d blocks (%d bytes) in %s", len(cache.disk.index), cache.disk.size, cache.Dir)
+}
+
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
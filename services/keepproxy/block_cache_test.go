@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&BlockCacheSuite{})
+
+type BlockCacheSuite struct{}
+
+func testBlock(i int) (string, []byte) {
+	data := []byte(fmt.Sprintf("block %08d", i))
+	return fmt.Sprintf("%x", md5.Sum(data)), data
+}
+
+func (s *BlockCacheSuite) TestMemoryLRU(c *C) {
+	_, data := testBlock(0)
+	cache := &BlockCache{MaxMemoryBytes: int64(len(data) * 3)}
+	for i := 0; i < 3; i++ {
+		hash, data := testBlock(i)
+		cache.Put(hash, data)
+	}
+	// Use block 0, so block 1 is least recently used.
+	hash0, data0 := testBlock(0)
+	c.Check(cache.Get(hash0), DeepEquals, data0)
+	hash3, data3 := testBlock(3)
+	cache.Put(hash3, data3)
+
+	hash1, _ := testBlock(1)
+	c.Check(cache.Get(hash1), IsNil)
+	for _, i := range []int{0, 2, 3} {
+		hash, data := testBlock(i)
+		c.Check(cache.Get(hash), DeepEquals, data)
+	}
+}
+
+func (s *BlockCacheSuite) TestTooBig(c *C) {
+	cache := &BlockCache{MaxMemoryBytes: 4}
+	hash, data := testBlock(0)
+	cache.Put(hash, data)
+	c.Check(cache.Get(hash), IsNil)
+}
+
+func (s *BlockCacheSuite) TestDisk(c *C) {
+	dir := c.MkDir()
+	_, data := testBlock(0)
+	cache := &BlockCache{
+		Dir:          dir,
+		MaxDiskBytes: int64(len(data) * 2),
+	}
+	for i := 0; i < 3; i++ {
+		hash, data := testBlock(i)
+		cache.Put(hash, data)
+	}
+	hash0, _ := testBlock(0)
+	c.Check(cache.Get(hash0), IsNil)
+	_, err := os.Stat(cache.path(hash0))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// A new cache using the same directory finds the blocks
+	// written by the old one.
+	cache = &BlockCache{
+		Dir:          dir,
+		MaxDiskBytes: int64(len(data) * 2),
+	}
+	for _, i := range []int{1, 2} {
+		hash, data := testBlock(i)
+		c.Check(cache.Get(hash), DeepEquals, data)
+	}
+
+	// Corrupt files are discarded.
+	hash1, _ := testBlock(1)
+	c.Assert(ioutil.WriteFile(cache.path(hash1), []byte("garbage"), 0600), IsNil)
+	cache = &BlockCache{
+		Dir:          dir,
+		MaxDiskBytes: int64(len(data) * 2),
+	}
+	c.Check(cache.Get(hash1), IsNil)
+	_, err = os.Stat(cache.path(hash1))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *BlockCacheSuite) TestConcurrent(c *C) {
+	_, data := testBlock(0)
+	cache := &BlockCache{
+		Dir:            c.MkDir(),
+		MaxMemoryBytes: int64(len(data) * 4),
+		MaxDiskBytes:   int64(len(data) * 8),
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				hash, data := testBlock((g + i) % 16)
+				if got := cache.Get(hash); got != nil {
+					c.Check(got, DeepEquals, data)
+				} else {
+					cache.Put(hash, data)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Check(cache.disk.size <= cache.MaxDiskBytes, Equals, true)
+	c.Check(cache.busy, HasLen, 0)
+}
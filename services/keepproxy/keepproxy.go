@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/tokencache"
 	"github.com/gorilla/mux"
 	"io"
 	"io/ioutil"
@@ -15,7 +18,6 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
-	"sync"
 	"syscall"
 	"time"
 )
@@ -34,6 +36,15 @@ func main() {
 		default_replicas int
 		timeout          int64
 		pidfile          string
+		cache            BlockCache
+		permissionKey    string
+		remoteClusters   string
+		uploadDir        string
+		uploadExpiry     time.Duration
+		uploadMaxCount   int
+		uploadMaxBytes   int64
+		tokenCache       tokencache.Cache
+		adminToken       string
 	)
 
 	flagset := flag.NewFlagSet("keepproxy", flag.ExitOnError)
@@ -76,6 +87,89 @@ func main() {
 		"",
 		"Path to write pid file")
 
+	flagset.Int64Var(
+		&cache.MaxMemoryBytes,
+		"cache-memory",
+		0,
+		"Maximum total size of data blocks to cache in memory (bytes). Use 0 to disable.")
+
+	flagset.StringVar(
+		&cache.Dir,
+		"cache-dir",
+		"",
+		"Directory to cache data blocks in. If empty, blocks are not cached on disk.")
+
+	flagset.Int64Var(
+		&cache.MaxDiskBytes,
+		"cache-disk",
+		0,
+		"Maximum total size of data blocks to cache in -cache-dir (bytes).")
+
+	flagset.StringVar(
+		&permissionKey,
+		"permission-key-file",
+		"",
+		"File containing the secret key used by Keep services to sign locators. "+
+			"If given, signatures are verified by keepproxy before returning cached blocks. "+
+			"Otherwise, each cache hit is confirmed by a HEAD request to a Keep service.")
+
+	flagset.StringVar(
+		&remoteClusters,
+		"remote-clusters",
+		"",
+		"JSON file describing the Keep proxies of other Arvados clusters, e.g., "+
+			`{"zzzzz":{"Proxy":"https://keep.zzzzz.example.com","Token":"..."}}. `+
+			"Blocks whose locators have a +K@zzzzz hint are retrieved from the given proxy, using the given token "+
+			"(or, if no token is given, the client's own token).")
+
+	flagset.StringVar(
+		&uploadDir,
+		"upload-dir",
+		"",
+		"Directory to hold partially received blocks during resumable uploads. If empty, resumable uploads are disabled.")
+
+	flagset.DurationVar(
+		&uploadExpiry,
+		"upload-expiry",
+		24*time.Hour,
+		"Abandon resumable uploads that have not received any data for this long.")
+
+	flagset.IntVar(
+		&uploadMaxCount,
+		"upload-max-per-token",
+		16,
+		"Maximum number of resumable uploads in progress for each API token. Use 0 for no limit.")
+
+	flagset.Int64Var(
+		&uploadMaxBytes,
+		"upload-max-bytes-per-token",
+		1<<30,
+		"Maximum total size (bytes) of resumable uploads in progress for each API token. Use 0 for no limit.")
+
+	flagset.IntVar(
+		&tokenCache.MaxEntries,
+		"token-cache-size",
+		tokencache.DefaultMaxEntries,
+		"Maximum number of API tokens to remember.")
+
+	flagset.DurationVar(
+		&tokenCache.TTL,
+		"token-cache-ttl",
+		tokencache.DefaultTTL,
+		"How long to remember that an API token is valid.")
+
+	flagset.DurationVar(
+		&tokenCache.NegativeTTL,
+		"token-cache-negative-ttl",
+		tokencache.DefaultNegativeTTL,
+		"How long to remember that an API token is invalid. Use a negative value to disable.")
+
+	flagset.StringVar(
+		&adminToken,
+		"admin-token",
+		"",
+		"Token that can be used to retrieve /status.json and to remove a revoked token from the token cache with \"POST /_admin/flush_token?token=...\". If empty, these are disabled.")
+
 	flagset.Parse(os.Args[1:])
 
 	arv, err := arvadosclient.MakeArvadosClient()
@@ -101,9 +195,49 @@ func main() {
 		defer os.Remove(pidfile)
 	}
 
+	var blockCache *BlockCache
+	if cache.MaxMemoryBytes > 0 || cache.Dir != "" {
+		if cache.Dir != "" && cache.MaxDiskBytes <= 0 {
+			log.Fatal("-cache-dir requires -cache-disk")
+		}
+		if permissionKey != "" {
+			if cache.PermissionSecret, err = ioutil.ReadFile(permissionKey); err != nil {
+				log.Fatalf("Error reading permission key file: %s", err)
+			}
+			ttl, err := arv.Discovery("blobSignatureTTL")
+			if err != nil {
+				log.Fatalf("Error getting blobSignatureTTL from discovery document: %s", err)
+			}
+			cache.BlobSignatureTTL = time.Duration(ttl.(float64)) * time.Second
+		}
+		blockCache = &cache
+	}
+
+	if remoteClusters != "" {
+		buf, err := ioutil.ReadFile(remoteClusters)
+		if err == nil {
+			err = json.Unmarshal(buf, &kc.RemoteClusters)
+		}
+		if err != nil {
+			log.Fatalf("Error loading remote clusters (%s): %s", remoteClusters, err)
+		}
+	}
+
+	var uploads *UploadStore
+	if uploadDir != "" && !no_put {
+		if uploads, err = NewUploadStore(uploadDir, uploadExpiry); err != nil {
+			log.Fatalf("Error setting up upload directory: %s", err)
+		}
+		uploads.MaxUploadsPerToken = uploadMaxCount
+		uploads.MaxBytesPerToken = uploadMaxBytes
+		go uploads.RunExpiry(time.Minute)
+	}
+
 	kc.Want_replicas = default_replicas
 	kc.Client.Timeout = time.Duration(timeout) * time.Second
-	go kc.RefreshServices(5*time.Minute, 3*time.Second)
+	kc.Client.Transport = countingTransport{kc.Client.Transport}
+	stats.refreshed(nil)
+	go refreshServices(kc, 5*time.Minute, 3*time.Second)
 
 	listener, err = net.Listen("tcp", listen)
 	if err != nil {
@@ -123,48 +257,11 @@ func main() {
 	signal.Notify(term, syscall.SIGINT)
 
 	// Start serving requests.
-	http.Serve(listener, MakeRESTRouter(!no_get, !no_put, kc))
+	http.Serve(listener, MakeRESTRouter(!no_get, !no_put, kc, blockCache, uploads, &tokenCache, adminToken))
 
 	log.Println("shutting down")
 }
 
-type ApiTokenCache struct {
-	tokens     map[string]int64
-	lock       sync.Mutex
-	expireTime int64
-}
-
-// Cache the token and set an expire time.  If we already have an expire time
-// on the token, it is not updated.
-func (this *ApiTokenCache) RememberToken(token string) {
-	this.lock.Lock()
-	defer this.lock.Unlock()
-
-	now := time.Now().Unix()
-	if this.tokens[token] == 0 {
-		this.tokens[token] = now + this.expireTime
-	}
-}
-
-// Check if the cached token is known and still believed to be valid.
-func (this *ApiTokenCache) RecallToken(token string) bool {
-	this.lock.Lock()
-	defer this.lock.Unlock()
-
-	now := time.Now().Unix()
-	if this.tokens[token] == 0 {
-		// Unknown token
-		return false
-	} else if now < this.tokens[token] {
-		// Token is known and still valid
-		return true
-	} else {
-		// Token is expired
-		this.tokens[token] = 0
-		return false
-	}
-}
-
 func GetRemoteAddress(req *http.Request) string {
 	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
 		return xff + "," + req.RemoteAddr
@@ -172,7 +269,7 @@ func GetRemoteAddress(req *http.Request) string {
 	return req.RemoteAddr
 }
 
-func CheckAuthorizationHeader(kc *keepclient.KeepClient, cache *ApiTokenCache, req *http.Request) (pass bool, tok string) {
+func CheckAuthorizationHeader(kc *keepclient.KeepClient, cache *tokencache.Cache, req *http.Request) (pass bool, tok string) {
 	var auth string
 	if auth = req.Header.Get("Authorization"); auth == "" {
 		return false, ""
@@ -184,37 +281,44 @@ func CheckAuthorizationHeader(kc *keepclient.KeepClient, cache *ApiTokenCache, r
 		return false, ""
 	}
 
-	if cache.RecallToken(tok) {
+	if _, ok := cache.Get(tok, ""); ok {
 		// Valid in the cache, short circuit
 		return true, tok
+	} else if cache.Invalid(tok) {
+		// Recently rejected by the API server
+		return false, ""
 	}
 
 	arv := *kc.Arvados
 	arv.ApiToken = tok
 	if err := arv.Call("HEAD", "users", "", "current", nil, nil); err != nil {
 		log.Printf("%s: CheckAuthorizationHeader error: %v", GetRemoteAddress(req), err)
+		if srvErr, ok := err.(arvadosclient.APIServerError); ok && srvErr.HttpStatusCode == http.StatusUnauthorized {
+			cache.SetInvalid(tok)
+		}
 		return false, ""
 	}
 
 	// Success!  Update cache
-	cache.RememberToken(tok)
+	cache.Set(tok, "", true)
 
 	return true, tok
 }
 
 type GetBlockHandler struct {
 	*keepclient.KeepClient
-	*ApiTokenCache
+	*tokencache.Cache
+	cache *BlockCache
 }
 
 type PutBlockHandler struct {
 	*keepclient.KeepClient
-	*ApiTokenCache
+	*tokencache.Cache
 }
 
 type IndexHandler struct {
 	*keepclient.KeepClient
-	*ApiTokenCache
+	*tokencache.Cache
 }
 
 type InvalidPathHandler struct{}
@@ -223,21 +327,32 @@ type OptionsHandler struct{}
 
 // MakeRESTRouter
 //     Returns a mux.Router that passes GET and PUT requests to the
-//     appropriate handlers.
+//     appropriate handlers. If cache is not nil, blocks retrieved by
+//     GET requests are cached. If uploads is not nil (and PUT is
+//     enabled), resumable uploads are accepted at /uploads. If
+//     adminToken is not empty, it can be used to remove a revoked
+//     token from the token cache t via /_admin/flush_token, and to
+//     retrieve /status.json.
 //
 func MakeRESTRouter(
 	enable_get bool,
 	enable_put bool,
-	kc *keepclient.KeepClient) *mux.Router {
-
-	t := &ApiTokenCache{tokens: make(map[string]int64), expireTime: 300}
+	kc *keepclient.KeepClient,
+	cache *BlockCache,
+	uploads *UploadStore,
+	t *tokencache.Cache,
+	adminToken string) *mux.Router {
+
+	if t == nil {
+		t = &tokencache.Cache{}
+	}
 
 	rest := mux.NewRouter()
 
 	if enable_get {
 		rest.Handle(`/{locator:[0-9a-f]{32}\+.*}`,
-			GetBlockHandler{kc, t}).Methods("GET", "HEAD")
-		rest.Handle(`/{locator:[0-9a-f]{32}}`, GetBlockHandler{kc, t}).Methods("GET", "HEAD")
+			GetBlockHandler{kc, t, cache}).Methods("GET", "HEAD")
+		rest.Handle(`/{locator:[0-9a-f]{32}}`, GetBlockHandler{kc, t, cache}).Methods("GET", "HEAD")
 
 		// List all blocks
 		rest.Handle(`/index`, IndexHandler{kc, t}).Methods("GET")
@@ -250,19 +365,29 @@ func MakeRESTRouter(
 		rest.Handle(`/{locator:[0-9a-f]{32}\+.*}`, PutBlockHandler{kc, t}).Methods("PUT")
 		rest.Handle(`/{locator:[0-9a-f]{32}}`, PutBlockHandler{kc, t}).Methods("PUT")
 		rest.Handle(`/`, PutBlockHandler{kc, t}).Methods("POST")
+		if uploads != nil {
+			rest.Handle(`/uploads`, UploadHandler{kc, t, uploads}).Methods("POST")
+			rest.Handle(`/uploads/{id:[0-9a-f]{32}}`, UploadHandler{kc, t, uploads}).Methods("HEAD", "PATCH", "DELETE")
+			rest.Handle(`/uploads/{id}`, OptionsHandler{}).Methods("OPTIONS")
+		}
 		rest.Handle(`/{any}`, OptionsHandler{}).Methods("OPTIONS")
 		rest.Handle(`/`, OptionsHandler{}).Methods("OPTIONS")
 	}
 
+	rest.Handle(`/_admin/flush_token`, &tokencache.FlushHandler{Cache: t, AdminToken: adminToken}).Methods("POST")
+	rest.Handle(`/status.json`, StatusHandler{kc, t, adminToken}).Methods("GET", "HEAD")
+	rest.Handle(`/_health/ping`, HealthHandler{}).Methods("GET", "HEAD")
+
 	rest.NotFoundHandler = InvalidPathHandler{}
 
 	return rest
 }
 
 func SetCorsHeaders(resp http.ResponseWriter) {
-	resp.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, OPTIONS")
+	resp.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
 	resp.Header().Set("Access-Control-Allow-Origin", "*")
-	resp.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas")
+	resp.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas, Upload-Length, Upload-Offset")
+	resp.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Length, Upload-Offset, X-Keep-Replicas-Stored")
 	resp.Header().Set("Access-Control-Max-Age", "86486400")
 }
 
@@ -282,8 +407,31 @@ var MethodNotSupported = errors.New("Method not supported")
 
 var removeHint, _ = regexp.Compile("\\+K@[a-z0-9]{5}(\\+|$)")
 
+// stripHints removes +K@zzzzz hints from the given locator, except
+// hints that refer to configured remote clusters, so blocks are
+// retrieved from the local Keep services unless they belong to a
+// remote cluster we know how to reach.
+func stripHints(kc *keepclient.KeepClient, locator string) string {
+	return removeHint.ReplaceAllStringFunc(locator, func(hint string) string {
+		if _, ok := kc.RemoteClusters[hint[3:8]]; ok {
+			return hint
+		}
+		return hint[8:]
+	})
+}
+
+// remoteCluster returns the cluster ID of the first +K@zzzzz hint on
+// the given locator, or "" if there is none.
+func remoteCluster(locator string) string {
+	if m := removeHint.FindString(locator); m != "" {
+		return m[3:8]
+	}
+	return ""
+}
+
 func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	SetCorsHeaders(resp)
+	defer stats.inFlight(&stats.InFlight.Get)()
 
 	locator := mux.Vars(req)["locator"]
 	var err error
@@ -302,7 +450,7 @@ func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 
 	var pass bool
 	var tok string
-	if pass, tok = CheckAuthorizationHeader(&kc, this.ApiTokenCache, req); !pass {
+	if pass, tok = CheckAuthorizationHeader(&kc, this.Cache, req); !pass {
 		status, err = http.StatusForbidden, BadAuthorizationHeader
 		return
 	}
@@ -314,12 +462,16 @@ func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 
 	var reader io.ReadCloser
 
-	locator = removeHint.ReplaceAllString(locator, "$1")
+	locator = stripHints(&kc, locator)
 
 	switch req.Method {
 	case "HEAD":
 		expectLength, proxiedURI, err = kc.Ask(locator)
 	case "GET":
+		if this.cache != nil {
+			reader, expectLength, proxiedURI, err = this.getCached(&kc, locator, tok)
+			break
+		}
 		reader, expectLength, proxiedURI, err = kc.Get(locator)
 		if reader != nil {
 			defer reader.Close()
@@ -354,16 +506,69 @@ func (this GetBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 		} else {
 			status = 422
 		}
+	case PermissionError:
+		status = http.StatusForbidden
 	default:
 		status = http.StatusInternalServerError
 	}
 }
 
+// PermissionError is returned by getCached when the signature on a
+// locator cannot be verified.
+type PermissionError struct {
+	error
+}
+
+// getCached returns the requested block from the cache if possible,
+// otherwise from a backend Keep service (in which case it is added
+// to the cache).
+//
+// Before returning a cached block, getCached checks that the client
+// is allowed to read it: either by verifying the locator signature
+// itself, or by asking a backend Keep service (which verifies the
+// signature) whether the block exists. Signatures on blocks from
+// remote clusters are always checked by the remote cluster.
+func (this GetBlockHandler) getCached(kc *keepclient.KeepClient, locator string, tok string) (io.ReadCloser, int64, string, error) {
+	hash := locator[:32]
+	if this.cache.PermissionSecret != nil && remoteCluster(locator) == "" {
+		if err := keepclient.VerifySignature(locator, tok, this.cache.BlobSignatureTTL, this.cache.PermissionSecret); err != nil {
+			return nil, 0, "", PermissionError{err}
+		}
+		if data := this.cache.Get(hash); data != nil {
+			return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), "cache", nil
+		}
+	} else if data := this.cache.Get(hash); data != nil {
+		if _, uri, err := kc.Ask(locator); err != nil {
+			return nil, 0, uri, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), "cache", nil
+	}
+
+	reader, expectLength, proxiedURI, err := kc.Get(locator)
+	if err != nil {
+		return nil, expectLength, proxiedURI, err
+	}
+	defer reader.Close()
+	// The reader returned by kc.Get returns an error at EOF if
+	// the data does not match the hash, so a block that is read
+	// without error is safe to cache.
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, expectLength, proxiedURI, err
+	}
+	if expectLength > -1 && int64(len(data)) != expectLength {
+		return nil, expectLength, proxiedURI, ContentLengthMismatch
+	}
+	this.cache.Put(hash, data)
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), proxiedURI, nil
+}
+
 var LengthRequiredError = errors.New(http.StatusText(http.StatusLengthRequired))
 var LengthMismatchError = errors.New("Locator size hint does not match Content-Length header")
 
 func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	SetCorsHeaders(resp)
+	defer stats.inFlight(&stats.InFlight.Put)()
 
 	kc := *this.KeepClient
 	var err error
@@ -402,7 +607,7 @@ func (this PutBlockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 
 	var pass bool
 	var tok string
-	if pass, tok = CheckAuthorizationHeader(&kc, this.ApiTokenCache, req); !pass {
+	if pass, tok = CheckAuthorizationHeader(&kc, this.Cache, req); !pass {
 		err = BadAuthorizationHeader
 		status = http.StatusForbidden
 		return
@@ -485,7 +690,7 @@ func (handler IndexHandler) ServeHTTP(resp http.ResponseWriter, req *http.Reques
 
 	kc := *handler.KeepClient
 
-	ok, token := CheckAuthorizationHeader(&kc, handler.ApiTokenCache, req)
+	ok, token := CheckAuthorizationHeader(&kc, handler.Cache, req)
 	if !ok {
 		status, err = http.StatusForbidden, BadAuthorizationHeader
 		return
@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
 	"fmt"
 	"git.curoverse.com/arvados.git/sdk/go/arvadosclient"
 	"git.curoverse.com/arvados.git/sdk/go/arvadostest"
 	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/tokencache"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -140,7 +142,7 @@ func (s *ServerRequiredSuite) TestPutWrongContentLength(c *C) {
 	// fixes the invalid Content-Length header. In order to test
 	// our server behavior, we have to call the handler directly
 	// using an httptest.ResponseRecorder.
-	rtr := MakeRESTRouter(true, true, kc)
+	rtr := MakeRESTRouter(true, true, kc, nil, nil, nil, "")
 
 	type testcase struct {
 		sendLength   string
@@ -242,6 +244,33 @@ func (s *ServerRequiredSuite) TestPutAskGet(c *C) {
 	}
 }
 
+func (s *ServerRequiredSuite) TestCachedGet(c *C) {
+	keyFile := c.MkDir() + "/key"
+	c.Assert(ioutil.WriteFile(keyFile, []byte(arvadostest.BlobSigningKey), 0600), IsNil)
+	kc := runProxy(c, []string{"-cache-memory=1000000", "-cache-dir=" + c.MkDir(), "-cache-disk=1000000", "-permission-key-file=" + keyFile}, false)
+	defer closeListener()
+
+	content := []byte("TestCachedGet")
+	locator, _, err := kc.PutB(content)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		reader, blocklen, _, err := kc.Get(locator)
+		c.Assert(err, IsNil)
+		all, err := ioutil.ReadAll(reader)
+		c.Check(err, IsNil)
+		c.Check(all, DeepEquals, content)
+		c.Check(blocklen, Equals, int64(len(content)))
+	}
+
+	// Cached blocks are not returned without a valid signature.
+	hash := fmt.Sprintf("%x", md5.Sum(content))
+	for _, loc := range []string{hash, fmt.Sprintf("%s+%d+A%s@%x", hash, len(content), strings.Repeat("0", 40), time.Now().Add(time.Hour).Unix())} {
+		_, _, _, err = kc.Get(loc)
+		c.Check(err, NotNil)
+	}
+}
+
 func (s *ServerRequiredSuite) TestPutAskGetForbidden(c *C) {
 	kc := runProxy(c, nil, true)
 	defer closeListener()
@@ -350,7 +379,7 @@ func (s *ServerRequiredSuite) TestCorsHeaders(c *C) {
 		c.Check(resp.StatusCode, Equals, 200)
 		body, err := ioutil.ReadAll(resp.Body)
 		c.Check(string(body), Equals, "")
-		c.Check(resp.Header.Get("Access-Control-Allow-Methods"), Equals, "GET, HEAD, POST, PUT, OPTIONS")
+		c.Check(resp.Header.Get("Access-Control-Allow-Methods"), Equals, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
 		c.Check(resp.Header.Get("Access-Control-Allow-Origin"), Equals, "*")
 	}
 
@@ -358,7 +387,7 @@ func (s *ServerRequiredSuite) TestCorsHeaders(c *C) {
 		resp, err := http.Get(
 			fmt.Sprintf("http://%s/%x+3", listener.Addr().String(), md5.Sum([]byte("foo"))))
 		c.Check(err, Equals, nil)
-		c.Check(resp.Header.Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas")
+		c.Check(resp.Header.Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Length, Content-Type, X-Keep-Desired-Replicas, Upload-Length, Upload-Offset")
 		c.Check(resp.Header.Get("Access-Control-Allow-Origin"), Equals, "*")
 	}
 }
@@ -399,6 +428,164 @@ func (s *ServerRequiredSuite) TestStripHint(c *C) {
 
 }
 
+func (s *ServerRequiredSuite) TestResumableUpload(c *C) {
+	kc := runProxy(c, []string{"-upload-dir=" + c.MkDir()}, false)
+	defer closeListener()
+	proxyURL := "http://" + listener.Addr().String()
+	content := []byte("TestResumableUpload")
+	hash := fmt.Sprintf("%x", md5.Sum(content))
+
+	do := func(method, path string, hdr map[string]string, body []byte) *http.Response {
+		req, err := http.NewRequest(method, proxyURL+path, bytes.NewReader(body))
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", "OAuth2 "+kc.Arvados.ApiToken)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		return resp
+	}
+
+	resp := do("POST", "/uploads", map[string]string{"Upload-Length": fmt.Sprint(len(content))}, nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	path := resp.Header.Get("Location")
+	c.Check(path, Matches, `/uploads/[0-9a-f]{32}`)
+
+	resp = do("PATCH", path, map[string]string{"Upload-Offset": "0"}, content[:5])
+	c.Check(resp.StatusCode, Equals, http.StatusNoContent)
+	c.Check(resp.Header.Get("Upload-Offset"), Equals, "5")
+
+	// Wrong offset
+	resp = do("PATCH", path, map[string]string{"Upload-Offset": "3"}, content[3:])
+	c.Check(resp.StatusCode, Equals, http.StatusConflict)
+
+	resp = do("HEAD", path, nil, nil)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(resp.Header.Get("Upload-Offset"), Equals, "5")
+
+	resp = do("PATCH", path, map[string]string{"Upload-Offset": "5"}, content[5:])
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	locator, err := ioutil.ReadAll(resp.Body)
+	c.Check(err, IsNil)
+	c.Check(string(locator), Matches, fmt.Sprintf(`^%s\+%d(\+.+)?$`, hash, len(content)))
+
+	// The upload is finished and forgotten
+	resp = do("HEAD", path, nil, nil)
+	c.Check(resp.StatusCode, Equals, http.StatusNotFound)
+
+	reader, _, _, err := kc.Get(string(locator))
+	c.Assert(err, IsNil)
+	all, err := ioutil.ReadAll(reader)
+	c.Check(all, DeepEquals, content)
+}
+
+func (s *ServerRequiredSuite) TestFlushToken(c *C) {
+	tokens := &tokencache.Cache{}
+	tokens.Set("revoked-token", "", true)
+	rtr := MakeRESTRouter(true, true, &keepclient.KeepClient{}, nil, nil, tokens, "admin-token")
+
+	for _, auth := range []string{"", "OAuth2 revoked-token"} {
+		req, err := http.NewRequest("POST", "/_admin/flush_token?token=revoked-token", nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", auth)
+		resp := httptest.NewRecorder()
+		rtr.ServeHTTP(resp, req)
+		c.Check(resp.Code, Equals, http.StatusUnauthorized)
+		c.Check(tokens.Len(), Equals, 1)
+	}
+
+	req, err := http.NewRequest("POST", "/_admin/flush_token?token=revoked-token", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", "OAuth2 admin-token")
+	resp := httptest.NewRecorder()
+	rtr.ServeHTTP(resp, req)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(tokens.Len(), Equals, 0)
+}
+
+func (s *ServerRequiredSuite) TestStatus(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	client := &http.Client{Transport: countingTransport{}}
+	resp, err := client.Get(backend.URL + "/acbd18db4cc2f85cedef654fccc4a4d8")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+
+	tokens := &tokencache.Cache{}
+	tokens.Set("some-token", "", true)
+	kc := &keepclient.KeepClient{}
+	kc.SetServiceRoots(map[string]string{"zzzzz-bi6l4-000000000000000": backend.URL}, nil, nil)
+	rtr := MakeRESTRouter(true, true, kc, nil, nil, tokens, "admin-token")
+
+	req, err := http.NewRequest("GET", "/status.json", nil)
+	c.Assert(err, IsNil)
+	rec := httptest.NewRecorder()
+	rtr.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusUnauthorized)
+
+	req.Header.Set("Authorization", "OAuth2 admin-token")
+	rec = httptest.NewRecorder()
+	rtr.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusOK)
+	var st ProxyStatus
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &st), IsNil)
+	c.Check(st.Services, Equals, 1)
+	c.Check(st.TokenCacheEntries, Equals, 1)
+	c.Check(st.InFlight, Equals, InFlightStatus{})
+	c.Assert(st.Backends[backend.URL], NotNil)
+	c.Check(st.Backends[backend.URL].Requests, Equals, int64(1))
+	c.Check(st.Backends[backend.URL].Errors, Equals, int64(1))
+	c.Check(st.Backends[backend.URL].LastError, Equals, "500 Internal Server Error")
+
+	req, err = http.NewRequest("GET", "/_health/ping", nil)
+	c.Assert(err, IsNil)
+	rec = httptest.NewRecorder()
+	rtr.ServeHTTP(rec, req)
+	c.Check(rec.Code, Equals, http.StatusOK)
+	c.Check(rec.Body.String(), Equals, `{"health":"OK"}`+"\n")
+}
+
+func (s *ServerRequiredSuite) TestStripRemoteHint(c *C) {
+	kc := &keepclient.KeepClient{RemoteClusters: map[string]keepclient.RemoteCluster{"xyzzy": {}}}
+	c.Check(stripHints(kc, "2228819a18d3727630fa30c81853d23f+67108864+K@zzzzz+K@xyzzy"),
+		Equals,
+		"2228819a18d3727630fa30c81853d23f+67108864+K@xyzzy")
+	c.Check(stripHints(kc, "2228819a18d3727630fa30c81853d23f+67108864+K@xyzzy+A37b6ab198qqqq28d903b975266b23ee711e1852c@55635f73"),
+		Equals,
+		"2228819a18d3727630fa30c81853d23f+67108864+K@xyzzy+A37b6ab198qqqq28d903b975266b23ee711e1852c@55635f73")
+	c.Check(remoteCluster("2228819a18d3727630fa30c81853d23f+67108864+K@xyzzy"), Equals, "xyzzy")
+	c.Check(remoteCluster("2228819a18d3727630fa30c81853d23f+67108864"), Equals, "")
+}
+
+func (s *ServerRequiredSuite) TestGetFromRemoteCluster(c *C) {
+	content := []byte("TestGetFromRemoteCluster")
+	locator := fmt.Sprintf("%x+%d+K@xyzzy", md5.Sum(content), len(content))
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, Equals, "/"+locator)
+		if req.Header.Get("Authorization") != "OAuth2 remote-token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write(content)
+	}))
+	defer remote.Close()
+
+	conf := c.MkDir() + "/remote.json"
+	c.Assert(ioutil.WriteFile(conf, []byte(`{"xyzzy":{"Proxy":"`+remote.URL+`","Token":"remote-token"}}`), 0600), IsNil)
+	kc := runProxy(c, []string{"-remote-clusters=" + conf}, false)
+	defer closeListener()
+
+	reader, blocklen, _, err := kc.Get(locator)
+	c.Assert(err, IsNil)
+	all, err := ioutil.ReadAll(reader)
+	c.Check(err, IsNil)
+	c.Check(all, DeepEquals, content)
+	c.Check(blocklen, Equals, int64(len(content)))
+}
+
 // Test GetIndex
 //   Put one block, with 2 replicas
 //   With no prefix (expect the block locator, twice)
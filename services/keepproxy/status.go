@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/tokencache"
+)
+
+// ProxyStatus is the data given in a /status.json response.
+type ProxyStatus struct {
+	// Number of backend Keep services known
+	Services int
+
+	// Time and outcome of the most recent attempt to refresh the
+	// list of backend services
+	LastRefresh      time.Time
+	LastRefreshError string
+	RefreshErrors    int
+
+	// Number of requests being handled right now
+	InFlight InFlightStatus
+
+	// Number of entries in the token cache
+	TokenCacheEntries int
+
+	// Requests sent to each backend service, keyed by base URL
+	Backends map[string]*BackendStatus
+}
+
+type InFlightStatus struct {
+	Get int
+	Put int
+}
+
+type BackendStatus struct {
+	Requests  int64
+	Errors    int64
+	LastError string
+}
+
+// proxyStatus tracks the ProxyStatus of this process.
+type proxyStatus struct {
+	ProxyStatus
+	mtx sync.Mutex
+}
+
+var stats = &proxyStatus{
+	ProxyStatus: ProxyStatus{Backends: make(map[string]*BackendStatus)},
+}
+
+// refreshed records the outcome of an attempt to refresh the list of
+// backend services.
+func (st *proxyStatus) refreshed(err error) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.LastRefresh = time.Now()
+	if err != nil {
+		st.LastRefreshError = err.Error()
+		st.RefreshErrors++
+	} else {
+		st.LastRefreshError = ""
+	}
+}
+
+// inFlight increments the given counter, and returns a func that
+// decrements it.
+func (st *proxyStatus) inFlight(counter *int) func() {
+	st.mtx.Lock()
+	*counter++
+	st.mtx.Unlock()
+	return func() {
+		st.mtx.Lock()
+		*counter--
+		st.mtx.Unlock()
+	}
+}
+
+// backendResult records the outcome of a request to a backend
+// service.
+func (st *proxyStatus) backendResult(backend string, errMsg string) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	bs, ok := st.Backends[backend]
+	if !ok {
+		bs = &BackendStatus{}
+		st.Backends[backend] = bs
+	}
+	bs.Requests++
+	if errMsg != "" {
+		bs.Errors++
+		bs.LastError = errMsg
+	}
+}
+
+// countingTransport records the outcome of each request in stats.
+// Network errors and 5xx responses count as errors.
+type countingTransport struct {
+	http.RoundTripper
+}
+
+func (t countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	resp, err := rt.RoundTrip(req)
+	backend := req.URL.Scheme + "://" + req.URL.Host
+	if err != nil {
+		stats.backendResult(backend, err.Error())
+	} else if resp.StatusCode >= 500 {
+		stats.backendResult(backend, resp.Status)
+	} else {
+		stats.backendResult(backend, "")
+	}
+	return resp, err
+}
+
+// refreshServices is like (*KeepClient)RefreshServices, but also
+// records the time and outcome of each refresh in stats.
+func refreshServices(kc *keepclient.KeepClient, interval, errInterval time.Duration) {
+	timer := time.NewTimer(interval)
+	gotHUP := make(chan os.Signal, 1)
+	signal.Notify(gotHUP, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-gotHUP:
+		case <-timer.C:
+		}
+		timer.Reset(interval)
+
+		err := kc.DiscoverKeepServers()
+		stats.refreshed(err)
+		if err != nil {
+			log.Printf("WARNING: Error retrieving services list: %v (retrying in %v)", err, errInterval)
+			timer.Reset(errInterval)
+		} else if len(kc.LocalRoots()) == 0 {
+			log.Printf("WARNING: No local services (retrying in %v)", errInterval)
+			timer.Reset(errInterval)
+		}
+	}
+}
+
+// StatusHandler responds to /status.json requests with the current
+// ProxyStatus. Requests must be authorized with the admin token.
+type StatusHandler struct {
+	*keepclient.KeepClient
+	*tokencache.Cache
+	adminToken string
+}
+
+func (this StatusHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if this.adminToken == "" || subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("OAuth2 "+this.adminToken)) != 1 {
+		http.Error(resp, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	services := len(this.KeepClient.LocalRoots())
+	tokens := this.Cache.Len()
+
+	stats.mtx.Lock()
+	stats.Services = services
+	stats.TokenCacheEntries = tokens
+	jstat, err := json.Marshal(&stats.ProxyStatus)
+	stats.mtx.Unlock()
+	if err != nil {
+		log.Printf("json.Marshal: %s", err)
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(jstat)
+}
+
+// HealthHandler responds to /_health/ping requests, so load balancers
+// can check whether keepproxy is alive.
+type HealthHandler struct{}
+
+func (HealthHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write([]byte(`{"health":"OK"}` + "\n"))
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.curoverse.com/arvados.git/sdk/go/keepclient"
+	"git.curoverse.com/arvados.git/sdk/go/tokencache"
+	"github.com/gorilla/mux"
+)
+
+// Headers used by the resumable upload protocol.
+const (
+	UploadLengthHeader = "Upload-Length"
+	UploadOffsetHeader = "Upload-Offset"
+)
+
+var UploadNotFoundError = errors.New("Upload not found")
+var UploadOffsetMismatchError = errors.New("Upload-Offset does not match the amount of data received so far")
+var UploadLengthExceededError = errors.New("Data exceeds Upload-Length")
+var UploadLimitError = errors.New("Too many uploads in progress")
+
+// UploadStore keeps track of resumable uploads in progress. The data
+// received so far for each upload is stored in a temporary file in
+// Dir. Uploads that have not been written to for longer than Expiry
+// are abandoned.
+//
+// The protocol is:
+//
+//   POST /uploads              start an upload; Upload-Length header
+//                              gives the block size. Responds 201 with
+//                              the new upload's path in Location.
+//   HEAD /uploads/{id}         report the amount of data received so
+//                              far in the Upload-Offset header.
+//   PATCH /uploads/{id}        append the request body. Upload-Offset
+//                              header must match the amount of data
+//                              received so far. When the block is
+//                              complete, it is stored in Keep and the
+//                              response is the same as for PUT.
+//   DELETE /uploads/{id}       abandon the upload.
+//
+// If a PATCH request is interrupted, the data received before the
+// interruption is kept, so the client can use HEAD to find out where
+// to resume.
+type UploadStore struct {
+	Dir    string
+	Expiry time.Duration
+
+	// Maximum number of uploads in progress for each token, and
+	// maximum total Upload-Length of those uploads. Zero means no
+	// limit.
+	MaxUploadsPerToken int
+	MaxBytesPerToken   int64
+
+	uploads map[string]*upload
+	mtx     sync.Mutex
+}
+
+type upload struct {
+	id         string
+	token      string
+	length     int64
+	offset     int64
+	replicas   int
+	lastActive time.Time
+	path       string
+	removed    bool
+	mtx        sync.Mutex
+}
+
+// NewUploadStore returns an UploadStore that keeps temporary files
+// in dir. Files left in dir by a previous process are removed.
+func NewUploadStore(dir string, expiry time.Duration) (*UploadStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "upload-*"))
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+	return &UploadStore{
+		Dir:     dir,
+		Expiry:  expiry,
+		uploads: make(map[string]*upload),
+	}, nil
+}
+
+// create starts a new upload of the given length, owned by the given
+// token. It returns UploadLimitError if the token already has too
+// many uploads in progress.
+func (store *UploadStore) create(token string, length int64, replicas int) (*upload, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%x", buf)
+	up := &upload{
+		id:         id,
+		token:      token,
+		length:     length,
+		replicas:   replicas,
+		lastActive: time.Now(),
+		path:       filepath.Join(store.Dir, "upload-"+id),
+	}
+
+	// Check the limits and add the new upload in one critical
+	// section, so concurrent requests can't exceed the limits.
+	store.mtx.Lock()
+	count, bytes := 1, length
+	for _, other := range store.uploads {
+		if other.token == token {
+			count++
+			bytes += other.length
+		}
+	}
+	if (store.MaxUploadsPerToken > 0 && count > store.MaxUploadsPerToken) ||
+		(store.MaxBytesPerToken > 0 && bytes > store.MaxBytesPerToken) {
+		store.mtx.Unlock()
+		return nil, UploadLimitError
+	}
+	store.uploads[id] = up
+	store.mtx.Unlock()
+
+	f, err := os.OpenFile(up.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		store.mtx.Lock()
+		delete(store.uploads, id)
+		store.mtx.Unlock()
+		return nil, err
+	}
+	f.Close()
+	return up, nil
+}
+
+// get returns the upload with the given ID, if it exists and is
+// owned by the given token.
+func (store *UploadStore) get(id, token string) (*upload, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	up, ok := store.uploads[id]
+	if !ok || up.token != token {
+		return nil, UploadNotFoundError
+	}
+	return up, nil
+}
+
+// remove forgets the given upload and deletes its temporary file.
+//
+// The caller must hold up.mtx.
+func (store *UploadStore) remove(up *upload) {
+	up.removed = true
+	store.mtx.Lock()
+	delete(store.uploads, up.id)
+	store.mtx.Unlock()
+	os.Remove(up.path)
+}
+
+// expire removes uploads that have not been written to since
+// store.Expiry before the given time.
+func (store *UploadStore) expire(now time.Time) {
+	// Don't wait for up.mtx while holding store.mtx: a PATCH
+	// request holds up.mtx while it receives data, and other
+	// requests need store.mtx to find their uploads.
+	store.mtx.Lock()
+	uploads := make([]*upload, 0, len(store.uploads))
+	for _, up := range store.uploads {
+		uploads = append(uploads, up)
+	}
+	store.mtx.Unlock()
+	for _, up := range uploads {
+		up.mtx.Lock()
+		if !up.removed && now.Sub(up.lastActive) > store.Expiry {
+			log.Printf("upload %s: expired after receiving %d of %d bytes", up.id, up.offset, up.length)
+			store.remove(up)
+		}
+		up.mtx.Unlock()
+	}
+}
+
+// RunExpiry calls expire periodically. It never returns.
+func (store *UploadStore) RunExpiry(interval time.Duration) {
+	for t := range time.Tick(interval) {
+		store.expire(t)
+	}
+}
+
+// write appends data from r to the upload, starting at the given
+// offset, which must be the amount of data received so far. Data
+// received before an error occurs is kept.
+//
+// The caller must hold up.mtx.
+func (up *upload) write(offset int64, r io.Reader) (int64, error) {
+	if offset != up.offset {
+		return 0, UploadOffsetMismatchError
+	}
+	f, err := os.OpenFile(up.path, os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	// Read one byte more than needed, to detect a body that
+	// exceeds Upload-Length.
+	n, err := io.Copy(f, io.LimitReader(r, up.length-offset+1))
+	if n > up.length-offset {
+		f.Truncate(up.length)
+		n, err = up.length-offset, UploadLengthExceededError
+	}
+	up.offset += n
+	up.lastActive = time.Now()
+	return n, err
+}
+
+// hash returns the MD5 hash of the data received.
+func (up *upload) hash() (string, error) {
+	f, err := os.Open(up.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+type UploadHandler struct {
+	*keepclient.KeepClient
+	*tokencache.Cache
+	*UploadStore
+}
+
+func (this UploadHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	SetCorsHeaders(resp)
+	defer stats.inFlight(&stats.InFlight.Put)()
+
+	var err error
+	var status = http.StatusInternalServerError
+	var wroteReplicas int
+	var locatorOut string = "-"
+	id := mux.Vars(req)["id"]
+
+	defer func() {
+		log.Println(GetRemoteAddress(req), req.Method, req.URL.Path, status, req.Header.Get(UploadOffsetHeader), wroteReplicas, locatorOut, err)
+		if status >= 400 {
+			http.Error(resp, err.Error(), status)
+		}
+	}()
+
+	var pass bool
+	var tok string
+	if pass, tok = CheckAuthorizationHeader(this.KeepClient, this.Cache, req); !pass {
+		err = BadAuthorizationHeader
+		status = http.StatusForbidden
+		return
+	}
+
+	if req.Method == "POST" {
+		var length int64
+		_, err = fmt.Sscanf(req.Header.Get(UploadLengthHeader), "%d", &length)
+		if err != nil || length < 0 {
+			err = errors.New("Missing or invalid " + UploadLengthHeader + " header")
+			status = http.StatusBadRequest
+			return
+		} else if length > keepclient.BLOCKSIZE {
+			err = keepclient.OversizeBlockError
+			status = http.StatusRequestEntityTooLarge
+			return
+		}
+		replicas := this.KeepClient.Want_replicas
+		if req.Header.Get(keepclient.X_Keep_Desired_Replicas) != "" {
+			fmt.Sscanf(req.Header.Get(keepclient.X_Keep_Desired_Replicas), "%d", &replicas)
+		}
+		var up *upload
+		if up, err = this.UploadStore.create(tok, length, replicas); err == UploadLimitError {
+			status = http.StatusTooManyRequests
+			return
+		} else if err != nil {
+			return
+		}
+		status = http.StatusCreated
+		resp.Header().Set("Location", "/uploads/"+up.id)
+		resp.Header().Set(UploadOffsetHeader, "0")
+		resp.WriteHeader(status)
+		_, err = io.WriteString(resp, up.id)
+		return
+	}
+
+	var up *upload
+	if up, err = this.UploadStore.get(id, tok); err != nil {
+		status = http.StatusNotFound
+		return
+	}
+	up.mtx.Lock()
+	defer up.mtx.Unlock()
+	if up.removed {
+		// Expired or deleted while we waited for the lock.
+		err, status = UploadNotFoundError, http.StatusNotFound
+		return
+	}
+
+	switch req.Method {
+	case "HEAD":
+		status = http.StatusOK
+		resp.Header().Set(UploadLengthHeader, fmt.Sprintf("%d", up.length))
+		resp.Header().Set(UploadOffsetHeader, fmt.Sprintf("%d", up.offset))
+		return
+	case "DELETE":
+		this.UploadStore.remove(up)
+		status = http.StatusNoContent
+		resp.WriteHeader(status)
+		return
+	case "PATCH":
+	default:
+		err, status = MethodNotSupported, http.StatusMethodNotAllowed
+		return
+	}
+
+	var offset int64
+	if _, err = fmt.Sscanf(req.Header.Get(UploadOffsetHeader), "%d", &offset); err != nil {
+		err = errors.New("Missing or invalid " + UploadOffsetHeader + " header")
+		status = http.StatusBadRequest
+		return
+	}
+	_, err = up.write(offset, req.Body)
+	resp.Header().Set(UploadOffsetHeader, fmt.Sprintf("%d", up.offset))
+	switch err {
+	case nil:
+	case UploadOffsetMismatchError:
+		status = http.StatusConflict
+		return
+	case UploadLengthExceededError:
+		status = http.StatusRequestEntityTooLarge
+		return
+	default:
+		status = http.StatusBadRequest
+		return
+	}
+	if up.offset < up.length {
+		status = http.StatusNoContent
+		resp.WriteHeader(status)
+		return
+	}
+
+	// The block is complete: store it.
+	var hash string
+	if hash, err = up.hash(); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = os.Open(up.path); err != nil {
+		return
+	}
+	defer f.Close()
+	kc := this.KeepClient.Clone()
+	arvclient := *kc.Arvados
+	arvclient.ApiToken = tok
+	kc.Arvados = &arvclient
+	kc.Want_replicas = up.replicas
+	locatorOut, wroteReplicas, err = kc.PutHR(hash, f, up.length)
+	resp.Header().Set(keepclient.X_Keep_Replicas_Stored, fmt.Sprintf("%d", wroteReplicas))
+	if err == nil || (err == keepclient.InsufficientReplicasError && wroteReplicas > 0) {
+		this.UploadStore.remove(up)
+		status = http.StatusOK
+		_, err = io.WriteString(resp, locatorOut)
+		return
+	}
+	// Keep the data, so the client can retry by sending an empty
+	// PATCH at the final offset.
+	if err == keepclient.InsufficientReplicasError {
+		status = http.StatusServiceUnavailable
+	} else {
+		status = http.StatusBadGateway
+	}
+}
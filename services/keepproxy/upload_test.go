@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&UploadStoreSuite{})
+
+type UploadStoreSuite struct{}
+
+func (s *UploadStoreSuite) TestWrite(c *C) {
+	store, err := NewUploadStore(c.MkDir(), time.Hour)
+	c.Assert(err, IsNil)
+	up, err := store.create("token", 6, 2)
+	c.Assert(err, IsNil)
+
+	_, err = store.get(up.id, "othertoken")
+	c.Check(err, Equals, UploadNotFoundError)
+	got, err := store.get(up.id, "token")
+	c.Check(err, IsNil)
+	c.Check(got, Equals, up)
+
+	n, err := up.write(0, bytes.NewBufferString("foo"))
+	c.Check(err, IsNil)
+	c.Check(n, Equals, int64(3))
+	_, err = up.write(1, bytes.NewBufferString("oobar"))
+	c.Check(err, Equals, UploadOffsetMismatchError)
+	_, err = up.write(3, bytes.NewBufferString("barbaz"))
+	c.Check(err, Equals, UploadLengthExceededError)
+	c.Check(up.offset, Equals, int64(6))
+
+	buf, err := ioutil.ReadFile(up.path)
+	c.Check(err, IsNil)
+	c.Check(string(buf), Equals, "foobar")
+	hash, err := up.hash()
+	c.Check(err, IsNil)
+	c.Check(hash, Equals, "3858f62230ac3c915f300c664312c63f")
+
+	store.remove(up)
+	_, err = os.Stat(up.path)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *UploadStoreSuite) TestExpire(c *C) {
+	dir := c.MkDir()
+	store, err := NewUploadStore(dir, time.Hour)
+	c.Assert(err, IsNil)
+	old, err := store.create("token", 3, 2)
+	c.Assert(err, IsNil)
+	old.lastActive = time.Now().Add(-2 * time.Hour)
+	fresh, err := store.create("token", 3, 2)
+	c.Assert(err, IsNil)
+
+	store.expire(time.Now())
+	_, err = store.get(old.id, "token")
+	c.Check(err, Equals, UploadNotFoundError)
+	_, err = os.Stat(old.path)
+	c.Check(os.IsNotExist(err), Equals, true)
+	_, err = store.get(fresh.id, "token")
+	c.Check(err, IsNil)
+
+	// A new store removes files left behind by the old one.
+	_, err = NewUploadStore(dir, time.Hour)
+	c.Assert(err, IsNil)
+	_, err = os.Stat(fresh.path)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *UploadStoreSuite) TestLimits(c *C) {
+	store, err := NewUploadStore(c.MkDir(), time.Hour)
+	c.Assert(err, IsNil)
+	store.MaxUploadsPerToken = 2
+	store.MaxBytesPerToken = 10
+
+	up, err := store.create("token", 6, 2)
+	c.Assert(err, IsNil)
+	_, err = store.create("token", 5, 2)
+	c.Check(err, Equals, UploadLimitError)
+	_, err = store.create("token", 4, 2)
+	c.Check(err, IsNil)
+	_, err = store.create("token", 0, 2)
+	c.Check(err, Equals, UploadLimitError)
+
+	// Limits apply to each token separately.
+	_, err = store.create("othertoken", 10, 2)
+	c.Check(err, IsNil)
+
+	store.remove(up)
+	_, err = store.create("token", 6, 2)
+	c.Check(err, IsNil)
+}
+
+func (s *UploadStoreSuite) TestExpireDoesNotBlockOtherUploads(c *C) {
+	store, err := NewUploadStore(c.MkDir(), time.Hour)
+	c.Assert(err, IsNil)
+	busy, err := store.create("token", 3, 2)
+	c.Assert(err, IsNil)
+	old, err := store.create("token", 3, 2)
+	c.Assert(err, IsNil)
+	old.lastActive = time.Now().Add(-2 * time.Hour)
+
+	// Simulate a PATCH request in progress.
+	busy.mtx.Lock()
+	expired := make(chan bool)
+	go func() {
+		store.expire(time.Now())
+		close(expired)
+	}()
+
+	// Other requests can still find their uploads.
+	done := make(chan bool)
+	go func() {
+		_, err := store.get(busy.id, "token")
+		c.Check(err, IsNil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("store.get blocked by expire")
+	}
+
+	busy.mtx.Unlock()
+	<-expired
+	_, err = store.get(old.id, "token")
+	c.Check(err, Equals, UploadNotFoundError)
+	c.Check(old.removed, Equals, true)
+}